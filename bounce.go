@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// bounceSubjects are Subject prefixes used by common MTAs for non-DSN
+// bounces.  They're compared in lower case.
+var bounceSubjects = []string{
+	"undelivered mail returned to sender",
+	"delivery status notification (failure)",
+	"mail delivery failed",
+	"mail delivery failure",
+	"delivery failure",
+	"undeliverable:",
+	"undeliverable mail",
+	"returned mail:",
+	"failure notice",
+	"mail system error",
+}
+
+// bounceSenders are the local parts of addresses that send bounces.
+var bounceSenders = []string{"mailer-daemon", "postmaster"}
+
+// In non-DSN bounces, lines containing a permanent (5xx) SMTP reply or
+// enhanced status code are searched for the addresses of failed recipients.
+var (
+	bounceCode = regexp.MustCompile(`(^|\s)(5\d\d|5\.\d{1,3}\.\d{1,3})\b`)
+	bounceAddy = regexp.MustCompile(`[^\s<>@:;,"]+@[^\s<>:;,"]+\.[a-zA-Z]{2,}`)
+)
+
+// bounceMessageID matches the Message-ID headers of the returned message (or
+// its headers) quoted in a bounce.
+var bounceMessageID = regexp.MustCompile(`(?im)^message-id:[ \t]*(<[^<>\s]+>)`)
+
+// bounceRecipient is a recipient that a bounce reports as failed.
+type bounceRecipient struct {
+	addy string
+	// hard is true for permanent failures
+	hard bool
+}
+
+// isBounce returns true if the headers identify a delivery status
+// notification or a bounce in one of the common non-DSN formats.
+func isBounce(h mail.Header) bool {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil && mediaType == "multipart/report" &&
+		strings.EqualFold(params["report-type"], "delivery-status") {
+		return true
+	}
+	if h.Get("X-Failed-Recipients") != "" {
+		return true
+	}
+	// Bounces are sent with a null envelope sender
+	if strings.TrimSpace(h.Get("Return-Path")) == "<>" {
+		return true
+	}
+	if from, err := mail.ParseAddress(h.Get("From")); err == nil {
+		local, _, _ := strings.Cut(strings.ToLower(from.Address), "@")
+		for _, sender := range bounceSenders {
+			if local == sender {
+				return true
+			}
+		}
+	}
+	subject := strings.ToLower(strings.TrimSpace(h.Get("Subject")))
+	for _, prefix := range bounceSubjects {
+		if strings.HasPrefix(subject, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBounce returns the failed recipients reported by a bounce.
+func parseBounce(msg *mail.Message) (recipients []bounceRecipient, err error) {
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType == "multipart/report" && params["boundary"] != "" {
+		recipients, err = parseDSN(body, params["boundary"])
+		if err != nil || len(recipients) > 0 {
+			return
+		}
+	}
+	// Exim names hard bounced recipients in a header
+	failed := msg.Header.Get("X-Failed-Recipients")
+	if failed != "" {
+		for _, addy := range strings.Split(failed, ",") {
+			addy = strings.TrimSpace(addy)
+			if addy != "" {
+				recipients = append(recipients, bounceRecipient{addy: addy, hard: true})
+			}
+		}
+		return
+	}
+	// Failing all else, look for recipients alongside a permanent failure
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		if !bounceCode.MatchString(line) {
+			continue
+		}
+		for _, addy := range bounceAddy.FindAllString(line, -1) {
+			if seen[strings.ToLower(addy)] {
+				continue
+			}
+			seen[strings.ToLower(addy)] = true
+			recipients = append(recipients, bounceRecipient{addy: addy, hard: true})
+		}
+	}
+	return
+}
+
+// parseDSN returns the recipients in the message/delivery-status part of an
+// RFC 3464 delivery status notification.
+func parseDSN(body []byte, boundary string) (recipients []bounceRecipient, err error) {
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		var part *multipart.Part
+		part, err = r.NextPart()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType != "message/delivery-status" {
+			continue
+		}
+		// The per-message fields are followed by blocks of
+		// per-recipient fields, separated by blank lines.
+		tp := textproto.NewReader(bufio.NewReader(part))
+		for {
+			fields, readErr := tp.ReadMIMEHeader()
+			if recipient, ok := dsnRecipient(fields); ok {
+				recipients = append(recipients, recipient)
+			}
+			if readErr != nil {
+				break
+			}
+		}
+	}
+}
+
+// dsnRecipient returns the failed recipient in a block of DSN per-recipient
+// fields.  Only failed and delayed actions are reported.
+func dsnRecipient(fields textproto.MIMEHeader) (recipient bounceRecipient, ok bool) {
+	addrType, addy, found := strings.Cut(fields.Get("Final-Recipient"), ";")
+	if !found {
+		addrType, addy, found = strings.Cut(fields.Get("Original-Recipient"), ";")
+	}
+	if !found || !strings.EqualFold(strings.TrimSpace(addrType), "rfc822") {
+		return
+	}
+	action := strings.ToLower(strings.TrimSpace(fields.Get("Action")))
+	if action != "failed" && action != "delayed" {
+		return
+	}
+	recipient.addy = strings.Trim(strings.TrimSpace(addy), "<>")
+	// RFC 3463: Class 5 status codes are permanent failures
+	recipient.hard = action == "failed" && strings.HasPrefix(strings.TrimSpace(fields.Get("Status")), "5")
+	ok = recipient.addy != ""
+	return
+}
+
+// processBounce counts the failed recipients of a bounce by domain.  Bounces
+// are never forwarded.  Addresses that hard bounce repeatedly are added to
+// the destination block list if bounces.block_after is configured.
+func (s *Server) processBounce(msg *mail.Message) {
+	s.stats.inBounce++
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		log.Infof("Unable to read bounce: %s", err)
+		return
+	}
+	msg.Body = bytes.NewReader(body)
+	var messageIDs []string
+	for _, match := range bounceMessageID.FindAllSubmatch(body, -1) {
+		messageIDs = append(messageIDs, string(match[1]))
+	}
+	recipients, err := parseBounce(msg)
+	if err != nil {
+		log.Infof("Unable to parse bounce: %s", err)
+		return
+	}
+	for _, recipient := range recipients {
+		addy := strings.ToLower(recipient.addy)
+		domain := addressDomain(addy)
+		if domain == "" {
+			continue
+		}
+		s.stats.bounce(domain)
+		if !recipient.hard {
+			log.Tracef("Soft bounce from %s", domain)
+			continue
+		}
+		log.Infof("Hard bounce from %s", domain)
+		if s.cfg.Bounces.BlockAfter <= 0 {
+			continue
+		}
+		err = s.countHardBounce(addy, messageIDs)
+		if err != nil {
+			log.Warnf("Unable to record bounce: %s", err)
+		}
+	}
+}
+
+// recordSent records the Message-ID of a delivery to finals so that bounces
+// of it can be told apart from forgeries.
+func (s *Server) recordSent(messageID string, finals []string) {
+	if len(finals) == 0 || s.cfg.Bounces.BlockAfter <= 0 {
+		return
+	}
+	l, err := s.limiter()
+	if err != nil {
+		log.Warnf("Unable to record delivery: %s", err)
+		return
+	}
+	var names []string
+	for _, addy := range finals {
+		names = append(names, "sent:"+messageID+" "+addy)
+	}
+	err = l.Record(names...)
+	if err != nil {
+		log.Warnf("Unable to record delivery: %s", err)
+	}
+}
+
+// countHardBounce records a hard bounce for addy and blocks it once
+// bounces.block_after hard bounces have been received within the window.
+// Anyone can send a bounce so it's only counted if it quotes one of
+// messageIDs that was delivered to addy within the window.
+func (s *Server) countHardBounce(addy string, messageIDs []string) (err error) {
+	l, err := s.limiter()
+	if err != nil {
+		return
+	}
+	since := time.Now().Add(-time.Duration(s.cfg.Bounces.Window) * 24 * time.Hour)
+	var sent bool
+	for _, messageID := range messageIDs {
+		var count int
+		count, err = l.Count("sent:"+messageID+" "+addy, since)
+		if err != nil {
+			return
+		}
+		if count > 0 {
+			sent = true
+			break
+		}
+	}
+	if !sent {
+		log.Infof("Ignoring a hard bounce that doesn't match a delivery to %s", addressDomain(addy))
+		return
+	}
+	name := "bounce:" + addy
+	err = l.Record(name)
+	if err != nil {
+		return
+	}
+	count, err := l.Count(name, since)
+	if err != nil || count < s.cfg.Bounces.BlockAfter {
+		return
+	}
+	b, err := s.blockList()
+	if err != nil || b.blocked(addy) {
+		return
+	}
+	err = b.add(addy)
+	if err != nil {
+		return
+	}
+	log.Infof("Blocked a destination in %s after %d hard bounces", addressDomain(addy), count)
+	return
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/mix2"
+)
+
+// openMix2 imports the Type II secret keys and writes their public
+// components for the operator to publish.
+func (s *Server) openMix2() (err error) {
+	s.mix2 = mix2.NewSecring()
+	err = s.mix2.Import(s.cfg.Files.Mix2Secring)
+	if err != nil {
+		return
+	}
+	f, err := os.Create(s.cfg.Files.Mix2Pubkey)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	caps := "C"
+	if !s.cfg.Remailer.Exit {
+		caps += "M"
+	}
+	err = s.mix2.WritePublic(f, s.cfg.Remailer.Name, s.cfg.Remailer.Address, caps)
+	if err != nil {
+		return
+	}
+	log.Infof("Type II keyring contains %d keys", s.mix2.Count())
+	return
+}
+
+// processMix2 decodes a Mixmaster armored Type II message.
+func (s *Server) processMix2(message []byte) {
+	raw, err := mix2.StripArmor(bytes.NewReader(message))
+	if err != nil {
+		log.Info(err)
+		return
+	}
+	err = s.decodeMix2(raw)
+	if err != nil {
+		log.Warnf("Type II decoding error: %s", err)
+	}
+}
+
+// decodeMix2 decodes a Mixmaster Type II packet.  Intermediate packets are
+// forwarded to the next Type II hop.  The user data of Final packets is
+// delivered if this is an exit or re-routed through a random YAMN exit.
+func (s *Server) decodeMix2(raw []byte) (err error) {
+	defer recoverDecode(&err)
+	p, err := mix2.Decode(raw, s.mix2)
+	if err != nil {
+		return
+	}
+	if !s.idDb.Unique(p.Header.PacketID) {
+		log.Trace("Discarding duplicate type II message (packet ID collision)")
+		return
+	}
+	if p.Header.Age() > s.cfg.Remailer.MaxAge || p.Header.Age() < 0 {
+		log.Warnf("Type II packet timestamp out of range. Age=%d", p.Header.Age())
+		return
+	}
+	s.stats.inMix2++
+	switch p.Header.PacketType {
+	case mix2.PacketTypeIntermediate:
+		var next []byte
+		next, err = p.Forward()
+		if err != nil {
+			return
+		}
+		err = s.writeMix2ToPool(p.Header.NextHop, next)
+		if err != nil {
+			return
+		}
+		s.stats.outMix2++
+	case mix2.PacketTypeFinal:
+		var data []byte
+		data, err = p.Payload()
+		if err != nil {
+			return
+		}
+		err = s.deliverMix2(data)
+	case mix2.PacketTypePartial:
+		var data []byte
+		data, err = p.Payload()
+		if err != nil {
+			return
+		}
+		err = s.mix2Chunk(p.Header, data)
+	}
+	return
+}
+
+// mix2Chunk stores a fragment of a Partial message in the chunk DB and
+// delivers the message once every fragment has been received.
+func (s *Server) mix2Chunk(h *mix2.Header, data []byte) (err error) {
+	filename := s.writeChunkToPool(data)
+	complete, err := s.chunkDb.Insert(h.MessageID, h.ChunkNum, h.NumChunks, filename)
+	if err != nil {
+		s.chunkDb.DeleteItems([]string{filename})
+		return
+	}
+	if !complete {
+		return
+	}
+	data, err = s.chunkDb.Join(s.chunkDb.Items(h.MessageID))
+	s.chunkDb.Delete(h.MessageID)
+	if err != nil {
+		return
+	}
+	err = s.deliverMix2(data)
+	return
+}
+
+// deliverMix2 delivers the complete user data of a Type II message.
+func (s *Server) deliverMix2(data []byte) (err error) {
+	msg, err := mix2.ParseMessage(data, s.maxMessageBytes())
+	if err != nil {
+		return
+	}
+	if msg.Dummy() {
+		log.Trace("Discarding type II dummy message")
+		s.stats.inDummy++
+		return
+	}
+	if len(msg.Destinations) == 0 {
+		return errors.New("type II message has no destinations")
+	}
+	for _, d := range msg.Destinations {
+		if strings.HasPrefix(d, "post:") {
+			return fmt.Errorf("unsupported type II destination: %s", d)
+		}
+	}
+	if !s.cfg.Remailer.Exit {
+		// The message continues its journey on the YAMN network
+		s.randhop(msg.Bytes())
+		return
+	}
+	s.writePlainToPool(msg.Bytes(), "e")
+	s.stats.outPlain++
+	return
+}
+
+// writeMix2ToPool writes a Mixmaster armored Type II packet, addressed to
+// sendTo, to the outbound pool.
+func (s *Server) writeMix2ToPool(sendTo string, packet []byte) (err error) {
+	f, err := s.newPoolFile("m")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	writeInternalHeader(f)
+	fmt.Fprintf(f, "To: %s\n", sendTo)
+	fmt.Fprintf(f, "From: %s\n\n", s.cfg.Remailer.Address)
+	err = mix2.Armor(f, packet)
+	return
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -9,23 +11,28 @@ import (
 	"time"
 
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/packet"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // Chunk holds variables that apply globally to all chunked message content.
 type Chunk struct {
 	db         *leveldb.DB   // A level DB instance
+	pooldir    string        // Directory containing the chunk files
 	expireDays time.Duration // How long to retain keys
 	deleteDays time.Duration // Age of partial files before deletion
 }
 
-// OpenChunk opens a levelDB database file
-func OpenChunk(filename string) *Chunk {
+// OpenChunk opens a levelDB database file.  Chunk files are stored in
+// pooldir.
+func OpenChunk(filename, pooldir string) (chunk *Chunk, err error) {
 	levelDB, err := leveldb.OpenFile(filename, nil)
 	if err != nil {
-		panic(err)
+		return
 	}
-	return &Chunk{db: levelDB}
+	chunk = &Chunk{db: levelDB, pooldir: pooldir}
+	return
 }
 
 // Close closes the levelDB
@@ -39,56 +46,106 @@ func (chunk *Chunk) SetExpire(days int) {
 	chunk.deleteDays = time.Duration(days*24*2) * time.Hour
 }
 
-// Get returns the content associated with messageID.  If messageID is
-// unknown, an empty slice of len numChunks is returned.
-func (chunk *Chunk) Get(messageID []byte, numChunks int) (items []string) {
-	var err error
-	var content []byte
-	content, err = chunk.db.Get(messageID, nil)
-	if err != nil {
-		if err.Error() == "leveldb: not found" {
-			items = make([]string, numChunks)
-		} else {
-			panic(err)
-		}
-	} else {
-		// Ignore the first item in the DB, it's the date field and
-		// only used internally.
-		items = strings.Split(string(content), ",")[1:]
-	}
-	return
+/*
+Chunk DB records
+Each message is described by a message record and a record for each chunk
+received.  Chunk records sort in chunk order.
+[ "m" + Message ID ] = "Expiry date,Num chunks,Chunks received"
+[ "c" + Message ID + Chunk num (2 Bytes, Big-Endian) ] = Chunk filename
+Records written by earlier versions are keyed by the bare Message ID and
+contain "Expiry date,Filename,Filename,...".  They're only read on expiry.
+*/
+
+const (
+	msgRecordBytes   = 17 // Length of a message record key
+	chunkRecordBytes = 19 // Length of a chunk record key
+	legacyRecord     = 16 // Length of a record key from earlier versions
+)
+
+// msgKey returns the DB key of the message record for messageID.
+func msgKey(messageID []byte) []byte {
+	return append([]byte("m"), messageID...)
+}
+
+// chunkKey returns the DB key of chunk chunkNum of messageID.
+func chunkKey(messageID []byte, chunkNum int) []byte {
+	key := append([]byte("c"), messageID...)
+	return binary.BigEndian.AppendUint16(key, uint16(chunkNum))
+}
+
+// chunkPrefix returns the DB key prefix of all the chunks of messageID.
+func chunkPrefix(messageID []byte) *util.Range {
+	return util.BytesPrefix(append([]byte("c"), messageID...))
 }
 
-// Insert writes an entry to the DB
-func (chunk *Chunk) Insert(messageid []byte, items []string) {
+// Insert records filename as chunk chunkNum, of numChunks, of messageID.  It
+// returns true when every chunk of the message has been received.
+func (chunk *Chunk) Insert(
+	messageID []byte,
+	chunkNum, numChunks int,
+	filename string) (complete bool, err error) {
+
 	if chunk.expireDays == 0 {
 		panic("Expiry duration not defined")
 	}
-	t := time.Now().Add(chunk.expireDays)
-	chunk.db.Put(
-		messageid,
-		[]byte(fmt.Sprintf(
-			"%s,%s",
-			t.Format("20060102"),
-			strings.Join(items, ","),
-		)),
-		nil,
+	expire := time.Now().Add(chunk.expireDays).Format("20060102")
+	received := 0
+	content, err := chunk.db.Get(msgKey(messageID), nil)
+	if err == nil {
+		var stored int
+		_, err = fmt.Sscanf(string(content), "%8s,%d,%d", &expire, &stored, &received)
+		if err != nil {
+			return
+		}
+		// A hostile sender could claim a different number of chunks
+		// to those recorded for this message ID.
+		if stored != numChunks {
+			err = fmt.Errorf(
+				"chunk count mismatch. Expected=%d, Got=%d",
+				stored,
+				numChunks,
+			)
+			return
+		}
+	} else if err != leveldb.ErrNotFound {
+		return
+	}
+	exists, err := chunk.db.Has(chunkKey(messageID, chunkNum), nil)
+	if err != nil {
+		return
+	}
+	if exists {
+		err = fmt.Errorf("duplicate chunk %d", chunkNum)
+		return
+	}
+	received++
+	batch := new(leveldb.Batch)
+	batch.Put(chunkKey(messageID, chunkNum), []byte(filename))
+	batch.Put(
+		msgKey(messageID),
+		[]byte(fmt.Sprintf("%s,%d,%d", expire, numChunks, received)),
 	)
+	err = chunk.db.Write(batch, nil)
+	if err != nil {
+		return
+	}
+	complete = received == numChunks
+	return
 }
 
-// IsPopulated returns true if all elements of items are populated
-func IsPopulated(items []string) bool {
-	for _, n := range items {
-		if n == "" {
-			return false
-		}
+// Items returns the filenames of the chunks of messageID, in chunk order.
+func (chunk *Chunk) Items(messageID []byte) (items []string) {
+	iter := chunk.db.NewIterator(chunkPrefix(messageID), nil)
+	defer iter.Release()
+	for iter.Next() {
+		items = append(items, string(iter.Value()))
 	}
-	return true
+	return
 }
 
 // Housekeep deletes files over a given age
 func (chunk *Chunk) Housekeep() (ret, del int) {
-	files, err := ioutil.ReadDir(cfg.Files.Pooldir)
+	files, err := ioutil.ReadDir(chunk.pooldir)
 	if err != nil {
 		log.Warnf("Chunk housekeeping failed: %s", err)
 		return
@@ -100,7 +157,7 @@ func (chunk *Chunk) Housekeep() (ret, del int) {
 			continue
 		}
 		if file.ModTime().Before(expire) {
-			os.Remove(path.Join(cfg.Files.Pooldir, file.Name()))
+			os.Remove(path.Join(chunk.pooldir, file.Name()))
 			del++
 		} else {
 			ret++
@@ -109,44 +166,113 @@ func (chunk *Chunk) Housekeep() (ret, del int) {
 	return
 }
 
+// chunkReader reads a sequence of chunk files as a single stream.  Files are
+// opened in turn so that messages of any number of chunks can be read.
+type chunkReader struct {
+	dir   string
+	items []string
+	f     *os.File
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.f == nil {
+			if len(r.items) == 0 {
+				return 0, io.EOF
+			}
+			r.f, err = os.Open(path.Join(r.dir, r.items[0]))
+			if err != nil {
+				return
+			}
+			r.items = r.items[1:]
+		}
+		n, err = r.f.Read(p)
+		if err != io.EOF {
+			return
+		}
+		// Move on to the next chunk file
+		r.f.Close()
+		r.f = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the chunk file currently being read.
+func (r *chunkReader) Close() {
+	if r.f != nil {
+		r.f.Close()
+	}
+}
+
 // Assemble takes all the file chunks, assembles them in order and stores the
-// result back into the pool.
-func (chunk *Chunk) Assemble(filename string, items []string) (err error) {
-	f, err := os.Create(filename)
+// result back into the pool.  Padded and compressed messages, as described by
+// final, are expanded as they're assembled.  The chunk files are deleted,
+// even if assembly fails or the message would exceed limit bytes.
+func (chunk *Chunk) Assemble(
+	filename string,
+	items []string,
+	final *packet.SlotFinal,
+	limit int) (err error) {
+
+	defer func() {
+		_, failed := chunk.DeleteItems(items)
+		if failed > 0 {
+			log.Warnf("Assembler failed to delete %d chunks", failed)
+		}
+	}()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	var content []byte
-	for _, c := range items {
-		infile := path.Join(cfg.Files.Pooldir, c)
-		content, err = ioutil.ReadFile(infile)
-		if err != nil {
-			log.Warnf("Chunk assembler says: %s", err)
-			continue
-		}
-		f.Write(content)
-		err = os.Remove(infile)
-		if err != nil {
-			log.Warnf("Assembler chunk delete failed: %s", err)
-			continue
-		}
+	r := &chunkReader{dir: chunk.pooldir, items: items}
+	defer r.Close()
+	writeInternalHeader(f)
+	_, err = final.ExpandTo(f, r, limit)
+	if err != nil {
+		f.Close()
+		// Don't leave a partial message in the pool
+		os.Remove(filename)
+		return
 	}
+	err = f.Close()
 	return
 }
 
-// Delete removes the specified Message ID from the DB
+// Join returns the content of the chunk files in items, concatenated in
+// order.  The chunk files are deleted.
+func (chunk *Chunk) Join(items []string) (content []byte, err error) {
+	r := &chunkReader{dir: chunk.pooldir, items: items}
+	content, err = io.ReadAll(r)
+	r.Close()
+	_, failed := chunk.DeleteItems(items)
+	if failed > 0 {
+		log.Warnf("Failed to delete %d joined chunks", failed)
+	}
+	return
+}
+
+// Delete removes the specified Message ID, and all its chunk records, from
+// the DB
 func (chunk *Chunk) Delete(messageid []byte) {
-	err := chunk.db.Delete(messageid, nil)
+	batch := new(leveldb.Batch)
+	batch.Delete(msgKey(messageid))
+	iter := chunk.db.NewIterator(chunkPrefix(messageid), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	err := chunk.db.Write(batch, nil)
 	if err != nil {
-		log.Warnf("Could not delete MsgID: %s. %s", messageid, err)
+		log.Warnf("Could not delete MsgID: %x. %s", messageid, err)
 	}
 }
 
 // DeleteItems removes all the filename defined in items
 func (chunk *Chunk) DeleteItems(items []string) (deleted, failed int) {
 	for _, file := range items {
-		fqfn := path.Join(cfg.Files.Pooldir, file)
+		fqfn := path.Join(chunk.pooldir, file)
 		err := os.Remove(fqfn)
 		if err != nil {
 			failed++
@@ -157,31 +283,47 @@ func (chunk *Chunk) DeleteItems(items []string) (deleted, failed int) {
 	return
 }
 
-// Expire iterates the DB and deletes entries (and files) that exceed the
+// Expire iterates the DB and deletes messages (and files) that exceed the
 // defined age.
 func (chunk *Chunk) Expire() (retained, deleted int) {
 	now := time.Now()
 	iter := chunk.db.NewIterator(nil, nil)
+	defer iter.Release()
 	for iter.Next() {
 		key := iter.Key()
-		items := strings.Split(string(iter.Value()), ",")
-		stamp := items[0]
-		// Now we have the timestamp, strip it from the slice
-		copy(items, items[1:])
+		var messageID []byte
+		var stamp string
+		var items []string
+		switch {
+		case len(key) == msgRecordBytes && key[0] == 'm':
+			messageID = append([]byte(nil), key[1:]...)
+			stamp, _, _ = strings.Cut(string(iter.Value()), ",")
+		case len(key) == legacyRecord:
+			// Records from earlier versions list their chunk
+			// files after the timestamp
+			messageID = append([]byte(nil), key...)
+			fields := strings.Split(string(iter.Value()), ",")
+			stamp, items = fields[0], fields[1:]
+		default:
+			// Chunk records are expired with their message
+			continue
+		}
 		expire, err := time.Parse("20060102", stamp)
 		if err != nil {
-			log.Warnf("Could not parse timestamp: %s", err)
 			// If the timestamp is invalid, delete the record
-			chunk.DeleteItems(items)
-			chunk.Delete(key)
+			log.Warnf("Could not parse timestamp: %s", err)
+		} else if !expire.Before(now) {
+			retained++
+			continue
 		}
-		if expire.Before(now) {
+		if len(key) == legacyRecord {
 			chunk.DeleteItems(items)
-			chunk.Delete(key)
-			deleted++
+			chunk.db.Delete(messageID, nil)
 		} else {
-			retained++
+			chunk.DeleteItems(chunk.Items(messageID))
+			chunk.Delete(messageID)
 		}
+		deleted++
 	}
 	return
 }
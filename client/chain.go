@@ -1,21 +1,39 @@
 // vim: tabstop=2 shiftwidth=2
 
-package main
+package client
 
 import (
 	"errors"
 	"fmt"
-	"os"
 
 	"github.com/Masterminds/log-go"
 	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
 )
 
+// isMemberStr tests for the membership of a string in a slice
+func isMemberStr(s string, slice []string) bool {
+	for _, n := range slice {
+		if n == s {
+			return true
+		}
+	}
+	return false
+}
+
+// popstr takes a pointer to a string slice and pops the last element
+func popstr(s *[]string) (element string) {
+	slice := *s
+	element, slice = slice[len(slice)-1], slice[:len(slice)-1]
+	*s = slice
+	return
+}
+
 // distanceCriteria enforces user-defined minimal distance criteria
 func distanceCriteria(addresses, dist []string) (c []string) {
 	for _, addy := range addresses {
-		if IsMemberStr(addy, dist) {
+		if isMemberStr(addy, dist) {
 			// Excluded due to distance
 			continue
 		}
@@ -25,11 +43,11 @@ func distanceCriteria(addresses, dist []string) (c []string) {
 }
 
 // makeChain takes a chain string and constructs a valid remailer chain
-func makeChain(inChain []string) (outChain []string, err error) {
+func (c *Client) makeChain(inChain []string) (outChain []string, err error) {
 	// Test if stats file has been modified since last imported
-	if Pubring.StatRefresh() {
+	if c.conf.Pubring.StatRefresh() {
 		// Try and import the modified stats file
-		err = Pubring.ImportStats()
+		err = c.conf.Pubring.ImportStats()
 		if err != nil {
 			log.Warnf("Unable to read stats: %s", err)
 			return
@@ -37,27 +55,31 @@ func makeChain(inChain []string) (outChain []string, err error) {
 		log.Info("Stats updated and reimported")
 	}
 	// Check generated timestamp from stats file
-	if Pubring.HaveStats() && Pubring.StatsStale(cfg.Stats.StaleHrs) {
+	if c.conf.Pubring.HaveStats() && c.conf.Pubring.StatsStale(c.conf.Stats.StaleHrs) {
 		log.Warnf(
 			"Stale stats.  Generated age exceeds "+
 				"configured threshold of %d hours",
-			cfg.Stats.StaleHrs,
+			c.conf.Stats.StaleHrs,
 		)
 	}
 	// If the chain contains a random remailer, we're going to need stats
-	if !Pubring.HaveStats() && IsMemberStr("*", inChain) {
+	if !c.conf.Pubring.HaveStats() && isMemberStr("*", inChain) {
 		err = errors.New("cannot use random remailers without stats")
 		log.Warn(err)
 		return
 	}
-	dist := cfg.Stats.Distance
-	if dist > maxChainLength {
-		dist = maxChainLength
+	dist := c.conf.Stats.Distance
+	if dist > packet.MaxChainLength {
+		dist = packet.MaxChainLength
 	}
 	var candidates []string // Candidate remailers for each hop
-	if len(inChain) > maxChainLength {
-		fmt.Fprintf(os.Stderr, "%d hops exceeds maximum of %d\n", len(inChain), maxChainLength)
-		os.Exit(1)
+	if len(inChain) > packet.MaxChainLength {
+		err = fmt.Errorf(
+			"%d hops exceeds maximum of %d",
+			len(inChain),
+			packet.MaxChainLength,
+		)
+		return
 	}
 	// If dist is greater than the actual chain length, all hops will be unique.
 	if dist > len(inChain) {
@@ -76,17 +98,17 @@ func makeChain(inChain []string) (outChain []string, err error) {
 			// Random remailer selection
 			if len(outChain) == 0 {
 				// Construct a list of suitable exit remailers
-				candidates = Pubring.Candidates(
-					cfg.Stats.Minlat,
-					cfg.Stats.Maxlat,
-					cfg.Stats.Relfinal,
+				candidates = c.conf.Pubring.Candidates(
+					c.conf.Stats.Minlat,
+					c.conf.Stats.Maxlat,
+					c.conf.Stats.Relfinal,
 					true)
 			} else {
 				// Construct a list of all suitable remailers
-				candidates = Pubring.Candidates(
-					cfg.Stats.Minlat,
-					cfg.Stats.Maxlat,
-					cfg.Stats.Minrel,
+				candidates = c.conf.Pubring.Candidates(
+					c.conf.Stats.Minlat,
+					c.conf.Stats.Maxlat,
+					c.conf.Stats.Minrel,
 					false)
 			}
 			if len(candidates) > 0 {
@@ -99,12 +121,12 @@ func makeChain(inChain []string) (outChain []string, err error) {
 				log.Warn("No candidate remailers match selection criteria")
 			}
 
-			if len(candidates) == 0 && flag.Remailer {
+			if len(candidates) == 0 && c.conf.Relaxed {
 				log.Warn("Relaxing latency and uptime criteria to build chain")
 				if len(outChain) == 0 {
 					// Construct a list of suitable exit remailers
 					log.Info("Constructing relaxed list of Exit remailers")
-					candidates = Pubring.Candidates(0, 480, 0, true)
+					candidates = c.conf.Pubring.Candidates(0, 480, 0, true)
 					log.Infof(
 						"Discovered %d Exit Remailers matching relaxed criteria",
 						len(candidates),
@@ -112,15 +134,17 @@ func makeChain(inChain []string) (outChain []string, err error) {
 				} else {
 					// Construct a list of all suitable remailers
 					log.Info("Constructing relaxed list of candidate remailers")
-					candidates = Pubring.Candidates(0, 480, 0, false)
+					candidates = c.conf.Pubring.Candidates(0, 480, 0, false)
 					log.Infof(
 						"Discovered %d candidate Remailers matching relaxed criteria",
 						len(candidates),
 					)
 				}
 			} else if len(candidates) == 0 {
-				// Insufficient remailers meet criteria and we're a client, so die.
-				os.Exit(1)
+				// Insufficient remailers meet criteria and we're a
+				// client, so give up.
+				err = errors.New("no remailers meet the chain selection criteria")
+				return
 			}
 			if len(candidates) == 0 {
 				err = errors.New("no remailers available to build random chain link")
@@ -137,7 +161,7 @@ func makeChain(inChain []string) (outChain []string, err error) {
 			}
 		} else {
 			var remailer keymgr.Remailer
-			remailer, err = Pubring.Get(hop)
+			remailer, err = c.conf.Pubring.Get(hop)
 			if err != nil {
 				return
 			}
@@ -168,7 +192,8 @@ func makeChain(inChain []string) (outChain []string, err error) {
 		distance = append(inDist, outDist...)
 	}
 	if len(outChain) != numHops {
-		panic("Constructed chain length doesn't match input chain length")
+		err = errors.New("constructed chain length doesn't match input chain length")
+		return
 	}
 	return
 }
@@ -0,0 +1,502 @@
+// Package client provides the sending side of YAMN.  A Client encodes
+// messages for a chain of remailers and hands the resulting packets to a
+// PoolWriter.  It has no dependence on command line flags or global
+// configuration, so it can be embedded in other Go programs.
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+)
+
+const (
+	// MaxFragLength is the largest plaintext fragment encoded into a
+	// single packet.
+	MaxFragLength = 17910
+	// MaxCopies is the maximum number of copies of each chunk.
+	MaxCopies = 5
+	// MaxDelay is the longest delay requested of any single hop.
+	MaxDelay = 24 * time.Hour
+)
+
+// Stats defines the criteria used when selecting random remailers.  They
+// correspond to the stats section of the YAMN config file.
+type Stats struct {
+	Minlat   int     // Minimum latency in minutes
+	Maxlat   int     // Maximum latency in minutes
+	Minrel   float32 // Minimum reliability of intermediate hops
+	Relfinal float32 // Minimum reliability of exit hops
+	Distance int     // Minimum distance between repeated hops
+	StaleHrs int     // Warn if stats are older than this many hours
+}
+
+// Config contains everything a Client needs to encode and pool messages.
+type Config struct {
+	// Pubring provides remailer keys and (optionally) reliability stats.
+	Pubring *keymgr.Pubring
+	// Stats are the random remailer selection criteria.
+	Stats Stats
+	// Chain is the remailer chain.  Random hops are defined as "*".
+	Chain []string
+	// Copies is the number of copies of each chunk to send.
+	Copies int
+	// Pool receives each encoded packet.
+	Pool PoolWriter
+	// Relaxed permits selection criteria to be relaxed when no remailers
+	// meet them.  This is appropriate for remailers, not for clients.
+	Relaxed bool
+	// NoDummy prevents dummy messages accompanying real ones.
+	NoDummy bool
+	// DummyChain is the chain used for dummy messages.  If undefined, two
+	// random hops are used.
+	DummyChain []string
+	// Delay is the mean of an exponential distribution from which a delay
+	// is drawn for each Intermediate hop (Stop-and-Go mixing).  Hops that
+	// don't advertise support for delays are sent Version 2 headers.  Zero
+	// disables delays.
+	Delay time.Duration
+	// Compression is the algorithm (packet.CompressNone, CompressDeflate
+	// or CompressZstd) used to compress messages before they're split
+	// into chunks.  Messages are only compressed when the Exit remailer
+	// advertises support and compression reduces their size.
+	Compression int
+	// SizeClasses are the permitted message sizes, in ascending chunks.
+	// Messages are padded to fill their final chunk and accompanied by
+	// dummy chunks, routed to the same Exit, up to the next size class.
+	// Messages larger than the largest class are padded to a multiple of
+	// it.  No padding is performed if SizeClasses is empty or the Exit
+	// doesn't advertise support.
+	SizeClasses []int
+	// Source supplies the entropy and clock used to encode packets.  It
+	// defaults to packet.DefaultSource.  Random hop selection, dummies
+	// and hop delays aren't drawn from it.
+	Source *packet.Source
+}
+
+// Receipt describes the packets produced by a Send.
+type Receipt struct {
+	// Chains contains the chain used for each packet.
+	Chains [][]string
+	// Chunks is the number of chunks the message was split into.
+	Chunks int
+	// Filenames contains the pool filename of each packet.
+	Filenames []string
+	// PadChunks is the number of dummy chunks sent to pad the message to
+	// its size class.
+	PadChunks int
+}
+
+// Client encodes messages and writes them to a pool.
+type Client struct {
+	conf Config
+}
+
+// New validates conf and returns a new Client.
+func New(conf Config) (*Client, error) {
+	if conf.Pubring == nil {
+		return nil, errors.New("client requires a public keyring")
+	}
+	if conf.Pool == nil {
+		return nil, errors.New("client requires a pool writer")
+	}
+	if len(conf.Chain) == 0 {
+		return nil, errors.New("empty input chain")
+	}
+	if len(conf.Chain) > packet.MaxChainLength {
+		return nil, fmt.Errorf(
+			"%d hops exceeds maximum of %d",
+			len(conf.Chain),
+			packet.MaxChainLength,
+		)
+	}
+	if conf.Copies < 1 {
+		conf.Copies = 1
+	} else if conf.Copies > MaxCopies {
+		// Limit copies to a maximum of MaxCopies
+		conf.Copies = MaxCopies
+	}
+	if conf.Delay < 0 {
+		return nil, errors.New("negative hop delay")
+	}
+	if conf.Compression != packet.CompressNone {
+		// Test the method is known by compressing nothing
+		_, err := packet.Compress(conf.Compression, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, class := range conf.SizeClasses {
+		if class < 1 || (i > 0 && class <= conf.SizeClasses[i-1]) {
+			return nil, errors.New("size classes must be positive and ascending")
+		}
+	}
+	if len(conf.DummyChain) == 0 {
+		conf.DummyChain = []string{"*", "*"}
+	}
+	if conf.Source == nil {
+		conf.Source = packet.DefaultSource
+	}
+	return &Client{conf: conf}, nil
+}
+
+// assemble converts a mail message into its byte representation, ready for
+// encoding.
+func assemble(msg *mail.Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for h := range msg.Header {
+		if strings.HasPrefix(h, "Yamn-") {
+			// Internal headers must never be sent
+			continue
+		}
+		buf.WriteString(h + ": " + msg.Header.Get(h) + "\n")
+	}
+	buf.WriteString("\n")
+	_, err := buf.ReadFrom(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Send encodes msg and writes the resulting packets to the pool.
+func (c *Client) Send(msg *mail.Message) (Receipt, error) {
+	plain, err := assemble(msg)
+	if err != nil {
+		return Receipt{}, err
+	}
+	return c.SendBytes(plain)
+}
+
+// SendBytes encodes a preassembled message (complete with headers) and
+// writes the resulting packets to the pool.
+func (c *Client) SendBytes(plain []byte) (r Receipt, err error) {
+	// plainLen is the length of the plain byte message and can exceed
+	// the total body size of the payload.
+	plainLen := len(plain)
+	if plainLen == 0 {
+		err = errors.New("no bytes in message")
+		return
+	}
+	// final is consistent across multiple copies so we define it early
+	final := c.conf.Source.NewSlotFinal()
+	// Take a copy of the chain.  Once an exit has been selected, it
+	// replaces the final hop so that all chunks and copies share a
+	// common exit.
+	inChain := append(c.conf.Chain[:0:0], c.conf.Chain...)
+	var exitnode string // Address of exit node (for multiple copy chains)
+	var gotExit bool    // Flag to indicate an exit node has been selected
+	if isNews(plain) {
+		// Usenet articles can only be posted by exits that
+		// advertise support.
+		inChain[len(inChain)-1], err = c.newsExit(inChain[len(inChain)-1])
+		if err != nil {
+			return
+		}
+		final.SetDeliveryMethod(packet.DeliveryNews)
+	}
+	if c.conf.Compression != packet.CompressNone ||
+		len(c.conf.SizeClasses) > 0 ||
+		plainLen > packet.MaxClassicChunks*MaxFragLength {
+		// Compression, padding and large messages depend on the
+		// capabilities of the exit so it has to be selected before the
+		// message is encoded.
+		var chain []string
+		chain, err = c.makeChain(append(inChain[:0:0], inChain...))
+		if err != nil {
+			return
+		}
+		exitnode = chain[len(chain)-1]
+		gotExit = true
+	}
+	if c.conf.Compression != packet.CompressNone {
+		plain, err = c.compress(plain, exitnode, final)
+		if err != nil {
+			return
+		}
+		plainLen = len(plain)
+	}
+	if len(c.conf.SizeClasses) > 0 {
+		plain, r.PadChunks, err = c.pad(plain, exitnode, final)
+		if err != nil {
+			return
+		}
+		plainLen = len(plain)
+	}
+	numc := (plainLen + MaxFragLength - 1) / MaxFragLength
+	err = final.SetNumChunks(numc)
+	if err != nil {
+		return
+	}
+	if numc > packet.MaxClassicChunks {
+		err = c.largeExit(exitnode, numc)
+		if err != nil {
+			return
+		}
+	}
+	r.Chunks = numc
+	// Fragments loop begins here
+	for cnum := 1; cnum <= numc; cnum++ {
+		err = final.SetChunkNum(cnum)
+		if err != nil {
+			return
+		}
+		// Copies of a chunk share a packet ID but, unless each chunk
+		// has its own, the exit will discard them as duplicates.
+		err = final.SetPacketID(c.conf.Source.Randbytes(16))
+		if err != nil {
+			return
+		}
+		// First byte of message fragment
+		firstByte := (cnum - 1) * MaxFragLength
+		lastByte := firstByte + MaxFragLength
+		// Don't slice beyond the end of the message
+		if lastByte > plainLen {
+			lastByte = plainLen
+		}
+		// Copies loop begins here
+		for n := 0; n < c.conf.Copies; n++ {
+			if gotExit {
+				// Set the last node in the chain to the
+				// previously select exitnode
+				inChain[len(inChain)-1] = exitnode
+			}
+			var chain []string
+			chain, err = c.makeChain(append(inChain[:0:0], inChain...))
+			if err != nil {
+				return
+			}
+			if len(chain) != len(inChain) {
+				err = fmt.Errorf(
+					"chain length mismatch: in=%d, out=%d",
+					len(inChain),
+					len(chain),
+				)
+				return
+			}
+			if !gotExit {
+				exitnode = chain[len(chain)-1]
+				gotExit = true
+			}
+			// Retain the entry hop.  We need to mail the message to it.
+			sendTo := chain[0]
+			r.Chains = append(r.Chains, append(chain[:0:0], chain...))
+			var yamnMsg []byte
+			yamnMsg, err = c.encodeMsg(
+				plain[firstByte:lastByte],
+				chain,
+				*final,
+			)
+			if err != nil {
+				return
+			}
+			var filename string
+			filename, err = c.conf.Pool.WriteMessage(sendTo, yamnMsg)
+			if err != nil {
+				return
+			}
+			r.Filenames = append(r.Filenames, filename)
+		} // End of copies loop
+	} // End of fragments loop
+
+	// Dummy chunks pad the message to its size class
+	for n := 0; n < r.PadChunks*c.conf.Copies; n++ {
+		err = c.padChunk(inChain)
+		if err != nil {
+			return
+		}
+	}
+
+	// Decide if we want to inject a dummy
+	if !c.conf.NoDummy && c.conf.Pubring.HaveStats() && crandom.Dice() < 80 {
+		_, err := c.Dummy()
+		if err != nil {
+			log.Warnf("Dummy creation failed: %s", err)
+		}
+	}
+	return
+}
+
+// compress returns plain compressed with the configured algorithm and records
+// the algorithm in final.  If exit can't expand compressed messages or
+// compression doesn't reduce the size of plain, it's returned unmodified.
+func (c *Client) compress(plain []byte, exit string, final *packet.SlotFinal) ([]byte, error) {
+	remailer, err := c.conf.Pubring.Get(exit)
+	if err != nil {
+		return nil, err
+	}
+	if !remailer.Compress() {
+		log.Infof("Exit remailer %s doesn't support compression", exit)
+		return plain, nil
+	}
+	compressed, err := packet.Compress(c.conf.Compression, plain)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(plain) {
+		log.Tracef("Compression would increase message size")
+		return plain, nil
+	}
+	numc := (len(compressed) + MaxFragLength - 1) / MaxFragLength
+	if len(plain) > packet.DecompressLimit(numc) {
+		// The exit would refuse to expand it
+		log.Infof("Message is too compressible to send compressed")
+		return plain, nil
+	}
+	err = final.SetCompression(c.conf.Compression)
+	if err != nil {
+		return nil, err
+	}
+	log.Tracef(
+		"Compressed message: In=%d, Out=%d",
+		len(plain),
+		len(compressed),
+	)
+	return compressed, nil
+}
+
+// largeExit returns an error if exit can't assemble a message of numc
+// chunks.  Messages of more than 255 chunks require Version 6 headers.
+func (c *Client) largeExit(exit string, numc int) error {
+	remailer, err := c.conf.Pubring.Get(exit)
+	if err != nil {
+		return err
+	}
+	if !remailer.Large() {
+		return fmt.Errorf(
+			"exit remailer %s doesn't support messages of %d chunks",
+			exit,
+			numc,
+		)
+	}
+	return nil
+}
+
+// isNews returns true if plain is a Usenet article, identified by a
+// Newsgroups header.
+func isNews(plain []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(plain))
+	return err == nil && msg.Header.Get("Newsgroups") != ""
+}
+
+// newsExit returns the address of an exit that posts to Usenet.  If exit is
+// random ("*"), one is selected from those that meet the stats criteria.
+func (c *Client) newsExit(exit string) (string, error) {
+	if exit != "*" {
+		remailer, err := c.conf.Pubring.Get(exit)
+		if err != nil {
+			return "", err
+		}
+		if !remailer.News() {
+			return "", fmt.Errorf("exit remailer %s doesn't post to Usenet", exit)
+		}
+		return remailer.Address, nil
+	}
+	if !c.conf.Pubring.HaveStats() {
+		return "", errors.New("cannot use random remailers without stats")
+	}
+	candidates := c.newsCandidates(
+		c.conf.Stats.Minlat,
+		c.conf.Stats.Maxlat,
+		c.conf.Stats.Relfinal,
+	)
+	if len(candidates) == 0 && c.conf.Relaxed {
+		log.Warn("Relaxing latency and uptime criteria to select a Usenet exit")
+		candidates = c.newsCandidates(0, 480, 0)
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("no exit remailers meet the criteria for posting to Usenet")
+	}
+	return candidates[crandom.RandomInt(len(candidates))], nil
+}
+
+// newsCandidates returns the exit remailers that meet the specified criteria
+// and post to Usenet.
+func (c *Client) newsCandidates(minlat, maxlat int, minrel float32) (candidates []string) {
+	for _, addy := range c.conf.Pubring.Candidates(minlat, maxlat, minrel, true) {
+		remailer, err := c.conf.Pubring.Get(addy)
+		if err == nil && remailer.News() {
+			candidates = append(candidates, addy)
+		}
+	}
+	return
+}
+
+// sizeClass returns the number of chunks a message of numc chunks should be
+// padded to.
+func (c *Client) sizeClass(numc int) int {
+	for _, class := range c.conf.SizeClasses {
+		if numc <= class {
+			return class
+		}
+	}
+	// Beyond the largest class, pad to a multiple of it
+	largest := c.conf.SizeClasses[len(c.conf.SizeClasses)-1]
+	return (numc + largest - 1) / largest * largest
+}
+
+// pad returns plain padded to fill its final chunk and the number of dummy
+// chunks required to reach its size class.  If exit can't strip padding,
+// plain is returned unmodified.
+func (c *Client) pad(plain []byte, exit string, final *packet.SlotFinal) ([]byte, int, error) {
+	remailer, err := c.conf.Pubring.Get(exit)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !remailer.Padding() {
+		log.Infof("Exit remailer %s doesn't support padding", exit)
+		return plain, 0, nil
+	}
+	numc := (len(plain) + packet.PadOverhead + MaxFragLength - 1) / MaxFragLength
+	padded, err := c.conf.Source.Pad(plain, numc*MaxFragLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	final.SetPadded(true)
+	return padded, c.sizeClass(numc) - numc, nil
+}
+
+// padChunk sends a dummy, the same size as a message chunk, through chain.
+// The final hop of chain should be the message exit.
+func (c *Client) padChunk(inChain []string) (err error) {
+	final := c.conf.Source.NewSlotFinal()
+	final.SetDeliveryMethod(packet.DeliveryDummy)
+	chain, err := c.makeChain(append(inChain[:0:0], inChain...))
+	if err != nil {
+		return
+	}
+	yamnMsg, err := c.encodeMsg(c.conf.Source.Randbytes(MaxFragLength), chain, *final)
+	if err != nil {
+		return
+	}
+	_, err = c.conf.Pool.WriteMessage(chain[0], yamnMsg)
+	return
+}
+
+// Dummy sends a dummy message through the configured DummyChain and returns
+// its pool filename.
+func (c *Client) Dummy() (filename string, err error) {
+	plainMsg := []byte("I hope Len approves")
+	final := c.conf.Source.NewSlotFinal()
+	// Override the default delivery method (255 = Dummy)
+	final.SetDeliveryMethod(packet.DeliveryDummy)
+	chain, err := c.makeChain(append(c.conf.DummyChain[:0:0], c.conf.DummyChain...))
+	if err != nil {
+		return
+	}
+	sendTo := chain[0]
+	log.Tracef("Sending dummy through: %s.", strings.Join(chain, ","))
+	yamnMsg, err := c.encodeMsg(plainMsg, chain, *final)
+	if err != nil {
+		return
+	}
+	return c.conf.Pool.WriteMessage(sendTo, yamnMsg)
+}
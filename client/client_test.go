@@ -0,0 +1,374 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+	"github.com/dchest/blake2s"
+)
+
+// memPool is a PoolWriter that retains packets in memory
+type memPool struct {
+	sendTo   []string
+	payloads [][]byte
+}
+
+func (p *memPool) WriteMessage(sendTo string, payload []byte) (filename string, err error) {
+	p.sendTo = append(p.sendTo, sendTo)
+	p.payloads = append(p.payloads, payload)
+	filename = fmt.Sprintf("mem%d", len(p.payloads))
+	return
+}
+
+// testPubring writes a single remailer pubring and returns it imported,
+// along with the remailer's secret key.
+func testPubring(t *testing.T) (pubring *keymgr.Pubring, sk []byte) {
+	pk, sk, err := packet.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := blake2s.New(&blake2s.Config{Size: 16})
+	digest.Write(pk)
+	keyid := hex.EncodeToString(digest.Sum(nil))
+	filename := path.Join(t.TempDir(), "pubring.mix")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(
+		f,
+		"test test@domain.foo %s 4:0.2a E 2016-01-01 2100-12-31\n\n",
+		keyid,
+	)
+	fmt.Fprintln(f, "-----Begin Mix Key-----")
+	fmt.Fprintln(f, keyid)
+	fmt.Fprintln(f, hex.EncodeToString(pk))
+	fmt.Fprintln(f, "-----End Mix Key-----")
+	f.Close()
+	pubring = keymgr.NewPubring(filename, path.Join(t.TempDir(), "mlist2.txt"))
+	err = pubring.ImportPubring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// decodeExit decrypts a single hop packet and returns its final slot and
+// body.
+func decodeExit(t *testing.T, payload, sk []byte) (*packet.SlotFinal, []byte) {
+	d, err := packet.NewDecMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := packet.NewDecodeHeader(d.Header())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetRecipientSK(sk)
+	data, _, err := h.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotData, err := packet.DecodeSlotData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slotData.PacketType() != packet.PacketTypeExit {
+		t.Fatalf("expected exit packet, got type %d", slotData.PacketType())
+	}
+	final, err := packet.DecodeFinal(slotData.PacketInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := d.DecryptBody(slotData.AesKey(), final.AesIV(), final.BodyBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return final, body
+}
+
+func TestNewValidation(t *testing.T) {
+	pubring, _ := testPubring(t)
+	_, err := New(Config{Pool: new(memPool), Chain: []string{"test"}})
+	if err == nil {
+		t.Error("expected error for missing pubring")
+	}
+	_, err = New(Config{Pubring: pubring, Chain: []string{"test"}})
+	if err == nil {
+		t.Error("expected error for missing pool")
+	}
+	_, err = New(Config{Pubring: pubring, Pool: new(memPool)})
+	if err == nil {
+		t.Error("expected error for empty chain")
+	}
+	c, err := New(Config{
+		Pubring: pubring,
+		Pool:    new(memPool),
+		Chain:   []string{"test"},
+		Copies:  99,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.conf.Copies != MaxCopies {
+		t.Errorf("expected copies=%d, got %d", MaxCopies, c.conf.Copies)
+	}
+}
+
+func TestSend(t *testing.T) {
+	pubring, sk := testPubring(t)
+	pool := new(memPool)
+	c, err := New(Config{
+		Pubring: pubring,
+		Pool:    pool,
+		Chain:   []string{"test"},
+		Copies:  2,
+		NoDummy: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: bob@example.com\nYamn-Pooled-Date: 1 Jan 2020\n\nHello World\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Chunks != 1 {
+		t.Errorf("expected 1 chunk, got %d", receipt.Chunks)
+	}
+	if len(receipt.Filenames) != 2 || len(receipt.Chains) != 2 {
+		t.Fatalf(
+			"expected 2 copies, got %d files and %d chains",
+			len(receipt.Filenames),
+			len(receipt.Chains),
+		)
+	}
+	for n, payload := range pool.payloads {
+		// The test remailer doesn't advertise hybrid headers
+		if len(payload) != packet.MessageBytes {
+			t.Errorf("expected a classic packet, got %d bytes", len(payload))
+		}
+		if pool.sendTo[n] != "test@domain.foo" {
+			t.Errorf("unexpected recipient: %s", pool.sendTo[n])
+		}
+		final, body := decodeExit(t, payload, sk)
+		if final.NumChunks() != 1 || final.ChunkNum() != 1 {
+			t.Errorf(
+				"unexpected chunk numbering: %d of %d",
+				final.ChunkNum(),
+				final.NumChunks(),
+			)
+		}
+		if !bytes.Contains(body, []byte("Hello World")) {
+			t.Errorf("message body not found in payload: %q", body)
+		}
+		if bytes.Contains(body, []byte("Yamn-Pooled-Date")) {
+			t.Error("internal header leaked into payload")
+		}
+	}
+}
+
+func TestSendChunks(t *testing.T) {
+	pubring, sk := testPubring(t)
+	pool := new(memPool)
+	c, err := New(Config{
+		Pubring: pubring,
+		Pool:    pool,
+		Chain:   []string{"test"},
+		NoDummy: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("x"), MaxFragLength*2+10)
+	receipt, err := c.SendBytes(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Chunks != 3 || len(pool.payloads) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", receipt.Chunks)
+	}
+	var msgID []byte
+	for n, payload := range pool.payloads {
+		final, _ := decodeExit(t, payload, sk)
+		if final.ChunkNum() != n+1 {
+			t.Errorf("expected chunk %d, got %d", n+1, final.ChunkNum())
+		}
+		if msgID == nil {
+			msgID = final.MessageID()
+		} else if !bytes.Equal(msgID, final.MessageID()) {
+			t.Error("chunks do not share a message ID")
+		}
+	}
+}
+
+func TestSendEmpty(t *testing.T) {
+	pubring, _ := testPubring(t)
+	c, err := New(Config{
+		Pubring: pubring,
+		Pool:    new(memPool),
+		Chain:   []string{"test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SendBytes(nil)
+	if err == nil {
+		t.Error("expected error sending an empty message")
+	}
+}
+
+func TestSendNews(t *testing.T) {
+	article := []byte("Newsgroups: alt.test\nSubject: Test\n\nHello World\n")
+	pubring, _ := testPubring(t)
+	c, err := New(Config{
+		Pubring: pubring,
+		Pool:    new(memPool),
+		Chain:   []string{"test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SendBytes(article)
+	if err == nil {
+		t.Error("expected error posting through an exit without Usenet support")
+	}
+
+	pk, sk, err := packet.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubring = keymgr.NewPubring("", "")
+	pubring.Put(keymgr.NewRemailer(
+		"news",
+		"news@domain.foo",
+		"E"+keymgr.CapNews,
+		pk,
+		nil,
+	))
+	pool := new(memPool)
+	c, err = New(Config{
+		Pubring: pubring,
+		Pool:    pool,
+		Chain:   []string{"news"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SendBytes(article)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, body := decodeExit(t, pool.payloads[0], sk)
+	if final.DeliveryMethod() != packet.DeliveryNews {
+		t.Errorf("expected Usenet delivery, got method %d", final.DeliveryMethod())
+	}
+	if !bytes.Equal(body, article) {
+		t.Errorf("unexpected article body: %q", body)
+	}
+}
+
+func TestPseudoHeaders(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		message string
+		found   bool
+		headers map[string]string
+		body    string
+	}{
+		{
+			"none",
+			"To: a@example.com\n\nHello\n",
+			false,
+			map[string]string{"To": "a@example.com"},
+			"Hello\n",
+		},
+		{
+			"directives",
+			"To: remailer@example.com\n\n::\nAnon-To: a@example.com\nRequest-Remailing-To: b@example.com\n\nHello\n",
+			true,
+			map[string]string{"To": "a@example.com, b@example.com"},
+			"Hello\n",
+		},
+		{
+			"paste",
+			"Subject: Real\n\n\n##\nSubject: Pasted\nReply-To: c@example.com\n\nHello\n",
+			true,
+			map[string]string{"Subject": "Pasted", "Reply-To": "c@example.com"},
+			"Hello\n",
+		},
+		{
+			"protected",
+			"From: Real <a@example.com>\n\n##\nFrom: Forged <b@example.com>\nSender: b@example.com\nX-Yamn-Reply-Block: 00\nSubject: Pasted\n\nHello\n",
+			true,
+			map[string]string{"From": "Real <a@example.com>", "Sender": "", "X-Yamn-Reply-Block": "", "Subject": "Pasted"},
+			"Hello\n",
+		},
+		{
+			"bare directives and paste",
+			"\nAnon-Post-To: alt.test\nNewsgroups: alt.anonymous\n\n##\nSubject: Test\n  folded\n\nHello\n",
+			true,
+			map[string]string{"Newsgroups": "alt.test,alt.anonymous", "Subject": "Test folded"},
+			"Hello\n",
+		},
+	} {
+		msg, err := mail.ReadMessage(strings.NewReader(test.message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := PseudoHeaders(msg)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if found != test.found {
+			t.Errorf("%s: Expected found=%v", test.name, test.found)
+		}
+		for name, value := range test.headers {
+			if msg.Header.Get(name) != value {
+				t.Errorf("%s: %s: Expected=%q, Got=%q", test.name, name, value, msg.Header.Get(name))
+			}
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(msg.Body)
+		if body.String() != test.body {
+			t.Errorf("%s: Expected body=%q, Got=%q", test.name, test.body, body.String())
+		}
+	}
+	// Armored packets aren't pseudo-headers
+	armored := "::\nRemailer-Type: yamn-0.2c\n\n-----BEGIN REMAILER MESSAGE-----\n"
+	msg, err := mail.ReadMessage(strings.NewReader("To: a@example.com\n\n" + armored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := PseudoHeaders(msg)
+	if err != nil || found {
+		t.Errorf("armored packet treated as pseudo-headers: %v", err)
+	}
+	body := new(bytes.Buffer)
+	body.ReadFrom(msg.Body)
+	if body.String() != armored {
+		t.Errorf("armored packet was modified: %q", body.String())
+	}
+	// Directives that can't be honoured are rejected
+	msg, err = mail.ReadMessage(strings.NewReader("\n::\nEncrypted: PGP\n\n-----BEGIN PGP MESSAGE-----\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = PseudoHeaders(msg)
+	if err == nil {
+		t.Error("expected an error for an unsupported directive")
+	}
+}
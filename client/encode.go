@@ -0,0 +1,302 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+)
+
+// chainFormat returns the packet format for chain.  Hybrid headers are only
+// used when every hop in the chain advertises them.
+func (c *Client) chainFormat(chain []string) packet.Format {
+	for _, hop := range chain {
+		remailer, err := c.conf.Pubring.Get(hop)
+		if err != nil || !remailer.Hybrid() {
+			return packet.FormatClassic
+		}
+	}
+	return packet.FormatHybrid
+}
+
+// newHeader returns an EncodeHeader that encrypts to remailer in the
+// specified packet format.
+func (c *Client) newHeader(remailer keymgr.Remailer, format packet.Format) (header *packet.EncodeHeader, err error) {
+	header = c.conf.Source.NewEncodeHeader()
+	// Tell the header function what KeyID and PK to NaCl encrypt with.
+	err = header.SetRecipient(remailer.Keyid, remailer.PK)
+	if err != nil {
+		return
+	}
+	if format == packet.FormatHybrid {
+		err = header.SetKEMRecipient(remailer.KEM)
+	}
+	return
+}
+
+// encodeMsg encodes a plaintext fragment into mixmaster format.
+func (c *Client) encodeMsg(
+	plain []byte,
+	chain []string,
+	final packet.SlotFinal) (payload []byte, err error) {
+
+	var hop string
+	m := c.conf.Source.NewFormatEncMessage(c.chainFormat(chain))
+	err = m.SetChainLength(len(chain))
+	if err != nil {
+		return
+	}
+	length, err := m.SetPlainText(plain)
+	if err != nil {
+		return
+	}
+	// Pop the exit remailer address from the chain
+	hop = popstr(&chain)
+	// Insert the plain message length into the Final Hop header.
+	err = final.SetBodyBytes(length)
+	if err != nil {
+		return
+	}
+	// Get KeyID and NaCl PK for the remailer we're enrypting to.
+	remailer, err := c.conf.Pubring.Get(hop)
+	if err != nil {
+		return
+	}
+	slotData := c.conf.Source.NewSlotData()
+	// Identify this hop as Packet-Type 1 (Exit).
+	slotData.SetExit()
+	if final.NumChunks() > packet.MaxClassicChunks {
+		// Only Version 6 can describe this many chunks
+		err = slotData.SetVersion(packet.Version6)
+	} else if remailer.MAC() {
+		err = slotData.SetVersion(packet.Version5)
+	}
+	if err != nil {
+		return
+	}
+	// For exit hops, the AES key can be entirely random.
+	err = slotData.SetAesKey(c.conf.Source.Randbytes(32))
+	if err != nil {
+		return
+	}
+	// Override the random PacketID so that multi-copy messages all share a
+	// common Exit PacketID.
+	err = slotData.SetPacketID(final.PacketID())
+	if err != nil {
+		return
+	}
+	// Encode the (final) Packet Info and store it in the Slot Data.
+	finalBytes, err := final.EncodeVersion(slotData.Version())
+	if err != nil {
+		return
+	}
+	err = slotData.SetPacketInfo(finalBytes)
+	if err != nil {
+		return
+	}
+	// Create a new Header.
+	header, err := c.newHeader(remailer, m.Format())
+	if err != nil {
+		return
+	}
+	log.Tracef(
+		"Encrypting Final Hop: Hop=%s, KeyID=%x",
+		hop,
+		remailer.Keyid,
+	)
+	// Only the body needs to be encrypted during Exit encoding.  At all other
+	// hops, the entire header stack will also need encrypting.
+	err = m.EncryptBody(slotData.AesKey(), final.AesIV())
+	if err != nil {
+		return
+	}
+	// Shift all the header down by headerBytes
+	m.ShiftHeaders()
+	// We've already popped an entry from the Chain so were testing for
+	// length greater than zero rather than 1.
+	if len(chain) > 0 {
+		// Single hop chains don't require deterministic headers.  All
+		// longer chains do.
+		err = m.Deterministic(0)
+		if err != nil {
+			return
+		}
+	}
+	// Set the Anti-tag hash (or MAC) in the slotData.
+	err = setTag(m, slotData, header)
+	if err != nil {
+		return
+	}
+	// Encode the slot data into Byte form.
+	slotDataBytes, err := slotData.Encode()
+	if err != nil {
+		return
+	}
+	// Encode the header and insert it into the payload.
+	headerBytes, err := header.Encode(slotDataBytes)
+	if err != nil {
+		return
+	}
+	err = m.InsertHeader(headerBytes)
+	if err != nil {
+		return
+	}
+
+	// That concludes Exit hop compilation.  Now for intermediates.
+	err = c.encodeIntermediates(m, chain, hop, packet.Version2)
+	if err != nil {
+		return
+	}
+	payload = m.Payload()
+	return
+}
+
+// setTag inserts the version specific integrity check of the payload below
+// the header into slotData.
+func setTag(m *packet.EncMessage, slotData *packet.SlotData, header *packet.EncodeHeader) (err error) {
+	switch slotData.Version() {
+	case packet.Version3:
+		// Reply Blocks don't know their body
+		err = slotData.SetTagHash(m.AntiTagHeaders())
+	case packet.Version5, packet.Version6:
+		// A MAC keyed by the secret shared with the hop
+		var key, mac []byte
+		key, err = header.MACKey()
+		if err != nil {
+			return
+		}
+		mac, err = m.MAC(key)
+		if err != nil {
+			return
+		}
+		err = slotData.SetTagHash(mac)
+	default:
+		err = slotData.SetTagHash(m.AntiTag())
+	}
+	return
+}
+
+// hopDelay returns a random delay, drawn from an exponential distribution
+// with a mean of the configured Delay.  Delays are truncated to MaxDelay.
+func (c *Client) hopDelay() time.Duration {
+	delay := time.Duration(crandom.ExpFloat64() * float64(c.conf.Delay))
+	if delay > MaxDelay {
+		delay = MaxDelay
+	}
+	return delay
+}
+
+// encodeIntermediates wraps the Exit header in m with a header for each
+// remaining hop in chain.  hop is the address of the Exit remailer.
+func (c *Client) encodeIntermediates(
+	m *packet.EncMessage,
+	chain []string,
+	hop string,
+	version int) (err error) {
+
+	interHops := m.IntermediateHops()
+	for interHop := 0; interHop < interHops; interHop++ {
+		inter := packet.NewSlotIntermediate()
+		var partialIV, key, interBytes, slotDataBytes, headerBytes []byte
+		partialIV, err = m.PartialIV(interHop)
+		if err != nil {
+			return
+		}
+		err = inter.SetPartialIV(partialIV)
+		if err != nil {
+			return
+		}
+		// hop still contains the previous iteration (or exit) address.
+		err = inter.SetNextHop(hop)
+		if err != nil {
+			return
+		}
+		// Pop another remailer from the left side of the Chain
+		hop = popstr(&chain)
+		var remailer keymgr.Remailer
+		remailer, err = c.conf.Pubring.Get(hop)
+		if err != nil {
+			return
+		}
+		// Delays are requested of hops that advertise support for them.
+		// Reply Blocks are never delayed.
+		slotVersion := version
+		if version == packet.Version2 && remailer.MAC() {
+			// Version 5 Intermediates always contain a delay
+			slotVersion = packet.Version5
+			err = inter.SetDelay(c.hopDelay())
+		} else if version == packet.Version2 && c.conf.Delay > 0 && remailer.Delays() {
+			slotVersion = packet.Version4
+			err = inter.SetDelay(c.hopDelay())
+		}
+		if err != nil {
+			return
+		}
+		// Create new Slot Data
+		slotData := c.conf.Source.NewSlotData()
+		err = slotData.SetVersion(slotVersion)
+		if err != nil {
+			return
+		}
+		key, err = m.Key(interHop)
+		if err != nil {
+			return
+		}
+		err = slotData.SetAesKey(key)
+		if err != nil {
+			return
+		}
+		interBytes, err = inter.Encode()
+		if err != nil {
+			return
+		}
+		err = slotData.SetPacketInfo(interBytes)
+		if err != nil {
+			return
+		}
+		err = m.EncryptAll(interHop)
+		if err != nil {
+			return
+		}
+		m.ShiftHeaders()
+		err = m.Deterministic(interHop + 1)
+		if err != nil {
+			return
+		}
+		var header *packet.EncodeHeader
+		header, err = c.newHeader(remailer, m.Format())
+		if err != nil {
+			return
+		}
+		err = setTag(m, slotData, header)
+		if err != nil {
+			return
+		}
+		slotDataBytes, err = slotData.Encode()
+		if err != nil {
+			return
+		}
+		log.Tracef(
+			"Encrypting: Hop=%s, KeyID=%x, Delay=%s",
+			hop,
+			remailer.Keyid,
+			inter.Delay(),
+		)
+		headerBytes, err = header.Encode(slotDataBytes)
+		if err != nil {
+			return
+		}
+		err = m.InsertHeader(headerBytes)
+		if err != nil {
+			return
+		}
+	}
+	if len(chain) != 0 {
+		err = errors.New("after encoding, chain was not empty")
+		return
+	}
+	return
+}
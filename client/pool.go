@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/packet"
+)
+
+// PoolWriter stores an encoded packet until it can be mailed to sendTo, the
+// entry remailer of its chain.  It returns an identifier for the stored
+// packet, normally a filename.
+type PoolWriter interface {
+	WriteMessage(sendTo string, payload []byte) (filename string, err error)
+}
+
+// DirPool is a PoolWriter that writes armored packets into a YAMN pool
+// directory, ready for "yamn --send" or a remailer to mail them.
+type DirPool struct {
+	Dir     string // Pool directory
+	From    string // From header on pooled messages
+	Version string // Yamn version advertised in the armor
+	Prefix  string // Filename prefix, defaults to "m" (outbound)
+}
+
+// WriteMessage writes an outbound ("m" prefixed) pool file containing mail
+// headers and the armored payload.
+func (p *DirPool) WriteMessage(sendTo string, payload []byte) (filename string, err error) {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = "m"
+	}
+	var f *os.File
+	for {
+		filename = prefix + hex.EncodeToString(crandom.Randbytes(7))
+		f, err = os.OpenFile(
+			path.Join(p.Dir, filename),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0600,
+		)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	// Internal header used to expire old pool files
+	fmt.Fprintf(w, "Yamn-Pooled-Date: %s\n", time.Now().Format("2 Jan 2006"))
+	fmt.Fprintf(w, "To: %s\n", sendTo)
+	fmt.Fprintf(w, "From: %s\n", p.From)
+	fmt.Fprintf(w, "Subject: yamn-%s\n", p.Version)
+	fmt.Fprint(w, "\n")
+	// Armor the payload
+	err = packet.Armor(w, payload, p.Version)
+	if err != nil {
+		return
+	}
+	err = w.Flush()
+	return
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+/*
+Mixmaster front-ends put pseudo-headers at the top of the message body:
+	::			Followed by remailing directives (Anon-To, etc.)
+	##			Followed by headers to paste into the message
+	Anon-To: addr		Directives without a preceding "::" line
+Each block ends with a blank line.  Multiple blocks may follow each other.
+A "::" block containing Remailer-Type is an armored remailer packet and is
+left untouched.  Pasted headers that identify the sender or are internal to
+yamn (see protectedHeader) are discarded.
+*/
+
+// pseudoDirectives map remailing directives to the headers they set.
+var pseudoDirectives = map[string]string{
+	"Anon-To":              "To",
+	"Request-Remailing-To": "To",
+	"Remail-To":            "To",
+	"Anon-Post-To":         "Newsgroups",
+	"Post-To":              "Newsgroups",
+	"Newsgroups":           "Newsgroups",
+}
+
+// protectedHeader returns true if name is a header that pasted headers can't
+// replace.
+func protectedHeader(name string) bool {
+	return name == "From" ||
+		name == "Sender" ||
+		strings.HasPrefix(name, "Yamn-") ||
+		strings.HasPrefix(name, "X-Yamn-")
+}
+
+// PseudoHeaders merges Mixmaster-style pseudo-headers at the top of the
+// body of msg into its header and strips them from the body.  Pseudo-headers
+// replace real headers of the same name.  found is true if any were merged.
+func PseudoHeaders(msg *mail.Message) (found bool, err error) {
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return
+	}
+	// Restore the unmodified body unless pseudo-headers are merged
+	msg.Body = bytes.NewReader(body)
+	merged := make(mail.Header)
+	rest := bytes.TrimLeft(body, "\r\n")
+	for {
+		var line, next []byte
+		line, next, _ = bytes.Cut(rest, []byte("\n"))
+		line = bytes.TrimRight(line, "\r \t")
+		var directives bool
+		switch {
+		case string(line) == "::":
+			directives = true
+			rest = next
+		case string(line) == "##":
+			rest = next
+		case isDirective(string(line)):
+			directives = true
+		default:
+			if found {
+				for name, values := range merged {
+					// Recipients and groups are combined into
+					// a single header
+					switch name {
+					case "To", "Cc":
+						values = []string{strings.Join(values, ", ")}
+					case "Newsgroups":
+						values = []string{strings.Join(values, ",")}
+					}
+					msg.Header[name] = values
+				}
+				msg.Body = bytes.NewReader(rest)
+			}
+			return
+		}
+		var fields []string
+		fields, rest = pseudoBlock(rest)
+		for _, field := range fields {
+			name, value, ok := strings.Cut(field, ":")
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			value = strings.TrimSpace(value)
+			if !ok || name == "" || strings.ContainsAny(name, " \t") {
+				err = fmt.Errorf("malformed pseudo-header: %s", field)
+				return
+			}
+			if directives && name == "Remailer-Type" {
+				// An armored remailer packet, not pseudo-headers
+				return false, nil
+			}
+			if directives {
+				header, known := pseudoDirectives[name]
+				if !known {
+					err = fmt.Errorf("unsupported remailing directive: %s", name)
+					return
+				}
+				name = header
+			} else if protectedHeader(name) {
+				continue
+			}
+			merged[name] = append(merged[name], value)
+		}
+		found = true
+	}
+}
+
+// isDirective returns true if line is a remailing directive.
+func isDirective(line string) bool {
+	name, _, ok := strings.Cut(line, ":")
+	_, known := pseudoDirectives[textproto.CanonicalMIMEHeaderKey(name)]
+	return ok && known
+}
+
+// pseudoBlock returns the header fields, with folded lines joined, that
+// precede the first blank line in b, and the remainder of b after it.
+func pseudoBlock(b []byte) (fields []string, rest []byte) {
+	rest = b
+	for len(rest) > 0 {
+		var line []byte
+		line, rest, _ = bytes.Cut(rest, []byte("\n"))
+		text := strings.TrimRight(string(line), "\r")
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		if len(fields) > 0 && (text[0] == ' ' || text[0] == '\t') {
+			fields[len(fields)-1] += " " + strings.TrimSpace(text)
+			continue
+		}
+		fields = append(fields, text)
+	}
+	return
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/packet"
+)
+
+// ReplyHeader is the mail header in which an Exit remailer identifies the
+// Reply Block used to deliver a message.
+const ReplyHeader = "X-Yamn-Reply-Block"
+
+// NewReplyBlock encodes a Reply Block that delivers to owner through the
+// configured chain.  The ReplyBlock can be given to correspondents; the
+// ReplySecret must be retained by the owner in order to read replies.
+func (c *Client) NewReplyBlock(owner string) (block *packet.ReplyBlock, secret *packet.ReplySecret, err error) {
+	// The slot below the Exit header carries the owner's address.
+	if len(c.conf.Chain) > packet.MaxChainLength-1 {
+		err = fmt.Errorf(
+			"%d hops exceeds maximum of %d for reply blocks",
+			len(c.conf.Chain),
+			packet.MaxChainLength-1,
+		)
+		return
+	}
+	chain, err := c.makeChain(append(c.conf.Chain[:0:0], c.conf.Chain...))
+	if err != nil {
+		return
+	}
+	log.Tracef("Reply block chain: %s", strings.Join(chain, ","))
+	entryHop := chain[0]
+	final := c.conf.Source.NewSlotFinal()
+	final.SetDeliveryMethod(packet.DeliveryReply)
+	m, err := c.encodeReplyBlock(owner, chain, *final)
+	if err != nil {
+		return
+	}
+	block = &packet.ReplyBlock{
+		EntryHop: entryHop,
+		Key:      c.conf.Source.Randbytes(32),
+		Headers:  make([]byte, packet.HeadersBytes),
+	}
+	copy(block.Headers, m.Payload()[:packet.HeadersBytes])
+	secret = &packet.ReplySecret{
+		ID:  final.MessageID(),
+		Key: block.Key,
+	}
+	for n := 0; n < m.IntermediateHops(); n++ {
+		var key, iv []byte
+		key, err = m.Key(n)
+		if err != nil {
+			return
+		}
+		iv, err = m.PartialIV(n)
+		if err != nil {
+			return
+		}
+		secret.Keys = append(secret.Keys, key)
+		secret.PartialIVs = append(secret.PartialIVs, iv)
+	}
+	return
+}
+
+// encodeReplyBlock encodes the header stack of a Reply Block.  It mirrors
+// encodeMsg but has no body and inserts the owner's address below the Exit
+// header.
+func (c *Client) encodeReplyBlock(
+	owner string,
+	chain []string,
+	final packet.SlotFinal) (m *packet.EncMessage, err error) {
+
+	m = c.conf.Source.NewFormatEncMessage(packet.FormatClassic)
+	err = m.SetChainLength(len(chain))
+	if err != nil {
+		return
+	}
+	// Pop the exit remailer address from the chain
+	hop := popstr(&chain)
+	// The body length is unknown.  Replies encode it within the body.
+	err = final.SetBodyBytes(0)
+	if err != nil {
+		return
+	}
+	slotData := c.conf.Source.NewSlotData()
+	err = slotData.SetVersion(packet.Version3)
+	if err != nil {
+		return
+	}
+	slotData.SetExit()
+	// The Exit never decrypts the body of a reply so its key is unused.
+	err = slotData.SetAesKey(c.conf.Source.Randbytes(32))
+	if err != nil {
+		return
+	}
+	err = slotData.SetPacketID(final.PacketID())
+	if err != nil {
+		return
+	}
+	finalBytes, err := final.Encode()
+	if err != nil {
+		return
+	}
+	err = slotData.SetPacketInfo(finalBytes)
+	if err != nil {
+		return
+	}
+	remailer, err := c.conf.Pubring.Get(hop)
+	if err != nil {
+		return
+	}
+	log.Tracef(
+		"Encrypting Reply Block Exit: Hop=%s, KeyID=%x",
+		hop,
+		remailer.Keyid,
+	)
+	// Encode the owner's address to the Exit remailer
+	slotOwner := packet.NewSlotOwner()
+	err = slotOwner.SetAddress(owner)
+	if err != nil {
+		return
+	}
+	ownerBytes, err := slotOwner.Encode()
+	if err != nil {
+		return
+	}
+	// Reply Blocks are of a fixed size so always use classic headers
+	header, err := c.newHeader(remailer, m.Format())
+	if err != nil {
+		return
+	}
+	ownerHeader, err := header.Encode(ownerBytes)
+	if err != nil {
+		return
+	}
+	m.ShiftHeaders()
+	// The owner header sits directly below the Exit header.  This slot is
+	// never overwritten by deterministic headers as the chain is shorter
+	// than MaxChainLength.
+	err = m.InsertHeaderAt(1, ownerHeader)
+	if err != nil {
+		return
+	}
+	if len(chain) > 0 {
+		err = m.Deterministic(0)
+		if err != nil {
+			return
+		}
+	}
+	err = slotData.SetTagHash(m.AntiTagHeaders())
+	if err != nil {
+		return
+	}
+	slotDataBytes, err := slotData.Encode()
+	if err != nil {
+		return
+	}
+	headerBytes, err := header.Encode(slotDataBytes)
+	if err != nil {
+		return
+	}
+	err = m.InsertHeader(headerBytes)
+	if err != nil {
+		return
+	}
+	err = c.encodeIntermediates(m, chain, hop, packet.Version3)
+	return
+}
+
+// SendReply encrypts plain using a Reply Block and writes the resulting
+// packet to the pool, addressed to the Reply Block's entry remailer.
+func (c *Client) SendReply(block *packet.ReplyBlock, plain []byte) (filename string, err error) {
+	payload, err := c.conf.Source.ReplyMessage(block, plain)
+	if err != nil {
+		return
+	}
+	return c.conf.Pool.WriteMessage(block.EntryHop, payload)
+}
+
+// ReadReply extracts the armored packet from a message delivered by a Reply
+// Block Exit and decrypts its body using secret.
+func ReadReply(r io.Reader, secret *packet.ReplySecret) (plain []byte, err error) {
+	payload, err := packet.StripArmor(r)
+	if err != nil {
+		return
+	}
+	if len(payload) != packet.MessageBytes {
+		err = errors.New("reply is not a complete packet")
+		return
+	}
+	return secret.Decrypt(payload[packet.HeadersBytes:])
+}
@@ -10,11 +10,19 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// DefaultMaxSize is the default remailer.max_size, in kB.
+	DefaultMaxSize = 20480
+	// LegacyMaxSize is the max_size shipped by releases that advertised it
+	// without enforcing it.  Configs that still set it are warned about.
+	LegacyMaxSize = 12
+)
+
 // Config contains all the configuration settings for Yamn.
 type Config struct {
 	General struct {
-		Loglevel     string `yaml:"loglevel"`
-		LogToFile    bool   `yaml:"logtofile"`
+		Loglevel  string `yaml:"loglevel"`
+		LogToFile bool   `yaml:"logtofile"`
 	} `yaml:"general"`
 	Files struct {
 		// Config is a special variable that returns the name of the active config file.
@@ -31,6 +39,13 @@ type Config struct {
 		IDlog    string `yaml:"idlog"`
 		ChunkDB  string `yaml:"chunkdb"`
 		Logfile  string `yaml:"logfile"`
+		// Hashed destination block list
+		DestBlock string `yaml:"dest_block"`
+		// Delivery rate limit database
+		RateDB string `yaml:"ratedb"`
+		// Mixmaster Type II secret keys (PEM) and published public keys
+		Mix2Secring string `yaml:"mix2_secring"`
+		Mix2Pubkey  string `yaml:"mix2_pubkey"`
 	} `yaml:"files"`
 	Urls struct {
 		Fetch   bool   `yaml:"fetch"`
@@ -38,6 +53,10 @@ type Config struct {
 		Mlist2  string `yaml:"mlist2"`
 	} `yaml:"urls"`
 	Mail struct {
+		// Transport is one of smtp, sendmail, pipe, outfile, lmtp or
+		// maildir.  If undefined, it's selected by the legacy
+		// sendmail, pipe and outfile options.
+		Transport     string `yaml:"transport"`
 		Sendmail      bool   `yaml:"sendmail"`
 		Pipe          string `yaml:"pipe"`
 		Outfile       bool   `yaml:"outfile"`
@@ -53,6 +72,22 @@ type Config struct {
 		OutboundAddy  string `yaml:"outbound_addy"`
 		CustomFrom    bool   `yaml:"custom_from"`
 		MessageDomain string `yaml:"message_domain"`
+		// Connect to the smtp_relay with TLS.  Implied by port 465.
+		ImplicitTLS bool `yaml:"implicit_tls"`
+		// Refuse to deliver unless the session is encrypted
+		RequireTLS bool `yaml:"require_tls"`
+		// PEM CA certificates that verify the relay.  If undefined, the
+		// system roots are used.
+		CAFile string `yaml:"ca_file"`
+		// Base64 SHA-256 hashes of acceptable relay public keys
+		SPKIPins []string `yaml:"spki_pins"`
+		// AUTH mechanism: plain, login or cram-md5.  If undefined, the
+		// best that the relay offers is used.
+		AuthMech string `yaml:"auth_mech"`
+		// LMTP server (host:port or Unix socket path)
+		LMTPAddr string `yaml:"lmtp_addr"`
+		// Maildir that the maildir transport delivers to
+		LocalMaildir string `yaml:"local_maildir"`
 	} `yaml:"mail"`
 	Stats struct {
 		Minlat     int     `yaml:"minlat"`
@@ -64,6 +99,12 @@ type Config struct {
 		Distance   int     `yaml:"distance"`
 		StaleHrs   int     `yaml:"stale_hours"`
 		UseExpired bool    `yaml:"use_expired"`
+		// Mean per-hop delay in minutes.  Zero disables delays.
+		HopDelay int `yaml:"hop_delay"`
+		// Compression algorithm: none, deflate or zstd
+		Compress string `yaml:"compress"`
+		// Pad messages up to these sizes (in chunks)
+		SizeClasses []int `yaml:"size_classes"`
 	} `yaml:"stats"`
 	Pool struct {
 		Size    int `yaml:"size"`
@@ -72,19 +113,102 @@ type Config struct {
 		Loop    int `yaml:"loop"`
 		// Delete excessively old messages from the outbound pool
 		MaxAge int `yaml:"max_age"`
+		// Maximum sender-specified delay honoured, in minutes
+		MaxHold int `yaml:"max_hold"`
 	} `yaml:"pool"`
 	Remailer struct {
-		Name        string `yaml:"name"`
-		Address     string `yaml:"address"`
-		Exit        bool   `yaml:"exit"`
-		MaxSize     int    `yaml:"max_size"`
-		IDexp       int    `yaml:"id_expire"`
-		ChunkExpire int    `yaml:"chunk_expire"`
-		MaxAge      int    `yaml:"max_age"`
-		Keylife     int    `yaml:"key_life"`
-		Keygrace    int    `yaml:"key_grace"`
-		Daemon      bool   `yaml:"daemon"`
+		Name    string `yaml:"name"`
+		Address string `yaml:"address"`
+		Exit    bool   `yaml:"exit"`
+		// Largest message delivered, in kB.  Zero is unlimited.
+		MaxSize     int  `yaml:"max_size"`
+		IDexp       int  `yaml:"id_expire"`
+		ChunkExpire int  `yaml:"chunk_expire"`
+		MaxAge      int  `yaml:"max_age"`
+		Keylife     int  `yaml:"key_life"`
+		Keygrace    int  `yaml:"key_grace"`
+		Daemon      bool `yaml:"daemon"`
+		// Decode Mixmaster Type II packets
+		Mix2 bool `yaml:"mix2"`
 	} `yaml:"remailer"`
+	// Limits restrict deliveries by Exit remailers.  Zero is unlimited.
+	Limits struct {
+		// Maximum recipients of a single message
+		MaxRecipients int `yaml:"max_recipients"`
+		// Sliding window, in minutes, for per_address and per_domain
+		Window int `yaml:"window"`
+		// Messages delivered to each address per window
+		PerAddress int `yaml:"per_address"`
+		// Messages delivered to each domain per window
+		PerDomain int `yaml:"per_domain"`
+		// Total messages delivered per day (UTC)
+		Daily int `yaml:"daily"`
+		// Action for messages over a rate limit: drop or defer
+		Action string `yaml:"action"`
+	} `yaml:"limits"`
+	// Gateway accepts plaintext (Type I style) mail with Anon-To headers
+	// and forwards it through a chain of random remailers
+	Gateway struct {
+		Enabled bool `yaml:"enabled"`
+		// Random hops in the chain.  The minimum is two.
+		Hops int `yaml:"hops"`
+		// Messages accepted from each sender per day.  Zero is
+		// unlimited.
+		PerSender int `yaml:"per_sender"`
+	} `yaml:"gateway"`
+	// Bounces configures the handling of bounced Exit deliveries
+	Bounces struct {
+		// Block addresses after this many hard bounces.  Zero never
+		// blocks.
+		BlockAfter int `yaml:"block_after"`
+		// Period, in days, over which hard bounces are counted
+		Window int `yaml:"window"`
+	} `yaml:"bounces"`
+	// Filter defines the header policy applied by Exit remailers
+	Filter struct {
+		// If defined, only headers matching an Allow rule are
+		// delivered.  To and Cc are exempt.
+		Allow []HeaderRule `yaml:"allow"`
+		// Headers matching a Deny rule are removed
+		Deny []HeaderRule `yaml:"deny"`
+	} `yaml:"filter"`
+	// Disclaimer is added to messages delivered by Exit remailers.
+	// Templates can reference {{.Name}}, {{.Address}} and {{.Abuse}}.
+	Disclaimer struct {
+		// Header lines (E.g. "Comments: ...") added to each delivery
+		Headers []string `yaml:"headers"`
+		// Text appended to (or attached to) each delivery
+		Footer string `yaml:"footer"`
+		// Abuse contact address
+		Abuse string `yaml:"abuse"`
+	} `yaml:"disclaimer"`
+	// DKIM signs messages delivered by Exit remailers
+	DKIM struct {
+		// Signing domain (d=) and selector (s=).  Signing is disabled
+		// unless both are defined.
+		Domain   string `yaml:"domain"`
+		Selector string `yaml:"selector"`
+		// PEM encoded RSA or Ed25519 private key
+		KeyFile string `yaml:"key_file"`
+		// Headers signed, if they survive the header filter.  From is
+		// always signed.
+		Headers []string `yaml:"headers"`
+	} `yaml:"dkim"`
+	News struct {
+		// NNTP server (host:port) that Exit articles are posted to
+		NNTPServer string `yaml:"nntp_server"`
+		Username   string `yaml:"username"`
+		Password   string `yaml:"password"`
+		// Mail2news gateway address used if no NNTP server is defined
+		Mail2News string `yaml:"mail2news"`
+	} `yaml:"news"`
+}
+
+// HeaderRule matches message headers by name and, optionally, by a regular
+// expression on their value.
+type HeaderRule struct {
+	Header string `yaml:"header"`
+	Value  string `yaml:"value"`
 }
 
 type Flags struct {
@@ -106,6 +230,10 @@ type Flags struct {
 	Dummy    bool
 	NoDummy  bool
 	Version  bool
+	Inspect  string
+	Vectors  bool
+	Block    string
+	DKIMGen  string
 }
 
 // GetCfg parses the command line flags and config file if they haven't been previously parsed.
@@ -171,8 +299,8 @@ func ParseFlags() *Flags {
 	flag.StringVar(&f.Subject, "subject", "", "Subject header")
 	flag.StringVar(&f.Subject, "s", "", "Subject header")
 	// Number of copies
-	flag.IntVar(&f.Copies, "copies", 2, "Number of copies")
-	flag.IntVar(&f.Copies, "c", 2, "Number of copies")
+	flag.IntVar(&f.Copies, "copies", 0, "Number of copies")
+	flag.IntVar(&f.Copies, "c", 0, "Number of copies")
 	// Config file
 	flag.StringVar(&f.Config, "config", "", "Config file")
 	// Read STDIN
@@ -192,6 +320,14 @@ func ParseFlags() *Flags {
 	flag.BoolVar(&f.Debug, "debug", false, "Print detailed config")
 	// Refresh remailer stats files
 	flag.BoolVar(&f.Refresh, "refresh", false, "Refresh remailer stats files")
+	// Inspect an armored message
+	flag.StringVar(&f.Inspect, "inspect", "", "Inspect an armored message FILE")
+	// Write packet test vectors
+	flag.BoolVar(&f.Vectors, "gen-vectors", false, "Write JSON packet test vectors to stdout")
+	// Add a destination block
+	flag.StringVar(&f.Block, "block", "", "Add an ADDRESS or DOMAIN to the destination block list")
+	// Generate a DKIM key
+	flag.StringVar(&f.DKIMGen, "dkim-keygen", "", "Generate a DKIM key of TYPE (rsa or ed25519) and print its DNS record")
 
 	flag.Parse()
 	return f
@@ -239,12 +375,19 @@ func (f *Flags) findConfig() (string, error) {
 	return "", os.ErrNotExist
 }
 
+// NewConfig returns an instance of Config populated with defaults.  Files
+// default to paths within dir.
+func NewConfig(dir string) *Config {
+	f := &Flags{Dir: dir}
+	return f.newConfig()
+}
+
 // newConfig returns a new instance of Config with some predefined defaults
 func (f *Flags) newConfig() *Config {
 	c := new(Config)
 	// Default values defined here will be overridden by unmarshaling a config file
 	c.General.Loglevel = "warn"
-	c.General.LogToFile = false    // By default, log to stdout/stderr
+	c.General.LogToFile = false // By default, log to stdout/stderr
 	// Config items in the Files section default to a path defined by the --dir flag
 	c.Files.Pubkey = path.Join(f.Dir, "key.txt")
 	c.Files.Pubring = path.Join(f.Dir, "pubring.mix")
@@ -257,9 +400,14 @@ func (f *Flags) newConfig() *Config {
 	c.Files.IDlog = path.Join(f.Dir, "idlog")
 	c.Files.ChunkDB = path.Join(f.Dir, "chunkdb")
 	c.Files.Logfile = path.Join(f.Dir, "yamn.log")
+	c.Files.DestBlock = path.Join(f.Dir, "dest.blk")
+	c.Files.RateDB = path.Join(f.Dir, "ratedb")
+	c.Files.Mix2Secring = path.Join(f.Dir, "mix2sec.pem")
+	c.Files.Mix2Pubkey = path.Join(f.Dir, "key2.txt")
 	c.Urls.Fetch = true
 	c.Urls.Pubring = "http://www.mixmin.net/yamn/pubring.mix"
 	c.Urls.Mlist2 = "http://www.mixmin.net/yamn/mlist2.txt"
+	c.Mail.Transport = ""
 	c.Mail.Sendmail = false
 	c.Mail.Outfile = false
 	c.Mail.SMTPRelay = "fleegle.mixmin.net"
@@ -274,6 +422,13 @@ func (f *Flags) newConfig() *Config {
 	c.Mail.OutboundAddy = "remailer@domain.invalid"
 	c.Mail.CustomFrom = false
 	c.Mail.MessageDomain = ""
+	c.Mail.ImplicitTLS = false
+	c.Mail.RequireTLS = false
+	c.Mail.CAFile = ""
+	c.Mail.SPKIPins = nil
+	c.Mail.AuthMech = ""
+	c.Mail.LMTPAddr = ""
+	c.Mail.LocalMaildir = path.Join(f.Dir, "Delivered")
 	c.Stats.Minrel = 98.0
 	c.Stats.Relfinal = 99.0
 	c.Stats.Minlat = 2
@@ -283,15 +438,18 @@ func (f *Flags) newConfig() *Config {
 	c.Stats.Distance = 2
 	c.Stats.StaleHrs = 24
 	c.Stats.UseExpired = false
+	c.Stats.HopDelay = 0
+	c.Stats.Compress = "none"
 	c.Pool.Size = 5 // Good for startups, too small for established
 	c.Pool.Rate = 65
 	c.Pool.MinSend = 5 // Only used in Binomial Mix Pools
 	c.Pool.Loop = 300
 	c.Pool.MaxAge = 28
+	c.Pool.MaxHold = 1440
 	c.Remailer.Name = "anon"
 	c.Remailer.Address = "mix@nowhere.invalid"
 	c.Remailer.Exit = false
-	c.Remailer.MaxSize = 12
+	c.Remailer.MaxSize = DefaultMaxSize
 	c.Remailer.IDexp = 14
 	c.Remailer.ChunkExpire = 60
 	// Discard messages if packet timestamp exceeds this age in days
@@ -299,6 +457,42 @@ func (f *Flags) newConfig() *Config {
 	c.Remailer.Keylife = 14
 	c.Remailer.Keygrace = 28
 	c.Remailer.Daemon = false
+	c.Remailer.Mix2 = false
+	c.Limits.MaxRecipients = 0
+	c.Limits.Window = 60
+	c.Limits.PerAddress = 0
+	c.Limits.PerDomain = 0
+	c.Limits.Daily = 0
+	c.Limits.Action = "defer"
+	c.Disclaimer.Headers = nil
+	c.Disclaimer.Footer = ""
+	c.Disclaimer.Abuse = ""
+	c.DKIM.Domain = ""
+	c.DKIM.Selector = ""
+	c.DKIM.KeyFile = path.Join(f.Dir, "dkim.pem")
+	c.DKIM.Headers = []string{
+		"From",
+		"To",
+		"Cc",
+		"Subject",
+		"Date",
+		"Message-Id",
+		"Reply-To",
+		"In-Reply-To",
+		"References",
+		"Mime-Version",
+		"Content-Type",
+		"Content-Transfer-Encoding",
+	}
+	c.Gateway.Enabled = false
+	c.Gateway.Hops = 2
+	c.Gateway.PerSender = 10
+	c.Bounces.BlockAfter = 0
+	c.Bounces.Window = 7
+	c.News.NNTPServer = ""
+	c.News.Username = ""
+	c.News.Password = ""
+	c.News.Mail2News = ""
 	return c
 }
 
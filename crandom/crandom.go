@@ -61,6 +61,13 @@ func RandomInt(max int) int {
 	return r.Intn(max)
 }
 
+// ExpFloat64 returns an exponentially distributed float64 with a mean of 1.
+// Multiply the result by the desired mean.
+func ExpFloat64() float64 {
+	r := rand.New(newCryptoRandSource())
+	return r.ExpFloat64()
+}
+
 // RandInts returns a randomly ordered slice of ints
 func RandInts(n int) (m []int) {
 	r := rand.New(newCryptoRandSource())
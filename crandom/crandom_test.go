@@ -121,3 +121,20 @@ func TestRandBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestExpFloat64(t *testing.T) {
+	iterations := 10000
+	var total float64
+	for n := 0; n < iterations; n++ {
+		f := ExpFloat64()
+		if f < 0 {
+			t.Fatalf("Exponential distribution returned negative: %f", f)
+		}
+		total += f
+	}
+	mean := total / float64(iterations)
+	// The mean should be close to 1
+	if mean < 0.9 || mean > 1.1 {
+		t.Errorf("Unexpected mean: %f", mean)
+	}
+}
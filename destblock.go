@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/dchest/blake2s"
+)
+
+/*
+The destination block list is a text file of entries, one per line:
+	key <hex>	Blake2s key used to hash entries and confirmation tokens
+	addr <hex>	Keyed hash of a blocked email address
+	domain <hex>	Keyed hash of a blocked domain (and its subdomains)
+	regex <pattern>	Regular expression matched against addresses
+Addresses and domains are stored hashed so that the list doesn't reveal who
+asked to be blocked.  Lines beginning with "#" are comments.
+*/
+
+// tokenDays is the number of days a remailer-block confirmation token is
+// valid for.
+const tokenDays = 3
+
+// Confirmation tokens are mailed to an unauthenticated sender address.  These
+// daily limits prevent the remailer being used to mail arbitrary third
+// parties.
+const (
+	confirmPerAddress = 1  // Tokens mailed to each address per day
+	confirmDaily      = 20 // Tokens mailed to all addresses per day
+)
+
+// destBlock is a destination block list.  Its methods are safe for
+// concurrent use.
+type destBlock struct {
+	filename string
+	modTime  time.Time
+	mu       sync.Mutex // Guards key, hashes and appending to the file
+	key      []byte
+	hashes   map[string]bool
+	regexes  []*regexp.Regexp
+}
+
+// openDestBlock reads a destination block list.  A missing file is an empty
+// list.
+func openDestBlock(filename string) (b *destBlock, err error) {
+	b = &destBlock{filename: filename, hashes: make(map[string]bool)}
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	b.modTime = stat.ModTime()
+	scanner := bufio.NewScanner(f)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			err = fmt.Errorf("%s:%d: malformed entry", filename, lineNum)
+			return
+		}
+		value := strings.TrimSpace(fields[1])
+		switch fields[0] {
+		case "key":
+			b.key, err = hex.DecodeString(value)
+			if err == nil && len(b.key) != 32 {
+				err = errors.New("key must be 32 bytes")
+			}
+		case "addr", "domain":
+			b.hashes[value] = true
+		case "regex":
+			var re *regexp.Regexp
+			re, err = regexp.Compile(value)
+			b.regexes = append(b.regexes, re)
+		default:
+			err = fmt.Errorf("unknown entry type: %s", fields[0])
+		}
+		if err != nil {
+			err = fmt.Errorf("%s:%d: %w", filename, lineNum, err)
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// digest returns the keyed hash of s.  The caller must hold b.mu.
+func (b *destBlock) digest(s string) string {
+	h, _ := blake2s.New(&blake2s.Config{Key: b.key})
+	h.Write([]byte(strings.ToLower(s)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// blocked returns true if mail to addy should not be delivered.
+func (b *destBlock) blocked(addy string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addy = strings.ToLower(addy)
+	for _, re := range b.regexes {
+		if re.MatchString(addy) {
+			return true
+		}
+	}
+	if b.key == nil {
+		// No hashed entries have been added
+		return false
+	}
+	if b.hashes[b.digest(addy)] {
+		return true
+	}
+	// Test the domain and each of its parent domains
+	_, domain, found := strings.Cut(addy, "@")
+	for found {
+		if b.hashes[b.digest(domain)] {
+			return true
+		}
+		_, domain, found = strings.Cut(domain, ".")
+	}
+	return false
+}
+
+// ensureKey generates and writes a key if the list doesn't already have one.
+func (b *destBlock) ensureKey() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ensureKeyLocked()
+}
+
+// ensureKeyLocked is ensureKey for callers that hold b.mu.
+func (b *destBlock) ensureKeyLocked() (err error) {
+	if b.key != nil {
+		return
+	}
+	f, err := keymgr.OpenAppend(b.filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	key := crandom.Randbytes(32)
+	_, err = fmt.Fprintf(f, "# yamn destination block list\nkey %x\n", key)
+	if err != nil {
+		return
+	}
+	b.key = key
+	return
+}
+
+// add appends an address (or a domain if entry contains no "@") to the block
+// list.
+func (b *destBlock) add(entry string) (err error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return errors.New("empty block list entry")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err = b.ensureKeyLocked()
+	if err != nil {
+		return
+	}
+	f, err := keymgr.OpenAppend(b.filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	kind := "domain"
+	if strings.Contains(entry, "@") {
+		kind = "addr"
+	}
+	hash := b.digest(entry)
+	_, err = fmt.Fprintf(f, "%s %s\n", kind, hash)
+	if err != nil {
+		return
+	}
+	b.hashes[hash] = true
+	return
+}
+
+// token returns the confirmation token mailed to addy on the given day.  The
+// list must have a key.
+func (b *destBlock) token(addy string, day int64) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokenLocked(addy, day)
+}
+
+// tokenLocked is token for callers that hold b.mu.
+func (b *destBlock) tokenLocked(addy string, day int64) string {
+	mac := b.digest("remailer-block " + addy + " " + strconv.FormatInt(day, 10))
+	return mac[:32]
+}
+
+// today returns the number of days since Epoch.
+func today() int64 {
+	return time.Now().UTC().Unix() / 86400
+}
+
+// confirm returns true if token was issued to addy within tokenDays.
+func (b *destBlock) confirm(addy, token string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.key == nil {
+		return false
+	}
+	for day := today(); day > today()-tokenDays; day-- {
+		expected := b.tokenLocked(addy, day)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// blockList returns the destination block list, rereading it if the file has
+// been modified.
+func (s *Server) blockList() (b *destBlock, err error) {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+	if s.destBlock != nil {
+		stat, err := os.Stat(s.cfg.Files.DestBlock)
+		if err != nil || stat.ModTime().Equal(s.destBlock.modTime) {
+			// Unmodified (or still missing)
+			return s.destBlock, nil
+		}
+	}
+	b, err = openDestBlock(s.cfg.Files.DestBlock)
+	if err != nil {
+		return
+	}
+	s.destBlock = b
+	return
+}
+
+// blockRequest processes a remailer-block request from sender and returns
+// the Subject and text of the reply.  Requests without a token are replied
+// to with one.  The block is only added when a valid token is returned.
+func (s *Server) blockRequest(token, sender string) (subject, reply string, err error) {
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		err = fmt.Errorf("remailer-block: invalid sender: %w", err)
+		return
+	}
+	addy := strings.ToLower(from.Address)
+	b, err := s.blockList()
+	if err != nil {
+		return
+	}
+	if b.blocked(addy) {
+		subject = "Remailer block confirmed"
+		reply = fmt.Sprintf(
+			"%s is already on the destination block list of the %s remailer.\n",
+			addy,
+			s.cfg.Remailer.Name,
+		)
+		return
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		err = b.ensureKey()
+		if err != nil {
+			return
+		}
+		err = s.confirmLimit(addy)
+		if err != nil {
+			return
+		}
+		subject = "Confirm your remailer-block request"
+		reply = fmt.Sprintf(
+			"Someone, hopefully you, asked the %s remailer to stop "+
+				"delivering anonymous mail to %s.\n\n"+
+				"To confirm, reply to this message with the Subject:\n\n"+
+				"remailer-block %s\n\n"+
+				"This token is valid for %d days.  If you didn't make "+
+				"this request, please ignore this message.\n",
+			s.cfg.Remailer.Name,
+			addy,
+			b.token(addy, today()),
+			tokenDays,
+		)
+		return
+	}
+	if !b.confirm(addy, token) {
+		// Don't reply as the sender may be forged
+		err = errors.New("remailer-block: invalid confirmation token")
+		return
+	}
+	err = b.add(addy)
+	if err != nil {
+		return
+	}
+	log.Info("Added a confirmed address to the destination block list")
+	subject = "Remailer block confirmed"
+	reply = fmt.Sprintf(
+		"%s has been added to the destination block list of the %s "+
+			"remailer.  It will not deliver anonymous mail to you.\n",
+		addy,
+		s.cfg.Remailer.Name,
+	)
+	return
+}
+
+// confirmLimit returns an error if a confirmation token can't be mailed to
+// addy without exceeding a daily limit.  Otherwise the token is counted
+// against the limits.
+func (s *Server) confirmLimit(addy string) (err error) {
+	l, err := s.limiter()
+	if err != nil {
+		return
+	}
+	since := time.Now().Add(-24 * time.Hour)
+	count, err := l.Count("confirm:"+addy, since)
+	if err != nil {
+		return
+	}
+	if count >= confirmPerAddress {
+		err = errors.New("remailer-block: Token already sent to this address today")
+		return
+	}
+	count, err = l.Count("confirm", since)
+	if err != nil {
+		return
+	}
+	if count >= confirmDaily {
+		err = fmt.Errorf(
+			"remailer-block: Daily limit of %d confirmation tokens reached",
+			confirmDaily,
+		)
+		return
+	}
+	err = l.Record("confirm", "confirm:"+addy)
+	if err != nil {
+		return
+	}
+	log.Infof(
+		"Sending remailer-block confirmation token: Domain=%s, Today=%d",
+		addressDomain(addy),
+		count+1,
+	)
+	return
+}
+
+// addBlock adds an address or domain to the destination block list on behalf
+// of the operator.
+func (s *Server) addBlock(entry string) (err error) {
+	b, err := s.blockList()
+	if err != nil {
+		return
+	}
+	return b.add(entry)
+}
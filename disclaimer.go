@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+// reservedHeaders can't be set by disclaimer headers because Exit delivery
+// depends on them.
+var reservedHeaders = map[string]bool{
+	"To":                        true,
+	"Cc":                        true,
+	"From":                      true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Newsgroups":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// disclaimerData are the fields available to disclaimer templates.
+type disclaimerData struct {
+	Name    string // Remailer name
+	Address string // Remailer address
+	Abuse   string // Abuse contact
+}
+
+// disclaimer is the parsed disclaimer section of the config.
+type disclaimer struct {
+	headers map[string]string
+	footer  string
+}
+
+// disclaimer returns the configured disclaimer headers and footer with their
+// templates expanded.
+func (s *Server) disclaimer() (d *disclaimer, err error) {
+	data := disclaimerData{
+		Name:    s.cfg.Remailer.Name,
+		Address: s.cfg.Remailer.Address,
+		Abuse:   s.cfg.Disclaimer.Abuse,
+	}
+	d = &disclaimer{headers: make(map[string]string)}
+	for _, line := range s.cfg.Disclaimer.Headers {
+		name, value, found := strings.Cut(line, ":")
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			err = fmt.Errorf("malformed disclaimer header: %s", line)
+			return
+		}
+		if reservedHeaders[name] {
+			err = fmt.Errorf("disclaimer can't set the %s header", name)
+			return
+		}
+		value, err = expandTemplate(strings.TrimSpace(value), data)
+		if err != nil {
+			err = fmt.Errorf("disclaimer header %s: %w", name, err)
+			return
+		}
+		d.headers[name] = value
+	}
+	d.footer, err = expandTemplate(s.cfg.Disclaimer.Footer, data)
+	if err != nil {
+		err = fmt.Errorf("disclaimer footer: %w", err)
+		return
+	}
+	return
+}
+
+// expandTemplate executes text as a template with the given data.
+func expandTemplate(text string, data disclaimerData) (expanded string, err error) {
+	tmpl, err := template.New("disclaimer").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return
+	}
+	buf := new(strings.Builder)
+	err = tmpl.Execute(buf, data)
+	expanded = buf.String()
+	return
+}
+
+// apply adds the disclaimer headers and footer to msg.  Disclaimer headers
+// replace any that the sender supplied.
+func (d *disclaimer) apply(msg *mail.Message) (err error) {
+	for name, value := range d.headers {
+		msg.Header[name] = []string{value}
+	}
+	if strings.TrimSpace(d.footer) == "" {
+		return
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return
+	}
+	footer := strings.TrimRight(d.footer, "\n") + "\n"
+	msg.Body = bytes.NewReader(addFooter(msg.Header, body, footer))
+	return
+}
+
+/*
+Footers are added according to the MIME structure of the message:
+	Plain text	Appended to the body
+	multipart/mixed	Inserted as a new text/plain part before the final
+			boundary
+	Other		The message is wrapped in a multipart/mixed with the
+			footer as a second text/plain part
+Encoded text (base64 or quoted-printable), text in a charset that can't
+represent the footer and other multipart types (alternative, signed, etc.)
+can't be modified in place so they are wrapped.
+*/
+
+// addFooter returns body with footer added.  h is updated when the message
+// is wrapped.
+func addFooter(h mail.Header, body []byte, footer string) []byte {
+	// RFC 2045: The default is text/plain; charset=us-ascii
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := h.Get("Content-Type"); ct != "" {
+		// Unparsable types are wrapped
+		mediaType, params, _ = mime.ParseMediaType(ct)
+	}
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	unencoded := encoding == "" || encoding == "7bit" || encoding == "8bit"
+	if mediaType == "text/plain" && unencoded && charsetFits(params["charset"], footer) {
+		if len(body) > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+			body = append(body, '\n')
+		}
+		return append(body, []byte("\n"+footer)...)
+	}
+	boundary := params["boundary"]
+	closing := []byte("\n--" + boundary + "--")
+	if mediaType == "multipart/mixed" && boundary != "" {
+		// Prefixing a newline matches a final boundary on the first line.
+		// The match's offset is then the start of the boundary line.
+		pos := bytes.LastIndex(append([]byte("\n"), body...), closing)
+		if pos >= 0 {
+			buf := new(bytes.Buffer)
+			buf.Write(body[:pos])
+			buf.WriteString("--" + boundary + "\n")
+			writeFooterPart(buf, footer)
+			buf.Write(body[pos:])
+			return buf.Bytes()
+		}
+	}
+	// Wrap the original content as the first part of a multipart/mixed
+	boundary = "yamn-" + hex.EncodeToString(crandom.Randbytes(12))
+	buf := new(bytes.Buffer)
+	buf.WriteString("This is a multi-part message in MIME format.\n")
+	buf.WriteString("--" + boundary + "\n")
+	for _, name := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+		if value := h.Get(name); value != "" {
+			buf.WriteString(name + ": " + value + "\n")
+		}
+		delete(h, name)
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("--" + boundary + "\n")
+	writeFooterPart(buf, footer)
+	buf.WriteString("--" + boundary + "--\n")
+	h["Mime-Version"] = []string{"1.0"}
+	h["Content-Type"] = []string{mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": boundary})}
+	return buf.Bytes()
+}
+
+// writeFooterPart writes the headers and body of a text/plain footer part.
+func writeFooterPart(buf *bytes.Buffer, footer string) {
+	if isASCII(footer) {
+		buf.WriteString("Content-Type: text/plain; charset=us-ascii\n")
+	} else {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\n")
+		buf.WriteString("Content-Transfer-Encoding: 8bit\n")
+	}
+	buf.WriteString("Content-Disposition: inline\n\n")
+	buf.WriteString(footer)
+}
+
+// charsetFits returns true if footer can be appended to text in charset.
+func charsetFits(charset, footer string) bool {
+	if isASCII(footer) {
+		return true
+	}
+	return strings.EqualFold(charset, "utf-8") && utf8.ValidString(footer)
+}
+
+// isASCII returns true if s contains only 7-bit characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/dkim"
+)
+
+// dkimEnabled returns true if Exit deliveries should be DKIM signed.
+func (s *Server) dkimEnabled() bool {
+	return s.cfg.DKIM.Domain != "" && s.cfg.DKIM.Selector != ""
+}
+
+// dkimSigner returns a Signer for the configured DKIM key.
+func (s *Server) dkimSigner() (signer *dkim.Signer, err error) {
+	pemKey, err := os.ReadFile(s.cfg.DKIM.KeyFile)
+	if err != nil {
+		return
+	}
+	signer, err = dkim.NewSigner(s.cfg.DKIM.Domain, s.cfg.DKIM.Selector, pemKey)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", s.cfg.DKIM.KeyFile, err)
+		return
+	}
+	signer.Headers = s.cfg.DKIM.Headers
+	return
+}
+
+// dkimSign returns payload with a DKIM signature, if signing is enabled.
+// Signing happens after the header filter has been applied, so only headers
+// that are actually delivered are signed.
+func (s *Server) dkimSign(payload []byte) (signed []byte, err error) {
+	if !s.dkimEnabled() {
+		return payload, nil
+	}
+	signer, err := s.dkimSigner()
+	if err != nil {
+		err = fmt.Errorf("DKIM signing failed: %w", err)
+		return
+	}
+	signed, err = signer.Sign(payload)
+	if err != nil {
+		err = fmt.Errorf("DKIM signing failed: %w", err)
+		return
+	}
+	log.Tracef("DKIM signed message: d=%s, s=%s", s.cfg.DKIM.Domain, s.cfg.DKIM.Selector)
+	return
+}
+
+// dkimKeygen writes a new DKIM key of the given type to the configured key
+// file and writes the DNS TXT record that publishes it to w.  An existing key
+// file is never overwritten.
+func (s *Server) dkimKeygen(keyType string, w io.Writer) (err error) {
+	if !s.dkimEnabled() {
+		return errors.New("dkim domain and selector must be configured")
+	}
+	pemKey, err := dkim.GenerateKey(keyType)
+	if err != nil {
+		return
+	}
+	signer, err := dkim.NewSigner(s.cfg.DKIM.Domain, s.cfg.DKIM.Selector, pemKey)
+	if err != nil {
+		return
+	}
+	record, err := signer.Record()
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(s.cfg.DKIM.KeyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(pemKey)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "DKIM key written to %s.  Publish this DNS record:\n", s.cfg.DKIM.KeyFile)
+	fmt.Fprintln(w, record)
+	return
+}
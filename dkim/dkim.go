@@ -0,0 +1,289 @@
+// Package dkim signs email messages with DomainKeys Identified Mail (RFC
+// 6376) signatures.  RSA-SHA256 and Ed25519-SHA256 (RFC 8463) keys are
+// supported.  Headers and bodies use relaxed canonicalization.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RSABits is the size of generated RSA keys.
+const RSABits = 2048
+
+// Signer signs messages on behalf of a domain.
+type Signer struct {
+	Domain   string
+	Selector string
+	// Headers are the names of the headers to sign, if present.  The From
+	// header is always signed.
+	Headers []string
+	// Now returns the signature timestamp.  It defaults to time.Now.
+	Now func() time.Time
+	key crypto.Signer
+}
+
+// NewSigner returns a Signer for a PEM encoded RSA or Ed25519 private key.
+func NewSigner(domain, selector string, pemKey []byte) (*Signer, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("dkim: domain and selector are required")
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM key found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("dkim: unsupported PEM type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Signer{
+		Domain:   domain,
+		Selector: selector,
+		Now:      time.Now,
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.key = k
+	case ed25519.PrivateKey:
+		s.key = k
+	default:
+		return nil, errors.New("dkim: key is neither RSA nor Ed25519")
+	}
+	return s, nil
+}
+
+// algorithm returns the a= tag value for the Signer's key.
+func (s *Signer) algorithm() string {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// Sign returns msg with a DKIM-Signature header prepended.  Lines may end in
+// LF or CRLF.  The signature covers the message as it will be transmitted
+// by SMTP, with CRLF line endings.
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	head, body, found := bytes.Cut(msg, []byte("\n\n"))
+	if !found {
+		head = bytes.TrimSuffix(msg, []byte("\n"))
+		body = nil
+	}
+	fields := splitHeader(string(head))
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	// Sign the requested headers that are present.  Where a header is
+	// repeated, instances are selected from the bottom up.
+	var names []string
+	var signed []string
+	used := make(map[int]bool)
+	for _, name := range append([]string{"From"}, s.Headers...) {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			names = append(names, strings.ToLower(name))
+			signed = append(signed, fields[i])
+			break
+		}
+	}
+	if len(signed) == 0 || names[0] != "from" {
+		return nil, errors.New("dkim: message has no From header")
+	}
+	sigValue := fmt.Sprintf(
+		"v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\n\tt=%d; h=%s;\n\tbh=%s;\n\tb=",
+		s.algorithm(),
+		s.Domain,
+		s.Selector,
+		s.Now().Unix(),
+		strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	h := sha256.New()
+	for _, field := range signed {
+		h.Write([]byte(relaxedHeader(field) + "\r\n"))
+	}
+	// The signature header itself is hashed, with an empty b= tag and
+	// without a trailing CRLF.
+	h.Write([]byte(relaxedHeader("DKIM-Signature: " + sigValue)))
+	digest := h.Sum(nil)
+	var sig []byte
+	var err error
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		// RFC 8463: Ed25519 signs the SHA-256 hash
+		sig = ed25519.Sign(k, digest)
+	default:
+		sig, err = s.key.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("DKIM-Signature: " + sigValue)
+	buf.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	buf.WriteString("\n")
+	buf.Write(msg)
+	return buf.Bytes(), nil
+}
+
+// foldBase64 folds a base64 tag value into lines of 72 characters.
+func foldBase64(b64 string) string {
+	var lines []string
+	for len(b64) > 72 {
+		lines = append(lines, b64[:72])
+		b64 = b64[72:]
+	}
+	lines = append(lines, b64)
+	return strings.Join(lines, "\n\t")
+}
+
+// splitHeader returns the header fields, including any folded continuation
+// lines, of an LF delimited message header.
+func splitHeader(head string) (fields []string) {
+	for _, line := range strings.Split(head, "\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return
+}
+
+// fieldName returns the name of a header field.
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// relaxedHeader returns the relaxed canonicalization of a header field
+// (RFC 6376, 3.4.2), without a trailing CRLF.
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	name = strings.ToLower(strings.TrimSpace(name))
+	// Unfold and reduce whitespace sequences to a single space
+	value = strings.ReplaceAll(value, "\r", "")
+	value = strings.ReplaceAll(value, "\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return name + ":" + value
+}
+
+// isWSP returns true for space and tab.
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// relaxedBody returns the relaxed canonicalization of an LF delimited
+// message body (RFC 6376, 3.4.4), with CRLF line endings.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		// Reduce internal whitespace sequences to a single space
+		var b strings.Builder
+		inWSP := false
+		for _, r := range line {
+			if isWSP(r) {
+				inWSP = true
+				continue
+			}
+			if inWSP {
+				b.WriteByte(' ')
+				inWSP = false
+			}
+			b.WriteRune(r)
+		}
+		lines[i] = b.String()
+	}
+	// Ignore empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// GenerateKey returns a new PEM encoded private key of the given type ("rsa"
+// or "ed25519").
+func GenerateKey(keyType string) (pemKey []byte, err error) {
+	var key any
+	switch strings.ToLower(keyType) {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, RSABits)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("dkim: unknown key type: %s", keyType)
+	}
+	if err != nil {
+		return
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	pemKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return
+}
+
+// Record returns the DNS TXT record that publishes the Signer's public key.
+// Long records are split into quoted strings of at most 255 characters.
+func (s *Signer) Record() (string, error) {
+	var keyType string
+	var pub []byte
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		keyType = "ed25519"
+		// RFC 8463: The raw 32 byte public key
+		pub = k.Public().(ed25519.PublicKey)
+	case *rsa.PrivateKey:
+		keyType = "rsa"
+		var err error
+		pub, err = x509.MarshalPKIXPublicKey(&k.PublicKey)
+		if err != nil {
+			return "", err
+		}
+	}
+	txt := fmt.Sprintf(
+		"v=DKIM1; k=%s; p=%s",
+		keyType,
+		base64.StdEncoding.EncodeToString(pub),
+	)
+	var quoted []string
+	for len(txt) > 255 {
+		quoted = append(quoted, `"`+txt[:255]+`"`)
+		txt = txt[255:]
+	}
+	quoted = append(quoted, `"`+txt+`"`)
+	return fmt.Sprintf(
+		"%s._domainkey.%s. IN TXT ( %s )",
+		s.Selector,
+		s.Domain,
+		strings.Join(quoted, " "),
+	), nil
+}
@@ -0,0 +1,217 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcMessage is the example message from RFC 6376 and RFC 8463
+const rfcMessage = `From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+// verify checks the DKIM-Signature at the top of msg using pub.
+func verify(msg []byte, pub crypto.PublicKey) (err error) {
+	head, body, _ := bytes.Cut(msg, []byte("\n\n"))
+	fields := splitHeader(string(head))
+	if fieldName(fields[0]) != "DKIM-Signature" {
+		return errors.New("no DKIM-Signature")
+	}
+	tags := make(map[string]string)
+	_, value, _ := strings.Cut(relaxedHeader(fields[0]), ":")
+	for _, tag := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(k)] = strings.ReplaceAll(strings.TrimSpace(v), " ", "")
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return errors.New("body hash mismatch")
+	}
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				h.Write([]byte(relaxedHeader(fields[i]) + "\r\n"))
+				break
+			}
+		}
+	}
+	// Hash the signature header with the b= value removed
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(fields[0], "b=")
+	h.Write([]byte(relaxedHeader(unsigned)))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, h.Sum(nil), sig) {
+			err = errors.New("ed25519 signature verification failed")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), sig)
+	}
+	return
+}
+
+func TestRelaxedHeader(t *testing.T) {
+	for _, test := range []struct {
+		field     string
+		canonical string
+	}{
+		{"Subject: Hello", "subject:Hello"},
+		{"SUBJECT : Hello  World \t", "subject:Hello World"},
+		{"Subject:\n\tfolded\n  value", "subject:folded value"},
+		{"Subject:", "subject:"},
+	} {
+		canonical := relaxedHeader(test.field)
+		if canonical != test.canonical {
+			t.Errorf("%q: Expected=%q, Got=%q", test.field, test.canonical, canonical)
+		}
+	}
+}
+
+func TestRelaxedBody(t *testing.T) {
+	for _, test := range []struct {
+		body      string
+		canonical string
+	}{
+		{"", ""},
+		{"\n\n", ""},
+		{"Hello", "Hello\r\n"},
+		{" Hello \t world  \n\n\n", " Hello world\r\n"},
+		{"a\n\nb\n", "a\r\n\r\nb\r\n"},
+	} {
+		canonical := string(relaxedBody([]byte(test.body)))
+		if canonical != test.canonical {
+			t.Errorf("%q: Expected=%q, Got=%q", test.body, test.canonical, canonical)
+		}
+	}
+}
+
+// TestRFC8463 signs the RFC 8463 example with its Ed25519 key
+func TestRFC8463(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	key := ed25519.NewKeyFromSeed(seed)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	s, err := NewSigner("football.example.com", "brisbane", pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Headers = []string{"To", "Subject", "Date", "Message-Id", "Cc"}
+	s.Now = func() time.Time { return time.Unix(1528637909, 0) }
+	signed, err := s.Sign([]byte(rfcMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigHeader := string(signed[:bytes.Index(signed, []byte("\nFrom:"))])
+	for _, tag := range []string{
+		"a=ed25519-sha256;",
+		"d=football.example.com;",
+		"s=brisbane;",
+		"t=1528637909;",
+		// Cc isn't present so it isn't signed
+		"h=from:to:subject:date:message-id;",
+		// The body hash published in RFC 8463
+		"bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+	} {
+		if !strings.Contains(sigHeader, tag) {
+			t.Errorf("Signature doesn't contain %s: %s", tag, sigHeader)
+		}
+	}
+	err = verify(signed, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `brisbane._domainkey.football.example.com. IN TXT ( "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=" )`
+	if record != expected {
+		t.Errorf("Expected=%s, Got=%s", expected, record)
+	}
+}
+
+func TestSignRSA(t *testing.T) {
+	pemKey, err := GenerateKey("rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSigner("example.com", "sel", pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Headers = []string{"To", "Subject"}
+	// CRLF line endings and trailing whitespace don't affect the signature
+	msg := strings.ReplaceAll(rfcMessage, "\n", "\r\n")
+	signed, err := s.Sign([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(signed, []byte("a=rsa-sha256;")) {
+		t.Error("Signature algorithm isn't rsa-sha256")
+	}
+	key := s.key.(*rsa.PrivateKey)
+	err = verify(signed, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A modified body must fail verification
+	tampered := bytes.Replace(signed, []byte("lost"), []byte("won"), 1)
+	if verify(tampered, &key.PublicKey) == nil {
+		t.Error("Tampered message passed verification")
+	}
+	record, err := s.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(record, `sel._domainkey.example.com. IN TXT ( "v=DKIM1; k=rsa; p=`) {
+		t.Errorf("Unexpected DNS record: %s", record)
+	}
+	// TXT strings are limited to 255 characters
+	if strings.Count(record, `"`) != 4 {
+		t.Errorf("RSA record should be split into two strings: %s", record)
+	}
+}
+
+func TestNoFrom(t *testing.T) {
+	pemKey, err := GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSigner("example.com", "sel", pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Sign([]byte("To: a@example.com\n\nHello\n"))
+	if err == nil {
+		t.Error("Expected an error signing a message without a From header")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/config"
+)
+
+// headerRule is a compiled config.HeaderRule.  A nil value matches any value.
+type headerRule struct {
+	name  string
+	value *regexp.Regexp
+}
+
+// matches returns true if the header name, with the given value, matches
+// the rule.
+func (r headerRule) matches(name, value string) bool {
+	return name == r.name && (r.value == nil || r.value.MatchString(value))
+}
+
+// String describes the rule in remailer-conf replies.
+func (r headerRule) String() string {
+	if r.value == nil {
+		return r.name
+	}
+	return fmt.Sprintf("%s: /%s/", r.name, r.value)
+}
+
+// headerFilter is the header policy applied by Exit remailers.
+type headerFilter struct {
+	allow []headerRule
+	deny  []headerRule
+}
+
+// compileRules compiles the regular expressions in rules.
+func compileRules(rules []config.HeaderRule) (compiled []headerRule, err error) {
+	for _, rule := range rules {
+		if rule.Header == "" {
+			err = fmt.Errorf("filter rule has no header name: %v", rule)
+			return
+		}
+		r := headerRule{name: textproto.CanonicalMIMEHeaderKey(rule.Header)}
+		if rule.Value != "" {
+			r.value, err = regexp.Compile(rule.Value)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", rule.Header, err)
+				return
+			}
+		}
+		compiled = append(compiled, r)
+	}
+	return
+}
+
+// headerFilter returns the configured header policy.
+func (s *Server) headerFilter() (f *headerFilter, err error) {
+	f = new(headerFilter)
+	f.allow, err = compileRules(s.cfg.Filter.Allow)
+	if err != nil {
+		return
+	}
+	f.deny, err = compileRules(s.cfg.Filter.Deny)
+	return
+}
+
+// permitted returns true if the policy permits a header with the given value.
+func (f *headerFilter) permitted(name, value string) bool {
+	for _, rule := range f.deny {
+		if rule.matches(name, value) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 || name == "To" || name == "Cc" {
+		return true
+	}
+	for _, rule := range f.allow {
+		if rule.matches(name, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply removes headers (or individual values of repeated headers) from h
+// that the policy doesn't permit.
+func (f *headerFilter) apply(h mail.Header) {
+	for name, values := range h {
+		var kept []string
+		for _, value := range values {
+			if f.permitted(name, value) {
+				kept = append(kept, value)
+			} else {
+				log.Tracef("Filtered header: %s", name)
+			}
+		}
+		if len(kept) == 0 {
+			delete(h, name)
+		} else {
+			h[name] = kept
+		}
+	}
+}
+
+// describe returns the policy as text for remailer-conf replies.
+func (f *headerFilter) describe() (lines []string) {
+	for _, rule := range f.deny {
+		lines = append(lines, rule.String())
+	}
+	if len(f.allow) > 0 {
+		lines = append(lines, "All headers except To, Cc and:")
+		for _, rule := range f.allow {
+			lines = append(lines, "   "+rule.String())
+		}
+	}
+	return
+}
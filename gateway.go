@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/client"
+)
+
+// minGatewayHops is the shortest chain that gateway messages are sent
+// through.  A single hop would let its exit link sender and recipient.
+const minGatewayHops = 2
+
+// gatewayHeaders are the headers of a plaintext message that are retained
+// when it enters the YAMN network.  Everything else, including the From,
+// Received and Message-Id headers, is stripped as it may identify the sender.
+var gatewayHeaders = []string{
+	"Subject",
+	"In-Reply-To",
+	"References",
+	"Newsgroups",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// gatewayDirectives are the real headers that name the recipient of a
+// plaintext message.
+var gatewayDirectives = []string{"Anon-To", "Request-Remailing-To", "Remail-To"}
+
+// gatewayMail accepts a plaintext (Type I style) message addressed with
+// Anon-To headers or pseudo-headers and forwards it through a random chain.
+// handled is false if msg isn't a gateway message, in which case it's left
+// unchanged.
+func (s *Server) gatewayMail(msg *mail.Message) (handled bool, err error) {
+	var anonTo []string
+	for _, name := range gatewayDirectives {
+		anonTo = append(anonTo, msg.Header[name]...)
+	}
+	original := msg.Header
+	msg.Header = make(mail.Header)
+	for _, name := range gatewayHeaders {
+		if values, ok := original[name]; ok {
+			msg.Header[name] = values
+		}
+	}
+	if len(anonTo) > 0 {
+		msg.Header["To"] = []string{strings.Join(anonTo, ", ")}
+	}
+	found, err := client.PseudoHeaders(msg)
+	if !found && err == nil && len(anonTo) == 0 {
+		// Not a gateway message
+		msg.Header = original
+		return
+	}
+	handled = true
+	if err != nil {
+		return
+	}
+	if msg.Header.Get("To") == "" && msg.Header.Get("Newsgroups") == "" {
+		err = errors.New("gateway: message has no recipients")
+		return
+	}
+	// Rate limits are applied to the sender.  Over-limit messages are
+	// dropped without a reply as the sender may be forged.
+	from, err := mail.ParseAddress(original.Get("From"))
+	if err != nil {
+		err = fmt.Errorf("gateway: invalid sender: %w", err)
+		return
+	}
+	sender := strings.ToLower(from.Address)
+	err = s.gatewayLimit(sender)
+	if err != nil {
+		return
+	}
+	// The message continues through a chain of random remailers
+	hops := max(s.cfg.Gateway.Hops, minGatewayHops)
+	chain := make([]string, hops)
+	for i := range chain {
+		chain[i] = "*"
+	}
+	c, err := s.newClient(chain)
+	if err != nil {
+		return
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		err = fmt.Errorf("gateway: encoding failed: %w", err)
+		return
+	}
+	s.recordGateway(sender)
+	for _, chain := range receipt.Chains {
+		log.Tracef("Gateway message sent via: %s", strings.Join(chain, ","))
+	}
+	s.stats.inGateway++
+	return
+}
+
+// gatewayLimit returns an error if sender has exceeded the number of
+// messages the gateway accepts from each sender per day.
+func (s *Server) gatewayLimit(sender string) (err error) {
+	if s.cfg.Gateway.PerSender <= 0 {
+		return
+	}
+	l, err := s.limiter()
+	if err != nil {
+		return
+	}
+	count, err := l.Count("gateway:"+sender, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return
+	}
+	if count >= s.cfg.Gateway.PerSender {
+		s.stats.outLimited++
+		err = fmt.Errorf(
+			"gateway: Sender limit of %d messages per day reached",
+			s.cfg.Gateway.PerSender,
+		)
+	}
+	return
+}
+
+// recordGateway counts a message accepted from sender against its limit.
+func (s *Server) recordGateway(sender string) {
+	if s.cfg.Gateway.PerSender <= 0 {
+		return
+	}
+	l, err := s.limiter()
+	if err == nil {
+		err = l.Record("gateway:" + sender)
+	}
+	if err != nil {
+		log.Warnf("Unable to record gateway message: %s", err)
+	}
+}
@@ -5,6 +5,7 @@ go 1.24.2
 require (
 	github.com/Masterminds/log-go v1.0.0
 	github.com/dchest/blake2s v1.0.0
+	github.com/klauspost/compress v1.18.0
 	github.com/luksen/maildir v0.0.0-20210101204218-7ed7afdce6bf
 	github.com/syndtr/goleveldb v1.0.0
 	golang.org/x/crypto v0.38.0
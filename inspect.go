@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+)
+
+// inspectFile is the --inspect entry point.  Only the secret keyring is
+// imported; the ID Log, Chunk DB and pool are never opened.
+func inspectFile(filename string) {
+	s := newServer(cfg)
+	s.secret = keymgr.NewSecring(cfg.Files.Secring, cfg.Files.Pubkey)
+	err := s.secret.ImportSecring()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to import secret keyring: %s\n", err)
+	}
+	err = s.inspect(os.Stdout, filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// inspect writes a description of the armored message in filename to w.  As
+// much of the top header as our secret keyring allows is decoded but nothing
+// is acted upon.
+func (s *Server) inspect(w io.Writer, filename string) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	a, err := packet.ReadArmor(f)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Stated length: %d\n", a.StatedLen)
+	fmt.Fprintf(w, "Actual length: %d\n", len(a.Payload))
+	fmt.Fprintf(w, "Stated digest: %x\n", a.Digest)
+	if err = a.Validate(); err != nil {
+		fmt.Fprintf(w, "Armor: Invalid (%s)\n", err)
+	} else {
+		fmt.Fprintln(w, "Armor: Valid")
+	}
+	// A payload that's neither format can't be inspected any further
+	d, err := packet.NewDecMessage(a.Payload)
+	if err != nil {
+		return
+	}
+	if d.Format() == packet.FormatHybrid {
+		fmt.Fprintln(w, "Format: Hybrid")
+	} else {
+		fmt.Fprintln(w, "Format: Classic")
+	}
+	header, err := packet.NewDecodeHeader(d.Header())
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Recipient keyid: %s\n", header.RecipientKeyID())
+	if err = s.setHeaderKeys(header); err != nil {
+		fmt.Fprintf(w, "Recipient key: Not in secring (%s)\n", err)
+		err = nil
+		return
+	}
+	fmt.Fprintln(w, "Recipient key: In secring")
+	slotDataBytes, packetVersion, err := header.Decode()
+	if err != nil {
+		return
+	}
+	slotData, err := packet.DecodeSlotData(slotDataBytes)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Version: %d\n", packetVersion)
+	fmt.Fprintf(w, "Packet ID: %s\n", hex.EncodeToString(slotData.PacketID()))
+	fmt.Fprintf(w, "Age: %d days\n", slotData.AgeTimestamp())
+	var tagOK bool
+	switch packetVersion {
+	case packet.Version3:
+		tagOK = d.TestHeaderTag(slotData.TagHash())
+	case packet.Version5, packet.Version6:
+		var key []byte
+		key, err = header.MACKey()
+		if err != nil {
+			return
+		}
+		tagOK = d.TestMAC(key, slotData.TagHash())
+	default:
+		tagOK = d.TestAntiTag(slotData.TagHash())
+	}
+	if tagOK {
+		fmt.Fprintln(w, "Anti-tag: OK")
+	} else {
+		fmt.Fprintln(w, "Anti-tag: Mismatch")
+	}
+	switch slotData.PacketType() {
+	case packet.PacketTypeIntermediate:
+		fmt.Fprintln(w, "Type: Intermediate")
+		var inter *packet.SlotIntermediate
+		inter, err = packet.DecodeIntermediate(slotData.PacketInfo())
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "Next hop: %s\n", inter.NextHop())
+		fmt.Fprintf(w, "Delay: %s\n", inter.Delay())
+	case packet.PacketTypeExit:
+		fmt.Fprintln(w, "Type: Exit")
+		var final *packet.SlotFinal
+		final, err = packet.DecodeFinalVersion(
+			slotData.PacketInfo(),
+			slotData.Version(),
+		)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "Delivery method: %d\n", final.DeliveryMethod())
+		fmt.Fprintf(w, "Message ID: %x\n", final.MessageID())
+		fmt.Fprintf(w, "Chunk: %d of %d\n", final.ChunkNum(), final.NumChunks())
+	default:
+		fmt.Fprintf(w, "Type: Unknown (%d)\n", slotData.PacketType())
+	}
+	return
+}
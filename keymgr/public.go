@@ -3,6 +3,7 @@ package keymgr
 import (
 	"bufio"
 	"bytes"
+	"crypto/mlkem"
 	"encoding/hex"
 	"fmt"
 	"github.com/dchest/blake2s"
@@ -15,6 +16,27 @@ import (
 const (
 	date_format     string = "2006-01-02"
 	generatedFormat string = "Mon 02 Jan 2006 15:04:05 GMT"
+	// CapHybrid in a capstring advertises an ML-KEM-768 key for hybrid
+	// headers
+	CapHybrid string = "Q"
+	// CapDelay in a capstring advertises support for sender-specified
+	// per-hop delays (Version 4 packets)
+	CapDelay string = "D"
+	// CapCompress in a capstring advertises an Exit that can expand
+	// Deflate and Zstandard compressed messages
+	CapCompress string = "Z"
+	// CapMAC in a capstring advertises support for headers authenticated
+	// by per-hop MACs (Version 5 packets)
+	CapMAC string = "S"
+	// CapPadding in a capstring advertises an Exit that can strip length
+	// padding from messages
+	CapPadding string = "P"
+	// CapLarge in a capstring advertises an Exit that can assemble
+	// messages of more than 255 chunks (Version 6 packets)
+	CapLarge string = "L"
+	// CapNews in a capstring advertises an Exit that posts articles to
+	// Usenet
+	CapNews string = "N"
 )
 
 type Remailer struct {
@@ -24,12 +46,65 @@ type Remailer struct {
 	version string    // Mixmaster version
 	caps    string    // Remailer capstring
 	PK      []byte    // Curve25519 Public Key
+	KEM     []byte    // ML-KEM-768 Encapsulation Key (optional)
 	from    time.Time // Valid-from date
 	until   time.Time // Valid until date
 	latent  int       // Latency (minutes)
 	uptime  int       // Uptime (10ths of a %)
 }
 
+// NewRemailer returns a Remailer for a Curve25519 public key that's not read
+// from a pubring, such as one generated for test vectors.  Its keyid is
+// derived from pk, as it is for generated keys.  kem may be nil.
+func NewRemailer(name, address, caps string, pk, kem []byte) Remailer {
+	return Remailer{
+		name:    name,
+		Address: address,
+		Keyid:   makeKeyID(pk),
+		caps:    caps,
+		PK:      pk,
+		KEM:     kem,
+	}
+}
+
+// Hybrid returns true if the remailer advertises support for hybrid headers
+// and its ML-KEM key is known.
+func (r Remailer) Hybrid() bool {
+	return strings.Contains(r.caps, CapHybrid) &&
+		len(r.KEM) == mlkem.EncapsulationKeySize768
+}
+
+// Delays returns true if the remailer honours sender-specified delays.
+func (r Remailer) Delays() bool {
+	return strings.Contains(r.caps, CapDelay)
+}
+
+// Compress returns true if the remailer can expand compressed messages.
+func (r Remailer) Compress() bool {
+	return strings.Contains(r.caps, CapCompress)
+}
+
+// MAC returns true if the remailer verifies per-hop MACs.
+func (r Remailer) MAC() bool {
+	return strings.Contains(r.caps, CapMAC)
+}
+
+// Padding returns true if the remailer can strip length padding.
+func (r Remailer) Padding() bool {
+	return strings.Contains(r.caps, CapPadding)
+}
+
+// Large returns true if the remailer can assemble messages of more than 255
+// chunks.
+func (r Remailer) Large() bool {
+	return strings.Contains(r.caps, CapLarge)
+}
+
+// News returns true if the remailer posts articles to Usenet.
+func (r Remailer) News() bool {
+	return strings.Contains(r.caps, CapNews)
+}
+
 type Pubring struct {
 	pubringFile    string // Pubring filename
 	statsFile      string // mlist type file
@@ -325,7 +400,7 @@ func (p *Pubring) ImportPubring() (err error) {
 	1	Expecting Begin cutmark
 	2	Expecting Keyid line
 	3	Expecting public key
-	4	Got End cutmark
+	4	Expecting ML-KEM key or End cutmark
 	*/
 
 	for scanner.Scan() {
@@ -427,7 +502,16 @@ func (p *Pubring) ImportPubring() (err error) {
 			if line == "-----End Mix Key-----" {
 				p.Put(*rem)
 				key_phase = 0
+				continue
+			}
+			// Hybrid keys carry an ML-KEM key before the cutmark
+			kemdata, err := hex.DecodeString(line)
+			if err != nil || len(kemdata) != mlkem.EncapsulationKeySize768 {
+				fmt.Fprintln(os.Stderr, "Unable to decode ML-KEM key")
+				key_phase = 0
+				continue
 			}
+			rem.KEM = kemdata
 		} // End of phases
 	} // End of file scan loop
 
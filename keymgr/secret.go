@@ -2,6 +2,7 @@ package keymgr
 
 import (
 	"bufio"
+	"crypto/mlkem"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,6 +19,7 @@ const (
 type secret struct {
 	keyid []byte    // keyid
 	sk    []byte    // Secret Key
+	kem   []byte    // ML-KEM-768 Decapsulation Key seed (optional)
 	from  time.Time // Valid from
 	until time.Time // Valid Until
 }
@@ -32,6 +34,7 @@ type Secring struct {
 	validity    time.Duration // Period of key validity
 	grace       time.Duration // Period of grace after key expiry
 	exit        bool          // Is this an Exit type remailer?
+	news        bool          // Does this Exit post to Usenet?
 	version     string        // Yamn version string
 }
 
@@ -109,6 +112,11 @@ func (s *Secring) SetExit(exit bool) {
 	s.exit = exit
 }
 
+// SetNews defines if this Exit remailer posts articles to Usenet
+func (s *Secring) SetNews(news bool) {
+	s.news = news
+}
+
 // SetValidity defines the time duration over which a key is deemed valid
 func (s *Secring) SetValidity(valid, grace int) {
 	s.validity = time.Duration(24*valid) * time.Hour
@@ -162,30 +170,65 @@ func (s *Secring) Insert(pub, sec []byte) (keyidstr string) {
 	return
 }
 
-// WritePublic writes the Public Key to disk.
-func (s *Secring) WritePublic(pub []byte, keyidstr string) {
+// SetKEM associates an ML-KEM-768 decapsulation key (in seed form) with an
+// existing keyid.  Keys with an ML-KEM component advertise hybrid headers.
+func (s *Secring) SetKEM(keyidstr string, kem []byte) {
 	var err error
-	if len(pub) != 32 {
+	if len(kem) != mlkem.SeedSize {
 		err = fmt.Errorf(
-			"Invalid pubkey length. Wanted=32, Got=%d",
-			len(pub),
+			"Invalid ML-KEM seed length. Wanted=%d, Got=%d",
+			mlkem.SeedSize,
+			len(kem),
 		)
 		panic(err)
 	}
+	key, exists := s.sec[keyidstr]
+	if !exists {
+		err = fmt.Errorf("%s: Keyid does not exist", keyidstr)
+		panic(err)
+	}
+	key.kem = kem
+	s.sec[keyidstr] = key
+}
 
-	var capstring string
+// capstring returns the capabilities advertised with a key
+func (s *Secring) capstring(key secret) (capstring string) {
 	// M = Middle, E = Exit
 	if s.exit {
-		capstring += "E"
+		capstring += "E" + CapCompress + CapPadding + CapLarge
+		if s.news {
+			capstring += CapNews
+		}
 	} else {
 		capstring += "M"
 	}
+	// All YAMN remailers hold messages with a sender-specified delay
+	capstring += CapDelay
+	// Per-hop MACs are also universally supported
+	capstring += CapMAC
+	if key.kem != nil {
+		capstring += CapHybrid
+	}
+	return
+}
+
+// WritePublic writes the Public Key to disk.
+func (s *Secring) WritePublic(pub []byte, keyidstr string) {
+	var err error
+	if len(pub) != 32 {
+		err = fmt.Errorf(
+			"Invalid pubkey length. Wanted=32, Got=%d",
+			len(pub),
+		)
+		panic(err)
+	}
 
 	key, exists := s.sec[keyidstr]
 	if !exists {
 		err = fmt.Errorf("%s: Keyid does not exist", keyidstr)
 		panic(err)
 	}
+	capstring := s.capstring(key)
 
 	header := s.name + " "
 	header += s.address + " "
@@ -207,6 +250,13 @@ func (s *Secring) WritePublic(pub []byte, keyidstr string) {
 	fmt.Fprintln(w, "-----Begin Mix Key-----")
 	fmt.Fprintln(w, keyidstr)
 	fmt.Fprintln(w, hex.EncodeToString(pub))
+	if key.kem != nil {
+		dk, err := mlkem.NewDecapsulationKey768(key.kem)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintln(w, hex.EncodeToString(dk.EncapsulationKey().Bytes()))
+	}
 	fmt.Fprintln(w, "-----End Mix Key-----")
 	err = w.Flush()
 	if err != nil {
@@ -238,6 +288,9 @@ func (s *Secring) WriteSecret(keyidstr string) {
 	)
 	keydata += keyidstr + "\n"
 	keydata += hex.EncodeToString(key.sk) + "\n"
+	if key.kem != nil {
+		keydata += hex.EncodeToString(key.kem) + "\n"
+	}
 	keydata += "-----End Mixmaster Secret Key-----\n"
 	_, err = f.WriteString(keydata)
 	if err != nil {
@@ -266,13 +319,6 @@ func (s *Secring) WriteMyKey(filename string) (keyidstr string) {
 		line = in.Text()
 		elements := strings.Fields(line)
 		if len(elements) == 7 {
-			var capstring string
-			// M = Middle, E = Exit
-			if s.exit {
-				capstring += "E"
-			} else {
-				capstring += "M"
-			}
 			// Extract the keyid so we can return it
 			keyidstr = elements[2]
 			if len(keyidstr) != 32 {
@@ -282,6 +328,7 @@ func (s *Secring) WriteMyKey(filename string) (keyidstr string) {
 				)
 				panic(err)
 			}
+			capstring := s.capstring(s.sec[keyidstr])
 			header := s.name + " "
 			header += s.address + " "
 			header += keyidstr + " "
@@ -329,6 +376,25 @@ func (s *Secring) GetSK(keyid string) (sk []byte, err error) {
 	return
 }
 
+// GetKEM returns the ML-KEM-768 decapsulation key seed that corresponds to
+// the requested Keyid.  Keys generated prior to hybrid support have none.
+func (s *Secring) GetKEM(keyid string) (kem []byte, err error) {
+	sec, exists := s.sec[keyid]
+	if !exists {
+		err = fmt.Errorf(
+			"%s: Keyid not found in secret keyring",
+			keyid,
+		)
+		return
+	}
+	if sec.kem == nil {
+		err = fmt.Errorf("%s: Keyid has no ML-KEM key", keyid)
+		return
+	}
+	kem = sec.kem
+	return
+}
+
 // Purge deletes expired keys and writes current ones to a backup secring
 func (s *Secring) Purge() (active, expiring, expired, purged int) {
 	/*
@@ -389,6 +455,9 @@ func (s *Secring) Purge() (active, expiring, expired, purged int) {
 		)
 		keydata += hex.EncodeToString(m.keyid) + "\n"
 		keydata += hex.EncodeToString(m.sk) + "\n"
+		if m.kem != nil {
+			keydata += hex.EncodeToString(m.kem) + "\n"
+		}
 		keydata += "-----End Mixmaster Secret Key-----\n\n"
 		_, err = f.WriteString(keydata)
 		if err != nil {
@@ -434,7 +503,7 @@ func (s *Secring) ImportSecring() (err error) {
 	2 Expecting Valid-to date
 	3 Expecting Keyid line
 	4	Expecting secret key
-	5 Got End cutmark
+	5 Expecting ML-KEM key or End cutmark
 	*/
 
 	for scanner.Scan() {
@@ -542,7 +611,18 @@ func (s *Secring) ImportSecring() (err error) {
 				// Add the key to the Keyring
 				s.sec[keyidMapKey] = *sec
 				key_phase = 0
+				continue
+			}
+			// Hybrid keys carry an ML-KEM seed before the cutmark
+			var kemdata []byte
+			kemdata, err = hex.DecodeString(line)
+			if err != nil || len(kemdata) != mlkem.SeedSize {
+				fmt.Fprintln(os.Stderr, "Incorrect ML-KEM key")
+				err = nil
+				key_phase = 0
+				continue
 			}
+			sec.kem = kemdata
 		} // End of switch
 	} // End of file lines loop
 	return
@@ -0,0 +1,98 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// newTestSecring returns a Secring, rooted in dir, containing a single key
+func newTestSecring(t *testing.T, dir string, hybrid bool) (s *Secring, keyidstr string) {
+	s = NewSecring(path.Join(dir, "secring.mix"), path.Join(dir, "key.txt"))
+	s.SetName("test")
+	s.SetAddress("test@domain.foo")
+	s.SetExit(true)
+	s.SetValidity(14, 28)
+	s.SetVersion("0.2a")
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyidstr = s.Insert(pk[:], sk[:])
+	if hybrid {
+		dk, err := mlkem.GenerateKey768()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetKEM(keyidstr, dk.Bytes())
+	}
+	s.WritePublic(pk[:], keyidstr)
+	s.WriteSecret(keyidstr)
+	return
+}
+
+func TestHybridKeys(t *testing.T) {
+	dir := t.TempDir()
+	s, keyidstr := newTestSecring(t, dir, true)
+	// The public key.txt should advertise and contain the ML-KEM key
+	p := NewPubring(path.Join(dir, "key.txt"), path.Join(dir, "mlist2.txt"))
+	err := p.ImportPubring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rem, err := p.Get("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rem.Hybrid() {
+		t.Fatalf("Expected a hybrid key, got caps=%s", rem.caps)
+	}
+	kem, err := s.GetKEM(keyidstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := mlkem.NewDecapsulationKey768(kem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rem.KEM, dk.EncapsulationKey().Bytes()) {
+		t.Fatal("Published ML-KEM key doesn't match the secret key")
+	}
+	// The secret keyring should retain the ML-KEM seed
+	imported := NewSecring(path.Join(dir, "secring.mix"), path.Join(dir, "key.txt"))
+	err = imported.ImportSecring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	importedKEM, err := imported.GetKEM(keyidstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kem, importedKEM) {
+		t.Fatal("Imported ML-KEM seed mismatch")
+	}
+}
+
+func TestClassicKeys(t *testing.T) {
+	dir := t.TempDir()
+	s, keyidstr := newTestSecring(t, dir, false)
+	p := NewPubring(path.Join(dir, "key.txt"), path.Join(dir, "mlist2.txt"))
+	err := p.ImportPubring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rem, err := p.Get("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rem.Hybrid() {
+		t.Fatal("Classic key should not advertise hybrid headers")
+	}
+	if _, err = s.GetKEM(keyidstr); err == nil {
+		t.Fatal("Expected error fetching ML-KEM key from a classic key")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/ratelimit"
+)
+
+// limitsEnabled returns true if any rate limits are configured.
+func (s *Server) limitsEnabled() bool {
+	return s.cfg.Limits.PerAddress > 0 ||
+		s.cfg.Limits.PerDomain > 0 ||
+		s.cfg.Limits.Daily > 0
+}
+
+// limiter returns the rate limit database, opening it if required.  It's
+// safe to call concurrently; the Limiter itself is safe for concurrent use.
+func (s *Server) limiter() (l *ratelimit.Limiter, err error) {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	if s.rateDb == nil {
+		log.Tracef("Opening the rate limit DB: %s", s.cfg.Files.RateDB)
+		s.rateDb, err = ratelimit.Open(s.cfg.Files.RateDB)
+	}
+	return s.rateDb, err
+}
+
+// rateExpire deletes rate limit events that no limit will count.
+func (s *Server) rateExpire() {
+	s.rateMu.Lock()
+	l := s.rateDb
+	s.rateMu.Unlock()
+	if l == nil {
+		return
+	}
+	// The daily limit counts events since midnight.  Hard bounces are
+	// counted over a window of days.
+	maxMins := max(s.cfg.Limits.Window, 24*60)
+	maxMins = max(maxMins, s.cfg.Bounces.Window*24*60)
+	maxAge := time.Duration(maxMins) * time.Minute
+	deleted, err := l.Expire(maxAge)
+	if err != nil {
+		log.Warnf("Rate limit expiry failed: %s", err)
+		return
+	}
+	log.Tracef("Rate limit DB: Deleted=%d", deleted)
+}
+
+// finalRecipients returns the addresses in sendTo that aren't remailers.
+// Only these are subject to limits.
+func (s *Server) finalRecipients(sendTo []string) (finals []string) {
+	for _, addy := range sendTo {
+		if !s.isRemailer(addy) {
+			finals = append(finals, strings.ToLower(addy))
+		}
+	}
+	return
+}
+
+// isRemailer returns true if addy is the address of a known remailer.
+func (s *Server) isRemailer(addy string) bool {
+	_, err := s.pubring.Get(addy)
+	return err == nil
+}
+
+// addressDomain returns the domain part of an email address.
+func addressDomain(addy string) string {
+	_, domain, _ := strings.Cut(addy, "@")
+	return domain
+}
+
+// checkLimits returns an error if delivering to finals would exceed a limit.
+// delFlag is true if the message should be dropped rather than deferred.
+func (s *Server) checkLimits(filename string, finals []string) (delFlag bool, err error) {
+	if len(finals) == 0 {
+		return
+	}
+	if s.cfg.Limits.MaxRecipients > 0 && len(finals) > s.cfg.Limits.MaxRecipients {
+		// Deferring can't help so these are always dropped
+		s.stats.outLimited++
+		err = fmt.Errorf(
+			"%s: %d recipients exceeds limit of %d",
+			filename,
+			len(finals),
+			s.cfg.Limits.MaxRecipients,
+		)
+		delFlag = true
+		return
+	}
+	if !s.limitsEnabled() {
+		return
+	}
+	l, err := s.limiter()
+	if err != nil {
+		return
+	}
+	reason, err := s.overLimit(l, finals)
+	if err != nil || reason == "" {
+		return
+	}
+	s.stats.outLimited++
+	delFlag = strings.ToLower(s.cfg.Limits.Action) == "drop"
+	err = fmt.Errorf("%s: Rate limited: %s", filename, reason)
+	return
+}
+
+// overLimit returns the reason finals can't be delivered to, or an empty
+// string if no limits are exceeded.
+func (s *Server) overLimit(l *ratelimit.Limiter, finals []string) (reason string, err error) {
+	now := time.Now()
+	var count int
+	if s.cfg.Limits.Daily > 0 {
+		count, err = l.Count("total", now.UTC().Truncate(24*time.Hour))
+		if err != nil {
+			return
+		}
+		if count >= s.cfg.Limits.Daily {
+			reason = fmt.Sprintf("Daily limit of %d deliveries reached", s.cfg.Limits.Daily)
+			return
+		}
+	}
+	since := now.Add(-time.Duration(s.cfg.Limits.Window) * time.Minute)
+	for _, addy := range finals {
+		if s.cfg.Limits.PerAddress > 0 {
+			count, err = l.Count("addr:"+addy, since)
+			if err != nil {
+				return
+			}
+			if count >= s.cfg.Limits.PerAddress {
+				// Don't log the address itself
+				reason = fmt.Sprintf(
+					"Address limit of %d per %d minutes reached",
+					s.cfg.Limits.PerAddress,
+					s.cfg.Limits.Window,
+				)
+				return
+			}
+		}
+		if s.cfg.Limits.PerDomain > 0 {
+			count, err = l.Count("domain:"+addressDomain(addy), since)
+			if err != nil {
+				return
+			}
+			if count >= s.cfg.Limits.PerDomain {
+				reason = fmt.Sprintf(
+					"Domain limit of %d per %d minutes reached",
+					s.cfg.Limits.PerDomain,
+					s.cfg.Limits.Window,
+				)
+				return
+			}
+		}
+	}
+	return
+}
+
+// recordDelivery records a delivery to finals against the rate limits.
+func (s *Server) recordDelivery(finals []string) {
+	if len(finals) == 0 || !s.limitsEnabled() {
+		return
+	}
+	l, err := s.limiter()
+	if err != nil {
+		log.Warnf("Unable to record delivery: %s", err)
+		return
+	}
+	names := []string{"total"}
+	domains := make(map[string]bool)
+	for _, addy := range finals {
+		names = append(names, "addr:"+addy)
+		domain := addressDomain(addy)
+		if !domains[domain] {
+			// Count each message once per domain
+			domains[domain] = true
+			names = append(names, "domain:"+domain)
+		}
+	}
+	err = l.Record(names...)
+	if err != nil {
+		log.Warnf("Unable to record delivery: %s", err)
+	}
+}
@@ -3,16 +3,20 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/mail"
 	"net/smtp"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/client"
 )
 
 func assemble(msg mail.Message) []byte {
@@ -69,7 +73,7 @@ func splitEmailAddress(addy string) (e emailAddress, err error) {
 }
 
 // mxLookup returns the responsible MX for a given email address
-func mxLookup(email string) (relay string, err error) {
+func (s *Server) mxLookup(email string) (relay string, err error) {
 	emailParts, err := splitEmailAddress(email)
 	if err != nil {
 		// Failed to ascertain domain name from email address
@@ -86,7 +90,7 @@ func mxLookup(email string) (relay string, err error) {
 		return
 	}
 	for _, mx := range mxRecords {
-		if !cfg.Mail.OnionRelay {
+		if !s.cfg.Mail.OnionRelay {
 			// We don't want no onions!
 			if strings.HasSuffix(mx.Host, ".onion.") {
 				// Ignore the onion, find another.
@@ -116,25 +120,25 @@ func mxLookup(email string) (relay string, err error) {
 // parseFrom takes a mail address of the format Name <name@foo> and validates
 // it.  If custom From headers are not allowed, it will be tweaked to conform
 // with the Remailer's configuration.
-func parseFrom(h mail.Header) []string {
+func (s *Server) parseFrom(h mail.Header) []string {
 	from, err := h.AddressList("From")
 	if err != nil {
 		// The supplied address is invalid.  Use defaults instead.
 		return []string{fmt.Sprintf(
 			"%s <%s>",
-			cfg.Mail.OutboundName,
-			cfg.Mail.OutboundAddy,
+			s.cfg.Mail.OutboundName,
+			s.cfg.Mail.OutboundAddy,
 		)}
 	}
 	if len(from) == 0 {
 		// The address list is empty so return defaults
 		return []string{fmt.Sprintf(
 			"%s <%s>",
-			cfg.Mail.OutboundName,
-			cfg.Mail.OutboundAddy,
+			s.cfg.Mail.OutboundName,
+			s.cfg.Mail.OutboundAddy,
 		)}
 	}
-	if cfg.Mail.CustomFrom {
+	if s.cfg.Mail.CustomFrom {
 		// Accept whatever was provided (it's already been validated by
 		// AddressList).
 		return []string{fmt.Sprintf(
@@ -146,19 +150,22 @@ func parseFrom(h mail.Header) []string {
 	if len(from[0].Name) == 0 {
 		return []string{fmt.Sprintf(
 			"%s <%s>",
-			cfg.Mail.OutboundName,
-			cfg.Mail.OutboundAddy,
+			s.cfg.Mail.OutboundName,
+			s.cfg.Mail.OutboundAddy,
 		)}
 	}
 	return []string{fmt.Sprintf(
 		"%s <%s>",
 		from[0].Name,
-		cfg.Mail.OutboundAddy,
+		s.cfg.Mail.OutboundAddy,
 	)}
 }
 
-// Read a file from the outbound pool and mail it
-func mailPoolFile(filename string) (delFlag bool, err error) {
+// Read a file from the outbound pool and mail it.  exit is true for final
+// deliveries, which the operator's header policy, disclaimer and DKIM
+// signature are applied to.  Packets forwarded to other remailers are sent
+// unmodified.
+func (s *Server) mailPoolFile(filename string, exit bool) (delFlag bool, err error) {
 	// This flag implies that, by default, we don't delete pool messages
 	delFlag = false
 
@@ -177,8 +184,122 @@ func mailPoolFile(filename string) (delFlag bool, err error) {
 		return
 	}
 
+	// Expired messages are marked for deletion.
+	delFlag, err = s.poolExpired(filename, msg.Header)
+	if delFlag || err != nil {
+		return
+	}
+
+	// Mixmaster clients may put pseudo-headers at the top of the body of
+	// exit messages.  Those that can't be parsed are delivered unchanged.
+	if exit {
+		_, err = client.PseudoHeaders(msg)
+		if err != nil {
+			log.Warnf("%s: Ignoring pseudo-headers: %s", filename, err)
+			err = nil
+		}
+	}
+	// Pseudo-headers can turn a message into a Usenet article.
+	if exit && msg.Header.Get("Newsgroups") != "" && msg.Header.Get("To") == "" && msg.Header.Get("Cc") == "" {
+		if !s.newsEnabled() {
+			err = fmt.Errorf("%s: Usenet posting is disabled", filename)
+			delFlag = true
+			return
+		}
+		return s.postMessage(filename, msg)
+	}
+
+	// Apply the header policy to exit deliveries, before adding the
+	// headers it can't override, and then the operator's disclaimer.
+	if exit {
+		var filter *headerFilter
+		filter, err = s.headerFilter()
+		if err != nil {
+			return
+		}
+		filter.apply(msg.Header)
+		var d *disclaimer
+		d, err = s.disclaimer()
+		if err != nil {
+			return
+		}
+		err = d.apply(msg)
+		if err != nil {
+			return
+		}
+	}
+	// Add some required headers.
+	msg.Header["Date"] = []string{time.Now().Format(rfc5322date)}
+	msg.Header["Message-Id"] = []string{s.messageID()}
+	msg.Header["From"] = s.parseFrom(msg.Header)
+	sendTo := headToAddy(msg.Header, "To")
+	sendTo = append(sendTo, headToAddy(msg.Header, "Cc")...)
+	if len(sendTo) == 0 {
+		err = fmt.Errorf("%s: No email recipients found", filename)
+		// No point in repeatedly trying to resend a malformed file.
+		delFlag = true
+		return
+	}
+	blockList, err := s.blockList()
+	if err != nil {
+		return
+	}
+	// Only final recipients are blocked.  Blocking a remailer would
+	// silently drop the packets in transit through it.
+	var permitted []string
+	for _, addy := range sendTo {
+		if !s.isRemailer(addy) && blockList.blocked(addy) {
+			log.Info("Not delivering to a blocked destination")
+			continue
+		}
+		permitted = append(permitted, addy)
+	}
+	if len(permitted) == 0 {
+		err = fmt.Errorf("%s: All recipients are blocked", filename)
+		delFlag = true
+		return
+	}
+	// Messages over a limit are dropped or deferred
+	finals := s.finalRecipients(permitted)
+	delFlag, err = s.checkLimits(filename, finals)
+	if err != nil {
+		return
+	}
+	payload := assemble(*msg)
+	if exit {
+		payload, err = s.dkimSign(payload)
+		if err != nil {
+			return
+		}
+	}
+	// Permanent delivery errors are deleted by emailPoolFile.  Other
+	// errors retain the pool file for a later attempt.
+	err = s.sendMail(payload, permitted)
+	var partial *partialError
+	if errors.As(err, &partial) {
+		// The message was delivered.  Permanently rejected recipients
+		// don't count against the limits.
+		log.Warnf("%s: %s", filename, err)
+		finals = slices.DeleteFunc(finals, func(addy string) bool {
+			return slices.ContainsFunc(partial.rejected, func(r string) bool {
+				return strings.EqualFold(r, addy)
+			})
+		})
+		err = nil
+	}
+	if err == nil {
+		s.recordDelivery(finals)
+		s.recordSent(msg.Header.Get("Message-Id"), finals)
+	}
+	return
+}
+
+// Mail a byte payload to a given address
+// poolExpired tests the Yamn-Pooled-Date header of a pool file and returns
+// true if it exceeds the configured max age.  The header is deleted from h.
+func (s *Server) poolExpired(filename string, h mail.Header) (expired bool, err error) {
 	// Test for a Pooled Date header in the message.
-	pooledHeader := msg.Header.Get("Yamn-Pooled-Date")
+	pooledHeader := h.Get("Yamn-Pooled-Date")
 	if pooledHeader == "" {
 		// Legacy condition.  All current versions apply this header.
 		log.Warn("No Yamn-Pooled-Date header in message")
@@ -190,80 +311,38 @@ func mailPoolFile(filename string) (delFlag bool, err error) {
 			return
 		}
 		age := daysAgo(pooledDate)
-		if age > cfg.Pool.MaxAge {
+		if age > s.cfg.Pool.MaxAge {
 			// The message has expired.  Give up trying to send it.
 			log.Infof(
 				"%s: Refusing to mail pool file. Exceeds max age of %d days",
 				filename,
-				cfg.Pool.MaxAge,
+				s.cfg.Pool.MaxAge,
 			)
-			// Set deletion flag.  We don't want to retain old
-			// messages forever.
-			delFlag = true
+			// We don't want to retain old messages forever.
+			expired = true
 			return
 		}
 		if age > 0 {
 			log.Tracef("Mailing pooled file that's %d days old.", age)
 		}
 		// Delete the internal header we just tested.
-		delete(msg.Header, "Yamn-Pooled-Date")
+		delete(h, "Yamn-Pooled-Date")
 	}
-
-	// Add some required headers to the message.
-	msg.Header["Date"] = []string{time.Now().Format(rfc5322date)}
-	msg.Header["Message-Id"] = []string{messageID()}
-	msg.Header["From"] = parseFrom(msg.Header)
-	sendTo := headToAddy(msg.Header, "To")
-	sendTo = append(sendTo, headToAddy(msg.Header, "Cc")...)
-	if len(sendTo) == 0 {
-		err = fmt.Errorf("%s: No email recipients found", filename)
-		// No point in repeatedly trying to resend a malformed file.
-		delFlag = true
-		return
-	}
-	// There is an assumption here that all errors from mailBytes should not
-	// delete pool files (delFlag is false by default).
-	err = mailBytes(assemble(*msg), sendTo)
 	return
 }
 
-// Mail a byte payload to a given address
-func mailBytes(payload []byte, sendTo []string) (err error) {
-	// Test if the message is destined for the local remailer
+func (s *Server) mailBytes(payload []byte, sendTo []string) (err error) {
 	log.Tracef("Message recipients are: %s", strings.Join(sendTo, ","))
-	if cfg.Mail.Outfile {
-		var f *os.File
-		filename := randPoolFilename("outfile-")
-		log.Tracef("Writing output to %s", filename)
-		f, err = os.Create(filename)
-		if err != nil {
-			log.Warnf("Pool file creation failed: %s\n", err)
-			return
-		}
-		defer f.Close()
-		_, err = f.WriteString(string(payload))
-		if err != nil {
-			log.Warnf("Outfile write failed: %s\n", err)
-			return
-		}
-	} else if cfg.Mail.Pipe != "" {
-		err = execSend(payload, cfg.Mail.Pipe)
-		if err != nil {
-			log.Warn("Email pipe failed")
-			return
-		}
-	} else if cfg.Mail.Sendmail {
-		err = sendmail(payload, sendTo)
-		if err != nil {
-			log.Warn("Sendmail failed")
-			return
-		}
-	} else {
-		err = smtpRelay(payload, sendTo)
-		if err != nil {
-			log.Warn("SMTP relay failed")
-			return
-		}
+	t, err := s.newTransport()
+	if err != nil {
+		// A config error isn't the fault of the message so it's
+		// temporary.
+		log.Errorf("Mail transport unavailable: %s", err)
+		return
+	}
+	err = t.Deliver(payload, sendTo)
+	if err != nil {
+		log.Warnf("Mail delivery failed: %s", err)
 	}
 	return
 }
@@ -297,14 +376,12 @@ func execSend(payload []byte, execCmd string) (err error) {
 	return
 }
 
-func smtpRelay(payload []byte, sendTo []string) (err error) {
-	conf := new(tls.Config)
-	//conf.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA}
-	conf.InsecureSkipVerify = true
-	//conf.MinVersion = tls.VersionSSL30
-	//conf.MaxVersion = tls.VersionTLS10
-	relay := cfg.Mail.SMTPRelay
-	port := cfg.Mail.SMTPPort
+// smtpRelay delivers payload to the configured SMTP relay or, if mx_relay is
+// set and there's a single recipient, direct to the recipient's MX.  Relay
+// certificates are verified.  Failures are logged with their reason.
+func (s *Server) smtpRelay(payload []byte, sendTo []string) (err error) {
+	relay := s.cfg.Mail.SMTPRelay
+	port := s.cfg.Mail.SMTPPort
 
 	/*
 		The following section tries to get the MX record for the
@@ -312,9 +389,10 @@ func smtpRelay(payload []byte, sendTo []string) (err error) {
 		If it succeeds, the email will be sent directly to the
 		recipient MX.
 	*/
-	if cfg.Mail.MXRelay && len(sendTo) == 1 {
+	var direct bool
+	if s.cfg.Mail.MXRelay && len(sendTo) == 1 {
 		log.Tracef("DNS lookup of MX record for %s.", sendTo[0])
-		mx, err := mxLookup(sendTo[0])
+		mx, err := s.mxLookup(sendTo[0])
 		if err == nil {
 			log.Tracef(
 				"Doing direct relay for %s to %s:25.",
@@ -323,29 +401,48 @@ func smtpRelay(payload []byte, sendTo []string) (err error) {
 			)
 			relay = mx
 			port = 25
+			direct = true
 		}
 	}
-	serverAddr := fmt.Sprintf("%s:%d", relay, port)
+	serverAddr := net.JoinHostPort(relay, strconv.Itoa(port))
+	// Implicit TLS is only used with the configured relay
+	implicit := !direct && (s.cfg.Mail.ImplicitTLS || port == smtpsPort)
+	requireTLS := implicit || s.cfg.Mail.RequireTLS
+	// Opportunistic STARTTLS to an MX can't insist on a valid certificate
+	strict := !direct || requireTLS
+	conf, err := s.relayTLSConfig(relay, strict)
+	if err != nil {
+		log.Warnf("TLS Config Error: Server=%s, Error=%s", serverAddr, err)
+		return
+	}
 
-	conn, err := net.Dial("tcp", serverAddr)
+	var conn net.Conn
+	if implicit {
+		conn, err = tls.Dial("tcp", serverAddr, conf)
+	} else {
+		conn, err = net.Dial("tcp", serverAddr)
+	}
 	if err != nil {
 		log.Warnf("Dial Error: Server=%s, Error=%s", serverAddr, err)
 		return
 	}
 
-	client, err := smtp.NewClient(conn, relay)
+	c, err := smtp.NewClient(conn, relay)
 	if err != nil {
 		log.Warnf(
 			"SMTP Connection Error: Server=%s, Error=%s",
 			serverAddr,
 			err,
 		)
+		conn.Close()
 		return
 	}
+	defer c.Close()
 	// Test if the remote MTA supports STARTTLS
-	ok, _ := client.Extension("STARTTLS")
-	if ok && cfg.Mail.UseTLS {
-		if err = client.StartTLS(conf); err != nil {
+	encrypted := implicit
+	ok, _ := c.Extension("STARTTLS")
+	if !implicit && ok && (s.cfg.Mail.UseTLS || requireTLS) {
+		if err = c.StartTLS(conf); err != nil {
 			log.Warnf(
 				"Error performing STARTTLS: Server=%s, Error=%s",
 				serverAddr,
@@ -353,44 +450,54 @@ func smtpRelay(payload []byte, sendTo []string) (err error) {
 			)
 			return
 		}
+		encrypted = true
+	}
+	if requireTLS && !encrypted {
+		// Fail closed
+		err = fmt.Errorf("%s: TLS is required but STARTTLS isn't offered", serverAddr)
+		log.Warnf("TLS Error: Server=%s, Error=%s", serverAddr, err)
+		return
 	}
 	// If AUTH is supported and a UserID and Password are configured, try to
 	// authenticate to the remote MTA.
-	ok, _ = client.Extension("AUTH")
-	if ok && cfg.Mail.Username != "" && cfg.Mail.Password != "" {
-		auth := smtp.PlainAuth(
-			"",
-			cfg.Mail.Username,
-			cfg.Mail.Password,
-			cfg.Mail.SMTPRelay,
-		)
-		if err = client.Auth(auth); err != nil {
+	ok, offered := c.Extension("AUTH")
+	if ok && s.cfg.Mail.Username != "" && s.cfg.Mail.Password != "" {
+		var auth smtp.Auth
+		auth, err = s.relayAuth(relay, offered, encrypted)
+		if err == nil {
+			err = c.Auth(auth)
+		}
+		if err != nil {
 			log.Warnf("Auth Error:  Server=%s, Error=%s", serverAddr, err)
 			return
 		}
 	}
-	// Remailer.Address is a legacy setting as clients may also need to
-	// set the sender address if their ISPs MTA demands it's valid.
-	// TODO remove cfg.Remailer.Address in a later version (27/04/2015)
-	var sender string
-	if cfg.Mail.Sender != "" {
-		sender = cfg.Mail.Sender
-	} else {
-		sender = cfg.Remailer.Address
-	}
-	if err = client.Mail(sender); err != nil {
+	if err = c.Mail(s.envelopeSender()); err != nil {
 		log.Warnf("SMTP Error: Server=%s, Error=%s", serverAddr, err)
 		return
 	}
 
+	// Only rejections of recipients, or of the message, are permanent
+	var rejected []string
+	var rejectErr error
 	for _, addr := range sendTo {
-		if err = client.Rcpt(addr); err != nil {
+		err = classifyReply(c.Rcpt(addr))
+		if isPermanent(err) {
+			log.Warnf("SMTP rejected %s: %s", addr, err)
+			rejected = append(rejected, addr)
+			rejectErr = err
+			continue
+		} else if err != nil {
 			log.Warnf("Error: %s\n", err)
 			return
 		}
 	}
+	if len(rejected) == len(sendTo) {
+		err = rejectErr
+		return
+	}
 
-	w, err := client.Data()
+	w, err := c.Data()
 	if err != nil {
 		log.Warnf("Error: %s\n", err)
 		return
@@ -403,26 +510,40 @@ func smtpRelay(payload []byte, sendTo []string) (err error) {
 
 	}
 
-	err = w.Close()
+	err = classifyReply(w.Close())
 	if err != nil {
 		log.Warnf("Error: %s\n", err)
 		return
 
 	}
 
-	client.Quit()
+	c.Quit()
+	if len(rejected) > 0 {
+		err = &partialError{rejected: rejected, err: rejectErr}
+	}
 	return
 }
 
+// envelopeSender returns the address used in SMTP MAIL FROM commands.
+func (s *Server) envelopeSender() string {
+	// Remailer.Address is a legacy setting as clients may also need to
+	// set the sender address if their ISPs MTA demands it's valid.
+	// TODO remove s.cfg.Remailer.Address in a later version (27/04/2015)
+	if s.cfg.Mail.Sender != "" {
+		return s.cfg.Mail.Sender
+	}
+	return s.cfg.Remailer.Address
+}
+
 // sendmail invokes go's sendmail method
-func sendmail(payload []byte, sendTo []string) (err error) {
+func (s *Server) sendmail(payload []byte, sendTo []string) (err error) {
 	auth := smtp.PlainAuth(
 		"",
-		cfg.Mail.Username,
-		cfg.Mail.Password,
-		cfg.Mail.SMTPRelay)
-	relay := fmt.Sprintf("%s:%d", cfg.Mail.SMTPRelay, cfg.Mail.SMTPPort)
-	err = smtp.SendMail(relay, auth, cfg.Remailer.Address, sendTo, payload)
+		s.cfg.Mail.Username,
+		s.cfg.Mail.Password,
+		s.cfg.Mail.SMTPRelay)
+	relay := net.JoinHostPort(s.cfg.Mail.SMTPRelay, strconv.Itoa(s.cfg.Mail.SMTPPort))
+	err = smtp.SendMail(relay, auth, s.cfg.Remailer.Address, sendTo, payload)
 	if err != nil {
 		log.Warn(err)
 		return
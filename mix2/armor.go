@@ -0,0 +1,110 @@
+package mix2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/crooks/yamn/linebreaker"
+)
+
+// base64LineWrap is the line length of Mixmaster's base64 encoding
+const base64LineWrap = 40
+
+// wrap40 writes b as wrapped base64 to w
+func wrap40(w io.Writer, b []byte) {
+	breaker := linebreaker.NewLineBreaker(w, base64LineWrap)
+	b64 := base64.NewEncoder(base64.StdEncoding, breaker)
+	b64.Write(b)
+	b64.Close()
+	breaker.Close()
+}
+
+// IsArmored returns true if message contains a Mixmaster armored packet.
+func IsArmored(message []byte) bool {
+	return bytes.Contains(message, []byte("\nRemailer-Type: Mixmaster"))
+}
+
+// Armor writes a Type II packet to w with Mixmaster's cutmarks and header
+// fields.
+func Armor(w io.Writer, packet []byte) (err error) {
+	if len(packet) != PacketBytes {
+		return fmt.Errorf(
+			"%w: type II packet is %d bytes, expected %d",
+			ErrRange,
+			len(packet),
+			PacketBytes,
+		)
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("::\n")
+	bw.WriteString("Remailer-Type: Mixmaster 3.0\n\n")
+	bw.WriteString("-----BEGIN REMAILER MESSAGE-----\n")
+	bw.WriteString(strconv.Itoa(len(packet)) + "\n")
+	digest := md5.Sum(packet)
+	wrap40(bw, digest[:])
+	bw.WriteString("\n")
+	wrap40(bw, packet)
+	bw.WriteString("\n-----END REMAILER MESSAGE-----\n")
+	return bw.Flush()
+}
+
+// StripArmor returns the Type II packet from a Mixmaster armored message.
+// The stated length and MD5 digest of the packet are validated.
+func StripArmor(r io.Reader) (packet []byte, err error) {
+	scanner := bufio.NewScanner(r)
+	var lines []string
+	inPacket := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "-----BEGIN REMAILER MESSAGE-----" {
+			inPacket = true
+			continue
+		}
+		if !inPacket {
+			continue
+		}
+		if line == "-----END REMAILER MESSAGE-----" {
+			inPacket = false
+			break
+		}
+		lines = append(lines, line)
+	}
+	if inPacket || len(lines) < 3 {
+		err = errors.New("no type II packet found in message")
+		return
+	}
+	statedLen, err := strconv.Atoi(lines[0])
+	if err != nil {
+		err = fmt.Errorf("unable to extract packet size from %s", lines[0])
+		return
+	}
+	digest, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(digest) != md5.Size {
+		err = errors.New("unable to decode type II packet digest")
+		return
+	}
+	packet, err = base64.StdEncoding.DecodeString(strings.Join(lines[2:], ""))
+	if err != nil {
+		return
+	}
+	if len(packet) != statedLen || statedLen != PacketBytes {
+		err = fmt.Errorf(
+			"type II packet size mismatch. Stated=%d, Got=%d",
+			statedLen,
+			len(packet),
+		)
+		return
+	}
+	got := md5.Sum(packet)
+	if !bytes.Equal(got[:], digest) {
+		err = errors.New("incorrect type II packet digest during dearmor")
+	}
+	return
+}
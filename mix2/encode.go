@@ -0,0 +1,150 @@
+package mix2
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+// MaxFragment is the largest user data fragment carried by a single packet.
+const MaxFragment = PayloadBytes - 4
+
+// Hop is a remailer in a chain of Type II hops.
+type Hop struct {
+	Address string
+	Key     *rsa.PublicKey
+}
+
+// Encode returns the packets that carry the user data through chain.  Data
+// larger than MaxFragment is split into Partial packets.  It's a minimal
+// encoder, used for testing remailers, rather than a Mixmaster client.
+func Encode(data []byte, chain []Hop) (packets [][]byte, err error) {
+	if len(chain) == 0 || len(chain) > NumHeaders {
+		err = fmt.Errorf("%w: chain must be 1-%d hops", ErrRange, NumHeaders)
+		return
+	}
+	numc := max(1, (len(data)+MaxFragment-1)/MaxFragment)
+	if numc > 255 {
+		err = fmt.Errorf("%w: %d chunks exceeds maximum of 255", ErrRange, numc)
+		return
+	}
+	messageID := crandom.Randbytes(16)
+	for cnum := 1; cnum <= numc; cnum++ {
+		frag := data[(cnum-1)*MaxFragment : min(cnum*MaxFragment, len(data))]
+		var p []byte
+		p, err = encodePacket(frag, cnum, numc, messageID, chain)
+		if err != nil {
+			return
+		}
+		packets = append(packets, p)
+	}
+	return
+}
+
+// encodePacket returns a single packet containing a fragment of user data.
+func encodePacket(
+	frag []byte,
+	chunkNum, numChunks int,
+	messageID []byte,
+	chain []Hop) (p []byte, err error) {
+
+	payload := make([]byte, 4, PayloadBytes)
+	binary.LittleEndian.PutUint32(payload, uint32(len(frag)))
+	payload = append(payload, frag...)
+	payload = append(payload, crandom.Randbytes(PayloadBytes-len(payload))...)
+	headers := make([][]byte, NumHeaders)
+	for i := range headers {
+		headers[i] = crandom.Randbytes(HeaderBytes)
+	}
+	// The Final hop
+	key := crandom.Randbytes(24)
+	iv := crandom.Randbytes(8)
+	payload, err = cbcEncrypt(key, iv, payload)
+	if err != nil {
+		return
+	}
+	packetType := PacketTypeFinal
+	info := append(messageID[:16:16], iv...)
+	if numChunks > 1 {
+		packetType = PacketTypePartial
+		info = append([]byte{byte(chunkNum), byte(numChunks)}, info...)
+	}
+	hop := chain[len(chain)-1]
+	headers[0], err = encodeHeader(hop.Key, key, packetType, info)
+	if err != nil {
+		return
+	}
+	// Intermediate hops, in reverse order
+	for n := len(chain) - 2; n >= 0; n-- {
+		key = crandom.Randbytes(24)
+		info = nil
+		var ivs [][]byte
+		for i := 0; i < numIVs; i++ {
+			ivs = append(ivs, crandom.Randbytes(8))
+			info = append(info, ivs[i]...)
+		}
+		address := make([]byte, AddressBytes)
+		copy(address, chain[n+1].Address)
+		info = append(info, address...)
+		// Shift the headers down, discarding the last
+		copy(headers[1:], headers[:NumHeaders-1])
+		for i := 1; i < NumHeaders; i++ {
+			headers[i], err = cbcEncrypt(key, ivs[i-1], headers[i])
+			if err != nil {
+				return
+			}
+		}
+		payload, err = cbcEncrypt(key, ivs[numIVs-1], payload)
+		if err != nil {
+			return
+		}
+		headers[0], err = encodeHeader(chain[n].Key, key, PacketTypeIntermediate, info)
+		if err != nil {
+			return
+		}
+	}
+	p = append(bytes.Join(headers, nil), payload...)
+	return
+}
+
+// encodeHeader returns a header encrypted to pub.
+func encodeHeader(pub *rsa.PublicKey, key []byte, packetType int, info []byte) (h []byte, err error) {
+	buf := new(bytes.Buffer)
+	buf.Write(crandom.Randbytes(16))
+	buf.Write(key)
+	buf.WriteByte(byte(packetType))
+	buf.Write(info)
+	buf.Write(timestampMarker)
+	days := make([]byte, 2)
+	binary.LittleEndian.PutUint16(days, uint16(time.Now().UTC().Unix()/86400))
+	buf.Write(days)
+	digest := md5.Sum(buf.Bytes())
+	buf.Write(digest[:])
+	buf.Write(crandom.Randbytes(EncHeaderBytes - buf.Len()))
+	sessionKey := crandom.Randbytes(24)
+	iv := crandom.Randbytes(8)
+	enc, err := cbcEncrypt(sessionKey, iv, buf.Bytes())
+	if err != nil {
+		return
+	}
+	rsaData, err := rsa.EncryptPKCS1v15(rand.Reader, pub, sessionKey)
+	if err != nil {
+		return
+	}
+	keyid, err := KeyID(pub)
+	if err != nil {
+		return
+	}
+	h = append(keyid, byte(len(rsaData)))
+	h = append(h, rsaData...)
+	h = append(h, iv...)
+	h = append(h, enc...)
+	h = append(h, crandom.Randbytes(HeaderBytes-len(h))...)
+	return
+}
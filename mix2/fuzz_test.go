@@ -0,0 +1,104 @@
+package mix2
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+// Fuzz targets for the Type II decoders that handle attacker-controlled
+// bytes.  Run with, for example:
+//
+//	go test ./mix2 -fuzz FuzzParseMessage
+
+func FuzzStripArmor(f *testing.F) {
+	// Complete packets are too large to fuzz efficiently so the seed is
+	// well formed armor around a short packet.
+	packet := crandom.Randbytes(48)
+	digest := md5.Sum(packet)
+	f.Add([]byte(fmt.Sprintf(
+		"::\nRemailer-Type: Mixmaster 3.0\n\n"+
+			"-----BEGIN REMAILER MESSAGE-----\n%d\n%s\n%s\n"+
+			"-----END REMAILER MESSAGE-----\n",
+		len(packet),
+		base64.StdEncoding.EncodeToString(digest[:]),
+		base64.StdEncoding.EncodeToString(packet),
+	)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := StripArmor(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(packet) != PacketBytes {
+			t.Fatalf("StripArmor accepted a %d byte packet", len(packet))
+		}
+	})
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	for _, packetType := range []int{
+		PacketTypeIntermediate,
+		PacketTypeFinal,
+		PacketTypePartial,
+	} {
+		n, err := infoBytes(packetType)
+		if err != nil {
+			f.Fatal(err)
+		}
+		plain := crandom.Randbytes(41 + n)
+		plain[40] = byte(packetType)
+		if packetType == PacketTypePartial {
+			// Chunk 1 of 2
+			plain[41] = 1
+			plain[42] = 2
+		}
+		plain = append(plain, timestampMarker...)
+		plain = append(plain, 0, 0)
+		digest := md5.Sum(plain)
+		plain = append(plain, digest[:]...)
+		plain = append(plain, make([]byte, EncHeaderBytes-len(plain))...)
+		f.Add(plain)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) != EncHeaderBytes {
+			return
+		}
+		h, err := decodeHeader(b)
+		if err != nil {
+			return
+		}
+		h.Age()
+		if h.PacketType == PacketTypeIntermediate && len(h.ivs) != numIVs {
+			t.Fatalf("Intermediate header has %d IVs", len(h.ivs))
+		}
+	})
+}
+
+func FuzzParseMessage(f *testing.F) {
+	msg := &Message{
+		Destinations: []string{"recipient@example.com"},
+		Headers:      []string{"Subject: Test"},
+		Body:         []byte("Hello World\n"),
+	}
+	data, err := msg.Encode()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add([]byte{0, 0, 0x1f, 0x8b})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseMessage(data, 1000)
+		if err != nil {
+			return
+		}
+		if len(m.Body) > max(len(data), 1000) {
+			t.Fatalf("Body of %d bytes exceeds limit", len(m.Body))
+		}
+		m.Dummy()
+		m.Bytes()
+	})
+}
@@ -0,0 +1,145 @@
+package mix2
+
+import (
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+Type II keys are 1024-bit RSA keys.  The secret keys are managed separately to
+YAMN's own and are read from a file of PEM encoded PKCS#1 ("RSA PRIVATE KEY")
+or PKCS#8 ("PRIVATE KEY") blocks.
+
+Public keys are published in Mixmaster's encoding:
+[ Key length in bits	  2 Bytes ] (Little-Endian)
+[ Modulus		128 Bytes ] (Big-Endian)
+[ Public exponent	128 Bytes ] (Big-Endian)
+The Key ID is the MD5 digest of the encoded public key.
+*/
+
+// Secring contains the secret keys used to decode Type II headers.
+type Secring struct {
+	keys map[string]*rsa.PrivateKey // Keyed by hex Key ID
+}
+
+// NewSecring returns an empty Secring.
+func NewSecring() *Secring {
+	return &Secring{keys: make(map[string]*rsa.PrivateKey)}
+}
+
+// EncodePublic returns the Mixmaster encoding of a public key.
+func EncodePublic(pub *rsa.PublicKey) ([]byte, error) {
+	if pub.Size() != rsaBytes {
+		return nil, fmt.Errorf(
+			"%w: type II keys must be %d bits",
+			ErrRange,
+			rsaBytes*8,
+		)
+	}
+	b := make([]byte, 2+rsaBytes*2)
+	binary.LittleEndian.PutUint16(b, uint16(rsaBytes*8))
+	pub.N.FillBytes(b[2 : 2+rsaBytes])
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(pub.E))
+	return b, nil
+}
+
+// KeyID returns the Mixmaster Key ID of a public key.
+func KeyID(pub *rsa.PublicKey) ([]byte, error) {
+	b, err := EncodePublic(pub)
+	if err != nil {
+		return nil, err
+	}
+	digest := md5.Sum(b)
+	return digest[:], nil
+}
+
+// Add inserts a secret key into the Secring and returns its Key ID.
+func (s *Secring) Add(key *rsa.PrivateKey) (keyid []byte, err error) {
+	keyid, err = KeyID(&key.PublicKey)
+	if err != nil {
+		return
+	}
+	s.keys[hex.EncodeToString(keyid)] = key
+	return
+}
+
+// Import reads all the PEM encoded RSA keys in filename into the Secring.
+func (s *Secring) Import(filename string) (err error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		var key any
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("%s: type II keys must be RSA", filename)
+		}
+		_, err = s.Add(rsaKey)
+		if err != nil {
+			return
+		}
+	}
+	if len(s.keys) == 0 {
+		err = fmt.Errorf("%s: no type II keys found", filename)
+	}
+	return
+}
+
+// Count returns the number of keys in the Secring.
+func (s *Secring) Count() int {
+	return len(s.keys)
+}
+
+// Get returns the secret key with the specified Key ID.
+func (s *Secring) Get(keyid []byte) (*rsa.PrivateKey, error) {
+	key, ok := s.keys[hex.EncodeToString(keyid)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %x", ErrUnknownKey, keyid)
+	}
+	return key, nil
+}
+
+// WritePublic writes the public component of every key in the Secring to w,
+// in the format of a Mixmaster pubring.mix.  name, address and caps populate
+// the key header line.
+func (s *Secring) WritePublic(w io.Writer, name, address, caps string) (err error) {
+	for keyid, key := range s.keys {
+		var b []byte
+		b, err = EncodePublic(&key.PublicKey)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s 2:3.0 %s\n\n", name, address, keyid, caps)
+		fmt.Fprintf(w, "-----Begin Mix Key-----\n%s\n%d\n", keyid, len(b))
+		wrap40(w, b)
+		_, err = fmt.Fprint(w, "\n-----End Mix Key-----\n\n")
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,138 @@
+package mix2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+User data
+[ Num destinations	  1 Byte  ]
+[ Destinations		 80 Bytes each ]
+[ Num header lines	  1 Byte  ]
+[ Header lines		 80 Bytes each ]
+[ Body			  n Bytes ] (GZIP compressed if it begins 0x1f 0x8b)
+
+Fields are null terminated.  A destination of "null:" identifies a dummy.
+*/
+
+// nullDestination is the destination of dummy messages
+const nullDestination = "null:"
+
+// gzipMagic identifies a compressed body
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Message is the user data delivered by a Final hop.
+type Message struct {
+	Destinations []string
+	Headers      []string
+	Body         []byte
+}
+
+// fields reads a count byte followed by that many null terminated fields.
+func fields(r *bytes.Reader) (f []string, err error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		err = fmt.Errorf("%w: user data is truncated", ErrRange)
+		return
+	}
+	field := make([]byte, AddressBytes)
+	for i := 0; i < int(n); i++ {
+		_, err = io.ReadFull(r, field)
+		if err != nil {
+			err = fmt.Errorf("%w: user data is truncated", ErrRange)
+			return
+		}
+		f = append(f, cString(field))
+	}
+	return
+}
+
+// ParseMessage converts the complete user data of a message into a Message.
+// Compressed bodies may not expand beyond limit bytes.
+func ParseMessage(data []byte, limit int) (m *Message, err error) {
+	r := bytes.NewReader(data)
+	m = new(Message)
+	m.Destinations, err = fields(r)
+	if err != nil {
+		return
+	}
+	m.Headers, err = fields(r)
+	if err != nil {
+		return
+	}
+	body := data[len(data)-r.Len():]
+	if !bytes.HasPrefix(body, gzipMagic) {
+		m.Body = body
+		return
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	// Read one byte more than the limit to detect oversized bodies
+	m.Body, err = io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return
+	}
+	if len(m.Body) > limit {
+		err = fmt.Errorf(
+			"%w: decompressed body exceeds maximum (%d bytes)",
+			ErrRange,
+			limit,
+		)
+	}
+	return
+}
+
+// Dummy returns true if the Message should be discarded.
+func (m *Message) Dummy() bool {
+	for _, d := range m.Destinations {
+		if d == nullDestination {
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes returns the Message as an email, addressed to its Destinations.
+func (m *Message) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	if len(m.Destinations) > 0 {
+		fmt.Fprintf(buf, "To: %s\n", strings.Join(m.Destinations, ", "))
+	}
+	for _, h := range m.Headers {
+		buf.WriteString(h + "\n")
+	}
+	buf.WriteString("\n")
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+// Encode returns the user data representation of the Message.
+func (m *Message) Encode() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	for _, f := range [][]string{m.Destinations, m.Headers} {
+		if len(f) > 255 {
+			err = fmt.Errorf("%w: too many user data fields", ErrRange)
+			return
+		}
+		buf.WriteByte(byte(len(f)))
+		for _, s := range f {
+			if len(s) >= AddressBytes {
+				err = fmt.Errorf("%w: field exceeds %d bytes", ErrRange, AddressBytes-1)
+				return
+			}
+			field := make([]byte, AddressBytes)
+			copy(field, s)
+			buf.Write(field)
+		}
+	}
+	buf.Write(m.Body)
+	data = buf.Bytes()
+	return
+}
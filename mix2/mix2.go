@@ -0,0 +1,327 @@
+// Package mix2 decodes Mixmaster Type II packets so that a YAMN remailer can
+// serve users of both networks while they migrate.  Like package packet, it
+// has no knowledge of configuration or delivery; callers supply keys and
+// receive decoded headers and payloads.
+package mix2
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+const (
+	HeaderBytes    = 512 // An entire header
+	NumHeaders     = 20  // Headers in every packet
+	HeadersBytes   = HeaderBytes * NumHeaders
+	PayloadBytes   = 10240
+	PacketBytes    = HeadersBytes + PayloadBytes
+	EncHeaderBytes = 328 // The 3DES encrypted component of a header
+	AddressBytes   = 80  // Remailer addresses and destination fields
+	rsaBytes       = 128 // RSA encrypted session key (1024-bit keys)
+	numIVs         = NumHeaders - 1
+)
+
+const (
+	// PacketTypeIntermediate identifies a header destined for a middle hop
+	PacketTypeIntermediate = 0
+	// PacketTypeFinal identifies a header destined for the final hop of a
+	// single packet message
+	PacketTypeFinal = 1
+	// PacketTypePartial identifies a header destined for the final hop of
+	// a message comprising several packets
+	PacketTypePartial = 2
+)
+
+var (
+	// ErrUnknownKey is returned when a header is encrypted to a key that
+	// isn't in the secret keyring.
+	ErrUnknownKey = errors.New("unknown type II key")
+	// ErrAuth is returned when a header fails decryption or its digest
+	// doesn't match.
+	ErrAuth = errors.New("type II header authentication failed")
+	// ErrRange is returned when a value falls outside the range permitted
+	// by the packet format.
+	ErrRange = errors.New("value out of range")
+)
+
+// timestampMarker precedes the timestamp in a header.  Headers created by
+// older clients have no timestamp.
+var timestampMarker = []byte("0000\x00")
+
+/*
+Header
+[ Public key ID		 16 Bytes ]
+[ RSA data length	  1 Byte  ] (Always 128)
+[ RSA encrypted key	128 Bytes ] (PKCS#1 v1.5, 3DES session key)
+[ Initialization vector	  8 Bytes ]
+[ Encrypted header	328 Bytes ] (3DES-CBC using the session key)
+[ Padding		 31 Bytes ]
+Total	512 Bytes
+
+Encrypted header
+[ Packet ID		 16 Bytes ]
+[ 3DES key		 24 Bytes ] (Decrypts the rest of the packet)
+[ Packet type		  1 Byte  ]
+[ Packet info		  n Bytes ]
+[ Timestamp		  7 Bytes ] (Optional. "0000\0" + days since Epoch)
+[ Digest		 16 Bytes ] (MD5 of all the preceding fields)
+[ Padding		  n Bytes ]
+Total	328 Bytes
+
+Packet info (Intermediate)
+[ Initialization vectors 19 * 8 Bytes ]
+[ Remailer address	 80 Bytes ]
+
+Packet info (Final)
+[ Message ID		 16 Bytes ]
+[ Initialization vector	  8 Bytes ]
+
+Packet info (Partial)
+[ Chunk num		  1 Byte  ]
+[ Num chunks		  1 Byte  ]
+[ Message ID		 16 Bytes ]
+[ Initialization vector	  8 Bytes ]
+
+Intermediate hops decrypt headers 2-20 using IVs 1-19 respectively and the
+payload using IV 19.  The decrypted headers are shifted up and a random header
+is appended.
+*/
+
+// Header is the decrypted top header of a Type II packet.
+type Header struct {
+	PacketID   []byte
+	PacketType int
+	NextHop    string // Intermediate hops only
+	MessageID  []byte // Final hops only
+	ChunkNum   int    // Final hops only
+	NumChunks  int    // Final hops only
+	days       int    // Timestamp, or -1 if there isn't one
+	key        []byte // 3DES key for the rest of the packet
+	ivs        [][]byte
+}
+
+// Age returns the age of the header's timestamp in days.  Headers without a
+// timestamp have an age of zero.
+func (h *Header) Age() int {
+	if h.days < 0 {
+		return 0
+	}
+	return int(time.Now().UTC().Unix()/86400) - h.days
+}
+
+// Packet is a Type II packet, decrypted to the extent its top header allows.
+type Packet struct {
+	Header *Header
+	raw    []byte
+}
+
+// cbcDecrypt returns b decrypted using 3DES-CBC.
+func cbcDecrypt(key, iv, b []byte) ([]byte, error) {
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(b))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, b)
+	return out, nil
+}
+
+// cbcEncrypt returns b encrypted using 3DES-CBC.
+func cbcEncrypt(key, iv, b []byte) ([]byte, error) {
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(b))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, b)
+	return out, nil
+}
+
+// Decode decrypts the top header of a Type II packet using a key from
+// secring.
+func Decode(raw []byte, secring *Secring) (p *Packet, err error) {
+	if len(raw) != PacketBytes {
+		err = fmt.Errorf(
+			"%w: type II packet is %d bytes, expected %d",
+			ErrRange,
+			len(raw),
+			PacketBytes,
+		)
+		return
+	}
+	h := raw[:HeaderBytes]
+	key, err := secring.Get(h[:16])
+	if err != nil {
+		return
+	}
+	if int(h[16]) != rsaBytes || key.Size() != rsaBytes {
+		err = fmt.Errorf("%w: unsupported RSA data length %d", ErrRange, h[16])
+		return
+	}
+	sessionKey, err := rsa.DecryptPKCS1v15(nil, key, h[17:17+rsaBytes])
+	if err != nil || len(sessionKey) != 24 {
+		err = fmt.Errorf("%w: session key decryption failed", ErrAuth)
+		return
+	}
+	ivStart := 17 + rsaBytes
+	encStart := ivStart + 8
+	plain, err := cbcDecrypt(
+		sessionKey,
+		h[ivStart:encStart],
+		h[encStart:encStart+EncHeaderBytes],
+	)
+	if err != nil {
+		return
+	}
+	header, err := decodeHeader(plain)
+	if err != nil {
+		return
+	}
+	p = &Packet{Header: header, raw: raw}
+	return
+}
+
+// infoBytes returns the length of the Packet Info for a packet type.
+func infoBytes(packetType int) (int, error) {
+	switch packetType {
+	case PacketTypeIntermediate:
+		return numIVs*8 + AddressBytes, nil
+	case PacketTypeFinal:
+		return 24, nil
+	case PacketTypePartial:
+		return 26, nil
+	}
+	return 0, fmt.Errorf("%w: unknown packet type %d", ErrRange, packetType)
+}
+
+// decodeHeader converts the decrypted component of a header into a Header.
+func decodeHeader(b []byte) (h *Header, err error) {
+	h = &Header{
+		PacketID:   b[:16],
+		key:        b[16:40],
+		PacketType: int(b[40]),
+		days:       -1,
+	}
+	n, err := infoBytes(h.PacketType)
+	if err != nil {
+		// The digest can't be located in a corrupt header
+		err = fmt.Errorf("%w: %w", ErrAuth, err)
+		return
+	}
+	info := b[41 : 41+n]
+	end := 41 + n
+	if bytes.HasPrefix(b[end:], timestampMarker) {
+		h.days = int(binary.LittleEndian.Uint16(b[end+5 : end+7]))
+		end += 7
+	}
+	digest := md5.Sum(b[:end])
+	if !bytes.Equal(digest[:], b[end:end+16]) {
+		err = ErrAuth
+		return
+	}
+	switch h.PacketType {
+	case PacketTypeIntermediate:
+		for i := 0; i < numIVs; i++ {
+			h.ivs = append(h.ivs, info[i*8:(i+1)*8])
+		}
+		h.NextHop = cString(info[numIVs*8:])
+	case PacketTypeFinal:
+		h.ChunkNum = 1
+		h.NumChunks = 1
+		h.MessageID = info[:16]
+		h.ivs = [][]byte{info[16:24]}
+	case PacketTypePartial:
+		h.ChunkNum = int(info[0])
+		h.NumChunks = int(info[1])
+		h.MessageID = info[2:18]
+		h.ivs = [][]byte{info[18:26]}
+		if h.NumChunks == 0 || h.ChunkNum == 0 || h.ChunkNum > h.NumChunks {
+			err = fmt.Errorf(
+				"%w: invalid chunk %d of %d",
+				ErrRange,
+				h.ChunkNum,
+				h.NumChunks,
+			)
+			return
+		}
+	}
+	return
+}
+
+// cString returns the content of a null terminated field.
+func cString(b []byte) string {
+	n := bytes.IndexByte(b, 0)
+	if n >= 0 {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+// Forward returns the packet an Intermediate hop should send to NextHop.
+func (p *Packet) Forward() (next []byte, err error) {
+	if p.Header.PacketType != PacketTypeIntermediate {
+		err = fmt.Errorf("%w: not an intermediate packet", ErrRange)
+		return
+	}
+	buf := new(bytes.Buffer)
+	for i := 1; i < NumHeaders; i++ {
+		var h []byte
+		h, err = cbcDecrypt(
+			p.Header.key,
+			p.Header.ivs[i-1],
+			p.raw[i*HeaderBytes:(i+1)*HeaderBytes],
+		)
+		if err != nil {
+			return
+		}
+		buf.Write(h)
+	}
+	buf.Write(crandom.Randbytes(HeaderBytes))
+	payload, err := cbcDecrypt(
+		p.Header.key,
+		p.Header.ivs[numIVs-1],
+		p.raw[HeadersBytes:],
+	)
+	if err != nil {
+		return
+	}
+	buf.Write(payload)
+	next = buf.Bytes()
+	return
+}
+
+// Payload returns the user data of a Final or Partial hop.  For Partial
+// hops, it's a fragment of the data; fragments are concatenated in chunk
+// order to form the complete data.  In both cases, ParseMessage converts the
+// complete data into a Message.
+func (p *Packet) Payload() (data []byte, err error) {
+	if p.Header.PacketType == PacketTypeIntermediate {
+		err = fmt.Errorf("%w: not a final packet", ErrRange)
+		return
+	}
+	payload, err := cbcDecrypt(p.Header.key, p.Header.ivs[0], p.raw[HeadersBytes:])
+	if err != nil {
+		return
+	}
+	length := binary.LittleEndian.Uint32(payload)
+	if length > PayloadBytes-4 {
+		err = fmt.Errorf(
+			"%w: payload length (%d bytes) exceeds maximum (%d bytes)",
+			ErrRange,
+			length,
+			PayloadBytes-4,
+		)
+		return
+	}
+	data = payload[4 : 4+length]
+	return
+}
@@ -0,0 +1,224 @@
+package mix2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// newKey returns a Secring containing a new key and the key's Hop.
+func newKey(t *testing.T, address string) (*Secring, Hop) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secring := NewSecring()
+	_, err = secring.Add(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secring, Hop{Address: address, Key: &key.PublicKey}
+}
+
+func TestImport(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := path.Join(t.TempDir(), "mix2sec.pem")
+	b := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	err = os.WriteFile(filename, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secring := NewSecring()
+	err = secring.Import(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyid, err := KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = secring.Get(keyid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = secring.Get(make([]byte, 16)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected ErrUnknownKey, got: %v", err)
+	}
+	pub := new(bytes.Buffer)
+	err = secring.WritePublic(pub, "test", "test@example.com", "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pub.String(), "-----Begin Mix Key-----\n") {
+		t.Fatalf("Public key block not written:\n%s", pub.String())
+	}
+}
+
+func TestTwoHops(t *testing.T) {
+	sec1, hop1 := newKey(t, "hop1@example.com")
+	sec2, hop2 := newKey(t, "hop2@example.com")
+	msg := &Message{
+		Destinations: []string{"recipient@example.com"},
+		Headers:      []string{"Subject: Test"},
+		Body:         []byte("Hello World\n"),
+	}
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := Encode(data, []Hop{hop1, hop2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || len(packets[0]) != PacketBytes {
+		t.Fatalf("Unexpected packets: %d", len(packets))
+	}
+	p, err := Decode(packets[0], sec1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Header.PacketType != PacketTypeIntermediate || p.Header.NextHop != hop2.Address {
+		t.Fatalf("Unexpected header: type=%d, next=%s", p.Header.PacketType, p.Header.NextHop)
+	}
+	if p.Header.Age() != 0 {
+		t.Errorf("Unexpected age: %d", p.Header.Age())
+	}
+	next, err := p.Forward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first hop can't decode the payload
+	if _, err = p.Payload(); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+	p, err = Decode(next, sec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Header.PacketType != PacketTypeFinal {
+		t.Fatalf("Unexpected packet type: %d", p.Header.PacketType)
+	}
+	payload, err := p.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseMessage(payload, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Dummy() {
+		t.Error("Message identified as a dummy")
+	}
+	expected := "To: recipient@example.com\nSubject: Test\n\nHello World\n"
+	if string(got.Bytes()) != expected {
+		t.Errorf("Unexpected message:\n%s", got.Bytes())
+	}
+}
+
+func TestPartial(t *testing.T) {
+	sec, hop := newKey(t, "hop@example.com")
+	data := bytes.Repeat([]byte("x"), MaxFragment+100)
+	packets, err := Encode(data, []Hop{hop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(packets))
+	}
+	var joined []byte
+	for i, raw := range packets {
+		p, err := Decode(raw, sec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := p.Header
+		if h.PacketType != PacketTypePartial || h.ChunkNum != i+1 || h.NumChunks != 2 {
+			t.Fatalf("Unexpected header: type=%d, chunk %d of %d", h.PacketType, h.ChunkNum, h.NumChunks)
+		}
+		frag, err := p.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined = append(joined, frag...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("Joined fragments don't match")
+	}
+}
+
+func TestTamper(t *testing.T) {
+	sec, hop := newKey(t, "hop@example.com")
+	packets, err := Encode([]byte{0, 0}, []Hop{hop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the encrypted header
+	packets[0][200] ^= 1
+	if _, err = Decode(packets[0], sec); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Expected ErrAuth, got: %v", err)
+	}
+	if _, err = Decode(packets[0][:100], sec); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
+
+func TestArmor(t *testing.T) {
+	_, hop := newKey(t, "hop@example.com")
+	packets, err := Encode([]byte{0, 0}, []Hop{hop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = Armor(buf, packets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsArmored(buf.Bytes()) {
+		t.Fatal("Armored packet not recognised")
+	}
+	got, err := StripArmor(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, packets[0]) {
+		t.Fatal("Dearmored packet doesn't match")
+	}
+}
+
+func TestCompressedBody(t *testing.T) {
+	body := new(bytes.Buffer)
+	zw := gzip.NewWriter(body)
+	zw.Write(bytes.Repeat([]byte("Hello World\n"), 100))
+	zw.Close()
+	msg := &Message{Destinations: []string{"null:"}, Body: body.Bytes()}
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseMessage(data, 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Body) != 1200 || !got.Dummy() {
+		t.Fatalf("Unexpected message: dummy=%v, body=%d", got.Dummy(), len(got.Body))
+	}
+	if _, err = ParseMessage(data, 1000); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+	if _, err = ParseMessage([]byte{1}, 1000); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// nntpTimeout limits the duration of an entire NNTP posting session.
+const nntpTimeout = 2 * time.Minute
+
+// newsHeaders are the only article headers retained by an Exit, as per
+// mail2news gateways.  Headers that could be used to inject control messages,
+// approve moderated postings or forge the article's path are all dropped.
+// Date, From and Message-ID are always provided by the Exit.
+var newsHeaders = []string{
+	"Newsgroups",
+	"Subject",
+	"Followup-To",
+	"References",
+	"Organization",
+	"Keywords",
+	"Summary",
+	"X-No-Archive",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// newsEnabled returns true if this remailer posts Usenet articles.
+func (s *Server) newsEnabled() bool {
+	return s.cfg.Remailer.Exit &&
+		(s.cfg.News.NNTPServer != "" || s.cfg.News.Mail2News != "")
+}
+
+// filterNews returns a copy of h containing only the headers that may be
+// posted to Usenet.
+func filterNews(h mail.Header) mail.Header {
+	filtered := make(mail.Header)
+	for _, name := range newsHeaders {
+		if v, exists := h[name]; exists {
+			filtered[name] = v
+		}
+	}
+	return filtered
+}
+
+// postPoolFile posts a Usenet article from the Pool.  Articles are posted to
+// the configured NNTP server or, failing that, mailed to a mail2news gateway.
+func (s *Server) postPoolFile(filename string) (delFlag bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("Failed to read file for posting: %s", err)
+		return
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		log.Errorf("Failed to process article file: %s", err)
+		// If we can't process it, it'll never get posted.
+		delFlag = true
+		return
+	}
+	// Expired articles are marked for deletion.
+	delFlag, err = s.poolExpired(filename, msg.Header)
+	if delFlag || err != nil {
+		return
+	}
+	return s.postMessage(filename, msg)
+}
+
+// postMessage filters and posts an article read from filename.
+func (s *Server) postMessage(filename string, msg *mail.Message) (delFlag bool, err error) {
+	if msg.Header.Get("Newsgroups") == "" {
+		err = fmt.Errorf("%s: No Newsgroups header in article", filename)
+		delFlag = true
+		return
+	}
+	from := s.parseFrom(msg.Header)
+	filter, err := s.headerFilter()
+	if err != nil {
+		return
+	}
+	msg.Header = filterNews(msg.Header)
+	filter.apply(msg.Header)
+	d, err := s.disclaimer()
+	if err != nil {
+		return
+	}
+	err = d.apply(msg)
+	if err != nil {
+		return
+	}
+	msg.Header["Date"] = []string{time.Now().Format(rfc5322date)}
+	msg.Header["Message-Id"] = []string{s.messageID()}
+	msg.Header["From"] = from
+	if s.cfg.News.NNTPServer == "" {
+		msg.Header["To"] = []string{s.cfg.News.Mail2News}
+		var payload []byte
+		payload, err = s.dkimSign(assemble(*msg))
+		if err != nil {
+			return
+		}
+		err = s.sendMail(payload, []string{s.cfg.News.Mail2News})
+		return
+	}
+	err = s.postNNTP(assemble(*msg))
+	return
+}
+
+// postNNTP posts an article to the configured NNTP server.  As with mail
+// transports, 5xx replies are permanent failures.
+func (s *Server) postNNTP(article []byte) (err error) {
+	conn, err := net.DialTimeout("tcp", s.cfg.News.NNTPServer, nntpTimeout)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(nntpTimeout))
+	t := textproto.NewConn(conn)
+	defer t.Close()
+	// 200 = Posting allowed.  201 = Posting prohibited.
+	_, _, err = t.ReadCodeLine(200)
+	if err != nil {
+		return
+	}
+	if s.cfg.News.Username != "" {
+		_, err = nntpCmd(t, 381, "AUTHINFO USER %s", s.cfg.News.Username)
+		if err != nil {
+			return
+		}
+		_, err = nntpCmd(t, 281, "AUTHINFO PASS %s", s.cfg.News.Password)
+		if err != nil {
+			return
+		}
+	}
+	_, err = nntpCmd(t, 340, "POST")
+	if err != nil {
+		return
+	}
+	// The DotWriter converts line endings to CRLF and dot-stuffs lines
+	w := t.DotWriter()
+	_, err = w.Write(article)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	_, _, err = t.ReadCodeLine(240)
+	if err != nil {
+		// 441 = Posting failed.  Other codes (E.g. 5xx) are permanent.
+		err = classifyReply(err)
+		return
+	}
+	// The article has been accepted so a failed QUIT isn't an error
+	nntpCmd(t, 205, "QUIT")
+	return
+}
+
+// nntpCmd sends an NNTP command and returns the response message.  An error
+// is returned if the response code isn't expectCode.
+func nntpCmd(t *textproto.Conn, expectCode int, format string, args ...any) (msg string, err error) {
+	id, err := t.Cmd(format, args...)
+	if err != nil {
+		return
+	}
+	t.StartResponse(id)
+	defer t.EndResponse(id)
+	_, msg, err = t.ReadCodeLine(expectCode)
+	if err != nil {
+		err = classifyReply(fmt.Errorf("NNTP %s: %w", strings.Fields(format)[0], err))
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/crooks/yamn/linebreaker"
+	"github.com/dchest/blake2s"
+)
+
+const base64LineWrap = 64
+
+// wrap64 writes a byte payload as wrapped base64 to an io.writer
+func wrap64(writer io.Writer, b []byte, wrap int) {
+	breaker := linebreaker.NewLineBreaker(writer, wrap)
+	b64 := base64.NewEncoder(base64.StdEncoding, breaker)
+	b64.Write(b)
+	b64.Close()
+	breaker.Close()
+}
+
+// Armor converts a plain-byte Yamn message to a Base64 armored message with
+// cutmarks and header fields.  The version is advertised in the
+// Remailer-Type field.
+func Armor(w io.Writer, payload []byte, version string) (err error) {
+	_, err = FormatOf(len(payload))
+	if err != nil {
+		return
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("::\n")
+	bw.WriteString(fmt.Sprintf("Remailer-Type: yamn-%s\n\n", version))
+	bw.WriteString("-----BEGIN REMAILER MESSAGE-----\n")
+	// Write message length
+	bw.WriteString(strconv.Itoa(len(payload)) + "\n")
+	digest, _ := blake2s.New(nil)
+	digest.Write(payload)
+	// Write message digest
+	bw.WriteString(hex.EncodeToString(digest.Sum(nil)) + "\n")
+	// Write the payload to the base64 wrapper
+	wrap64(bw, payload, base64LineWrap)
+	bw.WriteString("\n-----END REMAILER MESSAGE-----\n")
+	return bw.Flush()
+}
+
+// Armored is a dearmored message, along with the length and digest stated
+// in its armor.  The stated values are unverified until Validate is called.
+type Armored struct {
+	StatedLen int
+	Digest    []byte
+	Payload   []byte
+}
+
+// StripArmor takes a Mixmaster formatted message from an ioreader and
+// returns its payload as a byte slice
+func StripArmor(reader io.Reader) (payload []byte, err error) {
+	a, err := ReadArmor(reader)
+	if err != nil {
+		return
+	}
+	err = a.Validate()
+	if err != nil {
+		return
+	}
+	payload = a.Payload
+	return
+}
+
+// ReadArmor takes a Mixmaster formatted message from an ioreader and returns
+// its payload and stated values without validating them.
+func ReadArmor(reader io.Reader) (a *Armored, err error) {
+	scanner := bufio.NewScanner(reader)
+	scanPhase := 0
+	b64 := new(bytes.Buffer)
+	a = new(Armored)
+	/* Scan phases are:
+	0	Expecting ::
+	1 Expecting Begin cutmarks
+	2 Expecting size
+	3	Expecting hash
+	4 In payload and checking for End cutmark
+	5 Got End cutmark
+	*/
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch scanPhase {
+		case 0:
+			// Expecting ::\n
+			if line == "::" {
+				scanPhase = 1
+				continue
+			}
+		case 1:
+			// Expecting Begin cutmarks
+			if line == "-----BEGIN REMAILER MESSAGE-----" {
+				scanPhase = 2
+			}
+		case 2:
+			// Expecting size
+			a.StatedLen, err = strconv.Atoi(line)
+			if err != nil {
+				err = fmt.Errorf("unable to extract payload size from %s", line)
+				return
+			}
+			scanPhase = 3
+		case 3:
+			if len(line) != 64 {
+				err = fmt.Errorf("expected 64 digit Hex encoded Hash, got %d bytes", len(line))
+				return
+			}
+			a.Digest, err = hex.DecodeString(line)
+			if err != nil {
+				err = errors.New("unable to decode Hex hash on payload")
+				return
+			}
+			scanPhase = 4
+		case 4:
+			if line == "-----END REMAILER MESSAGE-----" {
+				scanPhase = 5
+				break
+			}
+			b64.WriteString(line)
+		} // End of switch
+	} // End of file scan
+	switch scanPhase {
+	case 0:
+		err = errors.New("no :: found on message")
+		return
+	case 1:
+		err = errors.New("no Begin cutmarks found on message")
+		return
+	case 4:
+		err = errors.New("no End cutmarks found on message")
+		return
+	}
+	payload := make([]byte, base64.StdEncoding.DecodedLen(b64.Len()))
+	payloadLen, err := base64.StdEncoding.Decode(payload, b64.Bytes())
+	if err != nil {
+		return
+	}
+	// Tuncate payload to the number of decoded bytes
+	a.Payload = payload[0:payloadLen]
+	return
+}
+
+// Validate checks the payload against its stated length, the packet format
+// and its stated digest.
+func (a *Armored) Validate() (err error) {
+	// Validate payload length against stated length.
+	if a.StatedLen != len(a.Payload) {
+		err = fmt.Errorf("payload size doesn't match stated size. Stated=%d, Got=%d", a.StatedLen, len(a.Payload))
+		return
+	}
+	// Validate payload length against packet format.
+	_, err = FormatOf(len(a.Payload))
+	if err != nil {
+		return
+	}
+	digest, _ := blake2s.New(nil)
+	digest.Write(a.Payload)
+	if !bytes.Equal(digest.Sum(nil), a.Digest) {
+		err = errors.New("incorrect payload digest during dearmor")
+		return
+	}
+	return
+}
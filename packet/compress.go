@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Compression
+The plain text of a message may be compressed before it's split into chunks.
+The Compression byte in the Final Hop header of every chunk records the
+algorithm used.
+0=None, 1=Deflate (RFC1951), 2=Zstandard (RFC8878)
+*/
+
+const (
+	// CompressNone indicates an uncompressed body
+	CompressNone = 0
+	// CompressDeflate indicates a raw Deflate body
+	CompressDeflate = 1
+	// CompressZstd indicates a Zstandard body
+	CompressZstd = 2
+	// MaxDecompressedBytes is the largest message that can be sent without
+	// compression.  Compressed messages may not expand beyond it.
+	MaxDecompressedBytes = MaxChunks * BodyBytes
+	// MaxExpansion is the largest ratio of decompressed to compressed size
+	// accepted by Exit remailers.
+	MaxExpansion = 20
+)
+
+// DecompressLimit returns the largest permitted decompressed size of a message
+// comprising numChunks chunks.
+func DecompressLimit(numChunks int) int {
+	return min(numChunks*BodyBytes*MaxExpansion, MaxDecompressedBytes)
+}
+
+// validCompression returns an error if n isn't a known compression method.
+func validCompression(n int) error {
+	if n != CompressNone && n != CompressDeflate && n != CompressZstd {
+		return fmt.Errorf("%w: unknown compression method %d", ErrRange, n)
+	}
+	return nil
+}
+
+// Compress returns plain compressed using the specified method.
+func Compress(method int, plain []byte) (b []byte, err error) {
+	err = validCompression(method)
+	if err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch method {
+	case CompressNone:
+		b = plain
+		return
+	case CompressDeflate:
+		w, err = flate.NewWriter(buf, flate.BestCompression)
+	case CompressZstd:
+		w, err = zstd.NewWriter(
+			buf,
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+			zstd.WithEncoderConcurrency(1),
+		)
+	}
+	if err != nil {
+		return
+	}
+	_, err = w.Write(plain)
+	if err != nil {
+		w.Close()
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	b = buf.Bytes()
+	return
+}
+
+// Decompress expands a body compressed using the specified method.  An error
+// is returned if the result would exceed limit bytes.
+func Decompress(method int, compressed []byte, limit int) (plain []byte, err error) {
+	buf := new(bytes.Buffer)
+	_, err = decompressTo(buf, method, bytes.NewReader(compressed), limit)
+	if err != nil {
+		return
+	}
+	plain = buf.Bytes()
+	return
+}
+
+// decompressTo writes the expansion of r, compressed using the specified
+// method, to w.  An error is returned if the result would exceed limit
+// bytes, in which case a partial expansion may have been written.
+func decompressTo(w io.Writer, method int, r io.Reader, limit int) (n int64, err error) {
+	err = validCompression(method)
+	if err != nil {
+		return
+	}
+	switch method {
+	case CompressDeflate:
+		fr := flate.NewReader(r)
+		defer fr.Close()
+		r = fr
+	case CompressZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(
+			r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(limit)),
+		)
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		r = zr
+	}
+	// Copy one byte more than the limit to detect oversized bodies
+	n, err = io.Copy(w, io.LimitReader(r, int64(limit)+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		// The Zstandard frame declares a size beyond the limit
+		err = fmt.Errorf("%w: %w", ErrRange, err)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if n > int64(limit) {
+		err = fmt.Errorf(
+			"%w: decompressed body exceeds maximum (%d bytes)",
+			ErrRange,
+			limit,
+		)
+	}
+	return
+}
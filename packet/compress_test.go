@@ -0,0 +1,59 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	plain := []byte(strings.Repeat("Hello World! ", 1000))
+	for _, method := range []int{CompressNone, CompressDeflate, CompressZstd} {
+		compressed, err := Compress(method, plain)
+		errTest(err)
+		if method != CompressNone && len(compressed) >= len(plain) {
+			t.Errorf("Method %d: compression didn't reduce size", method)
+		}
+		decompressed, err := Decompress(method, compressed, len(plain))
+		errTest(err)
+		if !bytes.Equal(decompressed, plain) {
+			t.Errorf("Method %d: decompression mismatch", method)
+		}
+		// Expansion beyond the limit must fail
+		_, err = Decompress(method, compressed, len(plain)-1)
+		if !errors.Is(err, ErrRange) {
+			t.Errorf("Method %d: Expected ErrRange, got: %v", method, err)
+		}
+	}
+	if _, err := Compress(3, plain); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	if DecompressLimit(1) != BodyBytes*MaxExpansion {
+		t.Errorf("Unexpected single chunk limit: %d", DecompressLimit(1))
+	}
+	if DecompressLimit(MaxChunks) != MaxDecompressedBytes {
+		t.Errorf("Unexpected limit: %d", DecompressLimit(MaxChunks))
+	}
+}
+
+func TestFinalCompression(t *testing.T) {
+	f := NewSlotFinal()
+	errTest(f.SetBodyBytes(100))
+	errTest(f.SetCompression(CompressZstd))
+	b, err := f.Encode()
+	errTest(err)
+	decoded, err := DecodeFinal(b)
+	errTest(err)
+	if decoded.Compression() != CompressZstd {
+		t.Fatalf("Expected compression %d, got %d", CompressZstd, decoded.Compression())
+	}
+	// Unknown algorithms are rejected
+	b[39] = 9
+	if _, err = DecodeFinal(b); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
@@ -1,7 +1,7 @@
 // aesgcm provides authenticated symmetric encryption using AES-GCM. It
 // generates random nonces for each message, and prepends the nonce to
 // the ciphertext.
-package main
+package packet
 
 import (
 	"crypto/aes"
@@ -0,0 +1,188 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/dchest/blake2s"
+)
+
+// Fuzz targets for the decoders that handle attacker-controlled bytes.  The
+// seed corpus is built from valid encodings so that mutations explore the
+// fields beyond the initial length checks.  Run with, for example:
+//
+//	go test ./packet -fuzz FuzzDecodeSlotData
+
+// seedSlotData returns encoded Slot Data for each packet version and type.
+func seedSlotData(t testing.TB) (seeds [][]byte) {
+	inter := NewSlotIntermediate()
+	errTest(inter.SetPartialIV(crandom.Randbytes(12)))
+	errTest(inter.SetNextHop("hop@remailer.invalid"))
+	interBytes, err := inter.Encode()
+	errTest(err)
+	errTest(inter.SetDelay(time.Hour))
+	delayBytes, err := inter.Encode()
+	errTest(err)
+	final := NewSlotFinal()
+	errTest(final.SetBodyBytes(100))
+	finalBytes, err := final.Encode()
+	errTest(err)
+	finalV6, err := final.EncodeVersion(Version6)
+	errTest(err)
+	for _, s := range []struct {
+		version int
+		exit    bool
+		info    []byte
+	}{
+		{Version2, false, interBytes},
+		{Version2, true, finalBytes},
+		{Version4, false, delayBytes},
+		{Version5, false, delayBytes},
+		{Version5, true, finalBytes},
+		{Version6, true, finalV6},
+	} {
+		slotData := NewSlotData()
+		errTest(slotData.SetVersion(s.version))
+		if s.exit {
+			slotData.SetExit()
+		}
+		errTest(slotData.SetAesKey(crandom.Randbytes(32)))
+		errTest(slotData.SetPacketInfo(s.info))
+		errTest(slotData.SetTagHash(crandom.Randbytes(32)))
+		var b []byte
+		b, err = slotData.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+	return
+}
+
+func FuzzStripArmor(f *testing.F) {
+	// Complete messages are too large to fuzz efficiently so the seed is
+	// well formed armor around a short payload.
+	payload := crandom.Randbytes(48)
+	digest := blake2s.Sum256(payload)
+	f.Add([]byte(fmt.Sprintf(
+		"::\nRemailer-Type: yamn-fuzz\n\n"+
+			"-----BEGIN REMAILER MESSAGE-----\n%d\n%x\n%s\n"+
+			"-----END REMAILER MESSAGE-----\n",
+		len(payload),
+		digest,
+		base64.StdEncoding.EncodeToString(payload),
+	)))
+	f.Add([]byte("::\n-----BEGIN REMAILER MESSAGE-----\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		payload, err := StripArmor(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// A validated payload must be a decodable message
+		if _, err = NewDecMessage(payload); err != nil {
+			t.Fatalf("StripArmor accepted an invalid payload: %s", err)
+		}
+	})
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	pk, sk := eccGenerate()
+	kemPK, kemSK := kemGenerate()
+	slotData := seedSlotData(f)[0]
+	for _, hybrid := range []bool{false, true} {
+		inHead := NewEncodeHeader()
+		errTest(inHead.SetRecipient(make([]byte, 16), pk))
+		if hybrid {
+			errTest(inHead.SetKEMRecipient(kemPK))
+		}
+		header, err := inHead.Encode(slotData)
+		errTest(err)
+		f.Add(header)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, err := NewDecodeHeader(b)
+		if err != nil {
+			return
+		}
+		h.RecipientKeyID()
+		errTest(h.SetRecipientSK(sk))
+		if h.Hybrid() {
+			errTest(h.SetRecipientKEM(kemSK))
+		}
+		data, _, err := h.Decode()
+		if err != nil {
+			return
+		}
+		DecodeSlotData(data)
+		h.MACKey()
+	})
+}
+
+func FuzzDecodeSlotData(f *testing.F) {
+	for _, seed := range seedSlotData(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		slotData, err := DecodeSlotData(b)
+		if err != nil {
+			return
+		}
+		slotData.AgeTimestamp()
+		switch slotData.PacketType() {
+		case PacketTypeIntermediate:
+			DecodeIntermediate(slotData.PacketInfo())
+		case PacketTypeExit:
+			DecodeFinalVersion(slotData.PacketInfo(), slotData.Version())
+		}
+	})
+}
+
+func FuzzDecodeFinal(f *testing.F) {
+	final := NewSlotFinal()
+	errTest(final.SetBodyBytes(BodyBytes))
+	for _, version := range []int{Version2, Version6} {
+		b, err := final.EncodeVersion(version)
+		errTest(err)
+		f.Add(b, version)
+	}
+	f.Fuzz(func(t *testing.T, b []byte, version int) {
+		final, err := DecodeFinalVersion(b, version)
+		if err != nil {
+			return
+		}
+		if final.BodyBytes() > BodyBytes || final.ChunkNum() > final.NumChunks() {
+			t.Fatalf(
+				"Out of range SlotFinal accepted: body=%d, chunk %d of %d",
+				final.BodyBytes(),
+				final.ChunkNum(),
+				final.NumChunks(),
+			)
+		}
+		final.Expand(bytes.Repeat([]byte{0}, final.BodyBytes()))
+	})
+}
+
+func FuzzDecodeIntermediate(f *testing.F) {
+	inter := NewSlotIntermediate()
+	errTest(inter.SetPartialIV(crandom.Randbytes(12)))
+	errTest(inter.SetNextHop("hop@remailer.invalid"))
+	b, err := inter.Encode()
+	errTest(err)
+	f.Add(b)
+	errTest(inter.SetDelay(time.Hour))
+	b, err = inter.Encode()
+	errTest(err)
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		inter, err := DecodeIntermediate(b)
+		if err != nil {
+			return
+		}
+		inter.NextHop()
+		inter.Delay()
+	})
+}
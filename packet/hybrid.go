@@ -0,0 +1,182 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/mlkem"
+
+	"github.com/dchest/blake2s"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+/*
+Hybrid Slot Header Format
+[ Recipient key ID	 16 Bytes ]
+[ Sender Public key	 32 Bytes ]
+[ ML-KEM ciphertext	1088 Bytes ]
+[ Xsalsa20 Nonce	 24 Bytes ]
+[ Encrypted header	176 Bytes ] (160 + Overhead)
+[ Random padding	  8 Bytes ]
+Total	1344 Bytes
+
+The Encrypted header is sealed with secretbox using a key derived from both
+the X25519 and ML-KEM-768 shared secrets:
+	Blake2s(ML-KEM secret || X25519 secret || ML-KEM ciphertext || Sender PK)
+An adversary must therefore break both algorithms to recover the header.
+Only the size of the header slots differs from classic packets.  Slot Data
+and everything below it is identical.
+*/
+
+const (
+	HybridHeaderBytes  = 1344 // An entire hybrid header slot
+	HybridHeadersBytes = HybridHeaderBytes * MaxChainLength
+	HybridMessageBytes = HybridHeadersBytes + BodyBytes
+	// KEMPublicKeyBytes is the length of an ML-KEM-768 encapsulation key
+	KEMPublicKeyBytes = mlkem.EncapsulationKeySize768
+	// KEMSecretKeyBytes is the length of an ML-KEM-768 decapsulation key
+	// in its seed form.
+	KEMSecretKeyBytes  = mlkem.SeedSize
+	kemCiphertextBytes = mlkem.CiphertextSize768
+)
+
+// Format identifies the header encryption of a packet and, with it, the size
+// of its header slots.
+type Format int
+
+const (
+	// FormatClassic headers are NaCl box encrypted to a Curve25519 key
+	FormatClassic Format = iota
+	// FormatHybrid headers combine X25519 with ML-KEM-768
+	FormatHybrid
+)
+
+// HeaderBytes returns the size of a single header slot.
+func (f Format) HeaderBytes() int {
+	if f == FormatHybrid {
+		return HybridHeaderBytes
+	}
+	return HeaderBytes
+}
+
+// HeadersBytes returns the size of the entire header stack.
+func (f Format) HeadersBytes() int {
+	return f.HeaderBytes() * MaxChainLength
+}
+
+// MessageBytes returns the size of a complete packet.
+func (f Format) MessageBytes() int {
+	return f.HeadersBytes() + BodyBytes
+}
+
+// FormatOf returns the packet Format that corresponds to a payload length.
+func FormatOf(length int) (Format, error) {
+	switch length {
+	case MessageBytes:
+		return FormatClassic, nil
+	case HybridMessageBytes:
+		return FormatHybrid, nil
+	}
+	return FormatClassic, lenCheck("message", length, MessageBytes)
+}
+
+// GenerateKEMKey returns a new ML-KEM-768 encapsulation key and the seed form
+// of its decapsulation key.
+func GenerateKEMKey() (pk, sk []byte, err error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return
+	}
+	pk = dk.EncapsulationKey().Bytes()
+	sk = dk.Bytes()
+	return
+}
+
+// KEMPublicKey derives the encapsulation key from the seed form of an
+// ML-KEM-768 decapsulation key.
+func KEMPublicKey(sk []byte) (pk []byte, err error) {
+	dk, err := mlkem.NewDecapsulationKey768(sk)
+	if err != nil {
+		return
+	}
+	pk = dk.EncapsulationKey().Bytes()
+	return
+}
+
+// hybridKey derives the secretbox key for a hybrid header.
+func hybridKey(kemShared, naclShared, ciphertext, senderPK []byte) (key [32]byte) {
+	digest, _ := blake2s.New(nil)
+	digest.Write(kemShared)
+	digest.Write(naclShared)
+	digest.Write(ciphertext)
+	digest.Write(senderPK)
+	copy(key[:], digest.Sum(nil))
+	return
+}
+
+// SetKEMRecipient defines the ML-KEM-768 encapsulation key of the recipient.
+// Once defined, Encode produces hybrid header slots.  SetRecipient must also
+// be called.
+func (h *EncodeHeader) SetKEMRecipient(recipientKEM []byte) (err error) {
+	h.recipientKEM, err = mlkem.NewEncapsulationKey768(recipientKEM)
+	return
+}
+
+// encodeHybrid returns a hybrid header slot containing encHead.  The header
+// must have been prepared.
+func (h *EncodeHeader) encodeHybrid(encHead []byte) (header []byte, err error) {
+	var nonce [24]byte
+	copy(nonce[:], h.src.Randbytes(24))
+	buf := new(bytes.Buffer)
+	buf.Write(h.recipientKeyID)
+	buf.Write(h.senderPK[:])
+	buf.Write(h.kemCiphertext)
+	buf.Write(nonce[:])
+	buf.Write(secretbox.Seal(nil, encHead, &nonce, &h.shared))
+	err = lenCheck("sealed header", buf.Len(), HybridHeaderBytes-8)
+	if err != nil {
+		return
+	}
+	buf.Write(h.src.Randbytes(HybridHeaderBytes - buf.Len()))
+	header = buf.Bytes()
+	return
+}
+
+// Hybrid returns true if the header slot is in the hybrid format.
+func (h *DecodeHeader) Hybrid() bool {
+	return len(h.header) == HybridHeaderBytes
+}
+
+// SetRecipientKEM defines the ML-KEM-768 decapsulation key (in seed form)
+// used to decrypt hybrid headers.
+func (h *DecodeHeader) SetRecipientKEM(recipientKEM []byte) (err error) {
+	h.recipientKEM, err = mlkem.NewDecapsulationKey768(recipientKEM)
+	return
+}
+
+// decodeHybrid decrypts a hybrid header and returns its Slot Data bytes.
+func (h *DecodeHeader) decodeHybrid() (data []byte, err error) {
+	if h.recipientKEM == nil {
+		err = ErrNoRecipient
+		return
+	}
+	var senderPK [32]byte
+	copy(senderPK[:], h.header[16:48])
+	ciphertext := h.header[48 : 48+kemCiphertextBytes]
+	var nonce [24]byte
+	copy(nonce[:], h.header[1136:1160])
+	kemShared, err := h.recipientKEM.Decapsulate(ciphertext)
+	if err != nil {
+		return
+	}
+	var naclShared [32]byte
+	box.Precompute(&naclShared, &senderPK, &h.recipientSK)
+	key := hybridKey(kemShared, naclShared[:], ciphertext, senderPK[:])
+	data, auth := secretbox.Open(nil, h.header[1160:1336], &nonce, &key)
+	if !auth {
+		err = ErrAuth
+		return
+	}
+	h.shared = key
+	h.gotShared = true
+	return
+}
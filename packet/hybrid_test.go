@@ -0,0 +1,198 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+func kemGenerate() (pk, sk []byte) {
+	pk, sk, err := GenerateKEMKey()
+	errTest(err)
+	return
+}
+
+func TestHybridHeader(t *testing.T) {
+	pk, sk := eccGenerate()
+	kemPK, kemSK := kemGenerate()
+	inHead := NewEncodeHeader()
+	errTest(inHead.SetRecipient(make([]byte, 16), pk))
+	errTest(inHead.SetKEMRecipient(kemPK))
+	inPlain := crandom.Randbytes(EncHeadBytes)
+	inPlain[0] = Version2
+	header, err := inHead.Encode(inPlain)
+	errTest(err)
+	if len(header) != HybridHeaderBytes {
+		t.Fatalf("Expected %d byte header, got %d", HybridHeaderBytes, len(header))
+	}
+	outHead, err := NewDecodeHeader(header)
+	errTest(err)
+	if !outHead.Hybrid() {
+		t.Fatal("Header not recognised as hybrid")
+	}
+	errTest(outHead.SetRecipientSK(sk))
+	// The X25519 key alone is insufficient
+	if _, _, err = outHead.Decode(); !errors.Is(err, ErrNoRecipient) {
+		t.Fatalf("Expected ErrNoRecipient, got: %v", err)
+	}
+	_, wrongKEM := kemGenerate()
+	errTest(outHead.SetRecipientKEM(wrongKEM))
+	if _, _, err = outHead.Decode(); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Expected ErrAuth, got: %v", err)
+	}
+	errTest(outHead.SetRecipientKEM(kemSK))
+	outPlain, version, err := outHead.Decode()
+	errTest(err)
+	if version != Version2 {
+		t.Fatalf("Expected version 2, got %d", version)
+	}
+	if !bytes.Equal(inPlain, outPlain) {
+		t.Fatal("Hybrid header encode/decode mismatch")
+	}
+	// The ML-KEM key alone is also insufficient
+	_, wrongSK := eccGenerate()
+	errTest(outHead.SetRecipientSK(wrongSK))
+	if _, _, err = outHead.Decode(); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Expected ErrAuth, got: %v", err)
+	}
+}
+
+func TestKEMPublicKey(t *testing.T) {
+	pk, sk := kemGenerate()
+	if len(pk) != KEMPublicKeyBytes || len(sk) != KEMSecretKeyBytes {
+		t.Fatalf("Unexpected ML-KEM key lengths: pk=%d, sk=%d", len(pk), len(sk))
+	}
+	derived, err := KEMPublicKey(sk)
+	errTest(err)
+	if !bytes.Equal(pk, derived) {
+		t.Fatal("Derived ML-KEM public key mismatch")
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	tests := []struct {
+		length int
+		format Format
+	}{
+		{MessageBytes, FormatClassic},
+		{HybridMessageBytes, FormatHybrid},
+	}
+	for _, test := range tests {
+		format, err := FormatOf(test.length)
+		errTest(err)
+		if format != test.format {
+			t.Errorf("Length=%d: Expected=%d, Got=%d", test.length, test.format, format)
+		}
+		if format.MessageBytes() != test.length {
+			t.Errorf("Format %d: MessageBytes=%d", format, format.MessageBytes())
+		}
+	}
+	var lerr *LengthError
+	if _, err := FormatOf(MessageBytes + 1); !errors.As(err, &lerr) {
+		t.Fatalf("Expected LengthError, got: %v", err)
+	}
+}
+
+func TestHybridMultiHop(t *testing.T) {
+	encPlain := []byte("Hello World!")
+	m := NewFormatEncMessage(FormatHybrid)
+	errTest(m.SetChainLength(2))
+	_, err := m.SetPlainText(encPlain)
+	errTest(err)
+	exitPK, exitSK := eccGenerate()
+	exitKEMPK, exitKEMSK := kemGenerate()
+	interPK, interSK := eccGenerate()
+	interKEMPK, interKEMSK := kemGenerate()
+
+	// Exit hop
+	final := NewSlotFinal()
+	errTest(final.SetBodyBytes(len(encPlain)))
+	exitData := NewSlotData()
+	exitData.SetExit()
+	errTest(exitData.SetAesKey(crandom.Randbytes(32)))
+	finalBytes, err := final.Encode()
+	errTest(err)
+	errTest(exitData.SetPacketInfo(finalBytes))
+	errTest(m.EncryptBody(exitData.AesKey(), final.AesIV()))
+	m.ShiftHeaders()
+	errTest(m.Deterministic(0))
+	errTest(exitData.SetTagHash(m.AntiTag()))
+	exitDataBytes, err := exitData.Encode()
+	errTest(err)
+	exitHead := NewEncodeHeader()
+	errTest(exitHead.SetRecipient(make([]byte, 16), exitPK))
+	errTest(exitHead.SetKEMRecipient(exitKEMPK))
+	header, err := exitHead.Encode(exitDataBytes)
+	errTest(err)
+	errTest(m.InsertHeader(header))
+
+	// Intermediate hop
+	inter := NewSlotIntermediate()
+	partialIV, err := m.PartialIV(0)
+	errTest(err)
+	errTest(inter.SetPartialIV(partialIV))
+	errTest(inter.SetNextHop("exit@example.com"))
+	interData := NewSlotData()
+	key, err := m.Key(0)
+	errTest(err)
+	errTest(interData.SetAesKey(key))
+	interBytes, err := inter.Encode()
+	errTest(err)
+	errTest(interData.SetPacketInfo(interBytes))
+	errTest(m.EncryptAll(0))
+	m.ShiftHeaders()
+	errTest(m.Deterministic(1))
+	errTest(interData.SetTagHash(m.AntiTag()))
+	interDataBytes, err := interData.Encode()
+	errTest(err)
+	interHead := NewEncodeHeader()
+	errTest(interHead.SetRecipient(make([]byte, 16), interPK))
+	errTest(interHead.SetKEMRecipient(interKEMPK))
+	header, err = interHead.Encode(interDataBytes)
+	errTest(err)
+	errTest(m.InsertHeader(header))
+	if len(m.Payload()) != HybridMessageBytes {
+		t.Fatalf("Expected %d byte packet, got %d", HybridMessageBytes, len(m.Payload()))
+	}
+
+	// Decode the intermediate hop
+	d, err := NewDecMessage(m.Payload())
+	errTest(err)
+	if d.Format() != FormatHybrid {
+		t.Fatal("Packet not recognised as hybrid")
+	}
+	decode := func(sk, kemSK []byte) *SlotData {
+		h, err := NewDecodeHeader(d.Header())
+		errTest(err)
+		errTest(h.SetRecipientSK(sk))
+		errTest(h.SetRecipientKEM(kemSK))
+		b, _, err := h.Decode()
+		errTest(err)
+		data, err := DecodeSlotData(b)
+		errTest(err)
+		if !d.TestAntiTag(data.TagHash()) {
+			t.Fatal("Anti-tag digest mismatch")
+		}
+		return data
+	}
+	data := decode(interSK, interKEMSK)
+	decInter, err := DecodeIntermediate(data.PacketInfo())
+	errTest(err)
+	if decInter.NextHop() != "exit@example.com" {
+		t.Fatalf("Unexpected next hop: %s", decInter.NextHop())
+	}
+	d.ShiftHeaders()
+	errTest(d.DecryptAll(data.AesKey(), decInter.PartialIV()))
+
+	// Decode the exit hop
+	data = decode(exitSK, exitKEMSK)
+	decFinal, err := DecodeFinal(data.PacketInfo())
+	errTest(err)
+	body, err := d.DecryptBody(data.AesKey(), decFinal.AesIV(), decFinal.BodyBytes())
+	errTest(err)
+	if !bytes.Equal(body, encPlain) {
+		t.Fatalf("Body decode mismatch. In=%s, Out=%s", encPlain, body)
+	}
+}
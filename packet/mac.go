@@ -0,0 +1,82 @@
+package packet
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/dchest/blake2s"
+)
+
+/*
+Per-Hop MACs (Version 5)
+In Version 2 packets, each header contains an unkeyed Blake2s digest of the
+payload below it.  Version 5 replaces the digest with a MAC keyed by a secret
+only the sender and the hop can derive.  The key is derived from the secret
+that seals the header's Slot Data:
+	Classic:	NaCl precomputed X25519 key
+	Hybrid:		Blake2s(ML-KEM secret || X25519 secret || ...)
+	MAC key = Blake2s-MAC(key=shared secret, "yamn-hop-mac")
+	MAC = Blake2s-MAC(key=MAC key, headers below this one || body)
+As the sender determines the content of every subsequent header (including
+the deterministic ones), a hop can verify the entire packet as it will be
+seen.  Modification of any header or the body is detected by the next hop.
+*/
+
+// macLabel separates the MAC key from other uses of the shared secret
+const macLabel = "yamn-hop-mac"
+
+// macKey derives a MAC key from the shared secret of a header.
+func macKey(shared []byte) []byte {
+	digest := blake2s.NewMAC(32, shared)
+	digest.Write([]byte(macLabel))
+	return digest.Sum(nil)
+}
+
+// hopMAC returns the MAC of the payload below the top header slot.
+func hopMAC(key []byte, format Format, payload []byte) []byte {
+	digest := blake2s.NewMAC(32, key)
+	digest.Write(payload[format.HeaderBytes():])
+	return digest.Sum(nil)
+}
+
+// MACKey returns the key used to MAC a Version 5 header.  The same key is
+// derived by the recipient when it decodes the header.
+func (h *EncodeHeader) MACKey() (key []byte, err error) {
+	err = h.prepare()
+	if err != nil {
+		return
+	}
+	key = macKey(h.shared[:])
+	return
+}
+
+// MACKey returns the key used to verify a Version 5 header.  It's only
+// available after a successful Decode.
+func (h *DecodeHeader) MACKey() (key []byte, err error) {
+	if !h.gotShared {
+		err = fmt.Errorf("%w: header has not been decoded", ErrIncomplete)
+		return
+	}
+	key = macKey(h.shared[:])
+	return
+}
+
+// MAC returns a per-hop MAC of the entire header stack and body.  Like
+// AntiTag, it needs to be run after deterministic headers are appended but
+// before a new header is inserted.
+func (m *EncMessage) MAC(key []byte) (mac []byte, err error) {
+	err = lenCheck("mac key", len(key), 32)
+	if err != nil {
+		return
+	}
+	mac = hopMAC(key, m.format, m.payload)
+	return
+}
+
+// TestMAC verifies the per-hop MAC of the payload (less the top header slot).
+func (m *DecMessage) TestMAC(key, mac []byte) bool {
+	if len(key) != 32 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(mac, hopMAC(key, m.format, m.payload)) == 1
+}
@@ -0,0 +1,177 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+// encodeV5 returns a three hop, Version 5 packet in which every hop uses the
+// same keys.
+func encodeV5(t *testing.T, format Format, pk, kemPK, plain []byte) []byte {
+	m := NewFormatEncMessage(format)
+	errTest(m.SetChainLength(3))
+	length, err := m.SetPlainText(plain)
+	errTest(err)
+	newHeader := func() *EncodeHeader {
+		h := NewEncodeHeader()
+		errTest(h.SetRecipient(make([]byte, 16), pk))
+		if format == FormatHybrid {
+			errTest(h.SetKEMRecipient(kemPK))
+		}
+		return h
+	}
+	// Exit hop
+	final := NewSlotFinal()
+	errTest(final.SetBodyBytes(length))
+	data := NewSlotData()
+	data.SetExit()
+	errTest(data.SetVersion(Version5))
+	errTest(data.SetAesKey(crandom.Randbytes(32)))
+	finalBytes, err := final.Encode()
+	errTest(err)
+	errTest(data.SetPacketInfo(finalBytes))
+	errTest(m.EncryptBody(data.AesKey(), final.AesIV()))
+	m.ShiftHeaders()
+	errTest(m.Deterministic(0))
+	head := newHeader()
+	key, err := head.MACKey()
+	errTest(err)
+	mac, err := m.MAC(key)
+	errTest(err)
+	errTest(data.SetTagHash(mac))
+	dataBytes, err := data.Encode()
+	errTest(err)
+	header, err := head.Encode(dataBytes)
+	errTest(err)
+	errTest(m.InsertHeader(header))
+	// Intermediate hops
+	for interHop := 0; interHop < m.IntermediateHops(); interHop++ {
+		inter := NewSlotIntermediate()
+		partialIV, err := m.PartialIV(interHop)
+		errTest(err)
+		errTest(inter.SetPartialIV(partialIV))
+		errTest(inter.SetNextHop("fake@remailer.org"))
+		errTest(inter.SetDelay(0))
+		data = NewSlotData()
+		errTest(data.SetVersion(Version5))
+		aesKey, err := m.Key(interHop)
+		errTest(err)
+		errTest(data.SetAesKey(aesKey))
+		interBytes, err := inter.Encode()
+		errTest(err)
+		errTest(data.SetPacketInfo(interBytes))
+		errTest(m.EncryptAll(interHop))
+		m.ShiftHeaders()
+		errTest(m.Deterministic(interHop + 1))
+		head = newHeader()
+		key, err = head.MACKey()
+		errTest(err)
+		mac, err = m.MAC(key)
+		errTest(err)
+		errTest(data.SetTagHash(mac))
+		dataBytes, err = data.Encode()
+		errTest(err)
+		header, err = head.Encode(dataBytes)
+		errTest(err)
+		errTest(m.InsertHeader(header))
+	}
+	return m.Payload()
+}
+
+// decodeV5 decodes the top header of d and reports if its MAC is valid.
+func decodeV5(t *testing.T, d *DecMessage, sk, kemSK []byte) (*SlotData, bool) {
+	h, err := NewDecodeHeader(d.Header())
+	errTest(err)
+	errTest(h.SetRecipientSK(sk))
+	if h.Hybrid() {
+		errTest(h.SetRecipientKEM(kemSK))
+	}
+	b, version, err := h.Decode()
+	errTest(err)
+	if version != Version5 {
+		t.Fatalf("Expected version 5, got %d", version)
+	}
+	data, err := DecodeSlotData(b)
+	errTest(err)
+	key, err := h.MACKey()
+	errTest(err)
+	return data, d.TestMAC(key, data.TagHash())
+}
+
+func TestMACMultiHop(t *testing.T) {
+	plain := []byte("Hello World!")
+	pk, sk := eccGenerate()
+	kemPK, kemSK := kemGenerate()
+	for _, format := range []Format{FormatClassic, FormatHybrid} {
+		d, err := NewDecMessage(encodeV5(t, format, pk, kemPK, plain))
+		errTest(err)
+		for hop := 0; hop < 3; hop++ {
+			data, ok := decodeV5(t, d, sk, kemSK)
+			if !ok {
+				t.Fatalf("Format %d: MAC verification failed at hop %d", format, hop)
+			}
+			if data.PacketType() == PacketTypeExit {
+				final, err := DecodeFinal(data.PacketInfo())
+				errTest(err)
+				body, err := d.DecryptBody(data.AesKey(), final.AesIV(), final.BodyBytes())
+				errTest(err)
+				if !bytes.Equal(body, plain) {
+					t.Fatalf("Format %d: Body mismatch: %q", format, body)
+				}
+				break
+			}
+			inter, err := DecodeIntermediate(data.PacketInfo())
+			errTest(err)
+			if !inter.HasDelay() {
+				t.Fatal("Version 5 Intermediate has no delay")
+			}
+			d.ShiftHeaders()
+			errTest(d.DecryptAll(data.AesKey(), inter.PartialIV()))
+		}
+	}
+}
+
+func TestMACTagging(t *testing.T) {
+	plain := []byte("Hello World!")
+	pk, sk := eccGenerate()
+	kemPK, kemSK := kemGenerate()
+	payload := encodeV5(t, FormatClassic, pk, kemPK, plain)
+	// Tags on the body, a lower header or a padding header
+	offsets := []int{
+		HeadersBytes + 5,
+		HeaderBytes + 100,
+		HeadersBytes - 1,
+	}
+	for _, offset := range offsets {
+		tagged := append([]byte(nil), payload...)
+		tagged[offset] ^= 0x01
+		d, err := NewDecMessage(tagged)
+		errTest(err)
+		if _, ok := decodeV5(t, d, sk, kemSK); ok {
+			t.Errorf("Tag at offset %d was not detected", offset)
+		}
+	}
+	// A tag applied after the first hop is detected by the second
+	d, err := NewDecMessage(payload)
+	errTest(err)
+	data, ok := decodeV5(t, d, sk, kemSK)
+	if !ok {
+		t.Fatal("MAC verification failed at the first hop")
+	}
+	inter, err := DecodeIntermediate(data.PacketInfo())
+	errTest(err)
+	d.ShiftHeaders()
+	errTest(d.DecryptAll(data.AesKey(), inter.PartialIV()))
+	d.Payload()[HeadersBytes+5] ^= 0x01
+	if _, ok = decodeV5(t, d, sk, kemSK); ok {
+		t.Error("Tag between hops was not detected")
+	}
+	// A MAC key is only available once a header is decoded
+	h, err := NewDecodeHeader(payload[:HeaderBytes])
+	errTest(err)
+	if _, err = h.MACKey(); err == nil {
+		t.Error("Expected an error fetching the MAC key of an undecoded header")
+	}
+}
@@ -0,0 +1,1552 @@
+// Package packet implements encoding and decoding of YAMN packets.  It has no
+// knowledge of keyrings, configuration or delivery; callers supply keys and
+// addresses and receive errors for any malformed input.
+package packet
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/dchest/blake2s"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	MaxChainLength  = 10
+	HeaderBytes     = 256 // An entire header slot
+	EncHeadBytes    = 160 // The encrypted component of a header
+	EncDataBytes    = 64  // Exit / Intermediate header component
+	DelayDataBytes  = 68  // Intermediate header component with a delay
+	HeadersBytes    = HeaderBytes * MaxChainLength
+	EncHeadersBytes = HeadersBytes - HeaderBytes
+	BodyBytes       = 17920
+	MessageBytes    = HeadersBytes + BodyBytes
+)
+
+const (
+	// Version2 is the packet version of regular messages
+	Version2 = 2
+	// Version3 is the packet version of messages sent using a Reply Block
+	Version3 = 3
+	// Version4 is the packet version of Intermediate hops that carry a
+	// sender-specified delay (Stop-and-Go mixing)
+	Version4 = 4
+	// Version5 is the packet version of headers authenticated by a per-hop
+	// MAC rather than an anti-tag digest.  Intermediate hops also carry a
+	// delay.
+	Version5 = 5
+	// Version6 is the packet version of Exit hops whose Final Hop header
+	// carries 16-bit chunk counters.  In all other respects, it's
+	// identical to Version 5.
+	Version6 = 6
+)
+
+const (
+	// MaxClassicChunks is the largest number of chunks that can be
+	// described by a Version 2-5 Final Hop header.
+	MaxClassicChunks = 255
+	// MaxChunks is the largest number of chunks in any message.
+	MaxChunks = 65535
+)
+
+const (
+	// PacketTypeIntermediate identifies a header destined for a middle hop
+	PacketTypeIntermediate = 0
+	// PacketTypeExit identifies a header destined for the final hop
+	PacketTypeExit = 1
+)
+
+const (
+	// DeliverySMTP is the Delivery Method for regular email
+	DeliverySMTP = 0
+	// DeliveryReply is the Delivery Method for messages that should be
+	// delivered to the owner of a Reply Block
+	DeliveryReply = 1
+	// DeliveryNews is the Delivery Method for articles that should be
+	// posted to Usenet
+	DeliveryNews = 2
+	// DeliveryDummy is the Delivery Method for messages that should be
+	// discarded by the Exit
+	DeliveryDummy = 255
+)
+
+var (
+	// ErrNoRecipient is returned when a header is encoded or decoded
+	// before the recipient key has been defined.
+	ErrNoRecipient = errors.New("header recipient not defined")
+	// ErrAuth is returned when a header fails NaCl authentication.
+	ErrAuth = errors.New("authentication failed decrypting slot data")
+	// ErrIncomplete is returned when a component is encoded before all
+	// its compulsory fields are populated.
+	ErrIncomplete = errors.New("incomplete packet component")
+	// ErrRange is returned when a value falls outside the range permitted
+	// by the packet format.
+	ErrRange = errors.New("value out of range")
+)
+
+// LengthError reports a field that isn't the length the packet format
+// requires.
+type LengthError struct {
+	Field    string
+	Expected int
+	Got      int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf(
+		"incorrect %s length: Expected=%d, Got=%d",
+		e.Field,
+		e.Expected,
+		e.Got,
+	)
+}
+
+// VersionError reports a packet version this library cannot decode.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("cannot decode packet version %d", e.Version)
+}
+
+// lenCheck returns a LengthError if got differs from expected
+func lenCheck(field string, got, expected int) error {
+	if got != expected {
+		return &LengthError{Field: field, Expected: expected, Got: got}
+	}
+	return nil
+}
+
+// GenerateKey returns a new Curve25519 public/private key pair
+func GenerateKey() (pk, sk []byte, err error) {
+	return DefaultSource.GenerateKey()
+}
+
+/*
+Slot Header Format
+[ Recipient key ID	 16 Bytes ]
+[ Sender Public key	 32 Bytes ]
+[ Xsalsa20 Nonce	 24 Bytes ]
+[ Encrypted header	176 Bytes ] (160 + Overhead)
+[ Random padding	  8 Bytes ]
+Total	256 Bytes
+*/
+
+// EncodeHeader constructs a single header slot
+type EncodeHeader struct {
+	gotRecipient   bool
+	recipientKeyID []byte
+	recipientPK    [32]byte
+	recipientKEM   *mlkem.EncapsulationKey768 // Hybrid headers only
+	// The ephemeral key and shared secret are generated on first use and
+	// consumed by Encode.
+	prepared      bool
+	senderPK      *[32]byte
+	shared        [32]byte // Key used to seal the Slot Data
+	kemCiphertext []byte   // Hybrid headers only
+	src           *Source
+}
+
+// NewEncodeHeader returns an EncodeHeader without a defined recipient
+func NewEncodeHeader() *EncodeHeader {
+	return DefaultSource.NewEncodeHeader()
+}
+
+// NewEncodeHeader returns an EncodeHeader, without a defined recipient, that
+// draws its ephemeral keys, nonce and padding from s.
+func (s *Source) NewEncodeHeader() *EncodeHeader {
+	return &EncodeHeader{
+		gotRecipient:   false,
+		recipientKeyID: make([]byte, 16),
+		src:            s,
+	}
+}
+
+// SetRecipient defines the KeyID and Public Key the header will be
+// encrypted to.
+func (h *EncodeHeader) SetRecipient(recipientKeyID, recipientPK []byte) (err error) {
+	err = lenCheck("recipient keyid", len(recipientKeyID), 16)
+	if err != nil {
+		return
+	}
+	err = lenCheck("recipient public key", len(recipientPK), 32)
+	if err != nil {
+		return
+	}
+	// Copying from a slice to an array requires trickery ([:])
+	copy(h.recipientPK[:], recipientPK)
+	copy(h.recipientKeyID, recipientKeyID)
+	h.gotRecipient = true
+	return
+}
+
+// prepare generates the ephemeral sender key pair and derives the secret
+// shared with the recipient.  It's called by MACKey and Encode.
+func (h *EncodeHeader) prepare() (err error) {
+	if h.prepared {
+		return
+	}
+	if !h.gotRecipient {
+		err = ErrNoRecipient
+		return
+	}
+	senderPK, senderSK, err := box.GenerateKey(h.src.Rand)
+	if err != nil {
+		return
+	}
+	h.senderPK = senderPK
+	box.Precompute(&h.shared, &h.recipientPK, senderSK)
+	if h.recipientKEM != nil {
+		var kemShared []byte
+		kemShared, h.kemCiphertext = h.recipientKEM.Encapsulate()
+		h.shared = hybridKey(kemShared, h.shared[:], h.kemCiphertext, senderPK[:])
+	}
+	h.prepared = true
+	return
+}
+
+// Encode NaCl encrypts encHead (normally encoded Slot Data) and returns a
+// complete header slot.  If a KEM recipient has been defined, the slot is in
+// the hybrid format.
+func (h *EncodeHeader) Encode(encHead []byte) (header []byte, err error) {
+	// Test a recipient has been defined
+	if !h.gotRecipient {
+		err = ErrNoRecipient
+		return
+	}
+	// Test passed encHead is the correct length
+	err = lenCheck("encrypted header", len(encHead), EncHeadBytes)
+	if err != nil {
+		return
+	}
+	err = h.prepare()
+	if err != nil {
+		return
+	}
+	// Every header has a randomly generated sender PK & SK.  Once used,
+	// a new pair is required.
+	defer func() { h.prepared = false }()
+	if h.recipientKEM != nil {
+		return h.encodeHybrid(encHead)
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], h.src.Randbytes(24))
+	buf := new(bytes.Buffer)
+	buf.Write(h.recipientKeyID)
+	buf.Write(h.senderPK[:])
+	buf.Write(nonce[:])
+	buf.Write(box.SealAfterPrecomputation(nil, encHead, &nonce, &h.shared))
+	err = lenCheck("sealed header", buf.Len(), 248)
+	if err != nil {
+		return
+	}
+	buf.Write(h.src.Randbytes(HeaderBytes - buf.Len()))
+	header = buf.Bytes()
+	return
+}
+
+// DecodeHeader decrypts a single header slot
+type DecodeHeader struct {
+	header       []byte
+	gotRecipient bool
+	recipientSK  [32]byte
+	recipientKEM *mlkem.DecapsulationKey768 // Hybrid headers only
+	gotShared    bool
+	shared       [32]byte // Key used to open the Slot Data
+}
+
+// NewDecodeHeader returns a DecodeHeader populated with a copy of the header
+// slot b.  Both classic and hybrid header slots are accepted.
+func NewDecodeHeader(b []byte) (*DecodeHeader, error) {
+	if len(b) != HybridHeaderBytes {
+		err := lenCheck("header", len(b), HeaderBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h := new(DecodeHeader)
+	h.header = make([]byte, len(b))
+	copy(h.header, b)
+	h.gotRecipient = false
+	return h, nil
+}
+
+// RecipientKeyID returns the encoded keyid as a string.  This is required to
+// ascertain the Recipient Secret Key that will be passed to
+// "SetRecipientSK".
+func (h *DecodeHeader) RecipientKeyID() (keyid string) {
+	return hex.EncodeToString(h.header[0:16])
+}
+
+// SetRecipientSK defines the Secret Key that will be used to decrypt the
+// Encrypted Header component.
+func (h *DecodeHeader) SetRecipientSK(recipientSK []byte) (err error) {
+	err = lenCheck("recipient secret key", len(recipientSK), 32)
+	if err != nil {
+		return
+	}
+	copy(h.recipientSK[:], recipientSK)
+	h.gotRecipient = true
+	return
+}
+
+// Decode decrypts the header and returns the Slot Data bytes along with the
+// packet version they claim to be.
+func (h *DecodeHeader) Decode() (data []byte, version int, err error) {
+	if !h.gotRecipient {
+		err = ErrNoRecipient
+		return
+	}
+	if h.Hybrid() {
+		data, err = h.decodeHybrid()
+		if err != nil {
+			return
+		}
+		version = int(data[0])
+		return
+	}
+	// Length to decode should be lenEndBytes plus the NaCl Box overhead
+	var senderPK [32]byte
+	copy(senderPK[:], h.header[16:48])
+	var nonce [24]byte
+	copy(nonce[:], h.header[48:72])
+	var shared [32]byte
+	box.Precompute(&shared, &senderPK, &h.recipientSK)
+	data, auth := box.OpenAfterPrecomputation(
+		nil,
+		h.header[72:248],
+		&nonce,
+		&shared,
+	)
+	if !auth {
+		err = ErrAuth
+		return
+	}
+	h.shared = shared
+	h.gotShared = true
+	// Version number is the first byte of decrypted data
+	version = int(data[0])
+	return
+}
+
+/*
+Encrypted data
+[ Packet version	  1 Byte  ]
+[ Packet type ID	  1 Byte  ]
+[ Delivery protocol	  1 Byte  ]
+[ Packet ID		 16 Bytes ]
+[ AES-CTR key		 32 Bytes ]
+[ Timestamp		  2 Bytes ]
+[ Packet info		 64 Bytes ] (68 Bytes in Version 4-6 Intermediates)
+[ Anti-tag digest	 32 Bytes ] (Per-hop MAC in Version 5/6)
+[ Padding		 11 Bytes ] (7 Bytes in Version 4-6 Intermediates)
+Total	160 Bytes
+
+Packet Type: 0=Intermediate 1=Exit
+Delivery protocol: 0=SMTP
+*/
+
+// packetInfoBytes returns the length of the Packet Info for a packet version
+// and type
+func packetInfoBytes(version, packetType int) int {
+	if version == Version4 {
+		return DelayDataBytes
+	}
+	if version >= Version5 && packetType == PacketTypeIntermediate {
+		return DelayDataBytes
+	}
+	return EncDataBytes
+}
+
+// validVersion returns a VersionError if v isn't a known packet version.
+func validVersion(v int) error {
+	if v < Version2 || v > Version6 {
+		return &VersionError{Version: v}
+	}
+	return nil
+}
+
+// SlotData is the content of the NaCl encrypted component of a header
+type SlotData struct {
+	version       uint8
+	packetType    uint8
+	protocol      uint8
+	packetID      []byte
+	gotAesKey     bool   // Test if the AES Key has been defined
+	aesKey        []byte // Used for encrypting slots and body
+	timestamp     []byte
+	gotPacketInfo bool // Test if packetInfo has been defined
+	packetInfo    []byte
+	gotTagHash    bool // Test if Anti-tag hash has been defined
+	tagHash       []byte
+	src           *Source
+}
+
+// NewSlotData returns an Intermediate type SlotData with a random Packet ID
+// and a randomized timestamp.
+func NewSlotData() *SlotData {
+	return DefaultSource.NewSlotData()
+}
+
+// NewSlotData returns an Intermediate type SlotData with a Packet ID and
+// timestamp drawn from s.
+func (s *Source) NewSlotData() *SlotData {
+	// timestamp will contain the current days since Epoch
+	timestamp := make([]byte, 2)
+	ts := s.days()
+	// Add some randomness to the timestamp by subtracting 0-3 days
+	ts -= int64(s.Randbytes(1)[0] % 4)
+	binary.LittleEndian.PutUint16(timestamp, uint16(ts))
+	return &SlotData{
+		version:    Version2, // Default packet format is v2
+		packetType: PacketTypeIntermediate,
+		protocol:   0,
+		// packetID is random for intermediate hops but needs to be
+		// identical on multi-copy Exits.
+		packetID:      s.Randbytes(16),
+		gotAesKey:     false,
+		aesKey:        make([]byte, 32),
+		timestamp:     timestamp,
+		gotPacketInfo: false,
+		gotTagHash:    false,
+		tagHash:       make([]byte, 32),
+		src:           s,
+	}
+}
+
+// Version returns the packet version of the Slot Data.
+func (head *SlotData) Version() int {
+	return int(head.version)
+}
+
+// SetVersion overrides the default packet version (2).  It should be called
+// before SetPacketInfo as Version 4 has a larger Packet Info.
+func (head *SlotData) SetVersion(v int) (err error) {
+	err = validVersion(v)
+	if err != nil {
+		return
+	}
+	head.version = uint8(v)
+	return
+}
+
+// PacketID returns the Packet-ID from the Slot Data.
+func (head *SlotData) PacketID() []byte {
+	return head.packetID
+}
+
+// PacketType returns 0 for Intermediate hops and 1 for Exits.
+func (head *SlotData) PacketType() int {
+	return int(head.packetType)
+}
+
+// SetExit overrides the default Packet Type (0 = Intermediate) with an Exit
+// Packet Type (Exit = 1)
+func (head *SlotData) SetExit() {
+	head.packetType = PacketTypeExit
+}
+
+// AesKey returns the key used to decrypt the header stack and body.
+func (head *SlotData) AesKey() []byte {
+	return head.aesKey
+}
+
+// SetAesKey defines the AES key required to decode the header stack and body.
+// For Exit headers, this can be completely random, but for Intermediates, it
+// needs to be predetermined in order to calculate Anti-Tag hashes.
+func (head *SlotData) SetAesKey(key []byte) (err error) {
+	err = lenCheck("aes key", len(key), 32)
+	if err != nil {
+		return
+	}
+	copy(head.aesKey, key)
+	head.gotAesKey = true
+	return
+}
+
+// SetPacketID overrides the random ID defined in NewSlotData.  This ensures
+// that on multi-copy messages, the exit hops all have the same Packet ID.
+func (head *SlotData) SetPacketID(id []byte) (err error) {
+	err = lenCheck("packet id", len(id), 16)
+	if err != nil {
+		return
+	}
+	copy(head.packetID, id)
+	return
+}
+
+// SetTagHash defines the Anti-tag digest of the remaining payload.
+func (head *SlotData) SetTagHash(hash []byte) (err error) {
+	err = lenCheck("anti-tag hash", len(hash), 32)
+	if err != nil {
+		return
+	}
+	copy(head.tagHash, hash)
+	head.gotTagHash = true
+	return
+}
+
+// TagHash returns the Anti-tag digest.
+func (head *SlotData) TagHash() []byte {
+	return head.tagHash
+}
+
+// SetPacketInfo stores an encoded SlotFinal or SlotIntermediate.
+func (head *SlotData) SetPacketInfo(ei []byte) (err error) {
+	err = lenCheck(
+		"packet info",
+		len(ei),
+		packetInfoBytes(int(head.version), int(head.packetType)),
+	)
+	if err != nil {
+		return
+	}
+	head.gotPacketInfo = true
+	head.packetInfo = ei
+	return
+}
+
+// PacketInfo returns the encoded SlotFinal or SlotIntermediate.
+func (head *SlotData) PacketInfo() []byte {
+	return head.packetInfo
+}
+
+// SetTimestamp creates a two-Byte timestamp (in little Endian format) based on
+// the number of days since Epoch.
+func (head *SlotData) SetTimestamp() {
+	d := uint16(head.src.days())
+	binary.LittleEndian.PutUint16(head.timestamp, d)
+}
+
+// AgeTimestamp returns an integer of the timestamp's age in days.
+func (head *SlotData) AgeTimestamp() int {
+	now := int(head.src.days())
+	then := int(binary.LittleEndian.Uint16(head.timestamp))
+	return now - then
+}
+
+// Encode returns the byte representation of the Slot Data, ready to be
+// passed to EncodeHeader.Encode.
+func (head *SlotData) Encode() (b []byte, err error) {
+	if !head.gotAesKey {
+		err = fmt.Errorf("%w: aes key not defined", ErrIncomplete)
+		return
+	}
+	if !head.gotPacketInfo {
+		err = fmt.Errorf("%w: exit/intermediate not defined", ErrIncomplete)
+		return
+	}
+	if !head.gotTagHash {
+		err = fmt.Errorf("%w: anti-tag hash not defined", ErrIncomplete)
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(head.version)
+	buf.WriteByte(head.packetType)
+	buf.WriteByte(head.protocol)
+	buf.Write(head.packetID)
+	buf.Write(head.aesKey)
+	buf.Write(head.timestamp)
+	buf.Write(head.packetInfo)
+	buf.Write(head.tagHash)
+	err = lenCheck(
+		"slot data",
+		buf.Len(),
+		85+packetInfoBytes(int(head.version), int(head.packetType)),
+	)
+	if err != nil {
+		return
+	}
+	buf.WriteString(strings.Repeat("\x00", EncHeadBytes-buf.Len()))
+	b = buf.Bytes()
+	return
+}
+
+// DecodeSlotData converts the decrypted bytes of a header into SlotData.
+func DecodeSlotData(b []byte) (*SlotData, error) {
+	err := lenCheck("slot data", len(b), EncHeadBytes)
+	if err != nil {
+		return nil, err
+	}
+	// Test the correct libary is being employed for the packet version
+	version := int(b[0])
+	err = validVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	// The anti-tag digest follows the variable length Packet Info
+	tagStart := 53 + packetInfoBytes(version, int(b[1]))
+	return &SlotData{
+		version:       b[0],
+		packetType:    b[1],
+		protocol:      b[2],
+		packetID:      b[3:19],
+		gotAesKey:     true,
+		aesKey:        b[19:51],
+		timestamp:     b[51:53],
+		gotPacketInfo: true,
+		packetInfo:    b[53:tagStart],
+		gotTagHash:    true,
+		tagHash:       b[tagStart : tagStart+32],
+		src:           DefaultSource,
+	}, nil
+}
+
+/*
+Enyrypted Final
+[ AES-CTR IV		 16 Bytes ]
+[ Chunk num		  1 Byte  ]
+[ Num chunks		  1 Byte  ]
+[ Message ID		 16 Bytes ]
+[ Body length		  4 Bytes ]
+[ Delivery method	  1 Byte ]
+[ Compression		  1 Byte ]
+[ Padded		  1 Byte ]
+[ Padding		 23 Bytes ]
+Total	64 Bytes
+
+In Version 6, the Chunk num and Num chunks are each 2 Bytes (Little-Endian)
+and all subsequent fields are offset by 2 Bytes.  The Padding is 21 Bytes.
+
+Delivery methods: 0=SMTP, 1=Reply Block owner, 2=Usenet, 255=Dummy
+Compression: 0=None, 1=Deflate, 2=Zstandard (see compress.go)
+Padded: 0=No, 1=Yes (see padding.go)
+*/
+
+// SlotFinal is the Packet Info of an Exit hop
+type SlotFinal struct {
+	aesIV          []byte
+	chunkNum       uint16
+	numChunks      uint16
+	messageID      []byte
+	packetID       []byte // Not encoded but used in Slot Header on Exits
+	gotBodyBytes   bool
+	bodyBytes      int
+	deliveryMethod uint8
+	compression    uint8
+	padded         bool
+}
+
+// NewSlotFinal returns a single chunk, SMTP delivery SlotFinal
+func NewSlotFinal() *SlotFinal {
+	return DefaultSource.NewSlotFinal()
+}
+
+// NewSlotFinal returns a single chunk, SMTP delivery SlotFinal with an IV,
+// Message ID and Packet ID drawn from s.
+func (s *Source) NewSlotFinal() *SlotFinal {
+	return &SlotFinal{
+		aesIV:          s.Randbytes(16),
+		chunkNum:       1,
+		numChunks:      1,
+		messageID:      s.Randbytes(16),
+		packetID:       s.Randbytes(16),
+		gotBodyBytes:   false,
+		deliveryMethod: DeliverySMTP,
+	}
+}
+
+// BodyBytes returns the length of the plain body.
+func (f *SlotFinal) BodyBytes() int {
+	return f.bodyBytes
+}
+
+// SetBodyBytes defines the length of the plain body.
+func (f *SlotFinal) SetBodyBytes(length int) (err error) {
+	if length < 0 || length > BodyBytes {
+		err = fmt.Errorf(
+			"%w: body (%d bytes) exceeds maximum (%d bytes)",
+			ErrRange,
+			length,
+			BodyBytes,
+		)
+		return
+	}
+	f.bodyBytes = length
+	f.gotBodyBytes = true
+	return
+}
+
+// AesIV returns the IV used to encrypt the body.
+func (f *SlotFinal) AesIV() []byte {
+	return f.aesIV
+}
+
+// PacketID returns the packet ID that should be copied into the Slot Data
+// for Exit Hop messages.  When creating mutliple copies, the PacketID needs to
+// be common across all exit packets to prevent duplicate deliveries.
+func (f *SlotFinal) PacketID() []byte {
+	return f.packetID
+}
+
+// SetPacketID overrides the random packet ID.  Each chunk of a message
+// requires a unique packet ID, shared by all copies of the chunk.
+func (f *SlotFinal) SetPacketID(id []byte) (err error) {
+	err = lenCheck("packet id", len(id), 16)
+	if err != nil {
+		return
+	}
+	f.packetID = id
+	return
+}
+
+// NumChunks returns the total number of chunks in the message.
+func (f *SlotFinal) NumChunks() int {
+	return int(f.numChunks)
+}
+
+// SetNumChunks defines the total number of chunks in the message.
+func (f *SlotFinal) SetNumChunks(n int) (err error) {
+	if n < 1 || n > MaxChunks {
+		err = fmt.Errorf(
+			"%w: number of chunks (%d) must be 1-%d",
+			ErrRange,
+			n,
+			MaxChunks,
+		)
+		return
+	}
+	f.numChunks = uint16(n)
+	return
+}
+
+// MessageID returns the ID common to all chunks of a message.
+func (f *SlotFinal) MessageID() []byte {
+	return f.messageID
+}
+
+// SetDeliveryMethod overrides the default (SMTP) Delivery Method.
+func (f *SlotFinal) SetDeliveryMethod(n int) {
+	f.deliveryMethod = uint8(n)
+}
+
+// DeliveryMethod returns the Delivery Method.
+func (f *SlotFinal) DeliveryMethod() int {
+	return int(f.deliveryMethod)
+}
+
+// SetCompression defines the algorithm used to compress the message body
+// before it was split into chunks.
+func (f *SlotFinal) SetCompression(n int) (err error) {
+	err = validCompression(n)
+	if err != nil {
+		return
+	}
+	f.compression = uint8(n)
+	return
+}
+
+// Compression returns the algorithm used to compress the message body.
+func (f *SlotFinal) Compression() int {
+	return int(f.compression)
+}
+
+// SetPadded records that the message has been length padded.
+func (f *SlotFinal) SetPadded(padded bool) {
+	f.padded = padded
+}
+
+// Padded returns true if the message has been length padded.
+func (f *SlotFinal) Padded() bool {
+	return f.padded
+}
+
+// ChunkNum returns the sequence number of this chunk.
+func (f *SlotFinal) ChunkNum() int {
+	return int(f.chunkNum)
+}
+
+// SetChunkNum defines the sequence number of this chunk.
+func (f *SlotFinal) SetChunkNum(n int) (err error) {
+	if n < 1 || n > int(f.numChunks) {
+		err = fmt.Errorf(
+			"%w: chunk num (%d) must be 1-%d",
+			ErrRange,
+			n,
+			int(f.numChunks),
+		)
+		return
+	}
+	f.chunkNum = uint16(n)
+	return
+}
+
+// Encode returns the byte representation of the SlotFinal, ready to be
+// passed to SlotData.SetPacketInfo of a Version 2-5 header.
+func (f *SlotFinal) Encode() ([]byte, error) {
+	return f.EncodeVersion(Version2)
+}
+
+// EncodeVersion returns the byte representation of the SlotFinal for a
+// header of the specified packet version.  Messages of more than
+// MaxClassicChunks chunks can only be encoded as Version 6.
+func (f *SlotFinal) EncodeVersion(version int) (b []byte, err error) {
+	if !f.gotBodyBytes {
+		err = fmt.Errorf("%w: body length not defined", ErrIncomplete)
+		return
+	}
+	err = validVersion(version)
+	if err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(f.aesIV)
+	if version == Version6 {
+		tmp := make([]byte, 4)
+		binary.LittleEndian.PutUint16(tmp, f.chunkNum)
+		binary.LittleEndian.PutUint16(tmp[2:], f.numChunks)
+		buf.Write(tmp)
+	} else if f.numChunks > MaxClassicChunks {
+		err = fmt.Errorf(
+			"%w: %d chunks requires a Version %d header",
+			ErrRange,
+			f.numChunks,
+			Version6,
+		)
+		return
+	} else {
+		buf.WriteByte(uint8(f.chunkNum))
+		buf.WriteByte(uint8(f.numChunks))
+	}
+	buf.Write(f.messageID)
+	tmp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(tmp, uint32(f.bodyBytes))
+	buf.Write(tmp)
+	buf.WriteByte(f.deliveryMethod)
+	buf.WriteByte(f.compression)
+	if f.padded {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	err = lenCheck("slot final", buf.Len(), 41+finalChunkOffset(version))
+	if err != nil {
+		return
+	}
+	buf.WriteString(strings.Repeat("\x00", EncDataBytes-buf.Len()))
+	b = buf.Bytes()
+	return
+}
+
+// finalChunkOffset returns the number of additional bytes occupied by the
+// chunk counters of a SlotFinal in the specified packet version.
+func finalChunkOffset(version int) int {
+	if version == Version6 {
+		return 2
+	}
+	return 0
+}
+
+// DecodeFinal converts the Packet Info of a Version 2-5 Exit hop into a
+// SlotFinal.
+func DecodeFinal(b []byte) (*SlotFinal, error) {
+	return DecodeFinalVersion(b, Version2)
+}
+
+// DecodeFinalVersion converts the Packet Info of an Exit hop, with the
+// specified packet version, into a SlotFinal.  The body length and chunk
+// numbers are validated as they're used to index the payload.
+func DecodeFinalVersion(b []byte, version int) (*SlotFinal, error) {
+	err := lenCheck("packet info", len(b), EncDataBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = validVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	f := &SlotFinal{aesIV: b[:16]}
+	if version == Version6 {
+		f.chunkNum = binary.LittleEndian.Uint16(b[16:18])
+		f.numChunks = binary.LittleEndian.Uint16(b[18:20])
+	} else {
+		f.chunkNum = uint16(b[16])
+		f.numChunks = uint16(b[17])
+	}
+	// Offset the remaining fields by the size of the chunk counters
+	b = b[finalChunkOffset(version):]
+	f.messageID = b[18:34]
+	f.deliveryMethod = b[38]
+	f.compression = b[39]
+	f.padded = b[40] == 1
+	// Decode the length as a uint32 to prevent negative lengths on
+	// 32-bit platforms.
+	length := binary.LittleEndian.Uint32(b[34:38])
+	if length > BodyBytes {
+		return nil, fmt.Errorf(
+			"%w: body (%d bytes) exceeds maximum (%d bytes)",
+			ErrRange,
+			length,
+			BodyBytes,
+		)
+	}
+	f.bodyBytes = int(length)
+	f.gotBodyBytes = true
+	err = validCompression(f.Compression())
+	if err != nil {
+		return nil, err
+	}
+	if b[40] > 1 {
+		return nil, fmt.Errorf("%w: invalid padded flag %d", ErrRange, b[40])
+	}
+	if f.numChunks == 0 || f.chunkNum == 0 || f.chunkNum > f.numChunks {
+		return nil, fmt.Errorf(
+			"%w: invalid chunk %d of %d",
+			ErrRange,
+			f.chunkNum,
+			f.numChunks,
+		)
+	}
+	return f, nil
+}
+
+/* Encrypted Intermediate
+[ AES-CTR IV (Partial)	 12 Bytes ]
+[ Next hop address	 52 Bytes ]
+[ Delay (Version 4)	  4 Bytes ]
+[ Padding		  0 Bytes ]
+Total	64 Bytes (68 Bytes in Version 4)
+
+The Delay is the number of seconds (uint32, Little-Endian) the hop should hold
+the message before forwarding it.
+
+IVs are:
+[ 9 * Header slots		 ]
+[ 1 * Deterministic header	 ]
+[ 1 * Payload header		 ]
+*/
+
+// SlotIntermediate is the Packet Info of an Intermediate hop
+type SlotIntermediate struct {
+	gotAesIV12 bool
+	aesIV12    []byte
+	nextHop    []byte
+	gotDelay   bool   // Delays are only encoded in Version 4
+	delay      uint32 // Seconds to hold the message
+}
+
+// NewSlotIntermediate returns an empty SlotIntermediate
+func NewSlotIntermediate() *SlotIntermediate {
+	return &SlotIntermediate{
+		gotAesIV12: false,
+		aesIV12:    make([]byte, 12),
+		nextHop:    make([]byte, 52),
+	}
+}
+
+// SetPartialIV defines the 12 Byte partial IV used to decrypt the header
+// stack and body.
+func (s *SlotIntermediate) SetPartialIV(partialIV []byte) (err error) {
+	err = lenCheck("partial iv", len(partialIV), 12)
+	if err != nil {
+		return
+	}
+	s.gotAesIV12 = true
+	copy(s.aesIV12, partialIV)
+	return
+}
+
+// PartialIV returns the 12 Byte partial IV.
+func (s *SlotIntermediate) PartialIV() []byte {
+	return s.aesIV12
+}
+
+// seqIV constructs a complete 16 Byte IV from a partial 12 Byte IV + a 4 Byte
+// counter.  The caller is responsible for passing a 12 Byte partialIV.
+func seqIV(partialIV []byte, slot int) (iv []byte) {
+	iv = make([]byte, 16)
+	copy(iv[0:4], partialIV[0:4])
+	copy(iv[8:16], partialIV[4:12])
+	ctr := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ctr, uint32(slot))
+	copy(iv[4:8], ctr)
+	return
+}
+
+// SetNextHop inserts the name of the next hop remailer and pads it.
+func (s *SlotIntermediate) SetNextHop(nh string) (err error) {
+	if len(nh) > 52 {
+		err = fmt.Errorf("%w: next hop address exceeds 52 chars", ErrRange)
+		return
+	}
+	s.nextHop = []byte(nh + strings.Repeat("\x00", 52-len(nh)))
+	return
+}
+
+// SetDelay defines how long the hop should hold the message before forwarding
+// it.  Packet Info with a delay must be encoded in a Version 4 SlotData.
+func (s *SlotIntermediate) SetDelay(d time.Duration) (err error) {
+	secs := d / time.Second
+	if secs < 0 || secs > math.MaxUint32 {
+		err = fmt.Errorf("%w: delay (%s) out of range", ErrRange, d)
+		return
+	}
+	s.delay = uint32(secs)
+	s.gotDelay = true
+	return
+}
+
+// Delay returns how long the hop should hold the message.
+func (s *SlotIntermediate) Delay() time.Duration {
+	return time.Duration(s.delay) * time.Second
+}
+
+// HasDelay returns true if the Packet Info contains a delay.
+func (s *SlotIntermediate) HasDelay() bool {
+	return s.gotDelay
+}
+
+// NextHop returns the next hop remailer name after stripping any padding.
+func (s *SlotIntermediate) NextHop() string {
+	return strings.TrimRight(string(s.nextHop), "\x00")
+}
+
+// Encode returns the byte representation of the SlotIntermediate, ready to
+// be passed to SlotData.SetPacketInfo.
+func (s *SlotIntermediate) Encode() (b []byte, err error) {
+	if !s.gotAesIV12 {
+		err = fmt.Errorf("%w: partial iv not defined", ErrIncomplete)
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(s.aesIV12)
+	buf.Write(s.nextHop)
+	if s.gotDelay {
+		tmp := make([]byte, 4)
+		binary.LittleEndian.PutUint32(tmp, s.delay)
+		buf.Write(tmp)
+		err = lenCheck("slot intermediate", buf.Len(), DelayDataBytes)
+	} else {
+		err = lenCheck("slot intermediate", buf.Len(), EncDataBytes)
+	}
+	if err != nil {
+		return
+	}
+	b = buf.Bytes()
+	return
+}
+
+// DecodeIntermediate converts the Packet Info of an Intermediate hop into a
+// SlotIntermediate.  Version 4 Packet Info additionally contains a delay.
+func DecodeIntermediate(b []byte) (*SlotIntermediate, error) {
+	if len(b) == DelayDataBytes {
+		return &SlotIntermediate{
+			gotAesIV12: true,
+			aesIV12:    b[:12],
+			nextHop:    b[12:64],
+			gotDelay:   true,
+			delay:      binary.LittleEndian.Uint32(b[64:68]),
+		}, nil
+	}
+	err := lenCheck("packet info", len(b), EncDataBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &SlotIntermediate{
+		gotAesIV12: true,
+		aesIV12:    b[:12],
+		nextHop:    b[12:],
+	}, nil
+}
+
+// ----- Deterministic Headers -----
+
+// EncMessage provides client-side functionality for creating a new Yamn
+// message.
+type EncMessage struct {
+	format           Format // Classic or Hybrid headers
+	gotPayload       bool   // Test if a Payload has been submitted
+	payload          []byte // The actual Yamn message
+	plainLength      int    // Length of the plain-text bytes
+	keys             [MaxChainLength - 1][]byte
+	ivs              [MaxChainLength - 1][]byte
+	chainLength      int // Number of hops in chain
+	intermediateHops int // Number of Intermediate hops
+	padHeaders       int // Number of padding headers
+	padBytes         int // Total bytes of padding
+	src              *Source
+}
+
+// NewEncMessage creates a new EncMessage object with classic headers.
+func NewEncMessage() *EncMessage {
+	return NewFormatEncMessage(FormatClassic)
+}
+
+// NewFormatEncMessage creates a new EncMessage object.  The format determines
+// the size of the header slots, and must match the headers inserted.
+func NewFormatEncMessage(format Format) *EncMessage {
+	return DefaultSource.NewFormatEncMessage(format)
+}
+
+// NewFormatEncMessage creates a new EncMessage object that draws its padding,
+// keys and IVs from s.
+func (s *Source) NewFormatEncMessage(format Format) *EncMessage {
+	return &EncMessage{
+		format:      format,
+		gotPayload:  false,
+		payload:     make([]byte, format.MessageBytes()),
+		chainLength: 0,
+		src:         s,
+	}
+}
+
+// Format returns the packet format of the message.
+func (m *EncMessage) Format() Format {
+	return m.format
+}
+
+// Payload returns the raw payload bytes.  Currently no checks are performed
+// as to what state the payload is in when its requested.
+func (m *EncMessage) Payload() []byte {
+	return m.payload
+}
+
+// SetChainLength takes an integer containing the length of the chain being
+// encoded.  From this we can derive various settings, such as the number of
+// fake (padding) headers required.  It also initializes and populates an array
+// of AES keys and IVs used to encrypt the intermediate hops.  These have to be
+// predefined as they're required to create deterministic headers.
+func (m *EncMessage) SetChainLength(chainLength int) (err error) {
+	if chainLength > MaxChainLength {
+		err = fmt.Errorf(
+			"%w: specified chain length (%d) exceeds maximum chain length (%d)",
+			ErrRange,
+			chainLength,
+			MaxChainLength,
+		)
+		return
+	}
+	if chainLength <= 0 {
+		err = fmt.Errorf("%w: chain length cannot be negative or zero", ErrRange)
+		return
+	}
+	m.chainLength = chainLength
+	m.intermediateHops = chainLength - 1
+	m.padHeaders = MaxChainLength - m.chainLength
+	m.padBytes = m.padHeaders * m.format.HeaderBytes()
+	// The padding bytes need to be randomized, otherwise the final
+	// intermediate remailer in the chain can know its position due to the
+	// zero bytes below the decrypted exit header.  After this, the payload
+	// will contain nothing but padding.
+	copy(m.payload, m.src.Randbytes(m.padBytes))
+	// Generate keys and (partial) IVs for each hop
+	for n := 0; n < m.intermediateHops; n++ {
+		m.keys[n] = m.src.Randbytes(32)
+		m.ivs[n] = m.src.Randbytes(12)
+	}
+	return
+}
+
+// SetPlainText inserts the plain message content into the payload and returns
+// its length in Bytes
+func (m *EncMessage) SetPlainText(plain []byte) (plainLength int, err error) {
+	plainLength = len(plain)
+	if plainLength > BodyBytes {
+		err = fmt.Errorf(
+			"%w: payload (%d) exceeds max length (%d)",
+			ErrRange,
+			plainLength,
+			BodyBytes,
+		)
+		return
+	}
+	// Insert the plain bytes after the headers
+	copy(m.payload[m.format.HeadersBytes():], plain)
+	m.plainLength = plainLength
+	m.gotPayload = true
+	return
+}
+
+// IntermediateHops returns the number of intermediate hops in the chain.
+func (m *EncMessage) IntermediateHops() int {
+	return m.intermediateHops
+}
+
+// hopCheck returns an error if intermediateHop isn't a valid index into the
+// predetermined keys and IVs.
+func (m *EncMessage) hopCheck(intermediateHop int) error {
+	if m.chainLength == 0 {
+		return fmt.Errorf("%w: chain length is not defined", ErrIncomplete)
+	}
+	if intermediateHop < 0 || intermediateHop >= m.intermediateHops {
+		return fmt.Errorf(
+			"%w: requested hop (%d) exceeds intermediate hops (%d)",
+			ErrRange,
+			intermediateHop,
+			m.intermediateHops,
+		)
+	}
+	return nil
+}
+
+// getIV constructs a 16 Byte IV from an input of 12 random Bytes and a uint32
+// counter.  The format is arbitrary but needs to be predictable and consistent
+// between encrypt and decrypt operations.
+func (m *EncMessage) getIV(intermediateHop, slot int) (iv []byte) {
+	// IV format is: RRRRCCCCRRRRRRRR. Where R=Random and C=Counter
+	iv = make([]byte, 16)
+	copy(iv, seqIV(m.ivs[intermediateHop], slot))
+	return
+}
+
+// Key returns the predetermined AES key for a specific Hop in the Chain.
+func (m *EncMessage) Key(intermediateHop int) (key []byte, err error) {
+	err = m.hopCheck(intermediateHop)
+	if err != nil {
+		return
+	}
+	key = m.keys[intermediateHop]
+	return
+}
+
+// PartialIV returns the predetermined partial IV for a specific Hop.
+func (m *EncMessage) PartialIV(intermediateHop int) (ivPartial []byte, err error) {
+	/*
+		It should be noted that the 12 byte partial IV returned by this
+		function cannot be used directly to encrypt anything.  It needs
+		a 4 byte sequence number added to it in order to be usable.
+	*/
+	err = m.hopCheck(intermediateHop)
+	if err != nil {
+		return
+	}
+	ivPartial = m.ivs[intermediateHop]
+	return
+}
+
+// AntiTag returns a digest for the entire header stack.  It needs to be run
+// before a new header is inserted but after deterministic headers are appended
+// to the bottom of the header stack.
+func (m *EncMessage) AntiTag() []byte {
+	digest, _ := blake2s.New(nil)
+	digest.Write(m.payload[m.format.HeaderBytes():])
+	return digest.Sum(nil)
+}
+
+// AntiTagHeaders returns a digest of the header stack, excluding the top
+// header and the body.  It's used in place of AntiTag on Reply Blocks as the
+// body isn't known when the headers are encoded.
+func (m *EncMessage) AntiTagHeaders() []byte {
+	digest, _ := blake2s.New(nil)
+	digest.Write(m.payload[m.format.HeaderBytes():m.format.HeadersBytes()])
+	return digest.Sum(nil)
+}
+
+// EncryptBody encrypts the body with the provided key and IV.  This should
+// only be used for encryption of the Body during Exit-Hop encoding.  At other
+// times, EncryptAll should be used.
+func (m *EncMessage) EncryptBody(key, iv []byte) (err error) {
+	if !m.gotPayload {
+		err = fmt.Errorf("%w: cannot encrypt payload until it's defined", ErrIncomplete)
+		return
+	}
+	err = lenCheck("aes key", len(key), 32)
+	if err != nil {
+		return
+	}
+	err = lenCheck("aes iv", len(iv), 16)
+	if err != nil {
+		return
+	}
+
+	copy(
+		m.payload[m.format.HeadersBytes():],
+		aesCtr(
+			m.payload[m.format.HeadersBytes():],
+			key,
+			iv,
+		),
+	)
+	return
+}
+
+// EncryptAll encrypts each Header Slot in the message using a predetermined
+// AES Key and partial (12 byte) IV, plus a 4 byte sequence number base on the
+// Slot number.  Finally, the body is encrypted using the same key and partial
+// IV (with the next sequenced number).
+func (m *EncMessage) EncryptAll(hop int) (err error) {
+	// The same key is used for all these encrypt operations
+	key, err := m.Key(hop)
+	if err != nil {
+		return
+	}
+	var iv []byte
+	/*
+		* This should run before headers are shifted down *
+		For MaxChainLength = 10:-
+		IVs 0-8 are used to encrypt headers
+		IV 9 is used to encrypt the payload
+	*/
+	for slot := 0; slot < MaxChainLength; slot++ {
+		sbyte := slot * m.format.HeaderBytes()
+		ebyte := (slot + 1) * m.format.HeaderBytes()
+		iv = m.getIV(hop, slot)
+		copy(
+			m.payload[sbyte:ebyte],
+			aesCtr(m.payload[sbyte:ebyte], key, iv),
+		)
+	}
+	iv = m.getIV(hop, MaxChainLength)
+	copy(
+		m.payload[m.format.HeadersBytes():],
+		aesCtr(m.payload[m.format.HeadersBytes():], key, iv),
+	)
+	return
+}
+
+// ShiftHeaders moves the entire header stack down by one header slot.
+func (m *EncMessage) ShiftHeaders() {
+	// Find a point one header size up from the bottom of the header stack
+	bottomHeader := m.format.HeadersBytes() - m.format.HeaderBytes()
+	// Move the header stack down by one header slot
+	copy(m.payload[m.format.HeaderBytes():], m.payload[:bottomHeader])
+}
+
+// InsertHeader copies provided header bytes into the payload
+func (m *EncMessage) InsertHeader(header []byte) (err error) {
+	return m.InsertHeaderAt(0, header)
+}
+
+// InsertHeaderAt copies provided header bytes into the specified slot of the
+// header stack.
+func (m *EncMessage) InsertHeaderAt(slot int, header []byte) (err error) {
+	err = lenCheck("header", len(header), m.format.HeaderBytes())
+	if err != nil {
+		return
+	}
+	if slot < 0 || slot >= MaxChainLength {
+		err = fmt.Errorf("%w: header slot %d", ErrRange, slot)
+		return
+	}
+	copy(m.payload[slot*m.format.HeaderBytes():(slot+1)*m.format.HeaderBytes()], header)
+	return
+}
+
+// Deterministic inserts predetermined headers at the bottom of the stack.  As
+// the stack scrolls up during decryption, a blank header is inserted at the
+// bottom.  This is then decrypted along with all the real headers.  This
+// hellish function works out what those headers will contain at each phase of
+// the remailer decryption chain.
+func (m *EncMessage) Deterministic(hop int) (err error) {
+	if m.chainLength == 0 {
+		err = fmt.Errorf(
+			"%w: cannot generate deterministic headers until chain length has been specified",
+			ErrIncomplete,
+		)
+		return
+	}
+	// The final call to Deterministic (for the entry hop) has no headers
+	// to insert but is harmless.
+	if hop < 0 || hop > m.intermediateHops {
+		err = fmt.Errorf(
+			"%w: deterministic hop (%d) exceeds intermediate hops (%d)",
+			ErrRange,
+			hop,
+			m.intermediateHops,
+		)
+		return
+	}
+	// The top and bottom slots are the slots we're populating during this
+	// cycle.
+	bottomSlot := MaxChainLength - 1
+	topSlot := bottomSlot - (m.intermediateHops - hop - 1)
+	// Slot in this context is the slot the header will be placed in, on
+	// the current hop.  Not, the slot to encrypt from.
+	for slot := topSlot; slot <= bottomSlot; slot++ {
+		// right is the rightmost hop, from which to encrypt.
+		right := bottomSlot - slot + hop
+		useSlot := bottomSlot
+		fakeHead := make([]byte, m.format.HeaderBytes())
+		// Work back from the rightmost slot to the first intermediate
+		// header.
+		for interHop := right; interHop-hop >= 0; interHop-- {
+			key := m.keys[interHop]
+			iv := m.getIV(interHop, useSlot)
+			copy(fakeHead, aesCtr(fakeHead, key, iv))
+			useSlot--
+		}
+		// Actually insert the fiendish header into the message
+		sByte := slot * m.format.HeaderBytes()
+		eByte := sByte + m.format.HeaderBytes()
+		copy(m.payload[sByte:eByte], fakeHead)
+	}
+	return
+}
+
+// DebugPacket is only used for debugging purposes.  It outputs the first 20
+// bytes of each message component.  The last line output will be the first 20
+// bytes of the payload body.
+func (m *EncMessage) DebugPacket() {
+	debugPacket("Encrypt diagnostic", m.format, m.payload)
+}
+
+// DecMessage provides server-side functionality for decoding a Yamn message.
+type DecMessage struct {
+	format  Format // Classic or Hybrid headers
+	payload []byte // The actual Yamn message
+}
+
+// NewDecMessage creates a new DecMessage object and populates it with a copy
+// of the provided message bytes (assumed to be an encrypted message).  The
+// packet format is determined by the message length.
+func NewDecMessage(encPayload []byte) (*DecMessage, error) {
+	format, err := FormatOf(len(encPayload))
+	if err != nil {
+		return nil, err
+	}
+	dec := new(DecMessage)
+	dec.format = format
+	dec.payload = make([]byte, len(encPayload))
+	copy(dec.payload, encPayload)
+	return dec, nil
+}
+
+// Format returns the packet format of the message.
+func (m *DecMessage) Format() Format {
+	return m.format
+}
+
+// Header returns the top-most header
+func (m *DecMessage) Header() []byte {
+	return m.payload[:m.format.HeaderBytes()]
+}
+
+// HeaderAt returns the header in the specified slot of the header stack.
+func (m *DecMessage) HeaderAt(slot int) (header []byte, err error) {
+	if slot < 0 || slot >= MaxChainLength {
+		err = fmt.Errorf("%w: header slot %d", ErrRange, slot)
+		return
+	}
+	header = m.payload[slot*m.format.HeaderBytes() : (slot+1)*m.format.HeaderBytes()]
+	return
+}
+
+// Payload returns the entire payload as a byte slice
+func (m *DecMessage) Payload() []byte {
+	return m.payload
+}
+
+// ShiftHeaders moves the entire header stack up by one header slot and chops
+// off the top header.  The created slot at the bottom is initialized.
+func (m *DecMessage) ShiftHeaders() {
+	// Find a point one header size up from the bottom of the header stack
+	bottomHeader := m.format.HeadersBytes() - m.format.HeaderBytes()
+	// Move the header stack up by one header slot
+	copy(m.payload, m.payload[m.format.HeaderBytes():m.format.HeadersBytes()])
+	// Insert a new empty header at the bottom of the stack
+	copy(m.payload[bottomHeader:], make([]byte, m.format.HeaderBytes()))
+}
+
+// TestAntiTag creates a Blake2 hash of the entire payload (less the top
+// header slot) and compares it with the provided hash.  If the two collide, it
+// returns True.
+func (m *DecMessage) TestAntiTag(tag []byte) bool {
+	digest, _ := blake2s.New(nil)
+	digest.Write(m.payload[m.format.HeaderBytes():])
+	return bytes.Equal(tag, digest.Sum(nil))
+}
+
+// TestHeaderTag is the Reply Block equivalent of TestAntiTag.  Only the
+// header stack (less the top header) is included in the digest.
+func (m *DecMessage) TestHeaderTag(tag []byte) bool {
+	digest, _ := blake2s.New(nil)
+	digest.Write(m.payload[m.format.HeaderBytes():m.format.HeadersBytes()])
+	return bytes.Equal(tag, digest.Sum(nil))
+}
+
+// DecryptBody decrypts the body with the provided key and IV.  This function
+// should only be called during exit decryption.  At other times, DecryptAll
+// should be used.
+func (m *DecMessage) DecryptBody(key, iv []byte, length int) (body []byte, err error) {
+	err = lenCheck("aes key", len(key), 32)
+	if err != nil {
+		return
+	}
+	err = lenCheck("aes iv", len(iv), 16)
+	if err != nil {
+		return
+	}
+	if length < 0 || length > BodyBytes {
+		err = fmt.Errorf(
+			"%w: body (%d bytes) exceeds maximum (%d bytes)",
+			ErrRange,
+			length,
+			BodyBytes,
+		)
+		return
+	}
+
+	copy(
+		m.payload[m.format.HeadersBytes():],
+		aesCtr(
+			m.payload[m.format.HeadersBytes():],
+			key,
+			iv,
+		),
+	)
+	body = m.payload[m.format.HeadersBytes() : m.format.HeadersBytes()+length]
+	return
+}
+
+// DecryptAll decrypts each header in turn using a supplied key and partial
+// IV.  It also decrypts the body using the same key and last IV in the
+// sequence.
+func (m *DecMessage) DecryptAll(key, partialIV []byte) (err error) {
+	err = lenCheck("aes key", len(key), 32)
+	if err != nil {
+		return
+	}
+	err = lenCheck("partial iv", len(partialIV), 12)
+	if err != nil {
+		return
+	}
+	var iv []byte
+	for slot := 0; slot < MaxChainLength; slot++ {
+		sbyte := slot * m.format.HeaderBytes()
+		ebyte := (slot + 1) * m.format.HeaderBytes()
+		iv = seqIV(partialIV, slot)
+		copy(
+			m.payload[sbyte:ebyte],
+			aesCtr(m.payload[sbyte:ebyte], key, iv),
+		)
+	}
+	// IVs from 0 to MaxChainLength-1 have been used for the headers.  The
+	// next IV in sequence (MaxChainLength) is used to decrypt the body.
+	iv = seqIV(partialIV, MaxChainLength)
+	copy(
+		m.payload[m.format.HeadersBytes():],
+		aesCtr(m.payload[m.format.HeadersBytes():], key, iv),
+	)
+	return
+}
+
+// DebugPacket is only used for debugging purposes.  It outputs the first 20
+// bytes of each message component.  The last line output will be the first 20
+// bytes of the payload body.
+func (m *DecMessage) DebugPacket() {
+	debugPacket("Decrypt diagnostic", m.format, m.payload)
+}
+
+func debugPacket(title string, format Format, payload []byte) {
+	fmt.Println(title)
+	for slot := 0; slot <= MaxChainLength; slot++ {
+		sbyte := slot * format.HeaderBytes()
+		ebyte := sbyte + 20
+		fmt.Printf(
+			"%05d-%05d: %x %02d\n",
+			sbyte,
+			ebyte,
+			payload[sbyte:ebyte],
+			slot,
+		)
+	}
+}
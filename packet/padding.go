@@ -0,0 +1,135 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+Length Padding
+Padded messages are prefixed with their true length and filled with random
+bytes so that every chunk has the same body length.  Padding is applied to the
+complete message, after any compression, before it's split into chunks.
+[ True length		  4 Bytes ] (Little-Endian)
+[ Message		  n Bytes ]
+[ Random padding	  p Bytes ]
+*/
+
+// PadOverhead is the number of bytes added to a padded message, in addition
+// to the random padding.
+const PadOverhead = 4
+
+// Pad returns plain prefixed with its length and padded with random bytes to
+// size bytes.
+func Pad(plain []byte, size int) ([]byte, error) {
+	return DefaultSource.Pad(plain, size)
+}
+
+// Pad returns plain prefixed with its length and padded with bytes drawn from
+// s to size bytes.
+func (s *Source) Pad(plain []byte, size int) (padded []byte, err error) {
+	if len(plain)+PadOverhead > size {
+		err = fmt.Errorf(
+			"%w: message (%d bytes) exceeds padded size (%d bytes)",
+			ErrRange,
+			len(plain),
+			size-PadOverhead,
+		)
+		return
+	}
+	padded = make([]byte, PadOverhead, size)
+	binary.LittleEndian.PutUint32(padded, uint32(len(plain)))
+	padded = append(padded, plain...)
+	padded = append(padded, s.Randbytes(size-len(padded))...)
+	return
+}
+
+// Unpad returns the true message from a padded one.
+func Unpad(padded []byte) (plain []byte, err error) {
+	if len(padded) < PadOverhead {
+		err = lenCheck("padded message", len(padded), PadOverhead)
+		return
+	}
+	length := binary.LittleEndian.Uint32(padded)
+	if uint64(length) > uint64(len(padded)-PadOverhead) {
+		err = fmt.Errorf(
+			"%w: true length (%d bytes) exceeds padded message (%d bytes)",
+			ErrRange,
+			length,
+			len(padded)-PadOverhead,
+		)
+		return
+	}
+	plain = padded[PadOverhead : PadOverhead+int(length)]
+	return
+}
+
+// unpadReader returns a Reader of the true message in a padded one.
+func unpadReader(padded io.Reader) (io.Reader, error) {
+	prefix := make([]byte, PadOverhead)
+	_, err := io.ReadFull(padded, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("%w: padded message is truncated", ErrRange)
+	}
+	return &exactReader{r: padded, n: int64(binary.LittleEndian.Uint32(prefix))}, nil
+}
+
+// exactReader reads exactly n bytes from r.  Unlike an io.LimitReader, it
+// returns an error if r is exhausted before n bytes have been read.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (n int, err error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err = e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		err = fmt.Errorf(
+			"%w: true length exceeds padded message by %d bytes",
+			ErrRange,
+			e.n,
+		)
+	}
+	return
+}
+
+// Expand reverses the padding and compression recorded in the SlotFinal.
+// body is the complete (assembled) message.
+func (f *SlotFinal) Expand(body []byte) (plain []byte, err error) {
+	buf := new(bytes.Buffer)
+	_, err = f.ExpandTo(buf, bytes.NewReader(body), DecompressLimit(f.NumChunks()))
+	if err != nil {
+		return
+	}
+	plain = buf.Bytes()
+	return
+}
+
+// ExpandTo writes the expansion of body, a complete message read in chunk
+// order, to w.  This avoids holding large messages in memory.  An error is
+// returned if the expanded message would exceed limit bytes or the
+// decompression limit for its number of chunks.
+func (f *SlotFinal) ExpandTo(w io.Writer, body io.Reader, limit int) (n int64, err error) {
+	if f.Padded() {
+		body, err = unpadReader(body)
+		if err != nil {
+			return
+		}
+	}
+	n, err = decompressTo(
+		w,
+		f.Compression(),
+		body,
+		min(limit, DecompressLimit(f.NumChunks())),
+	)
+	return
+}
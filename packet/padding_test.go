@@ -0,0 +1,78 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	plain := []byte("Hello World")
+	padded, err := Pad(plain, 1000)
+	errTest(err)
+	if len(padded) != 1000 {
+		t.Fatalf("Expected 1000 bytes, got %d", len(padded))
+	}
+	unpadded, err := Unpad(padded)
+	errTest(err)
+	if !bytes.Equal(unpadded, plain) {
+		t.Fatalf("Unpad mismatch: %q", unpadded)
+	}
+	if _, err = Pad(plain, len(plain)+PadOverhead-1); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+	// A hostile length must not index beyond the message
+	binary.LittleEndian.PutUint32(padded, 997)
+	if _, err = Unpad(padded); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+	var lerr *LengthError
+	if _, err = Unpad(padded[:3]); !errors.As(err, &lerr) {
+		t.Fatalf("Expected LengthError, got: %v", err)
+	}
+}
+
+func TestFinalPadded(t *testing.T) {
+	f := NewSlotFinal()
+	errTest(f.SetBodyBytes(100))
+	f.SetPadded(true)
+	b, err := f.Encode()
+	errTest(err)
+	decoded, err := DecodeFinal(b)
+	errTest(err)
+	if !decoded.Padded() {
+		t.Fatal("Padded flag not decoded")
+	}
+	b[40] = 2
+	if _, err = DecodeFinal(b); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
+
+func TestExpandTo(t *testing.T) {
+	f := NewSlotFinal()
+	f.SetPadded(true)
+	plain := []byte("Hello World")
+	padded, err := Pad(plain, 100)
+	errTest(err)
+	buf := new(bytes.Buffer)
+	n, err := f.ExpandTo(buf, bytes.NewReader(padded), 100)
+	errTest(err)
+	if n != int64(len(plain)) || !bytes.Equal(buf.Bytes(), plain) {
+		t.Fatalf("ExpandTo mismatch: %q", buf.Bytes())
+	}
+	// The caller's limit is enforced
+	if _, err = f.ExpandTo(io.Discard, bytes.NewReader(padded), 10); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+	// A hostile length must not read beyond the message
+	binary.LittleEndian.PutUint32(padded, 97)
+	if _, err = f.ExpandTo(io.Discard, bytes.NewReader(padded), 100); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+	if _, err = f.ExpandTo(io.Discard, bytes.NewReader(padded[:3]), 100); !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
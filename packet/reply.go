@@ -0,0 +1,263 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+Reply Blocks (SURBs) and v3 packets
+
+A Reply Block is a header stack, encoded by its owner, that routes a message
+back to the owner without revealing the owner's address to the sender or to
+the intermediate remailers.  Headers are encoded exactly as for v2 packets
+except:-
+
+  - The Slot Data version is 3.
+  - Anti-tag digests cover only the header stack (less the top header), as the
+    body is unknown when the Reply Block is created.
+  - The Exit hop has a Delivery Method of 1 (Reply Block owner) and the
+    Message ID in its SlotFinal identifies the Reply Block.
+  - The header slot immediately below the Exit header contains a SlotOwner,
+    NaCl encrypted to the Exit remailer.  Chains are therefore limited to
+    MaxChainLength - 1 hops.
+
+Reply Block format
+[ Entry remailer address  52 Bytes ]
+[ Body AES-CTR key        32 Bytes ]
+[ Header stack          2560 Bytes ]
+Total	2644 Bytes
+
+The sender encrypts the body with the Reply Block key, using a random IV
+that precedes it, and injects it, behind the header stack, to the entry
+remailer.  A fresh IV means a Reply Block used more than once never reuses
+its keystream.  Each intermediate remailer applies
+its AES-CTR layer to the body in the usual way.  The Exit remailer delivers
+the still-encrypted packet to the owner, who holds the keys necessary to
+remove every layer.  The Exit never decrypts the body.
+
+Reply body (after all hop layers are removed)
+[ AES-CTR IV	 16 Bytes ]
+[ Plain length	  4 Bytes ] Encrypted with the Reply Block key
+[ Plain text	  <= 17900 Bytes ]
+[ Random padding ]
+Total	17920 Bytes
+*/
+
+const (
+	// ReplyBlockBytes is the length of an encoded Reply Block
+	ReplyBlockBytes = 52 + 32 + HeadersBytes
+	// MaxReplyLength is the largest plain text that fits in a reply body
+	MaxReplyLength = BodyBytes - replyIVBytes - 4
+	// replyIVBytes is the length of the IV that precedes a reply body
+	replyIVBytes = 16
+)
+
+/*
+Encrypted Owner
+[ Packet version	  1 Byte  ]
+[ Owner address		128 Bytes ]
+[ Padding		 31 Bytes ]
+Total	160 Bytes
+*/
+
+// SlotOwner contains the address a Reply Block delivers to
+type SlotOwner struct {
+	address []byte
+}
+
+// NewSlotOwner returns an empty SlotOwner
+func NewSlotOwner() *SlotOwner {
+	return &SlotOwner{
+		address: make([]byte, 128),
+	}
+}
+
+// SetAddress inserts the email address of the Reply Block owner and pads it.
+func (o *SlotOwner) SetAddress(addy string) (err error) {
+	if len(addy) == 0 || len(addy) > 128 {
+		err = fmt.Errorf("%w: owner address must be 1-128 chars", ErrRange)
+		return
+	}
+	o.address = []byte(addy + strings.Repeat("\x00", 128-len(addy)))
+	return
+}
+
+// Address returns the owner's email address after stripping any padding.
+func (o *SlotOwner) Address() string {
+	return strings.TrimRight(string(o.address), "\x00")
+}
+
+// Encode returns the byte representation of the SlotOwner, ready to be
+// passed to EncodeHeader.Encode.
+func (o *SlotOwner) Encode() (b []byte, err error) {
+	if o.Address() == "" {
+		err = fmt.Errorf("%w: owner address not defined", ErrIncomplete)
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(Version3)
+	buf.Write(o.address)
+	buf.WriteString(strings.Repeat("\x00", EncHeadBytes-buf.Len()))
+	b = buf.Bytes()
+	return
+}
+
+// DecodeOwner converts a decrypted owner header into a SlotOwner.
+func DecodeOwner(b []byte) (*SlotOwner, error) {
+	err := lenCheck("slot owner", len(b), EncHeadBytes)
+	if err != nil {
+		return nil, err
+	}
+	if int(b[0]) != Version3 {
+		return nil, &VersionError{Version: int(b[0])}
+	}
+	o := &SlotOwner{address: b[1:129]}
+	if o.Address() == "" {
+		return nil, fmt.Errorf("%w: owner address not defined", ErrIncomplete)
+	}
+	return o, nil
+}
+
+// ReplyBlock is the public component of a Reply Block.  It's given to
+// anyone who should be able to send a reply.
+type ReplyBlock struct {
+	EntryHop string // Address of the first remailer in the chain
+	Key      []byte // Body encryption key
+	Headers  []byte // Encoded header stack
+}
+
+// Encode returns the byte representation of a Reply Block
+func (r *ReplyBlock) Encode() (b []byte, err error) {
+	if len(r.EntryHop) > 52 {
+		err = fmt.Errorf("%w: entry hop address exceeds 52 chars", ErrRange)
+		return
+	}
+	err = lenCheck("reply block key", len(r.Key), 32)
+	if err != nil {
+		return
+	}
+	err = lenCheck("reply block headers", len(r.Headers), HeadersBytes)
+	if err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(r.EntryHop)
+	buf.WriteString(strings.Repeat("\x00", 52-len(r.EntryHop)))
+	buf.Write(r.Key)
+	buf.Write(r.Headers)
+	b = buf.Bytes()
+	return
+}
+
+// DecodeReplyBlock converts the byte representation of a Reply Block into a
+// ReplyBlock.
+func DecodeReplyBlock(b []byte) (*ReplyBlock, error) {
+	err := lenCheck("reply block", len(b), ReplyBlockBytes)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReplyBlock{
+		EntryHop: strings.TrimRight(string(b[:52]), "\x00"),
+		Key:      make([]byte, 32),
+		Headers:  make([]byte, HeadersBytes),
+	}
+	if r.EntryHop == "" {
+		return nil, fmt.Errorf("%w: entry hop not defined", ErrIncomplete)
+	}
+	copy(r.Key, b[52:84])
+	copy(r.Headers, b[84:])
+	return r, nil
+}
+
+// Message encrypts plain using the Reply Block and returns a complete packet,
+// ready to be armored and sent to EntryHop.
+func (r *ReplyBlock) Message(plain []byte) (payload []byte, err error) {
+	return DefaultSource.ReplyMessage(r, plain)
+}
+
+// ReplyMessage is ReplyBlock.Message with the IV and padding drawn from s.
+func (s *Source) ReplyMessage(r *ReplyBlock, plain []byte) (payload []byte, err error) {
+	err = lenCheck("reply block key", len(r.Key), 32)
+	if err != nil {
+		return
+	}
+	err = lenCheck("reply block headers", len(r.Headers), HeadersBytes)
+	if err != nil {
+		return
+	}
+	if len(plain) > MaxReplyLength {
+		err = fmt.Errorf(
+			"%w: reply (%d bytes) exceeds max length (%d bytes)",
+			ErrRange,
+			len(plain),
+			MaxReplyLength,
+		)
+		return
+	}
+	iv := s.Randbytes(replyIVBytes)
+	body := s.Randbytes(BodyBytes - replyIVBytes)
+	binary.LittleEndian.PutUint32(body, uint32(len(plain)))
+	copy(body[4:], plain)
+	payload = make([]byte, MessageBytes)
+	copy(payload, r.Headers)
+	copy(payload[HeadersBytes:], iv)
+	copy(payload[HeadersBytes+replyIVBytes:], aesCtr(body, r.Key, iv))
+	return
+}
+
+// ReplySecret is the private component of a Reply Block.  It's retained by
+// the owner and used to decrypt replies.
+type ReplySecret struct {
+	ID         []byte   // Matches the Message ID of the Exit hop
+	Key        []byte   // Body encryption key
+	Keys       [][]byte // AES keys of the intermediate hops
+	PartialIVs [][]byte // Partial IVs of the intermediate hops
+}
+
+// Decrypt removes every layer of encryption from a reply body and returns
+// the plain text.
+func (r *ReplySecret) Decrypt(body []byte) (plain []byte, err error) {
+	err = lenCheck("reply body", len(body), BodyBytes)
+	if err != nil {
+		return
+	}
+	err = lenCheck("reply block key", len(r.Key), 32)
+	if err != nil {
+		return
+	}
+	if len(r.Keys) != len(r.PartialIVs) {
+		err = fmt.Errorf("%w: reply secret keys and ivs differ", ErrIncomplete)
+		return
+	}
+	plain = make([]byte, BodyBytes)
+	copy(plain, body)
+	for n := range r.Keys {
+		err = lenCheck("aes key", len(r.Keys[n]), 32)
+		if err != nil {
+			return
+		}
+		err = lenCheck("partial iv", len(r.PartialIVs[n]), 12)
+		if err != nil {
+			return
+		}
+		iv := seqIV(r.PartialIVs[n], MaxChainLength)
+		plain = aesCtr(plain, r.Keys[n], iv)
+	}
+	plain = aesCtr(plain[replyIVBytes:], r.Key, plain[:replyIVBytes])
+	length := binary.LittleEndian.Uint32(plain[:4])
+	if length > MaxReplyLength {
+		err = fmt.Errorf(
+			"%w: reply (%d bytes) exceeds max length (%d bytes)",
+			ErrRange,
+			length,
+			MaxReplyLength,
+		)
+		plain = nil
+		return
+	}
+	plain = plain[4 : 4+length]
+	return
+}
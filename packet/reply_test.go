@@ -0,0 +1,141 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+func TestSlotOwner(t *testing.T) {
+	o := NewSlotOwner()
+	if _, err := o.Encode(); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("Expected ErrIncomplete, got: %v", err)
+	}
+	err := o.SetAddress("owner@example.com")
+	errTest(err)
+	b, err := o.Encode()
+	errTest(err)
+	if len(b) != EncHeadBytes {
+		t.Fatalf("Owner slot should be %d bytes, got %d", EncHeadBytes, len(b))
+	}
+	decoded, err := DecodeOwner(b)
+	errTest(err)
+	if decoded.Address() != "owner@example.com" {
+		t.Fatalf("Owner address mismatch: %s", decoded.Address())
+	}
+	b[0] = Version2
+	_, err = DecodeOwner(b)
+	var verr *VersionError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected VersionError, got: %v", err)
+	}
+}
+
+func TestReplyBlockEncode(t *testing.T) {
+	r := &ReplyBlock{
+		EntryHop: "entry@example.com",
+		Key:      crandom.Randbytes(32),
+		Headers:  crandom.Randbytes(HeadersBytes),
+	}
+	b, err := r.Encode()
+	errTest(err)
+	if len(b) != ReplyBlockBytes {
+		t.Fatalf("Reply Block should be %d bytes, got %d", ReplyBlockBytes, len(b))
+	}
+	decoded, err := DecodeReplyBlock(b)
+	errTest(err)
+	if decoded.EntryHop != r.EntryHop {
+		t.Fatalf("Entry hop mismatch: %s", decoded.EntryHop)
+	}
+	if !bytes.Equal(decoded.Key, r.Key) || !bytes.Equal(decoded.Headers, r.Headers) {
+		t.Fatal("Reply Block key or headers mismatch")
+	}
+	_, err = DecodeReplyBlock(b[:100])
+	var lerr *LengthError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Expected LengthError, got: %v", err)
+	}
+}
+
+func TestReplyDecrypt(t *testing.T) {
+	r := &ReplyBlock{
+		EntryHop: "entry@example.com",
+		Key:      crandom.Randbytes(32),
+		Headers:  crandom.Randbytes(HeadersBytes),
+	}
+	plain := []byte("Hello World")
+	payload, err := r.Message(plain)
+	errTest(err)
+	if !bytes.Equal(payload[:HeadersBytes], r.Headers) {
+		t.Fatal("Reply headers not preserved")
+	}
+	secret := &ReplySecret{Key: r.Key}
+	body := payload[HeadersBytes:]
+	// Emulate the body decryption performed by two intermediate hops
+	for n := 0; n < 2; n++ {
+		key := crandom.Randbytes(32)
+		partialIV := crandom.Randbytes(12)
+		body = aesCtr(body, key, seqIV(partialIV, MaxChainLength))
+		secret.Keys = append(secret.Keys, key)
+		secret.PartialIVs = append(secret.PartialIVs, partialIV)
+	}
+	got, err := secret.Decrypt(body)
+	errTest(err)
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("Expected %q, got %q", plain, got)
+	}
+	_, err = r.Message(make([]byte, MaxReplyLength+1))
+	if !errors.Is(err, ErrRange) {
+		t.Fatalf("Expected ErrRange, got: %v", err)
+	}
+}
+
+func TestReplyIV(t *testing.T) {
+	r := &ReplyBlock{
+		EntryHop: "entry@example.com",
+		Key:      crandom.Randbytes(32),
+		Headers:  crandom.Randbytes(HeadersBytes),
+	}
+	// Replies sent with the same Reply Block must not share a keystream
+	plain := bytes.Repeat([]byte{0}, 1000)
+	secret := &ReplySecret{Key: r.Key}
+	var bodies [][]byte
+	for n := 0; n < 2; n++ {
+		payload, err := r.Message(plain)
+		errTest(err)
+		body := payload[HeadersBytes:]
+		got, err := secret.Decrypt(body)
+		errTest(err)
+		if !bytes.Equal(got, plain) {
+			t.Fatal("Reply decryption failed")
+		}
+		bodies = append(bodies, body)
+	}
+	if bytes.Equal(bodies[0][:replyIVBytes], bodies[1][:replyIVBytes]) {
+		t.Fatal("Reply IV reused")
+	}
+	start := replyIVBytes + 4
+	if bytes.Equal(bodies[0][start:start+len(plain)], bodies[1][start:start+len(plain)]) {
+		t.Fatal("Reply keystream reused")
+	}
+}
+
+func TestReplySource(t *testing.T) {
+	r := &ReplyBlock{
+		EntryHop: "entry@example.com",
+		Key:      crandom.Randbytes(32),
+		Headers:  crandom.Randbytes(HeadersBytes),
+	}
+	entropy := crandom.Randbytes(BodyBytes)
+	encode := func() []byte {
+		src := &Source{Rand: bytes.NewReader(entropy)}
+		payload, err := src.ReplyMessage(r, []byte("Hello World"))
+		errTest(err)
+		return payload
+	}
+	if !bytes.Equal(encode(), encode()) {
+		t.Fatal("Identical Sources produced different replies")
+	}
+}
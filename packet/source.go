@@ -0,0 +1,58 @@
+package packet
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Source supplies the entropy and the clock used during encoding.  Packets
+// are normally encoded using DefaultSource but a deterministic Source makes
+// them reproducible, allowing other implementations to be tested against
+// this one byte for byte.  The exception is the ML-KEM encapsulation in
+// hybrid headers, which always draws from crypto/rand.
+type Source struct {
+	Rand io.Reader        // Entropy
+	Now  func() time.Time // Clock
+}
+
+// DefaultSource draws entropy from crypto/rand and time from the system
+// clock.
+var DefaultSource = &Source{Rand: rand.Reader, Now: time.Now}
+
+// Randbytes returns n Bytes of entropy.  Like crandom.Randbytes, it panics
+// if insufficient entropy is available.
+func (s *Source) Randbytes(n int) (b []byte) {
+	b = make([]byte, n)
+	read, err := io.ReadFull(s.Rand, b)
+	if err != nil {
+		panic(fmt.Errorf(
+			"Insufficient entropy.  Wanted=%d, Got=%d: %w",
+			n,
+			read,
+			err,
+		))
+	}
+	return
+}
+
+// days returns the number of days since Epoch.
+func (s *Source) days() int64 {
+	return s.Now().UTC().Unix() / 86400
+}
+
+// GenerateKey returns a new Curve25519 public/private key pair
+func (s *Source) GenerateKey() (pk, sk []byte, err error) {
+	pka, ska, err := box.GenerateKey(s.Rand)
+	if err != nil {
+		return
+	}
+	pk = make([]byte, 32)
+	sk = make([]byte, 32)
+	copy(pk[:], pka[:])
+	copy(sk[:], ska[:])
+	return
+}
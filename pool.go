@@ -3,41 +3,46 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/mail"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	//"github.com/codahale/blake2"
 	"github.com/Masterminds/log-go"
 	"github.com/crooks/yamn/crandom"
-	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/mix2"
+	"github.com/crooks/yamn/packet"
 	"github.com/luksen/maildir"
 )
 
 // serverPoolOutboundSend is intended to be run concurrently with the server
 // daemon.  It sends messages from the pool at timed intervals.
-func serverPoolOutboundSend() {
-	if cfg.Pool.Loop < 120 {
+func (s *Server) serverPoolOutboundSend() {
+	if s.cfg.Pool.Loop < 120 {
 		log.Warnf(
 			"Pool loop of %d Seconds is too short. "+
 				"Adjusting to minimum of 120 Seconds.",
-			cfg.Pool.Loop,
+			s.cfg.Pool.Loop,
 		)
-		cfg.Pool.Loop = 120
+		s.cfg.Pool.Loop = 120
 	}
-	sleepFor := time.Duration(cfg.Pool.Loop) * time.Second
+	sleepFor := time.Duration(s.cfg.Pool.Loop) * time.Second
 	for {
 		// Read dynamic mix of outbound files from the Pool
 		// filenames = dynamicMix()
 		// Read binomialMix of outbound files from the Pool
-		filenames := binomialMix()
+		filenames := s.binomialMix()
 		for _, filename := range filenames {
-			emailPoolFile(filename)
+			s.emailPoolFile(filename)
 		}
 		time.Sleep(sleepFor)
 	}
@@ -45,9 +50,9 @@ func serverPoolOutboundSend() {
 
 // poolOutboundSend flushes the outbound pool.  This should only be performed
 // on clients, where all messages should be sent instantly after creation.
-func poolOutboundSend() {
+func (s *Server) poolOutboundSend() {
 	var err error
-	if cfg.Remailer.Daemon || flag.Daemon {
+	if s.daemon {
 		// This should never happen.  If the server is started as a
 		// daemon, the serverPoolOutboundSend process is initiated and
 		// runs in an endless loop.  This function would conflict with
@@ -57,52 +62,77 @@ func poolOutboundSend() {
 	}
 	var filenames []string
 	// Read all the pool files
-	filenames, err = readDir(cfg.Files.Pooldir, "m")
+	filenames, err = s.readOutbound()
 	if err != nil {
 		log.Warnf("Reading pool failed: %s", err)
 		return
 	}
-	if flag.Remailer {
-		// During normal operation, the pool shouldn't be flushed.
-		log.Warn("Flushing outbound remailer pool")
-	}
 	for _, filename := range filenames {
-		emailPoolFile(filename)
+		s.emailPoolFile(filename)
+	}
+}
+
+// readOutbound returns the filenames of outbound messages ("m"), exit
+// deliveries ("e") and Usenet articles ("n") in the Pool.  All are mixed
+// together.
+func (s *Server) readOutbound() (filenames []string, err error) {
+	for _, prefix := range []string{"m", "e", "n"} {
+		var files []string
+		files, err = readDir(s.cfg.Files.Pooldir, prefix)
+		if err != nil {
+			return
+		}
+		filenames = append(filenames, files...)
 	}
+	return
 }
 
-// emailPoolFile tries to email a given file from the Pool.  If conditions are
-// met, the file is then deleted.
-func emailPoolFile(filename string) {
-	delFlag, err := mailPoolFile(path.Join(cfg.Files.Pooldir, filename))
+// emailPoolFile tries to email (or post) a given file from the Pool.  If
+// conditions are met, the file is then deleted.
+func (s *Server) emailPoolFile(filename string) {
+	var delFlag bool
+	var err error
+	news := strings.HasPrefix(filename, "n")
+	if news {
+		delFlag, err = s.postPoolFile(path.Join(s.cfg.Files.Pooldir, filename))
+	} else {
+		delFlag, err = s.mailPoolFile(
+			path.Join(s.cfg.Files.Pooldir, filename),
+			strings.HasPrefix(filename, "e"),
+		)
+	}
 	if err != nil {
 		log.Warnf("Pool mailing failed: %s", err)
-		if delFlag {
-			// If delFlag is true, we delete the file, even though
-			// mailing failed.
-			poolDelete(filename)
+		if delFlag || isPermanent(err) {
+			// The file can never be sent so we delete it, even
+			// though mailing failed.
+			s.poolDelete(filename)
 		}
 	} else {
-		stats.outMail++
-		poolDelete(filename)
+		if news {
+			s.stats.outNews++
+		} else {
+			s.stats.outMail++
+		}
+		s.poolDelete(filename)
 	}
 }
 
 // dynamicMix returns a dynamic Mix of filenames from the outbound pool.
-func dynamicMix() []string {
+func (s *Server) dynamicMix() []string {
 	var empty []string
-	poolFiles, err := readDir(cfg.Files.Pooldir, "m")
+	poolFiles, err := s.readOutbound()
 	if err != nil {
 		log.Warnf("Unable to access pool: %s", err)
 		return empty
 	}
 	poolSize := len(poolFiles)
-	if poolSize < cfg.Pool.Size || poolSize == 0 {
+	if poolSize < s.cfg.Pool.Size || poolSize == 0 {
 		// Pool isn't sufficiently populated
 		log.Tracef(
 			"Pool insufficiently populated to trigger sending."+
 				"Require=%d, Got=%d",
-			cfg.Pool.Size,
+			s.cfg.Pool.Size,
 			poolSize,
 		)
 		return empty
@@ -111,39 +141,39 @@ func dynamicMix() []string {
 	// setset of the overall pool.
 	crandom.Shuffle(poolFiles)
 	// Normal pool processing condition
-	numToSend := int((float32(poolSize) / 100.0) * float32(cfg.Pool.Rate))
+	numToSend := int((float32(poolSize) / 100.0) * float32(s.cfg.Pool.Rate))
 	log.Tracef("Processing %d pool messages.\n", poolSize)
 	return poolFiles[:numToSend]
 }
 
 // getBatchSize takes a Pool size and returns a corresponding batch size.  This
 // is intended for use with Binomial Mix Pools.
-func getBatchSize(poolSize int) int {
+func (s *Server) getBatchSize(poolSize int) int {
 	/*
 		poolSize         -  Number of files in the pool
-		cfg.Pool.Size    -  Minimum messages to keep in pool
-		cfg.Pool.MinSend -  Minimum number of messages to consider sending
-		cfg.Pool.Rate    -  Percentage of Pool in the batch
+		s.cfg.Pool.Size    -  Minimum messages to keep in pool
+		s.cfg.Pool.MinSend -  Minimum number of messages to consider sending
+		s.cfg.Pool.Rate    -  Percentage of Pool in the batch
 	*/
-	if poolSize < (cfg.Pool.Size + cfg.Pool.MinSend) {
+	if poolSize < (s.cfg.Pool.Size + s.cfg.Pool.MinSend) {
 		return 0
 	}
-	sendable := poolSize - cfg.Pool.Size
-	rate := float32(cfg.Pool.Rate) / 100
+	sendable := poolSize - s.cfg.Pool.Size
+	rate := float32(s.cfg.Pool.Rate) / 100
 	maxSend := max(1, int(float32(poolSize)*rate))
 	return min(sendable, maxSend)
 }
 
 // binomialMix returns a batched subset of Pool files to send using a
 // Probability B/P method of selecting each file.
-func binomialMix() (batch []string) {
-	poolFiles, err := readDir(cfg.Files.Pooldir, "m")
+func (s *Server) binomialMix() (batch []string) {
+	poolFiles, err := s.readOutbound()
 	if err != nil {
 		log.Warnf("Unable to access pool: %s", err)
 		return
 	}
 	poolSize := len(poolFiles)
-	batchSize := getBatchSize(poolSize)
+	batchSize := s.getBatchSize(poolSize)
 	if batchSize == 0 {
 		log.Infof("Binomial Mix Pool: Size=%d", poolSize)
 		// If the batch is empty, don't bother to process it.
@@ -171,19 +201,19 @@ func binomialMix() (batch []string) {
 }
 
 // Delete a given file from the pool
-func poolDelete(filename string) {
+func (s *Server) poolDelete(filename string) {
 	// Delete a pool file
-	err := os.Remove(path.Join(cfg.Files.Pooldir, filename))
+	err := os.Remove(path.Join(s.cfg.Files.Pooldir, filename))
 	if err != nil {
-		log.Errorf("Failed to remove %s from %s\n", filename, cfg.Files.Pooldir)
+		log.Errorf("Failed to remove %s from %s\n", filename, s.cfg.Files.Pooldir)
 	} else {
 		log.Tracef("Deleted %s from Pool", filename)
 	}
 }
 
 // processMail reads the Remailer's Maildir and processes the content
-func processMail(secret *keymgr.Secring) (err error) {
-	dir := maildir.Dir(cfg.Files.Maildir)
+func (s *Server) processMail() (err error) {
+	dir := maildir.Dir(s.cfg.Files.Maildir)
 	// Get a list of Maildir keys from the directory
 	keys, err := dir.Unseen()
 	if err != nil {
@@ -197,10 +227,10 @@ func processMail(secret *keymgr.Secring) (err error) {
 	log.Tracef(
 		"Reading %d messages from %s\n",
 		newMsgs,
-		cfg.Files.Maildir,
+		s.cfg.Files.Maildir,
 	)
 	// Increment inbound Email counter
-	stats.inMail += newMsgs
+	s.stats.inMail += newMsgs
 	// Fetch headers for each Maildir key
 	var head mail.Header
 	for _, key := range keys {
@@ -209,14 +239,29 @@ func processMail(secret *keymgr.Secring) (err error) {
 			log.Warnf("%s: Getting headers failed with: %s", key, err)
 			continue
 		}
+		// Bounces are discarded before anything can reply to them
+		if isBounce(head) {
+			var bounce *mail.Message
+			bounce, err = dir.Message(key)
+			if err == nil {
+				s.processBounce(bounce)
+			} else {
+				log.Warnf("%s: Reading bounce failed with: %s", key, err)
+			}
+			err = dir.Purge(key)
+			if err != nil {
+				log.Warnf("Cannot delete bounce: %s", err)
+			}
+			continue
+		}
 		// The Subject determines if the message needs remailer-foo handling
 		subject := strings.TrimSpace(strings.ToLower(head.Get("Subject")))
 		if strings.HasPrefix(subject, "remailer-") {
 			// It's a remailer-foo request
-			err = remailerFoo(subject, head.Get("From"))
+			err = s.remailerFoo(subject, head.Get("From"))
 			if err == nil {
 				// Increments stats counter
-				stats.inRemFoo++
+				s.stats.inRemFoo++
 			} else {
 				log.Info(err)
 			}
@@ -241,9 +286,43 @@ func processMail(secret *keymgr.Secring) (err error) {
 			)
 			continue
 		}
+		if s.cfg.Gateway.Enabled {
+			// Plaintext messages with Anon-To headers enter the
+			// network through the gateway
+			var handled bool
+			handled, err = s.gatewayMail(mailMsg)
+			if err != nil {
+				log.Info(err)
+			}
+			if handled {
+				err = dir.Purge(key)
+				if err != nil {
+					log.Warnf("Cannot delete gateway mail: %s", err)
+				}
+				continue
+			}
+		}
+		if s.mix2 != nil {
+			// Type II packets are identified by their armor
+			var body []byte
+			body, err = io.ReadAll(mailMsg.Body)
+			if err != nil {
+				log.Warnf("%s: Reading body failed with: %s", key, err)
+				continue
+			}
+			if mix2.IsArmored(body) {
+				s.processMix2(body)
+				err = dir.Purge(key)
+				if err != nil {
+					log.Warnf("Cannot delete mail: %s", err)
+				}
+				continue
+			}
+			mailMsg.Body = bytes.NewReader(body)
+		}
 		var msg []byte
 		// Convert the armored Yamn message to its byte components
-		msg, err = stripArmor(mailMsg.Body)
+		msg, err = packet.StripArmor(mailMsg.Body)
 		if err != nil {
 			log.Info(err)
 			continue
@@ -252,7 +331,7 @@ func processMail(secret *keymgr.Secring) (err error) {
 			log.Warn("Dearmor returned zero bytes")
 			continue
 		}
-		err = decodeMsg(msg, secret)
+		err = s.decodeMsg(msg)
 		if err != nil {
 			log.Warnf("Decoding error: %s", err)
 		}
@@ -265,8 +344,8 @@ func processMail(secret *keymgr.Secring) (err error) {
 }
 
 // processInpool is similar to processMail but reads the Inbound Pool
-func processInpool(prefix string, secret *keymgr.Secring) {
-	poolFiles, err := readDir(cfg.Files.Pooldir, prefix)
+func (s *Server) processInpool(prefix string) {
+	poolFiles, err := readDir(s.cfg.Files.Pooldir, prefix)
 	if err != nil {
 		log.Warnf("Unable to access inbound pool: %s", err)
 		return
@@ -274,18 +353,18 @@ func processInpool(prefix string, secret *keymgr.Secring) {
 	poolSize := len(poolFiles)
 	processed := 0
 	for _, f := range poolFiles {
-		filename := path.Join(cfg.Files.Pooldir, f)
-		msg := make([]byte, messageBytes)
+		filename := path.Join(s.cfg.Files.Pooldir, f)
+		var msg []byte
 		msg, err = ioutil.ReadFile(filename)
 		if err != nil {
 			log.Warnf("Failed to read %s from pool: %s", f, err)
 			continue
 		}
-		err = decodeMsg(msg, secret)
+		err = s.decodeMsg(msg)
 		if err != nil {
 			log.Warnf("Decoding error: %s", err)
 		}
-		poolDelete(f)
+		s.poolDelete(f)
 		processed++
 	}
 	if poolSize > 0 {
@@ -296,10 +375,10 @@ func processInpool(prefix string, secret *keymgr.Secring) {
 
 // randPoolFilename returns a random filename with a given prefix.  This should
 // be used in all instances where a new pool file is required.
-func randPoolFilename(prefix string) (fqfn string) {
+func (s *Server) randPoolFilename(prefix string) (fqfn string) {
 	for {
 		outfileName := prefix + hex.EncodeToString(crandom.Randbytes(7))
-		fqfn = path.Join(cfg.Files.Pooldir, outfileName)
+		fqfn = path.Join(s.cfg.Files.Pooldir, outfileName)
 		_, err := os.Stat(fqfn)
 		if err != nil {
 			// For once we want an error (indicating the file
@@ -311,36 +390,105 @@ func randPoolFilename(prefix string) (fqfn string) {
 }
 
 // newPoolFile opens a new file in Write mode and sets user-only permissions
-func newPoolFile(prefix string) (f *os.File, err error) {
+func (s *Server) newPoolFile(prefix string) (f *os.File, err error) {
 	/*
 		Currently supported prefixs are:-
-		[ m              Oubound message (final or intermediate) ]
+		[ m       Outbound packet (to a remailer or reply owner) ]
+		[ e                          Outbound exit message (final) ]
+		[ n                        Outbound Usenet article (final) ]
 		[ i          Inbound message (destined for this remailer ]
 		[ p               Partial message chunk needing assembly ]
+		[ h   Held outbound message (see holdMessage for format) ]
 	*/
-	fqfn := randPoolFilename(prefix)
+	fqfn := s.randPoolFilename(prefix)
 	f, err = os.OpenFile(fqfn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	return
 }
 
 // writeMessageToPool requires a recipient address (another remailer) and a
 // payload (that gets Base64 armored).
-func writeMessageToPool(sendTo string, payload []byte) {
-	f, err := newPoolFile("m")
+func (s *Server) writeMessageToPool(sendTo string, payload []byte) {
+	_, err := s.outboundPool().WriteMessage(sendTo, payload)
+	if err != nil {
+		log.Errorf("Failed to write message to pool: %s", err)
+	}
+}
+
+// holdMessage writes an outbound message to the pool as a held ("h") file.
+// The filename encodes the release time as 16 hex digits of Unix time,
+// followed by the usual random component:
+//
+//	h<release time><random>
+//
+// The lexical order of held files is therefore their release order.  Delays
+// longer than the configured max_hold are truncated.
+func (s *Server) holdMessage(sendTo string, payload []byte, delay time.Duration) {
+	maxHold := time.Duration(s.cfg.Pool.MaxHold) * time.Minute
+	if delay > maxHold {
+		log.Infof(
+			"Requested delay (%s) exceeds max_hold. Holding for %s",
+			delay,
+			maxHold,
+		)
+		delay = maxHold
+	}
+	release := time.Now().Add(delay)
+	pool := s.outboundPool()
+	pool.Prefix = fmt.Sprintf("h%016x", release.Unix())
+	filename, err := pool.WriteMessage(sendTo, payload)
+	if err != nil {
+		log.Errorf("Failed to write held message to pool: %s", err)
+		return
+	}
+	log.Tracef("Holding %s until %s", filename, release.Format(time.RFC3339))
+	s.stats.outHeld++
+}
+
+// releaseHeld mails held messages whose release time has passed.  They
+// bypass the pool mix as the delay already provides their mixing.
+func (s *Server) releaseHeld() {
+	// readDir returns filenames in lexical (and therefore release) order
+	poolFiles, err := readDir(s.cfg.Files.Pooldir, "h")
+	if err != nil {
+		log.Warnf("Unable to access held messages: %s", err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, filename := range poolFiles {
+		if len(filename) < 17 {
+			log.Warnf("Malformed held filename: %s", filename)
+			continue
+		}
+		release, err := strconv.ParseInt(filename[1:17], 16, 64)
+		if err != nil {
+			log.Warnf("Malformed held filename: %s", filename)
+			continue
+		}
+		if release > now {
+			// All subsequent files are held for longer
+			break
+		}
+		s.emailPoolFile(filename)
+	}
+}
+
+// writeChunkToPool writes a partial message chunk to the pool and returns the
+// filename.  Chunks have no internal header as they're concatenated during
+// assembly.
+func (s *Server) writeChunkToPool(payload []byte) (filename string) {
+	f, err := s.newPoolFile("p")
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
-	// Add mail headers to the pool file
-	writeInternalHeader(f)
-	writeMailHeaders(f, sendTo)
-	// Armor the payload
-	armor(f, payload)
+	f.Write(payload)
+	_, filename = path.Split(f.Name())
+	return
 }
 
 // writePlainToPool writes a plaintext file to the pool and returns the filename
-func writePlainToPool(payload []byte, prefix string) (filename string) {
-	f, err := newPoolFile(prefix)
+func (s *Server) writePlainToPool(payload []byte, prefix string) (filename string) {
+	f, err := s.newPoolFile(prefix)
 	if err != nil {
 		panic(err)
 	}
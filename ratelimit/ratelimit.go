@@ -0,0 +1,116 @@
+// Package ratelimit records delivery events in a leveldb database and counts
+// them over sliding windows.  Event names, such as recipient addresses, are
+// stored as keyed hashes so the database doesn't reveal them.
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/dchest/blake2s"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+Database keys:
+	"key"					32 Byte Blake2s key
+	"e" + name hash (16) + time (8) + random (4)	Event
+Times are Big-Endian Unix nanoseconds so that the events of each name are
+stored in chronological order.
+*/
+
+var hashKey = []byte("key")
+
+// Limiter counts events in a leveldb database.
+type Limiter struct {
+	db  *leveldb.DB
+	key []byte
+	now func() time.Time
+}
+
+// Open opens (or creates) the database in filename.
+func Open(filename string) (l *Limiter, err error) {
+	db, err := leveldb.OpenFile(filename, nil)
+	if err != nil {
+		return
+	}
+	key, err := db.Get(hashKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		key = crandom.Randbytes(32)
+		err = db.Put(hashKey, key, nil)
+	}
+	if err != nil {
+		db.Close()
+		return
+	}
+	l = &Limiter{db: db, key: key, now: time.Now}
+	return
+}
+
+// Close closes the database.
+func (l *Limiter) Close() {
+	l.db.Close()
+}
+
+// prefix returns the key prefix of the events for name.
+func (l *Limiter) prefix(name string) []byte {
+	digest, _ := blake2s.New(&blake2s.Config{Size: 16, Key: l.key})
+	digest.Write([]byte(name))
+	return append([]byte("e"), digest.Sum(nil)...)
+}
+
+// timeKey returns the key of an event for name at time t, less its random
+// suffix.
+func (l *Limiter) timeKey(name string, t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(l.prefix(name), uint64(t.UnixNano()))
+}
+
+// Count returns the number of events for name since the given time.
+func (l *Limiter) Count(name string, since time.Time) (count int, err error) {
+	r := &util.Range{
+		Start: l.timeKey(name, since),
+		Limit: util.BytesPrefix(l.prefix(name)).Limit,
+	}
+	iter := l.db.NewIterator(r, nil)
+	for iter.Next() {
+		count++
+	}
+	iter.Release()
+	err = iter.Error()
+	return
+}
+
+// Record inserts an event, timed now, for each of names.
+func (l *Limiter) Record(names ...string) error {
+	now := l.now()
+	batch := new(leveldb.Batch)
+	for _, name := range names {
+		batch.Put(append(l.timeKey(name, now), crandom.Randbytes(4)...), nil)
+	}
+	return l.db.Write(batch, nil)
+}
+
+// Expire deletes events older than maxAge and returns the number deleted.
+func (l *Limiter) Expire(maxAge time.Duration) (deleted int, err error) {
+	oldest := binary.BigEndian.AppendUint64(nil, uint64(l.now().Add(-maxAge).UnixNano()))
+	batch := new(leveldb.Batch)
+	iter := l.db.NewIterator(util.BytesPrefix([]byte("e")), nil)
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) < 25 || bytes.Compare(key[17:25], oldest) < 0 {
+			batch.Delete(append([]byte(nil), key...))
+			deleted++
+		}
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return
+	}
+	err = l.db.Write(batch, nil)
+	return
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	filename := path.Join(t.TempDir(), "ratedb")
+	l, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	err = l.Record("a@example.com", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return now }
+	err = l.Record("a@example.com", "b@example.com", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		window time.Duration
+		count  int
+	}{
+		{"a@example.com", time.Hour, 1},
+		{"a@example.com", 3 * time.Hour, 2},
+		{"example.com", 3 * time.Hour, 2},
+		{"c@example.com", 3 * time.Hour, 0},
+	} {
+		count, err := l.Count(test.name, now.Add(-test.window))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.count {
+			t.Errorf("%s: expected %d events, got %d", test.name, test.count, count)
+		}
+	}
+	deleted, err := l.Expire(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 expired events, got %d", deleted)
+	}
+	// Names are hashed with a persistent key
+	l.Close()
+	l, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	count, err := l.Count("a@example.com", now.Add(-3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 event after reopening, got %d", count)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+)
+
+// smtpsPort is the port on which SMTP relays expect implicit TLS (RFC 8314).
+const smtpsPort = 465
+
+// relayTLSConfig returns the TLS config used to connect to an SMTP relay.
+// Certificates are verified against the system roots or, if defined, the
+// mail.ca_file.  If strict is false, verification failures are logged and the
+// session continues with unauthenticated encryption (RFC 7435).  SPKI pins
+// are always enforced.
+func (s *Server) relayTLSConfig(host string, strict bool) (conf *tls.Config, err error) {
+	var roots *x509.CertPool
+	if s.cfg.Mail.CAFile != "" {
+		var pem []byte
+		pem, err = os.ReadFile(s.cfg.Mail.CAFile)
+		if err != nil {
+			return
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("%s: no CA certificates found", s.cfg.Mail.CAFile)
+			return
+		}
+	}
+	pins := s.cfg.Mail.SPKIPins
+	conf = &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+		// Verification is performed by VerifyConnection so that it can
+		// be lenient when opportunistic.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			chains, err := verifyRelay(cs, host, roots)
+			if err != nil && strict {
+				return err
+			} else if err != nil {
+				log.Infof(
+					"Continuing with unverified TLS: Server=%s, Error=%s",
+					host,
+					err,
+				)
+			}
+			if len(pins) > 0 {
+				return matchPins(cs, chains, pins)
+			}
+			return nil
+		},
+	}
+	return
+}
+
+// verifyRelay verifies the certificate chain presented by host.
+func verifyRelay(cs tls.ConnectionState, host string, roots *x509.CertPool) (chains [][]*x509.Certificate, err error) {
+	if len(cs.PeerCertificates) == 0 {
+		err = errors.New("relay presented no certificates")
+		return
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err = cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		err = fmt.Errorf("certificate verification failed: %w", err)
+	}
+	return
+}
+
+// spkiHash returns the base64 SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo, as used by SPKI pins.
+func spkiHash(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// matchPins returns an error unless a certificate in the verified chains (or,
+// if verification failed, the presented certificates) matches an SPKI pin.
+func matchPins(cs tls.ConnectionState, chains [][]*x509.Certificate, pins []string) error {
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := spkiHash(cert)
+			for _, pin := range pins {
+				if strings.TrimSpace(pin) == hash {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("no relay certificate matches the configured SPKI pins")
+}
+
+// isLocalhost returns true if host is the local machine.  Credentials may be
+// sent to it without encryption.
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loginAuth implements the LOGIN SASL mechanism.  Like smtp.PlainAuth, it
+// refuses to send credentials over unencrypted connections, other than to
+// localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(strings.Trim(string(fromServer), " :\x00"))
+	switch prompt {
+	case "username", "user name":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+// relayAuth returns the smtp.Auth for the configured (or, if undefined, the
+// best offered) AUTH mechanism.  offered is the AUTH extension parameter.
+func (s *Server) relayAuth(host, offered string, encrypted bool) (auth smtp.Auth, err error) {
+	mech := strings.ToLower(s.cfg.Mail.AuthMech)
+	if mech == "" {
+		// Without encryption, only CRAM-MD5 protects the password
+		prefs := []string{"plain", "login", "cram-md5"}
+		if !encrypted && !isLocalhost(host) {
+			prefs = []string{"cram-md5"}
+		}
+		available := strings.Fields(strings.ToLower(offered))
+		for _, pref := range prefs {
+			if slices.Contains(available, pref) {
+				mech = pref
+				break
+			}
+		}
+		if mech == "" {
+			err = fmt.Errorf("no usable AUTH mechanism in: %s", offered)
+			return
+		}
+	}
+	switch mech {
+	case "plain":
+		auth = smtp.PlainAuth("", s.cfg.Mail.Username, s.cfg.Mail.Password, host)
+	case "login":
+		auth = &loginAuth{
+			username: s.cfg.Mail.Username,
+			password: s.cfg.Mail.Password,
+			host:     host,
+		}
+	case "cram-md5":
+		auth = smtp.CRAMMD5Auth(s.cfg.Mail.Username, s.cfg.Mail.Password)
+	default:
+		err = fmt.Errorf("%s: Unknown AUTH mechanism", mech)
+	}
+	return
+}
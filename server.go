@@ -3,64 +3,146 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/client"
+	"github.com/crooks/yamn/config"
 	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/idlog"
 	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/mix2"
+	"github.com/crooks/yamn/packet"
 	"github.com/crooks/yamn/quickmail"
+	"github.com/crooks/yamn/ratelimit"
 	//"github.com/codahale/blake2"
 )
 
-// Start the server process.  If run with --daemon, this will loop forever.
-func loopServer() (err error) {
-	// Initialize the Public Keyring
-	Pubring = keymgr.NewPubring(
-		cfg.Files.Pubring,
-		cfg.Files.Mlist2,
-	)
+// Server is a YAMN remailer instance.  It owns its configuration, keyrings,
+// databases and statistics so that several remailers can run within a single
+// process.
+type Server struct {
+	cfg     *config.Config
+	secret  *keymgr.Secring // Secret Keyring
+	pubring *keymgr.Pubring // Public Keyring
+	idDb    *idlog.IDLog    // Message ID log (replay protection)
+	chunkDb *Chunk          // Chunk database
+	mix2    *mix2.Secring   // Type II secret keys (optional)
+	stats   *statistics
+	// sendMail delivers an assembled email to a list of recipients.
+	sendMail func(payload []byte, sendTo []string) error
+	daemon   bool // Loop forever instead of performing a single run
+	noDummy  bool // Don't inject dummy messages
+	flush    bool // Outbound pool is flushed on every run
+	// destBlock is the destination block list, read on demand.  blockMu
+	// guards it as it's shared by the pool goroutine and the main loop.
+	destBlock *destBlock
+	blockMu   sync.Mutex
+	// rateDb is the delivery rate limit database, opened on demand.  It's
+	// shared by the pool goroutine and the main loop so rateMu guards it.
+	rateDb *ratelimit.Limiter
+	rateMu sync.Mutex
+}
+
+// newServer returns a Server for the given config.  Keyrings and databases
+// are not available until open is called.
+func newServer(c *config.Config) *Server {
+	s := &Server{
+		cfg:     c,
+		stats:   new(statistics),
+		daemon:  c.Remailer.Daemon,
+		pubring: keymgr.NewPubring(c.Files.Pubring, c.Files.Mlist2),
+	}
+	s.sendMail = s.mailBytes
+	return s
+}
+
+// open prepares a Server for processing messages.  It imports the keyrings,
+// creates directories, opens the ID Log and Chunk DB and ensures a valid key
+// is being advertised.
+func (s *Server) open() (err error) {
 	// Fetch keyring and stats URLs
-	timedURLFetch(cfg.Urls.Pubring, cfg.Files.Pubring)
-	timedURLFetch(cfg.Urls.Mlist2, cfg.Files.Mlist2)
+	if s.cfg.Urls.Fetch {
+		timedURLFetch(s.cfg.Urls.Pubring, s.cfg.Files.Pubring)
+		timedURLFetch(s.cfg.Urls.Mlist2, s.cfg.Files.Mlist2)
+	}
 	// Initialize the Secret Keyring
-	secret := keymgr.NewSecring(cfg.Files.Secring, cfg.Files.Pubkey)
-	Pubring.ImportPubring()
-	secret.ImportSecring()
+	s.secret = keymgr.NewSecring(s.cfg.Files.Secring, s.cfg.Files.Pubkey)
+	s.pubring.ImportPubring()
+	s.secret.ImportSecring()
 	// Tell the secret keyring some basic info about this remailer
-	secret.SetName(cfg.Remailer.Name)
-	secret.SetAddress(cfg.Remailer.Address)
-	secret.SetExit(cfg.Remailer.Exit)
-	secret.SetValidity(cfg.Remailer.Keylife, cfg.Remailer.Keygrace)
-	secret.SetVersion(version)
+	s.secret.SetName(s.cfg.Remailer.Name)
+	s.secret.SetAddress(s.cfg.Remailer.Address)
+	s.secret.SetExit(s.cfg.Remailer.Exit)
+	s.secret.SetNews(s.newsEnabled())
+	s.secret.SetValidity(s.cfg.Remailer.Keylife, s.cfg.Remailer.Keygrace)
+	s.secret.SetVersion(version)
+	// Refuse to start with an invalid header filter
+	_, err = s.headerFilter()
+	if err != nil {
+		return
+	}
+	// Likewise, refuse to start with an invalid disclaimer or an
+	// unusable DKIM key
+	_, err = s.disclaimer()
+	if err != nil {
+		return
+	}
+	if s.dkimEnabled() {
+		_, err = s.dkimSigner()
+		if err != nil {
+			return
+		}
+	}
+	// Load the destination block list
+	_, err = s.blockList()
+	if err != nil {
+		return
+	}
 	// Create some dirs if they don't already exist
-	createDirs()
+	err = s.createDirs()
+	if err != nil {
+		return
+	}
+	if s.cfg.Remailer.Mix2 {
+		err = s.openMix2()
+		if err != nil {
+			return
+		}
+	}
 
 	// Open the IDlog
-	log.Tracef("Opening ID Log: %s", cfg.Files.IDlog)
+	log.Tracef("Opening ID Log: %s", s.cfg.Files.IDlog)
 	// NewInstance takes the filename and entry validity in days
-	IDDb = idlog.NewIDLog(cfg.Files.IDlog, cfg.Remailer.IDexp)
-	defer IDDb.Close()
+	s.idDb = idlog.NewIDLog(s.cfg.Files.IDlog, s.cfg.Remailer.IDexp)
 	// Open the chunk DB
-	log.Tracef("Opening the Chunk DB: %s", cfg.Files.ChunkDB)
-	ChunkDb = OpenChunk(cfg.Files.ChunkDB)
-	ChunkDb.SetExpire(cfg.Remailer.ChunkExpire)
+	log.Tracef("Opening the Chunk DB: %s", s.cfg.Files.ChunkDB)
+	s.chunkDb, err = OpenChunk(s.cfg.Files.ChunkDB, s.cfg.Files.Pooldir)
+	if err != nil {
+		s.idDb.Close()
+		return
+	}
+	s.chunkDb.SetExpire(s.cfg.Remailer.ChunkExpire)
 
 	// Expire old entries in the ID Log
-	idLogExpire()
+	s.idLogExpire()
 	// Clean the chunk DB
-	chunkClean()
+	s.chunkClean()
 	// Complain about poor configs
-	nagOperator()
+	s.nagOperator()
 	// Run a key purge
-	if purgeSecring(secret) == 0 {
+	if s.purgeSecring() == 0 {
 		// If there are zero active keys, generate a new one.
-		generateKeypair(secret)
+		s.generateKeypair()
 	} else {
 		/*
 			If the operator changes his configuration, (such as
@@ -70,10 +152,45 @@ func loopServer() (err error) {
 			key.txt file with current settings.  This only needs to
 			be done if we haven't generated a new key.
 		*/
-		refreshPubkey(secret)
+		s.refreshPubkey()
 	}
 
-	log.Infof("Secret keyring contains %d keys", secret.Count())
+	log.Infof("Secret keyring contains %d keys", s.secret.Count())
+	return
+}
+
+// close releases the databases opened by open
+func (s *Server) close() {
+	s.chunkDb.Close()
+	s.idDb.Close()
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	if s.rateDb != nil {
+		s.rateDb.Close()
+		s.rateDb = nil
+	}
+}
+
+// process reads and decodes messages from the inbound pool and the Maildir
+func (s *Server) process() {
+	// Panic if the pooldir doesn't exist
+	assertIsPath(s.cfg.Files.Pooldir)
+	// Process the inbound Pool
+	s.processInpool("i")
+	// Process the Maildir
+	s.processMail()
+	// Send held messages that have reached their release time
+	s.releaseHeld()
+}
+
+// loopServer starts the server process.  If the Server is a daemon, this will
+// loop forever.
+func (s *Server) loopServer() (err error) {
+	err = s.open()
+	if err != nil {
+		return
+	}
+	defer s.close()
 
 	// Define triggers for timed events
 	daily := time.Now()
@@ -81,41 +198,35 @@ func loopServer() (err error) {
 	dayOfMonth := time.Now().Day()
 	oneDay := time.Duration(dayLength) * time.Second
 
-	// Determine if this is a single run or the start of a Daemon
-	runAsDaemon := cfg.Remailer.Daemon || flag.Daemon
-
 	// Actually start the server loop
-	if runAsDaemon {
-		log.Infof("Starting YAMN server: %s", cfg.Remailer.Name)
+	if s.daemon {
+		log.Infof("Starting YAMN server: %s", s.cfg.Remailer.Name)
 		log.Infof("Detaching Pool processing")
-		go serverPoolOutboundSend()
+		go s.serverPoolOutboundSend()
 	} else {
 		log.Infof("Performing routine remailer functions for: %s",
-			cfg.Remailer.Name)
+			s.cfg.Remailer.Name)
 	}
 	for {
-		// Panic if the pooldir doesn't exist
-		assertIsPath(cfg.Files.Pooldir)
-		// Process the inbound Pool
-		processInpool("i", secret)
-		// Process the Maildir
-		processMail(secret)
+		s.process()
 
 		// Midnight events
 		if time.Now().Day() != dayOfMonth {
 			log.Info("Performing midnight events")
 			// Remove expired keys from memory and rewrite a
 			// secring file without expired keys.
-			if purgeSecring(secret) == 0 {
-				generateKeypair(secret)
+			if s.purgeSecring() == 0 {
+				s.generateKeypair()
 			}
 			// Expire entries in the ID Log
-			idLogExpire()
+			s.idLogExpire()
 			// Expire entries in the chunker
-			chunkClean()
+			s.chunkClean()
+			// Expire delivery rate limit events
+			s.rateExpire()
 			// Report daily throughput and reset to zeros
-			stats.report()
-			stats.reset()
+			s.stats.report()
+			s.stats.reset()
 			// Reset dayOfMonth to today
 			dayOfMonth = time.Now().Day()
 		}
@@ -123,7 +234,7 @@ func loopServer() (err error) {
 		if time.Since(daily) > oneDay {
 			log.Info("Performing daily events")
 			// Complain about poor configs
-			nagOperator()
+			s.nagOperator()
 			// Reset today so we don't do these tasks for the next
 			// 24 hours.
 			daily = time.Now()
@@ -139,31 +250,31 @@ func loopServer() (err error) {
 				none.
 			*/
 			// Retrieve Mlist2 and Pubring URLs
-			if cfg.Urls.Fetch {
+			if s.cfg.Urls.Fetch {
 				timedURLFetch(
-					cfg.Urls.Pubring,
-					cfg.Files.Pubring,
+					s.cfg.Urls.Pubring,
+					s.cfg.Files.Pubring,
 				)
 				timedURLFetch(
-					cfg.Urls.Mlist2,
-					cfg.Files.Mlist2,
+					s.cfg.Urls.Mlist2,
+					s.cfg.Files.Mlist2,
 				)
 			}
 			// Test to see if the pubring.mix file has been updated
-			if Pubring.KeyRefresh() {
+			if s.pubring.KeyRefresh() {
 				log.Tracef(
 					"Reimporting Public Keyring: %s",
-					cfg.Files.Pubring,
+					s.cfg.Files.Pubring,
 				)
-				Pubring.ImportPubring()
+				s.pubring.ImportPubring()
 			}
 			// Report throughput
-			stats.report()
+			s.stats.report()
 			hourly = time.Now()
 		}
 
 		// Break out of the loop if we're not running as a daemon
-		if !runAsDaemon {
+		if !s.daemon {
 			break
 		}
 
@@ -174,14 +285,14 @@ func loopServer() (err error) {
 }
 
 // refreshPubkey updates an existing Public key file
-func refreshPubkey(secret *keymgr.Secring) {
-	tmpKey := cfg.Files.Pubkey + ".tmp"
-	keyidstr := secret.WriteMyKey(tmpKey)
+func (s *Server) refreshPubkey() {
+	tmpKey := s.cfg.Files.Pubkey + ".tmp"
+	keyidstr := s.secret.WriteMyKey(tmpKey)
 	log.Infof("Advertising keyid: %s", keyidstr)
 	log.Tracef("Writing current public key to %s", tmpKey)
 	// Overwrite the published key with the refreshed version
-	log.Tracef("Renaming %s to %s", tmpKey, cfg.Files.Pubkey)
-	err := os.Rename(tmpKey, cfg.Files.Pubkey)
+	log.Tracef("Renaming %s to %s", tmpKey, s.cfg.Files.Pubkey)
+	err := os.Rename(tmpKey, s.cfg.Files.Pubkey)
 	if err != nil {
 		log.Warn(err)
 	}
@@ -189,8 +300,8 @@ func refreshPubkey(secret *keymgr.Secring) {
 
 // purgeSecring deletes old keys and counts active ones.  If no active keys
 // are found, it triggers a generation.
-func purgeSecring(secret *keymgr.Secring) (active int) {
-	active, expiring, expired, purged := secret.Purge()
+func (s *Server) purgeSecring() (active int) {
+	active, expiring, expired, purged := s.secret.Purge()
 	log.Infof(
 		"Key purge complete. Active=%d, Expiring=%d, Expired=%d, "+
 			"Purged=%d",
@@ -203,26 +314,35 @@ func purgeSecring(secret *keymgr.Secring) (active int) {
 }
 
 // generateKeypair creates a new keypair and publishes it
-func generateKeypair(secret *keymgr.Secring) {
+func (s *Server) generateKeypair() {
 	log.Info("Generating and advertising a new key pair")
-	pub, sec := eccGenerate()
-	keyidstr := secret.Insert(pub, sec)
+	pub, sec, err := packet.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keyidstr := s.secret.Insert(pub, sec)
+	// Every new key has an ML-KEM component for hybrid headers
+	_, kem, err := packet.GenerateKEMKey()
+	if err != nil {
+		panic(err)
+	}
+	s.secret.SetKEM(keyidstr, kem)
 	log.Infof("Generated new keypair with keyid: %s", keyidstr)
 	log.Info("Writing new Public Key to disc")
-	secret.WritePublic(pub, keyidstr)
+	s.secret.WritePublic(pub, keyidstr)
 	log.Info("Inserting Secret Key into Secring")
-	secret.WriteSecret(keyidstr)
+	s.secret.WriteSecret(keyidstr)
 }
 
 // idLogExpire deletes old entries in the ID Log
-func idLogExpire() {
-	count, deleted := IDDb.Expire()
+func (s *Server) idLogExpire() {
+	count, deleted := s.idDb.Expire()
 	log.Infof("ID Log: Expired=%d, Contains=%d", deleted, count)
 }
 
 // chunkClean expires entries from the chunk DB and deletes any stranded files
-func chunkClean() {
-	cret, cexp := ChunkDb.Expire()
+func (s *Server) chunkClean() {
+	cret, cexp := s.chunkDb.Expire()
 	if cexp > 0 {
 		log.Infof(
 			"Chunk expiry complete. Retained=%d, Expired=%d\n",
@@ -230,7 +350,7 @@ func chunkClean() {
 			cexp,
 		)
 	}
-	fret, fdel := ChunkDb.Housekeep()
+	fret, fdel := s.chunkDb.Housekeep()
 	if fdel > 0 {
 		log.Infof(
 			"Stranded chunk deletion: Retained=%d, Deleted=%d",
@@ -241,213 +361,298 @@ func chunkClean() {
 }
 
 // nagOperator prompts a remailer operator about poor practices.
-func nagOperator() {
+func (s *Server) nagOperator() {
 	// Complain about excessively small loop values.
-	if cfg.Pool.Loop < 60 {
+	if s.cfg.Pool.Loop < 60 {
 		log.Warnf(
 			"Loop time of %d is excessively low. Will loop "+
 				"every 60 seconds. A higher setting is recommended.",
-			cfg.Pool.Loop,
+			s.cfg.Pool.Loop,
 		)
 	}
 	// Complain about high pool rates.
-	if cfg.Pool.Rate > 90 && !flag.Send {
+	if s.cfg.Pool.Rate > 90 && !s.flush {
 		log.Warnf(
 			"Your pool rate of %d is excessively high. Unless "+
 				"testing, a lower setting is recommended.",
-			cfg.Pool.Rate,
+			s.cfg.Pool.Rate,
+		)
+	}
+	// Complain about the legacy max_size, which is now enforced
+	if s.cfg.Remailer.MaxSize == config.LegacyMaxSize {
+		log.Warnf(
+			"A max_size of %d kB is the legacy default and "+
+				"larger messages will not be delivered. The "+
+				"current default is %d kB.",
+			config.LegacyMaxSize,
+			config.DefaultMaxSize,
 		)
 	}
 	// Complain about running a remailer with flag_send
-	if flag.Send && flag.Remailer {
+	if s.flush {
 		log.Warnf(
 			"Your remailer will flush the outbound pool every "+
 				"%d seconds. Unless you're testing, this is "+
 				"probably not what you want.",
-			cfg.Pool.Loop,
+			s.cfg.Pool.Loop,
 		)
 	}
 }
 
-func createDirs() {
-	var err error
-	err = os.MkdirAll(cfg.Files.IDlog, 0700)
-	if err != nil {
-		log.Errorf(
-			"Failed to create %s. %s",
-			cfg.Files.IDlog,
-			err,
-		)
-		os.Exit(1)
-	}
-	err = os.MkdirAll(cfg.Files.Pooldir, 0700)
-	if err != nil {
-		log.Errorf(
-			"Failed to create %s. %s",
-			cfg.Files.Pooldir,
-			err,
-		)
-		os.Exit(1)
+// createDirs creates the directories used by the Server, if they don't
+// already exist.
+func (s *Server) createDirs() (err error) {
+	dirs := []string{
+		s.cfg.Files.IDlog,
+		s.cfg.Files.Pooldir,
+		s.cfg.Files.ChunkDB,
+		s.cfg.Files.Maildir,
+		path.Join(s.cfg.Files.Maildir, "new"),
+		path.Join(s.cfg.Files.Maildir, "cur"),
+		path.Join(s.cfg.Files.Maildir, "tmp"),
 	}
-	err = os.MkdirAll(cfg.Files.ChunkDB, 0700)
-	if err != nil {
-		log.Errorf(
-			"Failed to create %s. %s",
-			cfg.Files.ChunkDB,
-			err,
-		)
-		os.Exit(1)
+	for _, dir := range dirs {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Errorf("Failed to create %s. %s", dir, err)
+			return
+		}
 	}
-	err = os.MkdirAll(cfg.Files.Maildir, 0700)
+	return
+}
+
+// setHeaderKeys looks up the Secret Keys required to decrypt header in the
+// Secret Keyring.  Hybrid headers additionally require an ML-KEM key.
+func (s *Server) setHeaderKeys(header *packet.DecodeHeader) (err error) {
+	recipientKeyID := header.RecipientKeyID()
+	recipientSK, err := s.secret.GetSK(recipientKeyID)
 	if err != nil {
-		log.Errorf(
-			"Failed to create %s. %s",
-			cfg.Files.Maildir,
-			err,
-		)
-		os.Exit(1)
+		return
 	}
-	mdirnew := path.Join(cfg.Files.Maildir, "new")
-	err = os.MkdirAll(mdirnew, 0700)
+	err = header.SetRecipientSK(recipientSK)
 	if err != nil {
-		log.Errorf("Failed to create %s. %s", mdirnew, err)
-		os.Exit(1)
+		return
 	}
-	mdircur := path.Join(cfg.Files.Maildir, "cur")
-	err = os.MkdirAll(mdircur, 0700)
-	if err != nil {
-		log.Errorf("Failed to create %s. %s", mdircur, err)
-		os.Exit(1)
+	if header.Hybrid() {
+		var kem []byte
+		kem, err = s.secret.GetKEM(recipientKeyID)
+		if err != nil {
+			return
+		}
+		err = header.SetRecipientKEM(kem)
 	}
-	mdirtmp := path.Join(cfg.Files.Maildir, "tmp")
-	err = os.MkdirAll(mdirtmp, 0700)
-	if err != nil {
-		log.Errorf("Failed to create %s. %s", mdirtmp, err)
-		os.Exit(1)
+	return
+}
+
+// errDecodePanic is returned when decoding a message panics.
+var errDecodePanic = errors.New("panic during decoding")
+
+// recoverDecode must be deferred by decoders of inbound messages.  Decoders
+// shouldn't panic, however hostile the message, but if one does, this
+// converts the panic to an error so that one message can't kill the daemon.
+func recoverDecode(err *error) {
+	r := recover()
+	if r == nil {
+		return
 	}
+	*err = fmt.Errorf("%w: %v", errDecodePanic, r)
+	log.Tracef("%s", debug.Stack())
 }
 
 // decodeMsg is the actual YAMN message decoder.  It's output is always a
 // pooled file, either in the Inbound or Outbound queue.
-func decodeMsg(rawMsg []byte, secret *keymgr.Secring) (err error) {
-
-	// At this point, rawMsg should always be messageBytes in length
-	err = lenCheck(len(rawMsg), messageBytes)
+func (s *Server) decodeMsg(rawMsg []byte) (err error) {
+	defer recoverDecode(&err)
+	// At this point, rawMsg should always be the length of a classic or
+	// hybrid packet
+	d, err := packet.NewDecMessage(rawMsg)
 	if err != nil {
-		log.Error(err)
 		return
 	}
-
-	d := newDecMessage(rawMsg)
 	// Extract the top header
-	header := newDecodeHeader(d.getHeader())
-	recipientKeyID := header.getRecipientKeyID()
-	recipientSK, err := secret.GetSK(recipientKeyID)
+	header, err := packet.NewDecodeHeader(d.Header())
+	if err != nil {
+		return
+	}
+	err = s.setHeaderKeys(header)
 	if err != nil {
 		log.Warnf("Failed to ascertain Recipient SK: %s", err)
 		return
 	}
-	header.setRecipientSK(recipientSK)
 
-	slotDataBytes, packetVersion, err := header.decode()
+	slotDataBytes, packetVersion, err := header.Decode()
 	if err != nil {
 		log.Warnf("Header decode failed: %s", err)
 		return
 	}
+	// Convert the raw Slot Data Bytes to meaningful slotData.
+	slotData, err := packet.DecodeSlotData(slotDataBytes)
+	if err != nil {
+		return
+	}
 	switch packetVersion {
-	case 2:
-		err = decodeV2(d, slotDataBytes)
+	case packet.Version2:
+		err = s.decodeV2(d, slotData)
+	case packet.Version3:
+		err = s.decodeV3(d, slotData)
+	case packet.Version4:
+		err = s.decodeV4(d, slotData)
+	case packet.Version5, packet.Version6:
+		err = s.decodeV5(d, slotData, header)
 	default:
-		err = fmt.Errorf("cannot decode packet version %d", packetVersion)
+		err = &packet.VersionError{Version: packetVersion}
 	}
 	return
 }
 
-func decodeV2(d *decMessage, slotDataBytes []byte) (err error) {
-	// Convert the raw Slot Data Bytes to meaningful slotData.
-	slotData := decodeSlotData(slotDataBytes)
+// validSlotData performs the checks common to all packet versions before a
+// header is acted upon.  tagOK is the result of the version specific
+// anti-tag test.
+func (s *Server) validSlotData(slotData *packet.SlotData, tagOK bool) bool {
 	// Test uniqueness of packet ID
-	if !IDDb.Unique(slotData.getPacketID()) {
+	if !s.idDb.Unique(slotData.PacketID()) {
 		log.Trace("Discarding duplicate message (packet ID collision)")
-		return
+		return false
 	}
-	if !d.testAntiTag(slotData.getTagHash()) {
+	if !tagOK {
 		log.Warn("Anti-tag digest mismatch")
-		return
+		return false
 	}
-	if slotData.ageTimestamp() > cfg.Remailer.MaxAge {
+	if slotData.AgeTimestamp() > s.cfg.Remailer.MaxAge {
 		log.Warnf(
 			"Max packet age in days exceeded. Age=%d, Max=%d",
-			slotData.ageTimestamp(),
-			cfg.Remailer.MaxAge,
+			slotData.AgeTimestamp(),
+			s.cfg.Remailer.MaxAge,
 		)
-		return
+		return false
 	}
-	if slotData.ageTimestamp() < 0 {
+	if slotData.AgeTimestamp() < 0 {
 		log.Warn("Packet timestamp is in the future. Rejecting")
+		return false
+	}
+	return true
+}
+
+// intermediateHop decrypts an Intermediate packet and forwards it to the next
+// hop.  It's common to all packet versions.
+func (s *Server) intermediateHop(d *packet.DecMessage, slotData *packet.SlotData) (err error) {
+	d.ShiftHeaders()
+	// Decode Intermediate
+	inter, err := packet.DecodeIntermediate(slotData.PacketInfo())
+	if err != nil {
 		return
 	}
-	if slotData.getPacketType() == 0 {
-		d.shiftHeaders()
-		// Decode Intermediate
-		inter := decodeIntermediate(slotData.packetInfo)
-		d.decryptAll(slotData.aesKey, inter.aesIV12)
-		/*
-			The following conditional tests if we are the next hop
-			in addition to being the current hop.  If we are, then
-			it's better to store the message in the inbound pool.
-			This prevents it being emailed back to us.
-		*/
-		if inter.getNextHop() == cfg.Remailer.Address {
-			log.Info(
-				"Message loops back to us. ",
-				"Storing in pool instead of sending it.")
-			outfileName := randPoolFilename("i")
-			err = ioutil.WriteFile(
-				outfileName,
-				d.getPayload(),
-				0600,
-			)
-			if err != nil {
-				log.Warnf("Failed to write to pool: %s", err)
-				return
-			}
-			stats.outLoop++
+	err = d.DecryptAll(slotData.AesKey(), inter.PartialIV())
+	if err != nil {
+		return
+	}
+	/*
+		The following conditional tests if we are the next hop
+		in addition to being the current hop.  If we are, then
+		it's better to store the message in the inbound pool.
+		This prevents it being emailed back to us.  Any delay
+		requested of this hop is not honoured in that case.
+	*/
+	if inter.NextHop() == s.cfg.Remailer.Address {
+		log.Info(
+			"Message loops back to us. ",
+			"Storing in pool instead of sending it.")
+		outfileName := s.randPoolFilename("i")
+		err = ioutil.WriteFile(
+			outfileName,
+			d.Payload(),
+			0600,
+		)
+		if err != nil {
+			log.Warnf("Failed to write to pool: %s", err)
+			return
+		}
+		s.stats.outLoop++
+	} else {
+		if inter.Delay() > 0 {
+			s.holdMessage(inter.NextHop(), d.Payload(), inter.Delay())
 		} else {
-			writeMessageToPool(inter.getNextHop(), d.getPayload())
-			stats.outYamn++
-			// Decide if we want to inject a dummy
-			if !flag.NoDummy && crandom.Dice() < 55 {
-				dummy()
-				stats.outDummy++
-			}
-		} // End of local or remote delivery
-	} else if slotData.getPacketType() == 1 {
+			s.writeMessageToPool(inter.NextHop(), d.Payload())
+		}
+		s.stats.outYamn++
+		// Decide if we want to inject a dummy
+		if !s.noDummy && crandom.Dice() < 55 {
+			s.dummy()
+			s.stats.outDummy++
+		}
+	} // End of local or remote delivery
+	return
+}
+
+func (s *Server) decodeV2(d *packet.DecMessage, slotData *packet.SlotData) (err error) {
+	if !s.validSlotData(slotData, d.TestAntiTag(slotData.TagHash())) {
+		return
+	}
+	err = s.routeHop(d, slotData)
+	return
+}
+
+// decodeV5 processes packets authenticated by per-hop MACs.  Once the MAC
+// is verified, they're handled as per v2.  Version 6 differs only in the
+// format of its Final Hop header.
+func (s *Server) decodeV5(d *packet.DecMessage, slotData *packet.SlotData, header *packet.DecodeHeader) (err error) {
+	key, err := header.MACKey()
+	if err != nil {
+		return
+	}
+	if !s.validSlotData(slotData, d.TestMAC(key, slotData.TagHash())) {
+		return
+	}
+	err = s.routeHop(d, slotData)
+	return
+}
+
+// routeHop acts upon a validated Intermediate or Exit header.
+func (s *Server) routeHop(d *packet.DecMessage, slotData *packet.SlotData) (err error) {
+	if slotData.PacketType() == packet.PacketTypeIntermediate {
+		err = s.intermediateHop(d, slotData)
+	} else if slotData.PacketType() == packet.PacketTypeExit {
 		// Decode Exit
-		final := decodeFinal(slotData.packetInfo)
-		if final.getDeliveryMethod() == 255 {
+		var final *packet.SlotFinal
+		final, err = packet.DecodeFinalVersion(
+			slotData.PacketInfo(),
+			slotData.Version(),
+		)
+		if err != nil {
+			return
+		}
+		if final.DeliveryMethod() == packet.DeliveryDummy {
 			log.Trace("Discarding dummy message")
-			stats.inDummy++
+			s.stats.inDummy++
 			return
 		}
 		// Decrypt the payload body
 		// This could be done under Delivery Method 0 but, future
 		// delivery methods (other than dummies) will require a
 		// decrypted body.
-		plain := d.decryptBody(
-			slotData.getAesKey(),
-			final.getAesIV(),
-			final.getBodyBytes(),
+		var plain []byte
+		plain, err = d.DecryptBody(
+			slotData.AesKey(),
+			final.AesIV(),
+			final.BodyBytes(),
 		)
+		if err != nil {
+			return
+		}
 		// Test delivery methods
-		switch final.getDeliveryMethod() {
-		case 0:
-			stats.inYamn++
-			if !cfg.Remailer.Exit {
-				if final.numChunks == 1 {
+		switch final.DeliveryMethod() {
+		case packet.DeliverySMTP:
+			s.stats.inYamn++
+			if !s.cfg.Remailer.Exit {
+				if final.NumChunks() == 1 {
 					// Need to randhop as we're not an exit
-					// remailer
-					randhop(plain)
+					// remailer.  The random exit may not
+					// support compression or padding.
+					plain, err = final.Expand(plain)
+					if err != nil {
+						return
+					}
+					s.randhop(plain)
 				} else {
 					log.Warn(
 						"Randhopping doesn't support " +
@@ -458,168 +663,373 @@ func decodeV2(d *decMessage, slotDataBytes []byte) (err error) {
 				}
 				return
 			}
-			smtpMethod(plain, final)
+			s.smtpMethod(plain, final)
+		case packet.DeliveryNews:
+			s.stats.inYamn++
+			if !s.newsEnabled() {
+				// Unlike SMTP, there's no randhop as the
+				// random exit may not post either.
+				log.Warn("Dropping Usenet article. Posting is not configured")
+				return
+			}
+			s.exitMethod(plain, final, "n")
 		default:
 			log.Warnf(
 				"Unsupported Delivery Method: %d",
-				final.getDeliveryMethod(),
+				final.DeliveryMethod(),
 			)
 			return
 		}
 	} else {
 		log.Warnf(
 			"Unknown Packet Type: %d",
-			slotData.getPacketType(),
+			slotData.PacketType(),
+		)
+		return
+	}
+	return
+}
+
+// decodeV3 processes packets encoded by Reply Blocks.  Intermediate hops are
+// handled as per v2 but the Exit hop delivers the still encrypted packet to
+// the Reply Block owner.
+func (s *Server) decodeV3(d *packet.DecMessage, slotData *packet.SlotData) (err error) {
+	// The body of a reply is unknown to the Reply Block creator so the
+	// anti-tag digest only covers the headers.
+	if !s.validSlotData(slotData, d.TestHeaderTag(slotData.TagHash())) {
+		return
+	}
+	switch slotData.PacketType() {
+	case packet.PacketTypeIntermediate:
+		err = s.intermediateHop(d, slotData)
+	case packet.PacketTypeExit:
+		var final *packet.SlotFinal
+		final, err = packet.DecodeFinal(slotData.PacketInfo())
+		if err != nil {
+			return
+		}
+		if final.DeliveryMethod() != packet.DeliveryReply {
+			log.Warnf(
+				"Unsupported v3 Delivery Method: %d",
+				final.DeliveryMethod(),
+			)
+			return
+		}
+		s.stats.inReply++
+		if !s.cfg.Remailer.Exit {
+			// Randhopping would expose the reply to a second Exit
+			// without an owner to deliver it to.
+			log.Warn("Reply Block delivery requires an exit remailer")
+			return
+		}
+		err = s.replyMethod(d, final)
+	default:
+		log.Warnf(
+			"Unknown Packet Type: %d",
+			slotData.PacketType(),
+		)
+	}
+	return
+}
+
+// decodeV4 processes Intermediate packets that carry a sender-specified
+// delay.  Exit hops are always encoded as Version 2.
+func (s *Server) decodeV4(d *packet.DecMessage, slotData *packet.SlotData) (err error) {
+	if !s.validSlotData(slotData, d.TestAntiTag(slotData.TagHash())) {
+		return
+	}
+	if slotData.PacketType() != packet.PacketTypeIntermediate {
+		log.Warnf(
+			"Unsupported v4 Packet Type: %d",
+			slotData.PacketType(),
 		)
 		return
 	}
+	err = s.intermediateHop(d, slotData)
 	return
 }
 
+// replyMethod decodes the Reply Block owner's address from the header below
+// the Exit header and pools the armored packet for delivery to them.
+func (s *Server) replyMethod(d *packet.DecMessage, final *packet.SlotFinal) (err error) {
+	ownerHeader, err := d.HeaderAt(1)
+	if err != nil {
+		return
+	}
+	header, err := packet.NewDecodeHeader(ownerHeader)
+	if err != nil {
+		return
+	}
+	err = s.setHeaderKeys(header)
+	if err != nil {
+		log.Warnf("Failed to ascertain Reply Block owner SK: %s", err)
+		return
+	}
+	ownerBytes, _, err := header.Decode()
+	if err != nil {
+		log.Warnf("Reply Block owner decode failed: %s", err)
+		return
+	}
+	owner, err := packet.DecodeOwner(ownerBytes)
+	if err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "To: %s\n", owner.Address())
+	fmt.Fprintf(buf, "Subject: yamn-reply\n")
+	fmt.Fprintf(buf, "%s: %x\n\n", client.ReplyHeader, final.MessageID())
+	err = packet.Armor(buf, d.Payload(), version)
+	if err != nil {
+		return
+	}
+	s.writePlainToPool(buf.Bytes(), "m")
+	s.stats.outReply++
+	return
+}
+
+// maxMessageBytes returns the size of the largest message this remailer will
+// deliver.  A max_size of zero imposes no limit beyond the packet format.
+func (s *Server) maxMessageBytes() int {
+	size := s.cfg.Remailer.MaxSize
+	if size <= 0 {
+		return packet.MaxDecompressedBytes
+	}
+	return min(size*1024, packet.MaxDecompressedBytes)
+}
+
 // smtpMethod is concerned with final-hop processing.
-func smtpMethod(plain []byte, final *slotFinal) {
+func (s *Server) smtpMethod(plain []byte, final *packet.SlotFinal) {
+	s.exitMethod(plain, final, "e")
+}
+
+// exitMethod expands plain, or assembles it with its sibling chunks, and
+// writes the resulting message to the pool with the given prefix.
+func (s *Server) exitMethod(plain []byte, final *packet.SlotFinal, prefix string) {
 	var err error
-	if final.getNumChunks() == 1 {
+	if final.NumChunks() == 1 {
 		// If this is a single chunk message, pool it and get out.
-		writePlainToPool(plain, "m")
-		stats.outPlain++
+		buf := new(bytes.Buffer)
+		_, err = final.ExpandTo(buf, bytes.NewReader(plain), s.maxMessageBytes())
+		if err != nil {
+			log.Warnf("Message expansion failed: %s", err)
+			return
+		}
+		s.writePlainToPool(buf.Bytes(), prefix)
+		s.stats.outPlain++
+		return
+	}
+	// Refuse chunks of messages that can't be within the size limit
+	// before they consume space in the pool.  Assembly enforces the
+	// limit on the expanded message.
+	maxChunks := (s.maxMessageBytes() + packet.PadOverhead + client.MaxFragLength - 1) /
+		client.MaxFragLength
+	if final.NumChunks() > maxChunks {
+		log.Warnf(
+			"Message exceeds maximum size. MsgID=%x, Chunks=%d, Max=%d",
+			final.MessageID(),
+			final.NumChunks(),
+			maxChunks,
+		)
 		return
 	}
 	// We're an exit and this is a multi-chunk message
-	chunkFilename := writePlainToPool(plain, "p")
+	chunkFilename := s.writeChunkToPool(plain)
 	log.Tracef(
 		"Pooled partial chunk. MsgID=%x, Num=%d, "+
 			"Parts=%d, Filename=%s",
-		final.getMessageID(),
-		final.getChunkNum(),
-		final.getNumChunks(),
+		final.MessageID(),
+		final.ChunkNum(),
+		final.NumChunks(),
 		chunkFilename,
 	)
-	// Fetch the chunks info from the DB for the given message ID
-	chunks := ChunkDb.Get(final.getMessageID(), final.getNumChunks())
-	// This saves losts of -1's as slices start at 0 and chunks at 1
-	cslot := final.getChunkNum() - 1
-	// Test that the slot for this chunk is empty
-	if chunks[cslot] != "" {
-		log.Warnf(
-			"Duplicate chunk %d in MsgID: %x",
-			final.chunkNum,
-			final.messageID,
-		)
+	complete, err := s.chunkDb.Insert(
+		final.MessageID(),
+		final.ChunkNum(),
+		final.NumChunks(),
+		chunkFilename,
+	)
+	if err != nil {
+		log.Warnf("Chunk rejected. MsgID=%x: %s", final.MessageID(), err)
+		s.chunkDb.DeleteItems([]string{chunkFilename})
+		return
+	}
+	if !complete {
+		return
 	}
-	// Insert the new chunk into the slice
-	chunks[cslot] = chunkFilename
+	newPoolFile := s.randPoolFilename(prefix)
 	log.Tracef(
-		"Chunk state: %s",
-		strings.Join(chunks, ","),
+		"Assembling chunked message into %s",
+		newPoolFile,
 	)
-	// Test if all chunk slots are populated
-	if IsPopulated(chunks) {
-		newPoolFile := randPoolFilename("m")
-		log.Tracef(
-			"Assembling chunked message into %s",
-			newPoolFile,
-		)
-		err = ChunkDb.Assemble(newPoolFile, chunks)
-		if err != nil {
-			log.Warnf("Chunk assembly failed: %s", err)
-			// Don't return here or the bad chunk will remain in
-			// the DB.
-		}
-		// Now the message is assembled into the Pool, the DB record
-		// can be deleted
-		ChunkDb.Delete(final.getMessageID())
-		stats.outPlain++
-	} else {
-		// Write the updated chunk status to
-		// the DB
-		ChunkDb.Insert(final.getMessageID(), chunks)
+	err = s.chunkDb.Assemble(
+		newPoolFile,
+		s.chunkDb.Items(final.MessageID()),
+		final,
+		s.maxMessageBytes(),
+	)
+	// Whether or not assembly succeeded, the chunks have been consumed
+	// and the DB record can be deleted
+	s.chunkDb.Delete(final.MessageID())
+	if err != nil {
+		log.Warnf("Chunk assembly failed: %s", err)
+		return
+	}
+	s.stats.outPlain++
+}
+
+// outboundPool returns a PoolWriter for the Server's pool directory
+func (s *Server) outboundPool() *client.DirPool {
+	return &client.DirPool{
+		Dir:     s.cfg.Files.Pooldir,
+		From:    s.cfg.Remailer.Address,
+		Version: version,
+	}
+}
+
+// newClient returns a YAMN client that encodes messages using the Server's
+// Public Keyring and writes them to its outbound pool.  As remailers cannot
+// be selective about the messages they handle, chain selection criteria are
+// relaxed.
+func (s *Server) newClient(chain []string) (*client.Client, error) {
+	return client.New(client.Config{
+		Pubring: s.pubring,
+		Stats: client.Stats{
+			Minlat:   s.cfg.Stats.Minlat,
+			Maxlat:   s.cfg.Stats.Maxlat,
+			Minrel:   s.cfg.Stats.Minrel,
+			Relfinal: s.cfg.Stats.Relfinal,
+			Distance: s.cfg.Stats.Distance,
+			StaleHrs: s.cfg.Stats.StaleHrs,
+		},
+		Chain:   chain,
+		Copies:  1,
+		Pool:    s.outboundPool(),
+		Relaxed: true,
+		// Remailers make their own decisions about dummy injection
+		NoDummy: true,
+	})
+}
+
+// dummy sends a dummy message through the client's default dummy chain of
+// two random remailers
+func (s *Server) dummy() {
+	c, err := s.newClient([]string{"*"})
+	if err != nil {
+		log.Warnf("Dummy creation failed: %s", err)
+		return
+	}
+	_, err = c.Dummy()
+	if err != nil {
+		log.Warnf("Dummy creation failed: %s", err)
 	}
 }
 
 // randhop is a simplified client function that does single-hop encodings
-func randhop(plainMsg []byte) {
-	var err error
+func (s *Server) randhop(plainMsg []byte) {
 	if len(plainMsg) == 0 {
 		log.Info("Zero-byte message during randhop, ignoring it.")
 		return
 	}
 	// Make a single hop chain with a random node
-	inChain := []string{"*"}
-	final := newSlotFinal()
-	var chain []string
-	chain, err = makeChain(inChain)
+	c, err := s.newClient([]string{"*"})
 	if err != nil {
 		log.Warn(err)
 		return
 	}
-	sendTo := chain[0]
-	if len(chain) != 1 {
-		err = fmt.Errorf("randhop chain must be single hop.  Got=%d", len(chain))
-		panic(err)
+	receipt, err := c.SendBytes(plainMsg)
+	if err != nil {
+		log.Warnf("Randhop encoding failed: %s", err)
+		return
 	}
-	log.Tracef("Performing a random hop to Exit Remailer: %s.", chain[0])
-	yamnMsg := encodeMsg(plainMsg, chain, *final)
-	writeMessageToPool(sendTo, yamnMsg)
-	stats.outRandhop++
+	for _, chain := range receipt.Chains {
+		log.Tracef("Performed a random hop to Exit Remailer: %s.", chain[0])
+	}
+	s.stats.outRandhop++
 }
 
 // remailerFoo responds to requests for remailer-* info
-func remailerFoo(subject, sender string) (err error) {
+func (s *Server) remailerFoo(subject, sender string) (err error) {
 	m := quickmail.NewMessage()
-	m.Set("From", cfg.Remailer.Address)
+	m.Set("From", s.cfg.Remailer.Address)
 	m.Set("To", sender)
 	if strings.HasPrefix(subject, "remailer-key") {
 		// remailer-key
 		log.Tracef("remailer-key request from %s", sender)
-		m.Set("Subject", fmt.Sprintf("Remailer key for %s", cfg.Remailer.Name))
-		m.Filename = cfg.Files.Pubkey
+		m.Set("Subject", fmt.Sprintf("Remailer key for %s", s.cfg.Remailer.Name))
+		m.Filename = s.cfg.Files.Pubkey
 		m.Prefix = "Here is the Mixmaster key:\n\n=-=-=-=-=-=-=-=-=-=-=-="
 	} else if strings.HasPrefix(subject, "remailer-conf") {
 		// remailer-conf
 		log.Tracef("remailer-conf request from %s", sender)
 		m.Set(
 			"Subject",
-			fmt.Sprintf("Capabilities of the %s remailer", cfg.Remailer.Name))
+			fmt.Sprintf("Capabilities of the %s remailer", s.cfg.Remailer.Name))
 		m.Text(fmt.Sprintf("Remailer-Type: Mixmaster %s\n", version))
 		m.Text("Supported Formats:\n   Mixmaster\n")
-		m.Text(fmt.Sprintf("Pool size: %d\n", cfg.Pool.Size))
-		m.Text(fmt.Sprintf("Maximum message size: %d kB\n", cfg.Remailer.MaxSize))
+		if s.cfg.Gateway.Enabled {
+			m.Text("   Type I (plaintext Anon-To gateway)\n")
+		}
+		m.Text(fmt.Sprintf("Pool size: %d\n", s.cfg.Pool.Size))
+		m.Text(fmt.Sprintf("Maximum message size: %d kB\n", s.maxMessageBytes()/1024))
 		m.Text("The following header lines will be filtered:\n")
+		var filter *headerFilter
+		filter, err = s.headerFilter()
+		if err != nil {
+			log.Warnf("Invalid header filter: %s", err)
+		} else {
+			for _, line := range filter.describe() {
+				m.Text(fmt.Sprintf("   %s\n", line))
+			}
+		}
 		m.Text(
 			fmt.Sprintf("\n$remailer{\"%s\"} = \"<%s>",
-				cfg.Remailer.Name, cfg.Remailer.Address))
-		if !cfg.Remailer.Exit {
+				s.cfg.Remailer.Name, s.cfg.Remailer.Address))
+		if !s.cfg.Remailer.Exit {
 			m.Text(" middle")
+		} else if s.newsEnabled() {
+			m.Text(" post")
 		}
-		packetVersions := []string{"v2"}
+		packetVersions := []string{"v2", "v3", "v4", "v5", "v6"}
 		for _, v := range packetVersions {
 			m.Text(fmt.Sprintf(" %s", v))
 		}
 		m.Text("\";\n")
 		m.Text("\nSUPPORTED MIXMASTER (TYPE II) REMAILERS")
 		var pubList []string
-		pubList, err := keymgr.Headers(cfg.Files.Pubring)
+		pubList, err := keymgr.Headers(s.cfg.Files.Pubring)
 		if err != nil {
-			log.Infof("Could not read %s", cfg.Files.Pubring)
+			log.Infof("Could not read %s", s.cfg.Files.Pubring)
 		} else {
 			m.List(pubList)
 		}
+	} else if strings.HasPrefix(subject, "remailer-block") {
+		// remailer-block
+		log.Trace("remailer-block request")
+		var blockSubject, reply string
+		blockSubject, reply, err = s.blockRequest(
+			strings.TrimPrefix(subject, "remailer-block"),
+			sender,
+		)
+		if err != nil {
+			return
+		}
+		m.Set("Subject", blockSubject)
+		m.Text(reply)
 	} else if strings.HasPrefix(subject, "remailer-adminkey") {
 		// remailer-adminkey
 		log.Tracef("remailer-adminkey request from %s", sender)
 		m.Set(
 			"Subject",
-			fmt.Sprintf("Admin key for the %s remailer", cfg.Remailer.Name))
-		m.Filename = cfg.Files.Adminkey
+			fmt.Sprintf("Admin key for the %s remailer", s.cfg.Remailer.Name))
+		m.Filename = s.cfg.Files.Adminkey
 	} else if strings.HasPrefix(subject, "remailer-help") {
 		// remailer-help
 		log.Tracef("remailer-help request from %s", sender)
 		m.Set(
 			"Subject",
 			fmt.Sprintf("Your help request for the %s Anonymous Remailer",
-				cfg.Remailer.Name))
-		m.Filename = cfg.Files.Help
+				s.cfg.Remailer.Name))
+		m.Filename = s.cfg.Files.Help
 	} else {
 		if len(subject) > 20 {
 			// Truncate long subject headers before logging them
@@ -634,7 +1044,7 @@ func remailerFoo(subject, sender string) (err error) {
 		log.Infof("Unable to send %s", subject)
 		return
 	}
-	err = mailBytes(msg, []string{sender})
+	err = s.sendMail(msg, []string{sender})
 	if err != nil {
 		log.Warnf("Failed to send %s to %s", subject, sender)
 		return
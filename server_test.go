@@ -0,0 +1,2283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/client"
+	"github.com/crooks/yamn/config"
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/mix2"
+	"github.com/crooks/yamn/packet"
+	"github.com/crooks/yamn/ratelimit"
+	"github.com/luksen/maildir"
+)
+
+// testMail2News is the mail2news gateway of test exit remailers
+const testMail2News = "mail2news@example.com"
+
+// testNetwork is a collection of Servers that exchange mail in memory
+type testNetwork struct {
+	servers   map[string]*Server // Servers keyed by address
+	delivered []string           // Messages delivered to non-remailers
+}
+
+// deliver routes a mail message to the Maildir of the addressed remailer.
+// Anything else is retained as a final delivery.
+func (n *testNetwork) deliver(payload []byte, sendTo []string) error {
+	for _, addy := range sendTo {
+		s, ok := n.servers[addy]
+		if !ok {
+			n.delivered = append(n.delivered, string(payload))
+			continue
+		}
+		newmsg, err := maildir.Dir(s.cfg.Files.Maildir).NewDelivery()
+		if err != nil {
+			return err
+		}
+		newmsg.Write(payload)
+		err = newmsg.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTestServer opens a Server rooted in its own directory.  All Servers
+// share the pubring.mix in dir.
+func (n *testNetwork) newTestServer(t *testing.T, dir, name string, exit bool) *Server {
+	c := config.NewConfig(path.Join(dir, name))
+	c.Files.Pubring = path.Join(dir, "pubring.mix")
+	c.Urls.Fetch = false
+	c.Remailer.Name = name
+	c.Remailer.Address = name + "@remailer.invalid"
+	c.Remailer.Exit = exit
+	if exit {
+		// Exits advertise Usenet posting.  Without an NNTP server,
+		// articles are delivered to the mail2news gateway.
+		c.News.Mail2News = testMail2News
+	}
+	s := newServer(c)
+	s.noDummy = true
+	s.sendMail = n.deliver
+	err := s.open()
+	if err != nil {
+		t.Fatalf("%s: open failed: %s", name, err)
+	}
+	n.servers[c.Remailer.Address] = s
+	return s
+}
+
+// newThreeHops creates a network of three remailers, the last of which is an
+// exit, and a client that chains through them in order.  The client options
+// in conf are supplemented with the keyring, chain and pool.
+func newThreeHops(t *testing.T, conf client.Config) (n *testNetwork, servers []*Server, c *client.Client, clientPool string) {
+	dir := t.TempDir()
+	n = &testNetwork{servers: make(map[string]*Server)}
+	names := []string{"alpha", "beta", "gamma"}
+	for i, name := range names {
+		// The final remailer in the chain is an exit
+		s := n.newTestServer(t, dir, name, i == len(names)-1)
+		t.Cleanup(s.close)
+		servers = append(servers, s)
+	}
+	// Publish every remailer's key.txt in the shared pubring
+	var pubring bytes.Buffer
+	for _, s := range servers {
+		key, err := os.ReadFile(s.cfg.Files.Pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubring.Write(key)
+		pubring.WriteString("\n")
+	}
+	pubringFile := path.Join(dir, "pubring.mix")
+	err := os.WriteFile(pubringFile, pubring.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		err = s.pubring.ImportPubring()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clientPubring := keymgr.NewPubring(pubringFile, path.Join(dir, "mlist2.txt"))
+	err = clientPubring.ImportPubring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPool = path.Join(dir, "client")
+	err = os.Mkdir(clientPool, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Pubring = clientPubring
+	conf.Chain = names
+	conf.Pool = &client.DirPool{Dir: clientPool, Version: version}
+	conf.NoDummy = true
+	c, err = client.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// inject posts a pooled client message to the entry remailer and has each
+// remailer in turn process and forward it.
+func (n *testNetwork) inject(t *testing.T, servers []*Server, pooled string) {
+	payload, err := os.ReadFile(pooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.deliver(payload, []string{servers[0].cfg.Remailer.Address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		s.process()
+		s.poolOutboundSend()
+	}
+}
+
+func TestThreeHops(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	names := []string{"alpha", "beta", "gamma"}
+
+	// Encode a message for the chain and post it to the entry remailer
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: recipient@example.com\nSubject: Test\n\nHello World\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled := path.Join(clientPool, receipt.Filenames[0])
+	// Every remailer advertises an ML-KEM key so hybrid headers are used
+	f, err := os.Open(pooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := packet.StripArmor(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != packet.HybridMessageBytes {
+		t.Errorf("expected a hybrid packet, got %d bytes", len(payload))
+	}
+	// Each remailer decodes its hop and mails it onward
+	n.inject(t, servers, pooled)
+	for i, s := range servers {
+		if s.stats.inMail != 1 {
+			t.Errorf("%s: expected 1 inbound mail, got %d", names[i], s.stats.inMail)
+		}
+	}
+	if servers[0].stats.outYamn != 1 || servers[1].stats.outYamn != 1 {
+		t.Error("intermediate remailers failed to forward the message")
+	}
+	if servers[2].stats.outPlain != 1 {
+		t.Errorf("exit remailer delivered %d messages", servers[2].stats.outPlain)
+	}
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+	final, err := mail.ReadMessage(strings.NewReader(n.delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.Header.Get("To") != "recipient@example.com" {
+		t.Errorf("unexpected recipient: %s", final.Header.Get("To"))
+	}
+	var body bytes.Buffer
+	body.ReadFrom(final.Body)
+	if !strings.Contains(body.String(), "Hello World") {
+		t.Errorf("message body not delivered: %q", body.String())
+	}
+}
+
+// testArticle is a Usenet article that includes headers an Exit must filter
+const testArticle = "Newsgroups: alt.test\n" +
+	"Subject: Test\n" +
+	"Path: forged!not-for-mail\n" +
+	"Control: cancel <forged@example.com>\n" +
+	"Approved: moderator@example.com\n" +
+	"\n" +
+	"Hello World\n" +
+	".\n"
+
+// sendArticle encodes testArticle for the three hops and injects it
+func sendArticle(t *testing.T, n *testNetwork, servers []*Server, c *client.Client, clientPool string) {
+	receipt, err := c.SendBytes([]byte(testArticle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.inject(t, servers, path.Join(clientPool, receipt.Filenames[0]))
+	if servers[2].stats.outNews != 1 {
+		t.Errorf("exit remailer posted %d articles", servers[2].stats.outNews)
+	}
+}
+
+// testFiltered confirms an article was filtered and posted intact
+func testFiltered(t *testing.T, article string) {
+	msg, err := mail.ReadMessage(strings.NewReader(article))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Newsgroups") != "alt.test" {
+		t.Errorf("unexpected Newsgroups: %s", msg.Header.Get("Newsgroups"))
+	}
+	for _, h := range []string{"Path", "Control", "Approved"} {
+		if msg.Header.Get(h) != "" {
+			t.Errorf("%s header was not filtered", h)
+		}
+	}
+	if msg.Header.Get("Message-Id") == "" || msg.Header.Get("From") == "" {
+		t.Error("exit failed to add required headers")
+	}
+	var body bytes.Buffer
+	body.ReadFrom(msg.Body)
+	if body.String() != "Hello World\n.\n" {
+		t.Errorf("unexpected article body: %q", body.String())
+	}
+}
+
+func TestNewsMail2News(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	sendArticle(t, n, servers, c, clientPool)
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 gateway delivery, got %d", len(n.delivered))
+	}
+	testFiltered(t, n.delivered[0])
+	if !strings.Contains(n.delivered[0], "To: "+testMail2News+"\n") {
+		t.Error("article was not addressed to the mail2news gateway")
+	}
+}
+
+func TestNewsNNTP(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	servers[2].cfg.News.NNTPServer = l.Addr().String()
+	posted := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		tp := textproto.NewConn(conn)
+		defer tp.Close()
+		tp.PrintfLine("200 Test server ready")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch line {
+			case "POST":
+				tp.PrintfLine("340 Send article")
+				article, _ := tp.ReadDotBytes()
+				posted <- string(article)
+				tp.PrintfLine("240 Article received")
+			case "QUIT":
+				tp.PrintfLine("205 Bye")
+				return
+			default:
+				tp.PrintfLine("500 Unknown command")
+			}
+		}
+	}()
+	sendArticle(t, n, servers, c, clientPool)
+	if len(n.delivered) != 0 {
+		t.Errorf("article was mailed instead of posted")
+	}
+	select {
+	case article := <-posted:
+		testFiltered(t, article)
+	default:
+		t.Fatal("NNTP server received no article")
+	}
+}
+
+func TestNewsDisabled(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	// The client selected gamma as it advertises posting.  If it then
+	// stops, articles are dropped.
+	servers[2].cfg.News.Mail2News = ""
+	receipt, err := c.SendBytes([]byte(testArticle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.inject(t, servers, path.Join(clientPool, receipt.Filenames[0]))
+	if len(n.delivered) != 0 || servers[2].stats.outPlain != 0 {
+		t.Error("article was delivered by an exit that doesn't post")
+	}
+}
+
+func TestTaggedPacket(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: recipient@example.com\nSubject: Test\n\nHello World\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled := path.Join(clientPool, receipt.Filenames[0])
+	f, err := os.Open(pooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := packet.StripArmor(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tag the body and re-pool the packet
+	payload[len(payload)-100] ^= 0x01
+	var buf bytes.Buffer
+	buf.WriteString("To: alpha@remailer.invalid\n\n")
+	err = packet.Armor(&buf, payload, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(pooled, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.inject(t, servers, pooled)
+	if servers[0].stats.outYamn != 0 {
+		t.Error("entry remailer forwarded a tagged packet")
+	}
+	if len(n.delivered) != 0 {
+		t.Error("tagged packet was delivered")
+	}
+}
+
+func TestReplyBlock(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	block, secret, err := c.NewReplyBlock("owner@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.EntryHop != "alpha@remailer.invalid" {
+		t.Errorf("unexpected entry hop: %s", block.EntryHop)
+	}
+	// The Reply Block is passed to a correspondent in encoded form
+	encoded, err := block.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err = packet.DecodeReplyBlock(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename, err := c.SendReply(block, []byte("Hello Owner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.inject(t, servers, path.Join(clientPool, filename))
+	if servers[2].stats.inReply != 1 || servers[2].stats.outReply != 1 {
+		t.Fatal("exit remailer failed to deliver the reply")
+	}
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+	final, err := mail.ReadMessage(strings.NewReader(n.delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.Header.Get("To") != "owner@example.com" {
+		t.Errorf("unexpected recipient: %s", final.Header.Get("To"))
+	}
+	if final.Header.Get(client.ReplyHeader) != hex.EncodeToString(secret.ID) {
+		t.Errorf("unexpected reply block ID: %s", final.Header.Get(client.ReplyHeader))
+	}
+	plain, err := client.ReadReply(final.Body, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "Hello Owner" {
+		t.Errorf("unexpected reply: %q", plain)
+	}
+
+	// Reply Blocks are single use
+	filename, err = c.SendReply(block, []byte("Hello Again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.inject(t, servers, path.Join(clientPool, filename))
+	if len(n.delivered) != 1 {
+		t.Error("reused Reply Block was delivered")
+	}
+}
+
+// expireHeld rewrites the release time of all the held messages in a
+// Server's pool so that they're due for sending.
+func expireHeld(t *testing.T, s *Server) {
+	held, err := readDir(s.cfg.Files.Pooldir, "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range held {
+		err = os.Rename(
+			path.Join(s.cfg.Files.Pooldir, f),
+			path.Join(s.cfg.Files.Pooldir, "h0000000000000000"+f[17:]),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHopDelay(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{Delay: time.Hour})
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: recipient@example.com\nSubject: Test\n\nHello World\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry remailer holds the message rather than pooling it
+	n.inject(t, servers, path.Join(clientPool, receipt.Filenames[0]))
+	if servers[0].stats.outHeld != 1 {
+		t.Fatalf("expected 1 held message, got %d", servers[0].stats.outHeld)
+	}
+	if servers[1].stats.inMail != 0 {
+		t.Fatal("held message was forwarded before its release time")
+	}
+	// Each intermediate hop releases the message once its delay expires
+	for i, s := range servers {
+		s.process()
+		expireHeld(t, s)
+		s.releaseHeld()
+		if i < 2 && s.stats.outHeld != 1 {
+			t.Errorf("%s: expected 1 held message, got %d", s.cfg.Remailer.Name, s.stats.outHeld)
+		}
+	}
+	// The exit hop isn't delayed
+	if servers[2].stats.outHeld != 0 {
+		t.Error("exit remailer held the message")
+	}
+	servers[2].poolOutboundSend()
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+	held, err := readDir(servers[0].cfg.Files.Pooldir, "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 0 {
+		t.Errorf("released messages remain in the pool: %v", held)
+	}
+}
+
+func TestHoldMaximum(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := os.MkdirAll(s.cfg.Files.Pooldir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A zero max_hold releases messages on the next pass
+	s.cfg.Pool.MaxHold = 0
+	var sent int
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		sent++
+		return nil
+	}
+	s.holdMessage("next@remailer.invalid", make([]byte, packet.MessageBytes), time.Hour)
+	s.releaseHeld()
+	if sent != 1 {
+		t.Fatalf("expected 1 released message, got %d", sent)
+	}
+}
+
+func TestCompressedMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression int
+	}{
+		{"deflate", packet.CompressDeflate},
+		{"zstd", packet.CompressZstd},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, servers, c, clientPool := newThreeHops(
+				t,
+				client.Config{Compression: test.compression},
+			)
+			// Uncompressed, the body would require three chunks
+			body := strings.Repeat("> Quoted history\n", 2*client.MaxFragLength/17+100)
+			msg, err := mail.ReadMessage(strings.NewReader(
+				"To: recipient@example.com\nSubject: Test\n\n" + body,
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			receipt, err := c.Send(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if receipt.Chunks != 1 {
+				t.Fatalf("expected 1 compressed chunk, got %d", receipt.Chunks)
+			}
+			n.inject(t, servers, path.Join(clientPool, receipt.Filenames[0]))
+			if len(n.delivered) != 1 {
+				t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+			}
+			final, err := mail.ReadMessage(strings.NewReader(n.delivered[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			got.ReadFrom(final.Body)
+			if !strings.Contains(got.String(), body) {
+				t.Errorf("decompressed body mismatch: %d bytes", got.Len())
+			}
+		})
+	}
+}
+
+func TestSizeClasses(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(
+		t,
+		client.Config{SizeClasses: []int{1, 2, 4}},
+	)
+	// Random content requires three chunks and is padded to four
+	body := hex.EncodeToString(crandom.Randbytes(client.MaxFragLength + 100))
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: recipient@example.com\nSubject: Test\n\n" + body,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Chunks != 3 || receipt.PadChunks != 1 {
+		t.Fatalf("expected 3+1 chunks, got %d+%d", receipt.Chunks, receipt.PadChunks)
+	}
+	pooled, err := readDir(clientPool, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pooled) != 4 {
+		t.Fatalf("expected 4 pooled packets, got %d", len(pooled))
+	}
+	for _, f := range pooled {
+		n.inject(t, servers, path.Join(clientPool, f))
+	}
+	if servers[2].stats.inDummy != 1 {
+		t.Errorf("exit received %d padding dummies", servers[2].stats.inDummy)
+	}
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+	final, err := mail.ReadMessage(strings.NewReader(n.delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	got.ReadFrom(final.Body)
+	if strings.TrimSpace(got.String()) != body {
+		t.Errorf("unpadded body mismatch: %d bytes", got.Len())
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	dir := t.TempDir()
+	chunk, err := OpenChunk(path.Join(dir, "chunkdb"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunk.Close()
+	final := packet.NewSlotFinal()
+	err = final.SetNumChunks(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = final.SetCompression(packet.CompressZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final.SetPadded(true)
+	// assemble compresses and pads plain, splits it into two chunks and
+	// assembles them.
+	assemble := func(plain []byte) (content []byte, err error) {
+		compressed, err := packet.Compress(packet.CompressZstd, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		padded, err := packet.Pad(compressed, 2*client.MaxFragLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []string
+		for i := 0; i < 2; i++ {
+			part := padded[i*client.MaxFragLength : (i+1)*client.MaxFragLength]
+			name := fmt.Sprintf("p%d", i)
+			err = os.WriteFile(path.Join(dir, name), part, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items = append(items, name)
+		}
+		assembled := path.Join(dir, "m"+hex.EncodeToString(plain[:4]))
+		err = chunk.Assemble(assembled, items, final, packet.MaxDecompressedBytes)
+		if err != nil {
+			return
+		}
+		return os.ReadFile(assembled)
+	}
+	plain := []byte(strings.Repeat("Hello World\n", 1000))
+	content, err := assemble(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(content, plain) {
+		t.Error("assembled message doesn't match the original")
+	}
+	// Messages may not expand beyond the limit for their chunk count
+	plain = []byte(strings.Repeat("Hi World\n", packet.DecompressLimit(2)/9+1))
+	_, err = assemble(plain)
+	if !errors.Is(err, packet.ErrRange) {
+		t.Fatalf("expected ErrRange, got: %v", err)
+	}
+}
+
+func TestChunkInsert(t *testing.T) {
+	dir := t.TempDir()
+	chunk, err := OpenChunk(path.Join(dir, "chunkdb"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunk.Close()
+	chunk.SetExpire(1)
+	msgID := crandom.Randbytes(16)
+	// Chunks can arrive in any order
+	for _, num := range []int{300, 2, 1} {
+		complete, err := chunk.Insert(msgID, num, 300, fmt.Sprintf("p%d", num))
+		if err != nil || complete {
+			t.Fatalf("chunk %d: complete=%v, err=%v", num, complete, err)
+		}
+	}
+	if _, err = chunk.Insert(msgID, 2, 300, "p2"); err == nil {
+		t.Error("duplicate chunk accepted")
+	}
+	if _, err = chunk.Insert(msgID, 3, 299, "p3"); err == nil {
+		t.Error("chunk count mismatch accepted")
+	}
+	items := chunk.Items(msgID)
+	if strings.Join(items, ",") != "p1,p2,p300" {
+		t.Errorf("unexpected items: %v", items)
+	}
+	chunk.Delete(msgID)
+	if len(chunk.Items(msgID)) != 0 {
+		t.Error("chunks remain after delete")
+	}
+	complete, err := chunk.Insert(msgID, 1, 1, "p1")
+	if err != nil || !complete {
+		t.Fatalf("single chunk: complete=%v, err=%v", complete, err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	servers[2].cfg.Remailer.MaxSize = 20
+	// Two chunks are accepted but the assembled message is too large
+	body := strings.Repeat("x", 30*1024)
+	_, err := c.SendBytes([]byte("To: recipient@example.com\n\n" + body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled, err := readDir(clientPool, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range pooled {
+		n.inject(t, servers, path.Join(clientPool, f))
+	}
+	if len(n.delivered) != 0 {
+		t.Fatalf("oversized message delivered")
+	}
+	chunks, err := readDir(servers[2].cfg.Files.Pooldir, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("%d chunks remain in the pool", len(chunks))
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	for _, test := range []struct {
+		maxSize  int
+		expected int
+	}{
+		{config.LegacyMaxSize, config.LegacyMaxSize * 1024},
+		{config.DefaultMaxSize, config.DefaultMaxSize * 1024},
+		{0, packet.MaxDecompressedBytes},
+	} {
+		s.cfg.Remailer.MaxSize = test.maxSize
+		if got := s.maxMessageBytes(); got != test.expected {
+			t.Errorf("max_size %d: Expected=%d, Got=%d", test.maxSize, test.expected, got)
+		}
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large message in short mode")
+	}
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	servers[2].cfg.Remailer.MaxSize = 0
+	body := hex.EncodeToString(
+		crandom.Randbytes(packet.MaxClassicChunks * client.MaxFragLength / 2),
+	)
+	receipt, err := c.SendBytes([]byte("To: recipient@example.com\n\n" + body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Chunks != packet.MaxClassicChunks+1 {
+		t.Fatalf("expected %d chunks, got %d", packet.MaxClassicChunks+1, receipt.Chunks)
+	}
+	pooled, err := readDir(clientPool, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range pooled {
+		n.inject(t, servers, path.Join(clientPool, f))
+	}
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+	final, err := mail.ReadMessage(strings.NewReader(n.delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	got.ReadFrom(final.Body)
+	if strings.TrimSpace(got.String()) != body {
+		t.Errorf("large message body mismatch: %d bytes", got.Len())
+	}
+}
+
+func TestMix2Bridge(t *testing.T) {
+	n, servers, _, clientPool := newThreeHops(t, client.Config{})
+	// alpha reads its Type II key from a PEM file, gamma is given one
+	var chain []mix2.Hop
+	for i, s := range []*Server{servers[0], servers[2]} {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			b := pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(key),
+			})
+			err = os.WriteFile(s.cfg.Files.Mix2Secring, b, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.openMix2()
+		} else {
+			s.mix2 = mix2.NewSecring()
+			_, err = s.mix2.Add(key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, mix2.Hop{Address: s.cfg.Remailer.Address, Key: &key.PublicKey})
+	}
+	if _, err := os.Stat(servers[0].cfg.Files.Mix2Pubkey); err != nil {
+		t.Fatal(err)
+	}
+	// The second message requires two Partial packets
+	bodies := []string{"Hello World\n", strings.Repeat("Hello World\n", 1000)}
+	for i, body := range bodies {
+		msg := &mix2.Message{
+			Destinations: []string{"recipient@example.com"},
+			Headers:      []string{"Subject: Type II"},
+			Body:         []byte(body),
+		}
+		data, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets, err := mix2.Encode(data, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range packets {
+			armored := new(bytes.Buffer)
+			fmt.Fprintf(armored, "To: %s\n\n", chain[0].Address)
+			err = mix2.Armor(armored, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pooled := path.Join(clientPool, "mix2")
+			err = os.WriteFile(pooled, armored.Bytes(), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.inject(t, servers, pooled)
+		}
+		if len(n.delivered) != i+1 {
+			t.Fatalf("expected %d final deliveries, got %d", i+1, len(n.delivered))
+		}
+		final, err := mail.ReadMessage(strings.NewReader(n.delivered[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if final.Header.Get("Subject") != "Type II" {
+			t.Errorf("unexpected subject: %s", final.Header.Get("Subject"))
+		}
+		var got bytes.Buffer
+		got.ReadFrom(final.Body)
+		if strings.TrimSpace(got.String()) != strings.TrimSpace(body) {
+			t.Errorf("type II body mismatch: %d bytes", got.Len())
+		}
+	}
+	if servers[0].stats.outMix2 != 3 || servers[2].stats.inMix2 != 3 {
+		t.Errorf(
+			"unexpected type II stats: out=%d, in=%d",
+			servers[0].stats.outMix2,
+			servers[2].stats.inMix2,
+		)
+	}
+}
+
+func TestGetBatchSize(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	s.cfg.Pool.Size = 5
+	s.cfg.Pool.MinSend = 5
+	s.cfg.Pool.Rate = 65
+	tests := []struct {
+		poolSize int
+		expected int
+	}{
+		{0, 0},
+		{9, 0},
+		{10, 5},
+		{20, 13},
+	}
+	for _, test := range tests {
+		got := s.getBatchSize(test.poolSize)
+		if got != test.expected {
+			t.Errorf(
+				"Pool=%d: Expected=%d, Got=%d",
+				test.poolSize,
+				test.expected,
+				got,
+			)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	n, servers, c, clientPool := newThreeHops(t, client.Config{})
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: recipient@example.com\nSubject: Test\n\nHello World\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled := path.Join(clientPool, receipt.Filenames[0])
+	out := new(bytes.Buffer)
+	err = servers[0].inspect(out, pooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"Armor: Valid\n",
+		"Recipient key: In secring\n",
+		"Anti-tag: OK\n",
+		"Type: Intermediate\n",
+		"Next hop: " + servers[1].cfg.Remailer.Address + "\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in output:\n%s", expected, out.String())
+		}
+	}
+	// The exit remailer can't decode the top header
+	out.Reset()
+	err = servers[2].inspect(out, pooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Recipient key: Not in secring") {
+		t.Errorf("expected an unknown key:\n%s", out.String())
+	}
+	// Inspection mustn't record the packet ID
+	n.inject(t, servers, pooled)
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+}
+
+func TestHostilePacket(t *testing.T) {
+	_, servers, c, clientPool := newThreeHops(t, client.Config{})
+	msg, err := mail.ReadMessage(strings.NewReader(
+		"To: recipient@example.com\nSubject: Test\n\nHello World\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := c.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path.Join(clientPool, receipt.Filenames[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := packet.StripArmor(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Retain the recipient keyid so the header is decrypted with a real key
+	hostile := append(payload[:16:16], crandom.Randbytes(len(payload)-16)...)
+	for _, b := range [][]byte{hostile, payload[:100], nil} {
+		if err = servers[0].decodeMsg(b); err == nil {
+			t.Error("hostile packet decoded without error")
+		}
+	}
+	// A panicking decoder returns an error
+	err = func() (err error) {
+		defer recoverDecode(&err)
+		panic("hostile")
+	}()
+	if !errors.Is(err, errDecodePanic) {
+		t.Errorf("expected errDecodePanic, got: %v", err)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := genVectors(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shipped, err := os.ReadFile("www/yamn_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), shipped) {
+		t.Fatal("www/yamn_vectors.json is stale. Regenerate it with: yamn --gen-vectors")
+	}
+}
+
+func TestTransportMaildir(t *testing.T) {
+	c := config.NewConfig(t.TempDir())
+	c.Mail.Transport = "maildir"
+	s := newServer(c)
+	err := s.mailBytes([]byte("Subject: Test\n\nHello World\n"), []string{"local@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := maildir.Dir(c.Mail.LocalMaildir).Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("expected 1 Maildir delivery, got %d", len(keys))
+	}
+}
+
+func TestTransportLMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	delivered := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tp := textproto.NewConn(conn)
+			tp.PrintfLine("220 Test LMTP server")
+			var rcpts int
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					break
+				}
+				switch {
+				case strings.HasPrefix(line, "LHLO"):
+					tp.PrintfLine("250-test\r\n250 PIPELINING")
+				case strings.HasPrefix(line, "MAIL FROM"):
+					tp.PrintfLine("250 OK")
+				case strings.Contains(line, "unknown@"):
+					tp.PrintfLine("550 No such user")
+				case strings.HasPrefix(line, "RCPT TO"):
+					rcpts++
+					tp.PrintfLine("250 OK")
+				case line == "DATA":
+					tp.PrintfLine("354 Go ahead")
+					msg, _ := tp.ReadDotBytes()
+					delivered <- string(msg)
+					for range rcpts {
+						tp.PrintfLine("250 Delivered")
+					}
+				case line == "QUIT":
+					tp.PrintfLine("221 Bye")
+				}
+			}
+			tp.Close()
+		}
+	}()
+	c := config.NewConfig(t.TempDir())
+	c.Mail.Transport = "lmtp"
+	c.Mail.LMTPAddr = l.Addr().String()
+	s := newServer(c)
+	err = s.mailBytes(
+		[]byte("Subject: Test\n\nHello World\n"),
+		[]string{"local@example.com", "unknown@example.com"},
+	)
+	// The rejected recipient is reported
+	var partial *partialError
+	if !errors.As(err, &partial) || !slices.Equal(partial.rejected, []string{"unknown@example.com"}) {
+		t.Fatalf("expected unknown@example.com to be rejected, got: %v", err)
+	}
+	msg := <-delivered
+	if !strings.Contains(msg, "Hello World") {
+		t.Errorf("unexpected LMTP delivery: %q", msg)
+	}
+	// A message without any valid recipients fails permanently
+	err = s.mailBytes([]byte("Subject: Test\n\nHello World\n"), []string{"unknown@example.com"})
+	if !isPermanent(err) {
+		t.Errorf("expected a permanent failure, got: %v", err)
+	}
+}
+
+func TestPermanentFailure(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("To: recipient@example.com\nSubject: Test\n\nHello World\n")
+	for _, test := range []struct {
+		err     error
+		retains bool
+	}{
+		{errors.New("connection refused"), true},
+		{permanent(errors.New("no such user")), false},
+	} {
+		filename := s.writePlainToPool(msg, "m")
+		s.sendMail = func(payload []byte, sendTo []string) error {
+			return test.err
+		}
+		s.emailPoolFile(filename)
+		_, err = os.Stat(path.Join(s.cfg.Files.Pooldir, filename))
+		if (err == nil) != test.retains {
+			t.Errorf("%s: pool file retained=%t", test.err, err == nil)
+		}
+	}
+
+	// Relay session failures are temporary.  Only rejected recipients are
+	// permanent.
+	caPEM, cert := testCA(t)
+	srv := startSMTP(t, cert, false, true)
+	s.cfg.Mail.SMTPRelay = "127.0.0.1"
+	s.cfg.Mail.SMTPPort = srv.port
+	s.cfg.Mail.MXRelay = false
+	s.cfg.Mail.CAFile = path.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(s.cfg.Mail.CAFile, caPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.Mail.Username = "user"
+	s.sendMail = s.mailBytes
+	for _, test := range []struct {
+		name     string
+		password string
+		to       string
+		retains  bool
+	}{
+		{"auth 535", "wrong", "recipient@example.com", true},
+		{"rcpt 550", "secret", "unknown@example.com", false},
+	} {
+		s.cfg.Mail.Password = test.password
+		filename := s.writePlainToPool([]byte("To: "+test.to+"\n\nHello World\n"), "e")
+		s.emailPoolFile(filename)
+		_, err = os.Stat(path.Join(s.cfg.Files.Pooldir, filename))
+		if (err == nil) != test.retains {
+			t.Errorf("%s: pool file retained=%t", test.name, err == nil)
+		}
+	}
+}
+
+func TestTransportPipe(t *testing.T) {
+	dir := t.TempDir()
+	for i, test := range []struct {
+		script    string
+		permanent bool
+	}{
+		{"exit 67", true},     // EX_NOUSER
+		{"exit 75", false},    // EX_TEMPFAIL
+		{"exit 1", false},     // A failing wrapper script
+		{"kill -9 $$", false}, // Killed by a signal
+	} {
+		script := path.Join(dir, fmt.Sprintf("pipe%d.sh", i))
+		err := os.WriteFile(script, []byte("#!/bin/sh\ncat >/dev/null\n"+test.script+"\n"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pipeTransport{command: script}.Deliver([]byte("Hello World\n"), nil)
+		if err == nil || isPermanent(err) != test.permanent {
+			t.Errorf("%s: Expected permanent=%t, Got=%v", test.script, test.permanent, err)
+		}
+	}
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	t.Cleanup(func() {
+		if s.rateDb != nil {
+			s.rateDb.Close()
+		}
+	})
+	limiters := make(chan *ratelimit.Limiter, 8)
+	for range cap(limiters) {
+		go func() {
+			l, err := s.limiter()
+			if err != nil {
+				t.Error(err)
+			}
+			limiters <- l
+		}()
+	}
+	first := <-limiters
+	for range cap(limiters) - 1 {
+		if l := <-limiters; l != first {
+			t.Fatal("rate limit DB opened more than once")
+		}
+	}
+}
+
+func TestPartialDelivery(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.rateDb != nil {
+			s.rateDb.Close()
+		}
+	})
+	s.cfg.Limits.PerAddress = 10
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		return &partialError{
+			rejected: []string{"unknown@example.com"},
+			err:      permanent(errors.New("no such user")),
+		}
+	}
+	filename := s.writePlainToPool(
+		[]byte("To: user@example.com, Unknown@example.com\n\nHello World\n"),
+		"e",
+	)
+	s.emailPoolFile(filename)
+	if _, err = os.Stat(path.Join(s.cfg.Files.Pooldir, filename)); err == nil {
+		t.Error("partially delivered pool file was retained")
+	}
+	l, err := s.limiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().Add(-time.Hour)
+	for addy, expected := range map[string]int{"user@example.com": 1, "unknown@example.com": 0} {
+		count, err := l.Count("addr:"+addy, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Errorf("%s: Expected %d deliveries, Got=%d", addy, expected, count)
+		}
+	}
+	if s.stats.outMail != 1 {
+		t.Errorf("expected 1 delivered message, got %d", s.stats.outMail)
+	}
+}
+
+func TestDisclaimer(t *testing.T) {
+	c := config.NewConfig(t.TempDir())
+	c.Remailer.Name = "exit"
+	c.Remailer.Address = "exit@remailer.invalid"
+	c.Disclaimer.Headers = []string{
+		"Comments: Sent by the {{.Name}} anonymous remailer <{{.Address}}>",
+		"x-anonymous: yes",
+		"X-Abuse-Contact: {{.Abuse}}",
+	}
+	c.Disclaimer.Abuse = "abuse@remailer.invalid"
+	c.Disclaimer.Footer = "Sent anonymously via {{.Name}}\n"
+	s := newServer(c)
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delivered string
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = string(payload)
+		return nil
+	}
+	deliver := func(message string) (msg *mail.Message, body string) {
+		filename := s.writePlainToPool([]byte(message), "e")
+		s.emailPoolFile(filename)
+		msg, err := mail.ReadMessage(strings.NewReader(delivered))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(msg.Body)
+		return msg, string(b)
+	}
+	// Parts returns the text of each part of a multipart message
+	parts := func(msg *mail.Message, body string) (texts []string) {
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/mixed" {
+			t.Fatalf("expected multipart/mixed, got %s", msg.Header.Get("Content-Type"))
+		}
+		r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+		for {
+			part, err := r.NextPart()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			text, _ := io.ReadAll(part)
+			texts = append(texts, string(text))
+		}
+	}
+
+	// Plain text gets headers and an appended footer
+	msg, body := deliver(
+		"To: recipient@example.com\n" +
+			"X-Anonymous: no\n" +
+			"Subject: Test\n\nHello World\n",
+	)
+	expected := "Sent by the exit anonymous remailer <exit@remailer.invalid>"
+	if msg.Header.Get("Comments") != expected {
+		t.Errorf("Comments: Expected=%q, Got=%q", expected, msg.Header.Get("Comments"))
+	}
+	if msg.Header.Get("X-Anonymous") != "yes" {
+		t.Error("disclaimer header didn't replace the sender's")
+	}
+	if msg.Header.Get("X-Abuse-Contact") != "abuse@remailer.invalid" {
+		t.Errorf("unexpected abuse contact: %s", msg.Header.Get("X-Abuse-Contact"))
+	}
+	if body != "Hello World\n\nSent anonymously via exit\n" {
+		t.Errorf("unexpected plain text body: %q", body)
+	}
+
+	// multipart/mixed gets a new part
+	msg, body = deliver(
+		"To: recipient@example.com\n" +
+			"Mime-Version: 1.0\n" +
+			"Content-Type: multipart/mixed; boundary=\"XYZ\"\n\n" +
+			"--XYZ\nContent-Type: text/plain\n\nHello World\n" +
+			"--XYZ\nContent-Type: application/octet-stream\n" +
+			"Content-Transfer-Encoding: base64\n\nAAEC\n" +
+			"--XYZ--\n",
+	)
+	texts := parts(msg, body)
+	if len(texts) != 3 || texts[0] != "Hello World" || texts[1] != "AAEC" {
+		t.Fatalf("original parts weren't preserved: %q", texts)
+	}
+	if texts[2] != "Sent anonymously via exit" {
+		t.Errorf("unexpected footer part: %q", texts[2])
+	}
+
+	// Other types are wrapped with the footer as a second part
+	msg, body = deliver(
+		"To: recipient@example.com\n" +
+			"Content-Type: text/plain; charset=utf-8\n" +
+			"Content-Transfer-Encoding: base64\n\nSGVsbG8gV29ybGQ=\n",
+	)
+	if msg.Header.Get("Content-Transfer-Encoding") != "" {
+		t.Error("encoding header wasn't moved to the wrapped part")
+	}
+	texts = parts(msg, body)
+	if len(texts) != 2 || texts[0] != "SGVsbG8gV29ybGQ=" {
+		t.Fatalf("original content wasn't wrapped: %q", texts)
+	}
+	if texts[1] != "Sent anonymously via exit" {
+		t.Errorf("unexpected footer part: %q", texts[1])
+	}
+
+	// Disclaimers can't override the headers delivery depends on
+	c.Disclaimer.Headers = []string{"To: someone@example.com"}
+	_, err = s.disclaimer()
+	if err == nil {
+		t.Error("expected an error for a reserved disclaimer header")
+	}
+}
+
+func TestForwardUnchanged(t *testing.T) {
+	c := config.NewConfig(t.TempDir())
+	c.Disclaimer.Headers = []string{"Comments: Sent by an anonymous remailer"}
+	c.Disclaimer.Footer = "Sent anonymously\n"
+	c.Filter.Allow = []config.HeaderRule{{Header: "Subject", Value: "^Test$"}}
+	c.DKIM.Domain = "example.org"
+	c.DKIM.Selector = "yamn"
+	s := newServer(c)
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.dkimKeygen("ed25519", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delivered []byte
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = payload
+		return nil
+	}
+	s.writeMessageToPool("next@remailer.invalid", crandom.Randbytes(packet.MessageBytes))
+	pooled, err := readDir(s.cfg.Files.Pooldir, "m")
+	if err != nil || len(pooled) != 1 {
+		t.Fatalf("expected 1 pooled packet: %v", err)
+	}
+	f, err := os.ReadFile(path.Join(s.cfg.Files.Pooldir, pooled[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, packetText, _ := bytes.Cut(f, []byte("\n\n"))
+	s.emailPoolFile(pooled[0])
+	msg, err := mail.ReadMessage(bytes.NewReader(delivered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if !bytes.Equal(body, packetText) {
+		t.Error("forwarded packet was modified")
+	}
+	if msg.Header.Get("Comments") != "" {
+		t.Error("disclaimer added to a forwarded packet")
+	}
+	if msg.Header.Get("Subject") != "yamn-"+version {
+		t.Error("header filter applied to a forwarded packet")
+	}
+	if msg.Header.Get("DKIM-Signature") != "" {
+		t.Error("forwarded packet was DKIM signed")
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	c := config.NewConfig(t.TempDir())
+	c.DKIM.Domain = "example.org"
+	c.DKIM.Selector = "yamn"
+	c.Filter.Deny = []config.HeaderRule{{Header: "Reply-To"}}
+	s := newServer(c)
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	err = s.dkimKeygen("ed25519", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `yamn._domainkey.example.org. IN TXT ( "v=DKIM1; k=ed25519; p=`) {
+		t.Errorf("unexpected keygen output: %s", out)
+	}
+	// An existing key is never overwritten
+	if s.dkimKeygen("ed25519", io.Discard) == nil {
+		t.Error("dkimKeygen overwrote an existing key")
+	}
+	var delivered string
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = string(payload)
+		return nil
+	}
+	filename := s.writePlainToPool([]byte(
+		"To: recipient@example.com\n"+
+			"Reply-To: someone@example.com\n"+
+			"Subject: Test\n\nHello World\n",
+	), "e")
+	s.emailPoolFile(filename)
+	msg, err := mail.ReadMessage(strings.NewReader(delivered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := msg.Header.Get("DKIM-Signature")
+	for _, tag := range []string{"a=ed25519-sha256;", "d=example.org;", "s=yamn;"} {
+		if !strings.Contains(sig, tag) {
+			t.Errorf("DKIM-Signature doesn't contain %s: %s", tag, sig)
+		}
+	}
+	// Filtered headers aren't signed
+	if !strings.Contains(sig, "h=from:to:subject:date:message-id;") {
+		t.Errorf("unexpected signed headers: %s", sig)
+	}
+}
+
+func TestHeaderFilter(t *testing.T) {
+	c := config.NewConfig(t.TempDir())
+	c.Filter.Deny = []config.HeaderRule{
+		{Header: "received"},
+		{Header: "Reply-To", Value: `@example\.com$`},
+	}
+	s := newServer(c)
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delivered string
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = string(payload)
+		return nil
+	}
+	filename := s.writePlainToPool([]byte(
+		"To: recipient@example.com\n"+
+			"Received: from somewhere\n"+
+			"Reply-To: abuse@example.com\n"+
+			"X-Mailer: Test\n"+
+			"Subject: Test\n\nHello World\n",
+	), "e")
+	s.emailPoolFile(filename)
+	msg, err := mail.ReadMessage(strings.NewReader(delivered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Received") != "" || msg.Header.Get("Reply-To") != "" {
+		t.Error("denied headers were delivered")
+	}
+	if msg.Header.Get("X-Mailer") != "Test" {
+		t.Error("permitted header was filtered")
+	}
+
+	// With an allow list, only To, Cc and allowed headers remain
+	c.Filter.Deny = nil
+	c.Filter.Allow = []config.HeaderRule{{Header: "Subject"}}
+	filter, err := s.headerFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mail.Header{
+		"To":       {"recipient@example.com"},
+		"Subject":  {"Test"},
+		"X-Mailer": {"Test"},
+	}
+	filter.apply(h)
+	if len(h) != 2 || h.Get("X-Mailer") != "" {
+		t.Errorf("unexpected headers after filtering: %v", h)
+	}
+
+	c.Filter.Allow = []config.HeaderRule{{Header: "Subject", Value: "("}}
+	_, err = s.headerFilter()
+	if err == nil {
+		t.Error("expected error compiling an invalid rule")
+	}
+}
+
+func TestDestBlock(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.rateDb != nil {
+			s.rateDb.Close()
+		}
+	})
+	var delivered []string
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = append(delivered, string(payload))
+		return nil
+	}
+	sender := "Someone <User@example.com>"
+	err = s.remailerFoo("remailer-block", sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 {
+		t.Fatalf("expected a confirmation request, got %d replies", len(delivered))
+	}
+	token := regexp.MustCompile(`remailer-block ([0-9a-f]{32})`).FindStringSubmatch(delivered[0])
+	if token == nil {
+		t.Fatalf("no token in confirmation request: %q", delivered[0])
+	}
+	// Confirmation requests are limited per address and in total
+	if s.remailerFoo("remailer-block", sender) == nil {
+		t.Error("second confirmation request sent to the same address")
+	}
+	for i := 1; i < confirmDaily; i++ {
+		err = s.remailerFoo("remailer-block", fmt.Sprintf("user%d@example.net", i))
+		if err != nil {
+			t.Fatalf("confirmation request %d: %s", i, err)
+		}
+	}
+	if s.remailerFoo("remailer-block", "another@example.net") == nil {
+		t.Error("confirmation requests exceeded the daily limit")
+	}
+	if len(delivered) != confirmDaily {
+		t.Errorf("expected %d confirmation requests, got %d", confirmDaily, len(delivered))
+	}
+	// A token issued to one address can't block another
+	err = s.remailerFoo("remailer-block "+token[1], "other@example.com")
+	if err == nil {
+		t.Error("token confirmed a block for a different address")
+	}
+	err = s.remailerFoo("remailer-block "+token[1], sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := os.ReadFile(s.cfg.Files.DestBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(list)), "user@example.com") {
+		t.Error("block list reveals a blocked address")
+	}
+
+	err = s.addBlock("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(s.cfg.Files.DestBlock, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, `regex ^postmaster@`)
+	fmt.Fprintln(f, `regex ^mix@`)
+	f.Close()
+	// Remailers are never blocked, even if a rule matches them
+	s.pubring.Put(keymgr.NewRemailer("mix", "mix@remailer.invalid", "", make([]byte, 32), nil))
+	delivered = nil
+	for _, test := range []struct {
+		to      string
+		blocked bool
+	}{
+		{"user@example.com", true},
+		{"user@mail.example.org", true},
+		{"postmaster@example.net", true},
+		{"other@example.com", false},
+		{"mix@remailer.invalid", false},
+	} {
+		filename := s.writePlainToPool([]byte("To: "+test.to+"\n\nHello World\n"), "m")
+		delivered = nil
+		s.emailPoolFile(filename)
+		if (len(delivered) == 0) != test.blocked {
+			t.Errorf("%s: blocked=%t", test.to, len(delivered) == 0)
+		}
+		if _, err = os.Stat(path.Join(s.cfg.Files.Pooldir, filename)); err == nil {
+			t.Errorf("%s: pool file was retained", test.to)
+		}
+	}
+}
+
+func TestDestBlockConcurrent(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	for i := range 4 {
+		go func() {
+			defer func() { done <- true }()
+			b, err := s.blockList()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			addy := fmt.Sprintf("user%d@example.com", i)
+			if err = b.add(addy); err != nil {
+				t.Error(err)
+			}
+			b.blocked("other@example.com")
+		}()
+	}
+	for range 4 {
+		<-done
+	}
+	b, err := s.blockList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		if !b.blocked(fmt.Sprintf("user%d@example.com", i)) {
+			t.Errorf("user%d@example.com isn't blocked", i)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.rateDb != nil {
+			s.rateDb.Close()
+		}
+	})
+	var delivered int
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered++
+		return nil
+	}
+	s.cfg.Limits.MaxRecipients = 2
+	s.cfg.Limits.PerAddress = 1
+	s.cfg.Limits.PerDomain = 2
+	for i, test := range []struct {
+		to       string
+		action   string
+		sent     bool
+		retained bool
+	}{
+		{"a@example.com", "defer", true, false},
+		{"a@example.com", "defer", false, true},
+		{"a@example.com", "drop", false, false},
+		{"b@example.com", "defer", true, false},
+		// The domain limit is reached
+		{"c@example.com", "defer", false, true},
+		{"d@example.net, e@example.net, f@example.net", "defer", false, false},
+	} {
+		s.cfg.Limits.Action = test.action
+		delivered = 0
+		filename := s.writePlainToPool([]byte("To: "+test.to+"\n\nHello World\n"), "m")
+		s.emailPoolFile(filename)
+		if (delivered == 1) != test.sent {
+			t.Errorf("%d: %s: sent=%t", i, test.to, delivered == 1)
+		}
+		_, err = os.Stat(path.Join(s.cfg.Files.Pooldir, filename))
+		if (err == nil) != test.retained {
+			t.Errorf("%d: %s: retained=%t", i, test.to, err == nil)
+		}
+	}
+	if s.stats.outLimited != 4 {
+		t.Errorf("expected 4 limited messages, got %d", s.stats.outLimited)
+	}
+}
+
+// testDSN is an RFC 3464 delivery status notification
+const testDSN = "From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\n" +
+	"To: exit@remailer.invalid\n" +
+	"Subject: Undelivered Mail Returned to Sender\n" +
+	"Mime-Version: 1.0\n" +
+	"Content-Type: multipart/report; report-type=delivery-status;\n" +
+	"\tboundary=\"DSN\"\n" +
+	"\n" +
+	"--DSN\n" +
+	"Content-Type: text/plain\n" +
+	"\n" +
+	"Your message could not be delivered.\n" +
+	"--DSN\n" +
+	"Content-Type: message/delivery-status\n" +
+	"\n" +
+	"Reporting-MTA: dns; mx.example.com\n" +
+	"\n" +
+	"Final-Recipient: rfc822; Gone@Example.com\n" +
+	"Action: failed\n" +
+	"Status: 5.1.1\n" +
+	"\n" +
+	"Final-Recipient: rfc822; busy@example.net\n" +
+	"Action: delayed\n" +
+	"Status: 4.2.2\n" +
+	"\n" +
+	"--DSN\n" +
+	"Content-Type: message/rfc822\n" +
+	"\n" +
+	"To: gone@example.com\n" +
+	"Subject: Test\n" +
+	"Message-Id: <test@remailer.invalid>\n" +
+	"\n" +
+	"::\n" +
+	"--DSN--\n"
+
+func TestBounces(t *testing.T) {
+	s := newServer(config.NewConfig(t.TempDir()))
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.rateDb != nil {
+			s.rateDb.Close()
+		}
+	})
+	var delivered []string
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = append(delivered, string(payload))
+		return nil
+	}
+	s.cfg.Bounces.BlockAfter = 2
+	dir := maildir.Dir(s.cfg.Files.Maildir)
+	bounce := func(dsn string) {
+		newmsg, err := dir.NewDelivery()
+		if err != nil {
+			t.Fatal(err)
+		}
+		newmsg.Write([]byte(dsn))
+		err = newmsg.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.processMail()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Bounces of messages that weren't sent are forgeries
+	for i := 1; i <= 2; i++ {
+		bounce(testDSN)
+	}
+	b, err := s.blockList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.blocked("gone@example.com") {
+		t.Error("forged bounces blocked an address")
+	}
+	// Bounces quoting the Message-ID of a delivery are counted
+	filename := s.writePlainToPool([]byte("To: gone@example.com\n\nHello World\n"), "e")
+	s.emailPoolFile(filename)
+	if len(delivered) != 1 {
+		t.Fatal("test message wasn't delivered")
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := strings.Replace(testDSN, "<test@remailer.invalid>", msg.Header.Get("Message-Id"), 1)
+	for i := 1; i <= 2; i++ {
+		bounce(dsn)
+		b, err := s.blockList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The second hard bounce blocks the address
+		if b.blocked("gone@example.com") != (i == 2) {
+			t.Errorf("bounce %d: unexpected block status", i)
+		}
+		if b.blocked("busy@example.net") {
+			t.Error("a delayed delivery was blocked")
+		}
+	}
+	if s.stats.inBounce != 4 {
+		t.Errorf("expected 4 bounces, got %d", s.stats.inBounce)
+	}
+	if s.stats.bounces["example.com"] != 4 || s.stats.bounces["example.net"] != 4 {
+		t.Errorf("unexpected bounce counts: %v", s.stats.bounces)
+	}
+	if len(delivered) != 1 {
+		t.Error("a bounce was replied to or forwarded")
+	}
+	// Bounces are purged from the Maildir and never pooled
+	keys, err := dir.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("%d bounces remain in the Maildir", len(keys))
+	}
+	pooled, err := readDir(s.cfg.Files.Pooldir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pooled) != 0 {
+		t.Errorf("bounce created %d pool files", len(pooled))
+	}
+}
+
+func TestParseBounce(t *testing.T) {
+	for _, test := range []struct {
+		message string
+		bounce  bool
+		addys   []string
+	}{
+		{
+			// Exim
+			"From: Mail Delivery System <Mailer-Daemon@mx.example.com>\n" +
+				"X-Failed-Recipients: a@example.com, b@example.org\n" +
+				"Subject: Mail delivery failed: returning message to sender\n\n" +
+				"This message was created automatically by mail delivery software.\n",
+			true,
+			[]string{"a@example.com", "b@example.org"},
+		},
+		{
+			// qmail
+			"From: MAILER-DAEMON@mx.example.com\n" +
+				"Subject: failure notice\n\n" +
+				"Hi. This is the qmail-send program at mx.example.com.\n\n" +
+				"<c@example.com>:\n" +
+				"192.0.2.1 does not like recipient.\n" +
+				"Remote host said: 550 5.1.1 <c@example.com>: Recipient address rejected\n",
+			true,
+			[]string{"c@example.com"},
+		},
+		{
+			"From: someone@example.com\n" +
+				"Subject: remailer-help\n\n",
+			false,
+			nil,
+		},
+	} {
+		msg, err := mail.ReadMessage(strings.NewReader(test.message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isBounce(msg.Header) != test.bounce {
+			t.Errorf("%s: Expected bounce=%v", msg.Header.Get("Subject"), test.bounce)
+			continue
+		}
+		if !test.bounce {
+			continue
+		}
+		recipients, err := parseBounce(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addys []string
+		for _, r := range recipients {
+			if !r.hard {
+				t.Errorf("%s: expected a hard bounce", r.addy)
+			}
+			addys = append(addys, r.addy)
+		}
+		if strings.Join(addys, ",") != strings.Join(test.addys, ",") {
+			t.Errorf("Expected=%v, Got=%v", test.addys, addys)
+		}
+	}
+}
+
+func TestPseudoHeaderExit(t *testing.T) {
+	c := config.NewConfig(t.TempDir())
+	c.Remailer.Exit = true
+	c.News.Mail2News = testMail2News
+	s := newServer(c)
+	err := s.createDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delivered []string
+	var sentTo [][]string
+	s.sendMail = func(payload []byte, sendTo []string) error {
+		delivered = append(delivered, string(payload))
+		sentTo = append(sentTo, sendTo)
+		return nil
+	}
+	// Anon-To sets the recipient
+	filename := s.writePlainToPool([]byte(
+		"Subject: Test\n\n::\nAnon-To: recipient@example.com\n\n"+
+			"##\nReply-To: nobody@example.com\nFrom: Forged <forged@example.com>\n\nHello World\n",
+	), "e")
+	s.emailPoolFile(filename)
+	if len(delivered) != 1 || strings.Join(sentTo[0], ",") != "recipient@example.com" {
+		t.Fatalf("message wasn't delivered to the Anon-To address: %v", sentTo)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Reply-To") != "nobody@example.com" {
+		t.Error("pasted header wasn't merged")
+	}
+	if strings.Contains(msg.Header.Get("From"), "forged") {
+		t.Errorf("pasted From was merged: %s", msg.Header.Get("From"))
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if string(body) != "Hello World\n" {
+		t.Errorf("pseudo-headers weren't stripped: %q", body)
+	}
+
+	// Newsgroups makes it an article for the mail2news gateway
+	filename = s.writePlainToPool([]byte(
+		"Subject: Test\n\nNewsgroups: alt.test\n\nHello World\n",
+	), "e")
+	s.emailPoolFile(filename)
+	if len(delivered) != 2 || strings.Join(sentTo[1], ",") != testMail2News {
+		t.Fatalf("article wasn't posted: %v", sentTo)
+	}
+	msg, err = mail.ReadMessage(strings.NewReader(delivered[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Newsgroups") != "alt.test" {
+		t.Errorf("unexpected Newsgroups: %s", msg.Header.Get("Newsgroups"))
+	}
+
+	// Forwarded packets are left alone
+	body = []byte("To: next@example.com\n\n::\nAnon-To: recipient@example.com\n\nPacket\n")
+	filename = s.writePlainToPool(body, "m")
+	s.emailPoolFile(filename)
+	if len(delivered) != 3 || strings.Join(sentTo[2], ",") != "next@example.com" {
+		t.Fatalf("forwarded packet was redirected: %v", sentTo)
+	}
+	if !strings.HasSuffix(delivered[2], "\n::\nAnon-To: recipient@example.com\n\nPacket\n") {
+		t.Errorf("forwarded body was modified: %q", delivered[2])
+	}
+
+	// Unknown directives are delivered unchanged
+	filename = s.writePlainToPool([]byte(
+		"To: recipient@example.com\n\n::\nEncrypted: PGP\n\nHello World\n",
+	), "e")
+	s.emailPoolFile(filename)
+	if len(delivered) != 4 {
+		t.Fatal("message with an unknown directive wasn't delivered")
+	}
+	if !strings.HasSuffix(delivered[3], "\n::\nEncrypted: PGP\n\nHello World\n") {
+		t.Errorf("unexpected body: %q", delivered[3])
+	}
+}
+
+// writeStats publishes perfect stats for servers to each of their pubrings so
+// that they can select random remailers.
+func writeStats(t *testing.T, servers []*Server) {
+	stats := new(bytes.Buffer)
+	stats.WriteString("Stats-Version: 2.0\n")
+	fmt.Fprintf(stats, "Generated: %s\n", time.Now().UTC().Format("Mon 02 Jan 2006 15:04:05 GMT"))
+	stats.WriteString("Mixmaster    Latent-Hist   Latent  Uptime-Hist   Uptime  Options\n")
+	stats.WriteString(strings.Repeat("-", 64) + "\n")
+	for _, s := range servers {
+		fmt.Fprintf(
+			stats,
+			"%-12s %s    :05   %s  100.0%%\n",
+			s.cfg.Remailer.Name,
+			strings.Repeat("0", 12),
+			strings.Repeat("+", 12),
+		)
+	}
+	stats.WriteString("\n")
+	for _, s := range servers {
+		err := os.WriteFile(s.cfg.Files.Mlist2, stats.Bytes(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.pubring.ImportStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	n, servers, _, _ := newThreeHops(t, client.Config{})
+	writeStats(t, servers)
+	entry := servers[0]
+	entry.cfg.Gateway.Enabled = true
+	entry.cfg.Gateway.PerSender = 1
+	plain := "From: Someone <user@example.com>\n" +
+		"To: " + entry.cfg.Remailer.Address + "\n" +
+		"Received: from user.example.com\n" +
+		"Message-Id: <identifying@example.com>\n" +
+		"Anon-To: recipient@example.com\n" +
+		"Subject: Test\n\nHello World\n"
+	for i := 0; i < 2; i++ {
+		err := n.deliver([]byte(plain), []string{entry.cfg.Remailer.Address})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The random chain may visit any remailer so process them until the
+	// message has had time to reach the exit.
+	for round := 0; round < 4; round++ {
+		for _, s := range servers {
+			s.process()
+			s.poolOutboundSend()
+		}
+	}
+	// The second message exceeds the sender limit
+	if entry.stats.inGateway != 1 {
+		t.Errorf("expected 1 gateway message, got %d", entry.stats.inGateway)
+	}
+	if len(n.delivered) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(n.delivered))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(n.delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "recipient@example.com" {
+		t.Errorf("unexpected recipient: %s", msg.Header.Get("To"))
+	}
+	if strings.Contains(n.delivered[0], "user@example.com") ||
+		strings.Contains(n.delivered[0], "identifying") ||
+		msg.Header.Get("Received") != "" {
+		t.Errorf("identifying headers were delivered: %q", n.delivered[0])
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if string(body) != "Hello World\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+// testCA returns a PEM encoded CA certificate and a certificate for
+// 127.0.0.1 signed by it.
+func testCA(t *testing.T) (caPEM []byte, cert tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return
+}
+
+// smtpStandIn is a local SMTP relay that supports STARTTLS, implicit TLS and
+// the PLAIN, LOGIN and CRAM-MD5 AUTH mechanisms.  It accepts user/secret.
+type smtpStandIn struct {
+	port      int
+	delivered chan string // Messages received
+	mechs     chan string // Successful AUTH mechanisms
+}
+
+// startSMTP runs an SMTP stand-in until the test ends.
+func startSMTP(t *testing.T, cert tls.Certificate, implicit, startTLS bool) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if implicit {
+		l = tls.NewListener(l, conf)
+	}
+	srv := &smtpStandIn{
+		port:      l.Addr().(*net.TCPAddr).Port,
+		delivered: make(chan string, 1),
+		mechs:     make(chan string, 1),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.serve(conn, conf, implicit, startTLS)
+		}
+	}()
+	return srv
+}
+
+func (srv *smtpStandIn) serve(conn net.Conn, conf *tls.Config, encrypted, startTLS bool) {
+	tp := textproto.NewConn(conn)
+	defer func() { tp.Close() }()
+	tp.PrintfLine("220 Test ESMTP")
+	// challenge returns the decoded client response to a 334 challenge
+	challenge := func(text string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(text)))
+		line, _ := tp.ReadLine()
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded)
+	}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ok := false
+		switch strings.ToUpper(fields[0]) {
+		case "EHLO":
+			if startTLS && !encrypted {
+				tp.PrintfLine("250-Test\r\n250-STARTTLS\r\n250 AUTH PLAIN LOGIN CRAM-MD5")
+			} else {
+				tp.PrintfLine("250-Test\r\n250 AUTH PLAIN LOGIN CRAM-MD5")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, conf)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			encrypted = true
+		case "AUTH":
+			switch strings.ToUpper(fields[1]) {
+			case "PLAIN":
+				decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+				ok = string(decoded) == "\x00user\x00secret"
+			case "LOGIN":
+				ok = challenge("Username:") == "user" && challenge("Password:") == "secret"
+			case "CRAM-MD5":
+				const cramChallenge = "<1.2@test>"
+				mac := hmac.New(md5.New, []byte("secret"))
+				mac.Write([]byte(cramChallenge))
+				ok = challenge(cramChallenge) == "user "+hex.EncodeToString(mac.Sum(nil))
+			}
+			if ok {
+				srv.mechs <- strings.ToUpper(fields[1])
+				tp.PrintfLine("235 Authenticated")
+			} else {
+				tp.PrintfLine("535 Authentication failed")
+			}
+		case "MAIL":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if strings.Contains(line, "unknown@") {
+				tp.PrintfLine("550 No such user")
+			} else {
+				tp.PrintfLine("250 OK")
+			}
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			msg, _ := tp.ReadDotBytes()
+			srv.delivered <- string(msg)
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+func TestSMTPRelayTLS(t *testing.T) {
+	caPEM, cert := testCA(t)
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, caPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodPin := spkiHash(cert.Leaf)
+	badPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for _, test := range []struct {
+		name     string
+		implicit bool // Stand-in uses implicit TLS
+		startTLS bool // Stand-in offers STARTTLS
+		setup    func(c *config.Config)
+		mech     string // Expected AUTH mechanism; empty if delivery fails
+	}{
+		{"starttls", false, true, func(c *config.Config) {}, "PLAIN"},
+		{"login", false, true, func(c *config.Config) { c.Mail.AuthMech = "login" }, "LOGIN"},
+		{"implicit", true, false, func(c *config.Config) {
+			c.Mail.ImplicitTLS = true
+			c.Mail.AuthMech = "cram-md5"
+		}, "CRAM-MD5"},
+		{"untrusted", false, true, func(c *config.Config) { c.Mail.CAFile = "" }, ""},
+		{"pinned", false, true, func(c *config.Config) { c.Mail.SPKIPins = []string{goodPin} }, "PLAIN"},
+		{"bad pin", false, true, func(c *config.Config) { c.Mail.SPKIPins = []string{badPin} }, ""},
+		{"require", false, false, func(c *config.Config) { c.Mail.RequireTLS = true }, ""},
+	} {
+		srv := startSMTP(t, cert, test.implicit, test.startTLS)
+		c := config.NewConfig(t.TempDir())
+		c.Mail.SMTPRelay = "127.0.0.1"
+		c.Mail.SMTPPort = srv.port
+		c.Mail.MXRelay = false
+		c.Mail.CAFile = caFile
+		c.Mail.Username = "user"
+		c.Mail.Password = "secret"
+		test.setup(c)
+		s := newServer(c)
+		err := s.smtpRelay(
+			[]byte("Subject: Test\n\nHello World\n"),
+			[]string{"recipient@example.com"},
+		)
+		if test.mech == "" {
+			if err == nil {
+				t.Errorf("%s: expected delivery to fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if mech := <-srv.mechs; mech != test.mech {
+			t.Errorf("%s: Expected AUTH %s, Got=%s", test.name, test.mech, mech)
+		}
+		if msg := <-srv.delivered; !strings.Contains(msg, "Hello World") {
+			t.Errorf("%s: unexpected delivery: %q", test.name, msg)
+		}
+	}
+}
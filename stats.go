@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/Masterminds/log-go"
 )
@@ -11,12 +13,23 @@ type statistics struct {
 	inMail     int
 	inRemFoo   int
 	inYamn     int
+	inReply    int
+	inMix2     int
+	inBounce   int
+	inGateway  int
 	outDummy   int
 	outMail    int
+	outNews    int
 	outYamn    int
 	outLoop    int
 	outRandhop int
 	outPlain   int
+	outReply   int
+	outHeld    int
+	outMix2    int
+	outLimited int
+	// Bounces keyed by destination domain
+	bounces map[string]int
 }
 
 func (s *statistics) reset() {
@@ -24,36 +37,69 @@ func (s *statistics) reset() {
 	s.inMail = 0
 	s.inYamn = 0
 	s.inRemFoo = 0
+	s.inReply = 0
+	s.inMix2 = 0
+	s.inBounce = 0
+	s.inGateway = 0
+	s.bounces = nil
 	s.outDummy = 0
 	s.outMail = 0
+	s.outNews = 0
 	s.outYamn = 0
 	s.outLoop = 0
 	s.outRandhop = 0
 	s.outPlain = 0
+	s.outReply = 0
+	s.outHeld = 0
+	s.outMix2 = 0
+	s.outLimited = 0
 	log.Info("Daily stats reset")
 }
 
 func (s *statistics) report() {
 	log.Infof(
-		"MailIn=%d, RemFoo=%d, YamnIn=%d, DummyIn=%d",
+		"MailIn=%d, RemFoo=%d, YamnIn=%d, ReplyIn=%d, DummyIn=%d, Mix2In=%d, BounceIn=%d, GatewayIn=%d",
 		s.inMail,
 		s.inRemFoo,
 		s.inYamn,
+		s.inReply,
 		s.inDummy,
+		s.inMix2,
+		s.inBounce,
+		s.inGateway,
 	)
 	line1 := fmt.Sprintf(
-		"MailOut=%d, YamnOut=%d, YamnLoop=%d, Randhop=%d, ",
+		"MailOut=%d, NewsOut=%d, YamnOut=%d, YamnLoop=%d, Randhop=%d, ",
 		s.outMail,
+		s.outNews,
 		s.outYamn,
 		s.outLoop,
 		s.outRandhop,
 	)
 	line2 := fmt.Sprintf(
-		"FinalOut=%d, DummyOut=%d",
+		"FinalOut=%d, ReplyOut=%d, DummyOut=%d, Held=%d, Mix2Out=%d, Limited=%d",
 		s.outPlain,
+		s.outReply,
 		s.outDummy,
+		s.outHeld,
+		s.outMix2,
+		s.outLimited,
 	)
 	log.Infof(line1 + line2)
+	if len(s.bounces) > 0 {
+		var domains []string
+		for domain, count := range s.bounces {
+			domains = append(domains, fmt.Sprintf("%s=%d", domain, count))
+		}
+		sort.Strings(domains)
+		log.Infof("Bounces: %s", strings.Join(domains, ", "))
+	}
 }
 
-var stats = new(statistics)
+// bounce counts a bounced delivery to domain.
+func (s *statistics) bounce(domain string) {
+	if s.bounces == nil {
+		s.bounces = make(map[string]int)
+	}
+	s.bounces[domain]++
+}
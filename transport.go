@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/luksen/maildir"
+)
+
+// Transport delivers an assembled email to a list of recipients.  Errors
+// are temporary, and the message is retried, unless they're wrapped by
+// permanent.
+type Transport interface {
+	Deliver(payload []byte, sendTo []string) error
+}
+
+// lmtpTimeout limits the duration of an entire LMTP session.
+const lmtpTimeout = 2 * time.Minute
+
+// permanentExits are the sysexits.h statuses that MTAs return for failures
+// that retrying won't resolve.
+var permanentExits = []int{
+	65, // EX_DATAERR
+	67, // EX_NOUSER
+	68, // EX_NOHOST
+}
+
+// permanentError is a delivery error that retrying won't resolve.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks err as a permanent delivery failure.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// isPermanent returns true if err is a permanent delivery failure.
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// partialError reports the recipients that were permanently rejected when a
+// message was delivered to the others.
+type partialError struct {
+	rejected []string
+	err      error
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf(
+		"rejected recipients: %s: %s",
+		strings.Join(e.rejected, ","),
+		e.err,
+	)
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+// classifyReply marks 5xx rejections as permanent.  Network errors and other
+// replies are temporary.  Mail transports only classify replies to RCPT and
+// to the end of DATA; a 5xx during the rest of a session (E.g. AUTH or MAIL
+// FROM) is more likely a fault with the relay, or its configuration, than
+// with the message.
+func classifyReply(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return permanent(err)
+	}
+	return err
+}
+
+// newTransport returns the Transport selected by the mail section of the
+// config.  If no transport is named, the legacy outfile, pipe and sendmail
+// options are honoured.
+func (s *Server) newTransport() (Transport, error) {
+	name := s.cfg.Mail.Transport
+	if name == "" {
+		if s.cfg.Mail.Outfile {
+			name = "outfile"
+		} else if s.cfg.Mail.Pipe != "" {
+			name = "pipe"
+		} else if s.cfg.Mail.Sendmail {
+			name = "sendmail"
+		} else {
+			name = "smtp"
+		}
+	}
+	switch strings.ToLower(name) {
+	case "smtp":
+		return smtpTransport{s: s}, nil
+	case "sendmail":
+		return sendmailTransport{s: s}, nil
+	case "pipe":
+		if s.cfg.Mail.Pipe == "" {
+			return nil, errors.New("pipe transport requires a pipe command")
+		}
+		return pipeTransport{command: s.cfg.Mail.Pipe}, nil
+	case "outfile":
+		return outfileTransport{s: s}, nil
+	case "lmtp":
+		if s.cfg.Mail.LMTPAddr == "" {
+			return nil, errors.New("lmtp transport requires an lmtp_addr")
+		}
+		return lmtpTransport{
+			addr:   s.cfg.Mail.LMTPAddr,
+			sender: s.envelopeSender(),
+			domain: s.messageDomain(),
+		}, nil
+	case "maildir":
+		if s.cfg.Mail.LocalMaildir == "" {
+			return nil, errors.New("maildir transport requires a local_maildir")
+		}
+		return maildirTransport{dir: s.cfg.Mail.LocalMaildir}, nil
+	}
+	return nil, fmt.Errorf("%s: Unknown mail transport", name)
+}
+
+// smtpTransport relays mail through the configured SMTP relay, or direct to
+// the recipient's MX.
+type smtpTransport struct {
+	s *Server
+}
+
+func (t smtpTransport) Deliver(payload []byte, sendTo []string) error {
+	return t.s.smtpRelay(payload, sendTo)
+}
+
+// sendmailTransport relays mail using Go's smtp.SendMail.
+type sendmailTransport struct {
+	s *Server
+}
+
+// Deliver treats all errors as temporary as smtp.SendMail doesn't report
+// which command failed.
+func (t sendmailTransport) Deliver(payload []byte, sendTo []string) error {
+	return t.s.sendmail(payload, sendTo)
+}
+
+// pipeTransport pipes mail to an external command (E.g. sendmail -t).
+type pipeTransport struct {
+	command string
+}
+
+// Deliver treats the exit statuses in permanentExits as permanent.  Other
+// statuses, signals and failure to run the command are temporary.
+func (t pipeTransport) Deliver(payload []byte, sendTo []string) error {
+	err := execSend(payload, t.command)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && slices.Contains(permanentExits, exitErr.ExitCode()) {
+		return permanent(err)
+	}
+	return err
+}
+
+// outfileTransport writes mail to files in the pool instead of sending it.
+type outfileTransport struct {
+	s *Server
+}
+
+func (t outfileTransport) Deliver(payload []byte, sendTo []string) (err error) {
+	filename := t.s.randPoolFilename("outfile-")
+	log.Tracef("Writing output to %s", filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Warnf("Pool file creation failed: %s\n", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(payload)
+	if err != nil {
+		log.Warnf("Outfile write failed: %s\n", err)
+		return
+	}
+	return
+}
+
+// maildirTransport delivers mail to a local Maildir, regardless of the
+// recipients.
+type maildirTransport struct {
+	dir string
+}
+
+func (t maildirTransport) Deliver(payload []byte, sendTo []string) (err error) {
+	d := maildir.Dir(t.dir)
+	// Create is harmless if the Maildir already exists
+	err = d.Create()
+	if err != nil {
+		return
+	}
+	delivery, err := d.NewDelivery()
+	if err != nil {
+		return
+	}
+	_, err = delivery.Write(payload)
+	if err != nil {
+		delivery.Abort()
+		return
+	}
+	err = delivery.Close()
+	return
+}
+
+// lmtpTransport delivers mail to a co-located MTA using LMTP (RFC 2033).  An
+// addr beginning with "/" is a Unix socket.
+type lmtpTransport struct {
+	addr   string
+	sender string
+	domain string
+}
+
+// Deliver only returns a permanent error if every recipient is permanently
+// rejected.  If some are, a partialError lists them.  If any recipient is
+// temporarily rejected, the message is retried for all of them.
+func (t lmtpTransport) Deliver(payload []byte, sendTo []string) (err error) {
+	network := "tcp"
+	if strings.HasPrefix(t.addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, t.addr, lmtpTimeout)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(lmtpTimeout))
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+	_, _, err = tp.ReadResponse(220)
+	if err != nil {
+		return
+	}
+	err = lmtpCmd(tp, 250, "LHLO %s", t.domain)
+	if err != nil {
+		return
+	}
+	err = lmtpCmd(tp, 250, "MAIL FROM:<%s>", t.sender)
+	if err != nil {
+		return
+	}
+	var accepted, rejected []string
+	var rejectErr error
+	for _, addy := range sendTo {
+		// 250 = OK, 251 = User not local; will forward
+		err = classifyReply(lmtpCmd(tp, 25, "RCPT TO:<%s>", addy))
+		if isPermanent(err) {
+			log.Warnf("LMTP rejected %s: %s", addy, err)
+			rejected = append(rejected, addy)
+			rejectErr = err
+			continue
+		} else if err != nil {
+			return
+		}
+		accepted = append(accepted, addy)
+	}
+	if len(accepted) == 0 {
+		err = rejectErr
+		if err == nil {
+			err = permanent(errors.New("no LMTP recipients"))
+		}
+		return
+	}
+	err = lmtpCmd(tp, 354, "DATA")
+	if err != nil {
+		return
+	}
+	w := tp.DotWriter()
+	_, err = w.Write(payload)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	// LMTP returns a reply for each accepted recipient
+	var delivered int
+	for _, addy := range accepted {
+		_, _, err = tp.ReadResponse(250)
+		err = classifyReply(err)
+		if isPermanent(err) {
+			log.Warnf("LMTP delivery to %s failed: %s", addy, err)
+			rejected = append(rejected, addy)
+			rejectErr = err
+			continue
+		} else if err != nil {
+			return
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return rejectErr
+	}
+	// The message has been delivered so a failed QUIT isn't an error
+	lmtpCmd(tp, 221, "QUIT")
+	if len(rejected) > 0 {
+		return &partialError{rejected: rejected, err: rejectErr}
+	}
+	return nil
+}
+
+// lmtpCmd sends an LMTP command and reads its (possibly multi-line) reply.
+// An error is returned if the reply code doesn't start with expectCode.
+func lmtpCmd(tp *textproto.Conn, expectCode int, format string, args ...any) (err error) {
+	id, err := tp.Cmd(format, args...)
+	if err != nil {
+		return
+	}
+	tp.StartResponse(id)
+	defer tp.EndResponse(id)
+	_, _, err = tp.ReadResponse(expectCode)
+	return
+}
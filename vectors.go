@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/crooks/yamn/client"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+	"github.com/dchest/blake2s"
+	"golang.org/x/crypto/chacha20"
+)
+
+// vectorTime is the clock of every vector's Source.
+var vectorTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// vectorPlain is the message encoded by every vector.
+const vectorPlain = "To: recipient@example.com\nSubject: Test vector\n\nHello World\n"
+
+// vectorSpecs define the vectors written by genVectors.  Each is encoded
+// through a chain of three classic remailers with the specified capstring.
+var vectorSpecs = []struct {
+	name string
+	caps string
+}{
+	{"v2", ""},
+	{"v5", keymgr.CapMAC},
+}
+
+/*
+Test vectors are encoded using a Source whose entropy is the ChaCha20
+keystream with a zero nonce and a key of:
+	Blake2s-256("yamn test vectors " + vector name)
+The Source's clock is fixed at vectorTime.  Remailer keys are drawn from the
+Source, in chain order, before the message is encoded.  Hybrid headers
+aren't reproducible so vectors only use classic headers.
+*/
+
+// keystream is a deterministic entropy source.
+type keystream struct {
+	c *chacha20.Cipher
+}
+
+func (k *keystream) Read(p []byte) (int, error) {
+	clear(p)
+	k.c.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// vectorKey is a remailer key used in a vector.
+type vectorKey struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Caps    string `json:"caps"`
+	Keyid   string `json:"keyid"`
+	PK      string `json:"pk"`
+	SK      string `json:"sk"`
+}
+
+// vectorHop is the top header of the packet as received by a hop.
+type vectorHop struct {
+	Address    string `json:"address"`
+	Header     string `json:"header"`
+	SlotData   string `json:"slot_data"`
+	Version    int    `json:"version"`
+	PacketType int    `json:"packet_type"`
+	PacketID   string `json:"packet_id"`
+	AesKey     string `json:"aes_key"`
+	PacketInfo string `json:"packet_info"`
+	TagHash    string `json:"tag_hash"`
+	NextHop    string `json:"next_hop,omitempty"`
+}
+
+// vector is a single test vector.
+type vector struct {
+	Name      string      `json:"name"`
+	Seed      string      `json:"seed"`
+	Time      time.Time   `json:"time"`
+	Keys      []vectorKey `json:"keys"`
+	Chain     []string    `json:"chain"`
+	Plaintext string      `json:"plaintext"`
+	Hops      []vectorHop `json:"hops"`
+	Packet    string      `json:"packet"`
+}
+
+// vectorPool is a PoolWriter that retains packets in memory.
+type vectorPool struct {
+	payloads [][]byte
+}
+
+func (p *vectorPool) WriteMessage(sendTo string, payload []byte) (string, error) {
+	p.payloads = append(p.payloads, payload)
+	return sendTo, nil
+}
+
+// genVectors writes JSON test vectors to w.
+func genVectors(w io.Writer) (err error) {
+	var vectors []vector
+	for _, spec := range vectorSpecs {
+		var v vector
+		v, err = newVector(spec.name, spec.caps)
+		if err != nil {
+			return
+		}
+		vectors = append(vectors, v)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(vectors)
+}
+
+// newVector encodes vectorPlain through a chain of three remailers, each
+// advertising caps, and decodes it hop by hop.
+func newVector(name, caps string) (v vector, err error) {
+	seed := blake2s.Sum256([]byte("yamn test vectors " + name))
+	stream, err := chacha20.NewUnauthenticatedCipher(
+		seed[:],
+		make([]byte, chacha20.NonceSize),
+	)
+	if err != nil {
+		return
+	}
+	src := &packet.Source{
+		Rand: &keystream{c: stream},
+		Now:  func() time.Time { return vectorTime },
+	}
+	v = vector{
+		Name:      name,
+		Seed:      hex.EncodeToString(seed[:]),
+		Time:      vectorTime,
+		Chain:     []string{"alpha", "beta", "gamma"},
+		Plaintext: vectorPlain,
+	}
+	pubring := keymgr.NewPubring("", "")
+	secret := make(map[string][]byte)
+	for _, hop := range v.Chain {
+		var pk, sk []byte
+		pk, sk, err = src.GenerateKey()
+		if err != nil {
+			return
+		}
+		address := hop + "@remailer.invalid"
+		remailer := keymgr.NewRemailer(hop, address, caps, pk, nil)
+		pubring.Put(remailer)
+		secret[address] = sk
+		v.Keys = append(v.Keys, vectorKey{
+			Name:    hop,
+			Address: address,
+			Caps:    caps,
+			Keyid:   hex.EncodeToString(remailer.Keyid),
+			PK:      hex.EncodeToString(pk),
+			SK:      hex.EncodeToString(sk),
+		})
+	}
+	pool := new(vectorPool)
+	c, err := client.New(client.Config{
+		Pubring: pubring,
+		Chain:   v.Chain,
+		Pool:    pool,
+		NoDummy: true,
+		Source:  src,
+	})
+	if err != nil {
+		return
+	}
+	_, err = c.SendBytes([]byte(vectorPlain))
+	if err != nil {
+		return
+	}
+	if len(pool.payloads) != 1 {
+		err = fmt.Errorf("expected 1 packet, got %d", len(pool.payloads))
+		return
+	}
+	armored := new(bytes.Buffer)
+	err = packet.Armor(armored, pool.payloads[0], version)
+	if err != nil {
+		return
+	}
+	v.Packet = armored.String()
+	// Decode the packet hop by hop, recording each top header
+	d, err := packet.NewDecMessage(pool.payloads[0])
+	if err != nil {
+		return
+	}
+	address := v.Keys[0].Address
+	var slotData *packet.SlotData
+	for {
+		var hop vectorHop
+		hop, slotData, err = decodeVectorHop(d, address, secret[address])
+		if err != nil {
+			return
+		}
+		v.Hops = append(v.Hops, hop)
+		if slotData.PacketType() == packet.PacketTypeExit {
+			break
+		}
+		var inter *packet.SlotIntermediate
+		inter, err = packet.DecodeIntermediate(slotData.PacketInfo())
+		if err != nil {
+			return
+		}
+		d.ShiftHeaders()
+		err = d.DecryptAll(slotData.AesKey(), inter.PartialIV())
+		if err != nil {
+			return
+		}
+		address = inter.NextHop()
+	}
+	// Confirm the Exit recovers the plaintext
+	final, err := packet.DecodeFinalVersion(slotData.PacketInfo(), slotData.Version())
+	if err != nil {
+		return
+	}
+	plain, err := d.DecryptBody(slotData.AesKey(), final.AesIV(), final.BodyBytes())
+	if err != nil {
+		return
+	}
+	if string(plain) != vectorPlain {
+		err = errors.New("vector exit failed to recover the plaintext")
+	}
+	return
+}
+
+// decodeVectorHop decodes the top header of d using sk.
+func decodeVectorHop(d *packet.DecMessage, address string, sk []byte) (hop vectorHop, slotData *packet.SlotData, err error) {
+	header, err := packet.NewDecodeHeader(d.Header())
+	if err != nil {
+		return
+	}
+	err = header.SetRecipientSK(sk)
+	if err != nil {
+		return
+	}
+	slotDataBytes, _, err := header.Decode()
+	if err != nil {
+		return
+	}
+	slotData, err = packet.DecodeSlotData(slotDataBytes)
+	if err != nil {
+		return
+	}
+	hop = vectorHop{
+		Address:    address,
+		Header:     hex.EncodeToString(d.Header()),
+		SlotData:   hex.EncodeToString(slotDataBytes),
+		Version:    slotData.Version(),
+		PacketType: slotData.PacketType(),
+		PacketID:   hex.EncodeToString(slotData.PacketID()),
+		AesKey:     hex.EncodeToString(slotData.AesKey()),
+		PacketInfo: hex.EncodeToString(slotData.PacketInfo()),
+		TagHash:    hex.EncodeToString(slotData.TagHash()),
+	}
+	var tagOK bool
+	if slotData.Version() == packet.Version5 {
+		var key []byte
+		key, err = header.MACKey()
+		if err != nil {
+			return
+		}
+		tagOK = d.TestMAC(key, slotData.TagHash())
+	} else {
+		tagOK = d.TestAntiTag(slotData.TagHash())
+	}
+	if !tagOK {
+		err = fmt.Errorf("%s: vector anti-tag digest mismatch", address)
+		return
+	}
+	if slotData.PacketType() == packet.PacketTypeIntermediate {
+		var inter *packet.SlotIntermediate
+		inter, err = packet.DecodeIntermediate(slotData.PacketInfo())
+		if err != nil {
+			return
+		}
+		hop.NextHop = inter.NextHop()
+	}
+	return
+}
@@ -8,19 +8,14 @@ import (
 
 	"github.com/Masterminds/log-go"
 	"github.com/crooks/yamn/config"
-	"github.com/crooks/yamn/idlog"
-	"github.com/crooks/yamn/keymgr"
 	"github.com/luksen/maildir"
 )
 
 const (
-	version        string = "0.2.6"
-	dayLength      int    = 24 * 60 * 60 // Day in seconds
-	maxFragLength         = 17910
-	maxCopies             = 5
-	base64LineWrap        = 64
-	rfc5322date           = "Mon, 2 Jan 2006 15:04:05 -0700"
-	shortdate             = "2 Jan 2006"
+	version     string = "0.2.6"
+	dayLength   int    = 24 * 60 * 60 // Day in seconds
+	rfc5322date        = "Mon, 2 Jan 2006 15:04:05 -0700"
+	shortdate          = "2 Jan 2006"
 )
 
 var (
@@ -28,12 +23,6 @@ var (
 	flag *config.Flags
 	// cfg - Config parameters
 	cfg *config.Config
-	// Pubring - Public Keyring
-	Pubring *keymgr.Pubring
-	// IDDb - Message ID log (replay protection)
-	IDDb *idlog.IDLog
-	// ChunkDb - Chunk database
-	ChunkDb *Chunk
 )
 
 func main() {
@@ -96,12 +85,32 @@ func main() {
 		newmsg.Write(stdin)
 		newmsg.Close()
 	} else if flag.Remailer {
-		err = loopServer()
+		err = newCLIServer().loopServer()
 		if err != nil {
 			panic(err)
 		}
 	} else if flag.Dummy {
 		injectDummy()
+	} else if flag.Inspect != "" {
+		inspectFile(flag.Inspect)
+	} else if flag.Block != "" {
+		err = newCLIServer().addBlock(flag.Block)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if flag.DKIMGen != "" {
+		err = newCLIServer().dkimKeygen(flag.DKIMGen, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if flag.Vectors {
+		err = genVectors(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	} else if flag.Refresh {
 		fmt.Printf("Keyring refresh: from=%s, to=%s\n", cfg.Urls.Pubring, cfg.Files.Pubring)
 		httpGet(cfg.Urls.Pubring, cfg.Files.Pubring)
@@ -109,7 +118,21 @@ func main() {
 		httpGet(cfg.Urls.Mlist2, cfg.Files.Mlist2)
 	}
 	if flag.Send {
+		if flag.Remailer {
+			// During normal operation, the pool shouldn't be flushed.
+			log.Warn("Flushing outbound remailer pool")
+		}
 		// Flush the outbound pool
-		poolOutboundSend()
+		newCLIServer().poolOutboundSend()
 	}
 }
+
+// newCLIServer returns a Server configured from the config file and command
+// line flags.
+func newCLIServer() *Server {
+	s := newServer(cfg)
+	s.daemon = cfg.Remailer.Daemon || flag.Daemon
+	s.noDummy = flag.NoDummy
+	s.flush = flag.Send
+	return s
+}